@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/segmentio/stats/datadog"
+)
+
+func bench(args ...string) {
+	var fset = flag.NewFlagSet("dogstatsd bench [options...]", flag.ExitOnError)
+	var config benchConfig
+	var verify bool
+	var maxLoss float64
+
+	fset.StringVar(&config.addr, "addr", "localhost:8125", "The network address where a dogstatsd server is listening for incoming datagrams (udp://, unixgram:// or unix://)")
+	fset.DurationVar(&config.duration, "duration", 10*time.Second, "How long the benchmark runs")
+	fset.IntVar(&config.rate, "rate", 0, "The target number of metrics sent per second (unlimited when zero)")
+	fset.IntVar(&config.concurrency, "concurrency", 1, "The number of goroutines sending metrics, each with its own connection")
+	fset.IntVar(&config.bufferSize, "buffer-size", datadog.DefaultBufferSize, "The size of the datagrams sent to the server")
+	fset.IntVar(&config.names, "names", 100, "The number of distinct metric names")
+	fset.IntVar(&config.tags, "tags", 2, "The number of tags set on each metric")
+	fset.IntVar(&config.tagValues, "tag-values", 10, "The number of distinct values of each tag")
+	fset.Var(&config.mix, "mix", "The proportions of each metric type, as a comma-separated list of type=weight (types are counter, gauge and histogram)")
+	fset.BoolVar(&verify, "verify", false, "Send the metrics to a local dogstatsd server and verify how many were received")
+	fset.Float64Var(&maxLoss, "max-loss", 100, "The percentage of metrics that may be lost with -verify, exits with status 1 when exceeded")
+	fset.Parse(args)
+
+	if len(config.mix) == 0 {
+		config.mix.Set("counter=50,gauge=25,histogram=25")
+	}
+
+	if config.concurrency < 1 || config.names < 1 || config.tags < 0 || config.tagValues < 1 {
+		errorf("the concurrency, names and tag values must be positive, and the number of tags must not be negative")
+	}
+
+	var srv *datadog.Server
+	var received benchReceiver
+
+	if verify {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			errorf("%s", err)
+		}
+		srv = &datadog.Server{Handler: &received}
+		go srv.Serve(conn)
+		config.addr = conn.LocalAddr().String()
+	}
+
+	res, err := runBench(config)
+	if err != nil {
+		errorf("%s", err)
+	}
+
+	res.print(os.Stdout)
+
+	if verify {
+		n := received.wait(res.metrics, time.Second)
+		srv.Shutdown(context.Background())
+		stats := srv.Stats()
+		loss := 100 * (1 - float64(n)/float64(res.metrics))
+
+		fmt.Printf("received:   %d metrics in %d datagrams (%.2f%% loss), %d parse errors\n",
+			n, stats.Packets, loss, stats.ParseErrors)
+
+		if loss > maxLoss {
+			os.Exit(1)
+		}
+	}
+}
+
+type benchConfig struct {
+	addr        string
+	duration    time.Duration
+	rate        int
+	concurrency int
+	bufferSize  int
+	names       int
+	tags        int
+	tagValues   int
+	mix         benchMix
+}
+
+// benchResult carries the statistics of a benchmark run.
+type benchResult struct {
+	elapsed   time.Duration
+	metrics   int64
+	datagrams int64
+	bytes     int64
+	errors    int64
+	minSize   int64
+	maxSize   int64
+}
+
+func (r *benchResult) print(w io.Writer) {
+	seconds := r.elapsed.Seconds()
+	avgSize := int64(0)
+
+	if r.datagrams != 0 {
+		avgSize = r.bytes / r.datagrams
+	}
+
+	fmt.Fprintf(w, "duration:   %s\n", r.elapsed)
+	fmt.Fprintf(w, "metrics:    %d (%.0f/s)\n", r.metrics, float64(r.metrics)/seconds)
+	fmt.Fprintf(w, "datagrams:  %d (%.0f/s)\n", r.datagrams, float64(r.datagrams)/seconds)
+	fmt.Fprintf(w, "throughput: %.2f MB/s\n", float64(r.bytes)/seconds/1e6)
+	fmt.Fprintf(w, "sizes:      min=%d avg=%d max=%d bytes\n", r.minSize, avgSize, r.maxSize)
+	fmt.Fprintf(w, "errors:     %d\n", r.errors)
+}
+
+func runBench(config benchConfig) (*benchResult, error) {
+	res := &benchResult{}
+	conns := make([]*datadog.Conn, config.concurrency)
+
+	for i := range conns {
+		c, err := datadog.DialConfig(datadog.ConnConfig{
+			Address:    config.addr,
+			BufferSize: config.bufferSize,
+			WrapConn:   func(c net.Conn) net.Conn { return &benchConn{Conn: c, res: res} },
+		})
+		if err != nil {
+			for _, c := range conns[:i] {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns[i] = c
+	}
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	deadline := start.Add(config.duration)
+
+	for i, c := range conns {
+		wg.Add(1)
+		go func(c *datadog.Conn, seed int64) {
+			defer wg.Done()
+			defer c.Close()
+			config.run(c, res, rand.New(rand.NewSource(seed)), start, deadline)
+		}(c, int64(i))
+	}
+
+	wg.Wait()
+	res.elapsed = time.Since(start)
+	return res, nil
+}
+
+// run sends metrics to c until the deadline, pacing them to achieve the share
+// of the target rate of a single goroutine.
+func (config benchConfig) run(c *datadog.Conn, res *benchResult, r *rand.Rand, start time.Time, deadline time.Time) {
+	var interval time.Duration
+	var b []byte
+
+	if config.rate > 0 {
+		interval = time.Duration(float64(time.Second) * float64(config.concurrency) / float64(config.rate))
+	}
+
+	next := start
+
+	for {
+		now := time.Now()
+
+		if now.After(deadline) {
+			return
+		}
+
+		if interval != 0 {
+			// Sleeping for very short durations is imprecise, the goroutine
+			// only sleeps when it is ahead of schedule by more than 1ms.
+			next = next.Add(interval)
+			if d := next.Sub(now); d > time.Millisecond {
+				time.Sleep(d)
+			}
+		}
+
+		b = config.appendMetric(b[:0], r)
+
+		// Errors from sending datagrams are counted by benchConn, the write
+		// only discards the metric when it doesn't fit in the buffer.
+		if n, _ := c.Write(b); n == 0 {
+			atomic.AddInt64(&res.errors, 1)
+			continue
+		}
+
+		atomic.AddInt64(&res.metrics, 1)
+	}
+}
+
+// appendMetric appends a random metric line to b, using the name and tag
+// cardinalities of the configuration.
+func (config benchConfig) appendMetric(b []byte, r *rand.Rand) []byte {
+	typ := config.mix.pick(r)
+
+	b = append(b, "bench.metric."...)
+	b = strconv.AppendInt(b, int64(r.Intn(config.names)), 10)
+	b = append(b, ':')
+
+	switch typ {
+	case datadog.Counter:
+		b = append(b, '1')
+	default:
+		b = strconv.AppendFloat(b, r.Float64()*100, 'f', 3, 64)
+	}
+
+	b = append(b, '|')
+	b = append(b, typ...)
+
+	for i := 0; i != config.tags; i++ {
+		if i == 0 {
+			b = append(b, "|#"...)
+		} else {
+			b = append(b, ',')
+		}
+		b = append(b, "tag"...)
+		b = strconv.AppendInt(b, int64(i), 10)
+		b = append(b, ":value"...)
+		b = strconv.AppendInt(b, int64(r.Intn(config.tagValues)), 10)
+	}
+
+	return append(b, '\n')
+}
+
+// benchConn wraps the connections used by the benchmark to collect statistics
+// on the datagrams that are sent.
+type benchConn struct {
+	net.Conn
+	res *benchResult
+}
+
+func (c *benchConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+
+	if err != nil {
+		atomic.AddInt64(&c.res.errors, 1)
+		return n, err
+	}
+
+	size := int64(len(b))
+	atomic.AddInt64(&c.res.datagrams, 1)
+	atomic.AddInt64(&c.res.bytes, size)
+
+	for {
+		min := atomic.LoadInt64(&c.res.minSize)
+		if (min != 0 && min <= size) || atomic.CompareAndSwapInt64(&c.res.minSize, min, size) {
+			break
+		}
+	}
+
+	for {
+		max := atomic.LoadInt64(&c.res.maxSize)
+		if max >= size || atomic.CompareAndSwapInt64(&c.res.maxSize, max, size) {
+			break
+		}
+	}
+
+	return n, err
+}
+
+// benchMix is a flag value representing the proportions of the metric types
+// generated by the benchmark.
+type benchMix []benchWeight
+
+type benchWeight struct {
+	typ    datadog.MetricType
+	name   string
+	weight int
+}
+
+func (mix benchMix) String() string {
+	s := make([]string, len(mix))
+	for i, w := range mix {
+		s[i] = w.name + "=" + strconv.Itoa(w.weight)
+	}
+	return strings.Join(s, ",")
+}
+
+func (mix *benchMix) Set(s string) error {
+	var m benchMix
+	var total int
+
+	for _, pair := range strings.Split(s, ",") {
+		var w benchWeight
+		var err error
+
+		i := strings.IndexByte(pair, '=')
+		if i < 0 {
+			return fmt.Errorf("malformed type=weight pair: %q", pair)
+		}
+
+		switch w.name = pair[:i]; w.name {
+		case "counter":
+			w.typ = datadog.Counter
+		case "gauge":
+			w.typ = datadog.Gauge
+		case "histogram":
+			w.typ = datadog.Histogram
+		default:
+			return fmt.Errorf("unsupported metric type: %q", w.name)
+		}
+
+		if w.weight, err = strconv.Atoi(pair[i+1:]); err != nil || w.weight < 0 {
+			return fmt.Errorf("bad weight for %s: %q", w.name, pair[i+1:])
+		}
+
+		total += w.weight
+		m = append(m, w)
+	}
+
+	if total == 0 {
+		return fmt.Errorf("the sum of weights must be positive")
+	}
+
+	*mix = m
+	return nil
+}
+
+func (mix benchMix) pick(r *rand.Rand) datadog.MetricType {
+	total := 0
+	for _, w := range mix {
+		total += w.weight
+	}
+
+	n := r.Intn(total)
+
+	for _, w := range mix {
+		if n < w.weight {
+			return w.typ
+		}
+		n -= w.weight
+	}
+
+	return mix[len(mix)-1].typ
+}
+
+// benchReceiver is the handler of the server used to verify the number of
+// metrics received during a benchmark.
+type benchReceiver struct {
+	n int64
+}
+
+func (r *benchReceiver) HandleMetric(m datadog.Metric, from net.Addr) {
+	atomic.AddInt64(&r.n, 1)
+}
+
+func (r *benchReceiver) HandleMetrics(metrics []datadog.Metric, from net.Addr) {
+	atomic.AddInt64(&r.n, int64(len(metrics)))
+}
+
+func (r *benchReceiver) count() int64 {
+	return atomic.LoadInt64(&r.n)
+}
+
+// wait waits for the server to be done processing the datagrams, returning the
+// number of metrics received. It returns once the expected number was reached
+// or when no metrics were received for the idle duration.
+func (r *benchReceiver) wait(expected int64, idle time.Duration) int64 {
+	n := r.count()
+
+	for deadline := time.Now().Add(idle); n < expected && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+
+		if c := r.count(); c != n {
+			n, deadline = c, time.Now().Add(idle)
+		}
+	}
+
+	return n
+}
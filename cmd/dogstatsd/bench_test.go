@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats/datadog"
+)
+
+func TestBenchMix(t *testing.T) {
+	var mix benchMix
+
+	for _, s := range []string{"", "counter", "timer=1", "counter=-1", "counter=0,gauge=0"} {
+		if err := mix.Set(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+
+	if err := mix.Set("counter=3,histogram=1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := mix.String(); s != "counter=3,histogram=1" {
+		t.Error("bad mix:", s)
+	}
+
+	r := rand.New(rand.NewSource(0))
+	counts := map[datadog.MetricType]int{}
+
+	for i := 0; i != 10000; i++ {
+		counts[mix.pick(r)]++
+	}
+
+	if counts[datadog.Gauge] != 0 || counts[datadog.Counter] < 7000 || counts[datadog.Counter] > 8000 {
+		t.Errorf("bad distribution of metric types: %v", counts)
+	}
+}
+
+func TestBenchAppendMetric(t *testing.T) {
+	config := benchConfig{names: 3, tags: 2, tagValues: 4}
+	config.mix.Set("histogram=1")
+
+	r := rand.New(rand.NewSource(0))
+	names := map[string]bool{}
+
+	for i := 0; i != 1000; i++ {
+		line := string(config.appendMetric(nil, r))
+		names[line[:strings.IndexByte(line, ':')]] = true
+
+		if !strings.HasSuffix(line, "\n") || !strings.Contains(line, "|h|#tag0:value") || !strings.Contains(line, ",tag1:value") {
+			t.Fatalf("bad metric line: %q", line)
+		}
+	}
+
+	if len(names) != 3 {
+		t.Errorf("bad name cardinality: %d", len(names))
+	}
+}
+
+func TestRunBench(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := &benchReceiver{}
+	srv := &datadog.Server{Handler: received}
+	go srv.Serve(conn)
+	defer srv.Shutdown(context.Background())
+
+	config := benchConfig{
+		addr:        "udp://" + conn.LocalAddr().String(),
+		duration:    200 * time.Millisecond,
+		rate:        1000,
+		concurrency: 2,
+		bufferSize:  512,
+		names:       10,
+		tags:        1,
+		tagValues:   10,
+	}
+	config.mix.Set("counter=1,gauge=1,histogram=1")
+
+	res, err := runBench(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.metrics < 100 || res.metrics > 300 {
+		t.Errorf("the rate wasn't respected: %d metrics sent in %s", res.metrics, res.elapsed)
+	}
+
+	if res.errors != 0 {
+		t.Errorf("%d errors", res.errors)
+	}
+
+	if res.maxSize > 512 || res.minSize <= 0 || res.minSize > res.maxSize {
+		t.Errorf("bad datagram sizes: min=%d max=%d", res.minSize, res.maxSize)
+	}
+
+	if n := received.wait(res.metrics, time.Second); n != res.metrics {
+		t.Errorf("%d metrics sent but %d received", res.metrics, n)
+	}
+
+	if _, err := runBench(benchConfig{addr: "tcp://localhost:8125", concurrency: 1}); err == nil {
+		t.Error("expected an error for an unsupported network")
+	}
+}
+
+func TestBenchReceiverWait(t *testing.T) {
+	r := &benchReceiver{}
+
+	go func() {
+		for i := 0; i != 5; i++ {
+			time.Sleep(20 * time.Millisecond)
+			r.HandleMetric(datadog.Metric{}, nil)
+		}
+	}()
+
+	// The idle timeout is reset every time metrics are received.
+	if n := r.wait(10, 100*time.Millisecond); n != 5 {
+		t.Errorf("bad number of metrics received: %d", n)
+	}
+
+	if n := r.wait(5, time.Hour); n != 5 {
+		t.Errorf("bad number of metrics received: %d", n)
+	}
+}
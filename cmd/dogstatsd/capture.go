@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// The capture files produced by dogstatsd record start with a magic string and
+// the time of the capture, followed by one record per datagram:
+//
+//	header: magic | uvarint(unix time in microseconds)
+//	record: uvarint(µs since previous record) | uvarint(address index) | [address] | uvarint(length) | data
+//
+// Addresses are written once, the first time they are seen, records for which
+// the index is equal to the number of addresses already seen carry the address
+// as a length-prefixed string.
+const captureMagic = "dogstatsd-capture-v1\n"
+
+var errBadCapture = errors.New("not a dogstatsd capture file")
+
+// errTruncatedCapture is returned by replayConn when the capture file ends in
+// the middle of a datagram. Unlike io.ErrUnexpectedEOF, it isn't mistaken for
+// the end of the connection by datadog.Server.
+var errTruncatedCapture = errors.New("truncated capture file")
+
+// capturedDatagram is a datagram read from a capture file.
+type capturedDatagram struct {
+	time time.Time
+	addr string
+	data []byte
+}
+
+// captureWriter writes datagrams to a capture file, it is safe to use from
+// multiple goroutines.
+type captureWriter struct {
+	mutex sync.Mutex
+	w     *bufio.Writer
+	last  time.Time
+	addrs map[string]uint64
+	buf   []byte
+	count int
+}
+
+func newCaptureWriter(w io.Writer, now time.Time) (*captureWriter, error) {
+	c := &captureWriter{
+		w:     bufio.NewWriter(w),
+		last:  now,
+		addrs: make(map[string]uint64),
+	}
+
+	c.buf = append(c.buf, captureMagic...)
+	c.buf = appendUvarint(c.buf, uint64(now.UnixNano()/1e3))
+
+	if _, err := c.w.Write(c.buf); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *captureWriter) write(t time.Time, addr string, data []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Datagrams may be captured concurrently, time never goes backward in the
+	// capture file.
+	delta := t.Sub(c.last)
+	if delta < 0 {
+		delta = 0
+	} else {
+		c.last = t
+	}
+
+	b := appendUvarint(c.buf[:0], uint64(delta/time.Microsecond))
+
+	index, ok := c.addrs[addr]
+	if !ok {
+		index = uint64(len(c.addrs))
+		c.addrs[addr] = index
+	}
+
+	b = appendUvarint(b, index)
+
+	if !ok {
+		b = appendUvarint(b, uint64(len(addr)))
+		b = append(b, addr...)
+	}
+
+	b = appendUvarint(b, uint64(len(data)))
+	c.buf = b
+
+	if _, err := c.w.Write(b); err != nil {
+		return err
+	}
+
+	if _, err := c.w.Write(data); err != nil {
+		return err
+	}
+
+	c.count++
+	return nil
+}
+
+func (c *captureWriter) flush() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.w.Flush()
+}
+
+// captureReader reads datagrams from a capture file.
+type captureReader struct {
+	r     *bufio.Reader
+	time  time.Time
+	addrs []string
+}
+
+func newCaptureReader(r io.Reader) (*captureReader, error) {
+	c := &captureReader{r: bufio.NewReader(r)}
+
+	magic := make([]byte, len(captureMagic))
+
+	if _, err := io.ReadFull(c.r, magic); err != nil || string(magic) != captureMagic {
+		return nil, errBadCapture
+	}
+
+	t, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return nil, errBadCapture
+	}
+
+	c.time = time.Unix(0, int64(t)*1e3)
+	return c, nil
+}
+
+// read returns the next datagram of the capture, or io.EOF when the end of the
+// file was reached.
+func (c *captureReader) read() (d capturedDatagram, err error) {
+	var delta, index uint64
+
+	if delta, err = binary.ReadUvarint(c.r); err != nil {
+		return
+	}
+
+	if index, err = binary.ReadUvarint(c.r); err != nil {
+		return d, c.truncated(err)
+	}
+
+	switch {
+	case index < uint64(len(c.addrs)):
+		d.addr = c.addrs[index]
+
+	case index == uint64(len(c.addrs)):
+		var b []byte
+		if b, err = c.readBytes(); err != nil {
+			return d, c.truncated(err)
+		}
+		d.addr = string(b)
+		c.addrs = append(c.addrs, d.addr)
+
+	default:
+		return d, fmt.Errorf("bad address index in capture file: %d", index)
+	}
+
+	if d.data, err = c.readBytes(); err != nil {
+		return d, c.truncated(err)
+	}
+
+	c.time = c.time.Add(time.Duration(delta) * time.Microsecond)
+	d.time = c.time
+	return
+}
+
+func (c *captureReader) readBytes() ([]byte, error) {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return nil, err
+	}
+
+	if n > 65536 {
+		return nil, fmt.Errorf("datagram too large in capture file: %d bytes", n)
+	}
+
+	b := make([]byte, n)
+	_, err = io.ReadFull(c.r, b)
+	return b, err
+}
+
+func (c *captureReader) truncated(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var a [binary.MaxVarintLen64]byte
+	return append(b, a[:binary.PutUvarint(a[:], v)]...)
+}
+
+// recordConn is a net.PacketConn which writes the datagrams it reads to a
+// capture file.
+type recordConn struct {
+	net.PacketConn
+	capture *captureWriter
+}
+
+func (c *recordConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	if n, addr, err = c.PacketConn.ReadFrom(b); err == nil {
+		if err := c.capture.write(time.Now(), addr.String(), b[:n]); err != nil {
+			errorf("%s", err)
+		}
+	}
+	return
+}
+
+// replayConn is a net.PacketConn which returns the datagrams of a capture file,
+// spaced in time according to a speed factor. A speed of zero returns the
+// datagrams as fast as possible.
+type replayConn struct {
+	capture *captureReader
+	speed   float64
+	start   time.Time // wall clock time of the first datagram
+	first   time.Time // capture time of the first datagram
+	count   int
+}
+
+func (c *replayConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	d, err := c.capture.read()
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errTruncatedCapture
+		}
+		return 0, nil, err
+	}
+
+	if c.count == 0 {
+		c.start, c.first = time.Now(), d.time
+	} else if c.speed > 0 {
+		offset := time.Duration(float64(d.time.Sub(c.first)) / c.speed)
+		if wait := time.Until(c.start.Add(offset)); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+
+	c.count++
+	return copy(b, d.data), replayAddr(d.addr), nil
+}
+
+func (c *replayConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return 0, errors.New("replay connections are read-only")
+}
+
+func (c *replayConn) Close() error                       { return nil }
+func (c *replayConn) LocalAddr() net.Addr                { return replayAddr("") }
+func (c *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// replayAddr is the address of a datagram read from a capture file.
+type replayAddr string
+
+func (a replayAddr) Network() string { return "capture" }
+func (a replayAddr) String() string  { return string(a) }
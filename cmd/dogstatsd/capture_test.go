@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+	"github.com/segmentio/stats/datadog"
+)
+
+func TestCapture(t *testing.T) {
+	start := time.Unix(1500000000, 0)
+	datagrams := []capturedDatagram{
+		{time: start.Add(10 * time.Millisecond), addr: "127.0.0.1:1234", data: []byte("a:1|c")},
+		{time: start.Add(15 * time.Millisecond), addr: "127.0.0.1:4321", data: []byte("b:2|g\nc:3|h")},
+		{time: start.Add(3 * time.Second), addr: "127.0.0.1:1234", data: []byte{}},
+	}
+
+	b := &bytes.Buffer{}
+	w, err := newCaptureWriter(b, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range datagrams {
+		if err := w.write(d.time, d.addr, d.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Datagrams captured out of order get the time of the previous one.
+	w.write(start, "127.0.0.1:4321", []byte("d:4|c"))
+	datagrams = append(datagrams, capturedDatagram{time: start.Add(3 * time.Second), addr: "127.0.0.1:4321", data: []byte("d:4|c")})
+
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	size := b.Len()
+	r, err := newCaptureReader(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, expected := range datagrams {
+		d, err := r.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !d.time.Equal(expected.time) || d.addr != expected.addr || !bytes.Equal(d.data, expected.data) {
+			t.Errorf("datagram %d: expected %+v but got %+v", i, expected, d)
+		}
+	}
+
+	if _, err := r.read(); err != io.EOF {
+		t.Errorf("expected io.EOF but got %v", err)
+	}
+
+	if _, err := newCaptureReader(bytes.NewReader(b.Bytes()[:size-2])); err != nil {
+		t.Fatal(err)
+	} else {
+		r, _ := newCaptureReader(bytes.NewReader(b.Bytes()[:size-2]))
+		for err == nil {
+			_, err = r.read()
+		}
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("expected io.ErrUnexpectedEOF on truncated capture but got %v", err)
+		}
+	}
+
+	if _, err := newCaptureReader(strings.NewReader("a:1|c")); err != errBadCapture {
+		t.Errorf("expected errBadCapture but got %v", err)
+	}
+}
+
+func TestRecordConn(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &bytes.Buffer{}
+	w, _ := newCaptureWriter(b, time.Now())
+	srv := &datadog.Server{}
+	done := make(chan error)
+
+	go func() { done <- srv.Serve(&recordConn{PacketConn: conn, capture: w}) }()
+
+	c, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.Write([]byte("a:1|c"))
+	c.Write([]byte("b:2|c"))
+
+	for i := 0; i != 100 && srv.Stats().Packets != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	srv.Shutdown(context.Background())
+	<-done
+	w.flush()
+
+	r, err := newCaptureReader(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"a:1|c", "b:2|c"} {
+		d, err := r.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(d.data) != expected || d.addr != c.LocalAddr().String() {
+			t.Errorf("bad datagram: %+v", d)
+		}
+	}
+}
+
+func TestReplayConn(t *testing.T) {
+	start := time.Now()
+	b := &bytes.Buffer{}
+	w, _ := newCaptureWriter(b, start)
+	w.write(start, "a", []byte("a:1|c"))
+	w.write(start.Add(100*time.Millisecond), "a", []byte("b:1|c|#host:a,env:prod"))
+	w.flush()
+
+	capture := b.Bytes()
+
+	tests := []struct {
+		speed float64
+		min   time.Duration
+		max   time.Duration
+	}{
+		{speed: 1, min: 100 * time.Millisecond, max: time.Second},
+		{speed: 4, min: 25 * time.Millisecond, max: 100 * time.Millisecond},
+		{speed: 0, min: 0, max: 50 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		r, _ := newCaptureReader(bytes.NewReader(capture))
+		c := &replayConn{capture: r, speed: test.speed}
+		buf := make([]byte, 1024)
+		then := time.Now()
+
+		for {
+			if _, _, err := c.ReadFrom(buf); err != nil {
+				break
+			}
+		}
+
+		if elapsed := time.Since(then); elapsed < test.min || elapsed > test.max {
+			t.Errorf("speed %g: replay took %s", test.speed, elapsed)
+		}
+
+		if c.count != 2 {
+			t.Errorf("speed %g: bad number of datagrams: %d", test.speed, c.count)
+		}
+	}
+
+	// Replaying through a server to rewrite the tags of metrics.
+	var metrics []datadog.Metric
+
+	r, _ := newCaptureReader(bytes.NewReader(capture))
+	rel := &relay{
+		sampleRate: 1,
+		tags:       []stats.Tag{{"env", "dev"}},
+		strip:      []string{"ho*"},
+		handler: datadog.HandlerFunc(func(m datadog.Metric, _ net.Addr) {
+			m.Tags = append([]stats.Tag{}, m.Tags...)
+			metrics = append(metrics, m)
+		}),
+	}
+
+	srv := &datadog.Server{Handler: rel, Concurrency: 1}
+	if err := srv.Serve(&replayConn{capture: r}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []datadog.Metric{
+		{Type: datadog.Counter, Name: "a", Value: 1, Rate: 1, Tags: []stats.Tag{{"env", "dev"}}},
+		{Type: datadog.Counter, Name: "b", Value: 1, Rate: 1, Tags: []stats.Tag{{"env", "dev"}}},
+	}
+
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("bad replayed metrics:\n- expected: %v\n- found:    %v", expected, metrics)
+	}
+}
+
+func TestReplayConnTruncated(t *testing.T) {
+	b := &bytes.Buffer{}
+	w, _ := newCaptureWriter(b, time.Now())
+	w.write(time.Now(), "a", []byte("a:1|c"))
+	w.flush()
+
+	r, _ := newCaptureReader(bytes.NewReader(b.Bytes()[:b.Len()-2]))
+	srv := &datadog.Server{Concurrency: 1}
+
+	if err := srv.Serve(&replayConn{capture: r}); err != errTruncatedCapture {
+		t.Errorf("expected errTruncatedCapture but got %v", err)
+	}
+}
@@ -2,18 +2,24 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/segmentio/stats"
 	"github.com/segmentio/stats/datadog"
+	"github.com/segmentio/stats/prometheus"
 )
 
 func main() {
@@ -24,10 +30,26 @@ func main() {
 	}
 
 	switch cmd, args := args[0], args[1:]; cmd {
-	case "add", "set", "time":
+	case "add", "set", "incr", "decr", "observe", "dist", "unique":
 		client(cmd, args...)
+	case "time":
+		timeCommand(args...)
+	case "pipe":
+		pipe(args...)
+	case "event":
+		event(args...)
+	case "check":
+		check(args...)
 	case "agent":
 		server(args...)
+	case "top":
+		top(args...)
+	case "bench":
+		bench(args...)
+	case "record":
+		record(args...)
+	case "replay":
+		replay(args...)
 	default:
 		usage()
 	}
@@ -39,98 +61,326 @@ func usage() {
 commands:
  - add
  - agent
+ - bench
+ - check
+ - decr
+ - dist
+ - event
  - help
+ - incr
+ - observe
+ - pipe
+ - record
+ - replay
  - set
  - time
+ - top
+ - unique
 
 `)
 	os.Exit(1)
 }
 
 func client(cmd string, args ...string) {
-	var fset = flag.NewFlagSet("dogstatsd "+cmd+" [options...] metric value [-- args...]", flag.ExitOnError)
-	var extra []string
+	var fset = flag.NewFlagSet("dogstatsd "+cmd+" [options...] metric value", flag.ExitOnError)
 	var tags tags
 	var addr string
-	var name string
-	var value float64
-	var err error
+	var signedDeltas bool
 
-	args, extra = split(args, "--")
 	fset.StringVar(&addr, "addr", "localhost:8125", "The network address where a dogstatsd server is listening for incoming UDP datagrams")
 	fset.Var(&tags, "tags", "A comma-separated list of tags to set on the metric")
+	if cmd == "decr" {
+		fset.BoolVar(&signedDeltas, "signed-gauge-deltas", false, "Confirm that the server treats gauge values with a leading '-' as decrements (statsd, or dogstatsd agent -signed-gauge-deltas)")
+	}
 	fset.Parse(args)
-	args = fset.Args()
 
+	m, err := clientMetric(cmd, fset.Args(), signedDeltas)
+	if err != nil {
+		errorf("%s", err)
+	}
+	m.Tags = tags
+
+	dd := datadog.NewClient(addr)
+	defer dd.Close()
+	dd.Send(m)
+}
+
+// clientMetric builds the metric sent by the client command cmd from its
+// arguments.
+//
+// decr sends a gauge value with a leading '-', which the datadog agent and a
+// default datadog.Server read as an absolute value, so the command fails
+// unless signedDeltas confirms that the receiver parses it as a decrement.
+func clientMetric(cmd string, args []string, signedDeltas bool) (m datadog.Metric, err error) {
 	if len(args) == 0 {
-		errorf("missing metric name")
+		return m, errors.New("missing metric name")
+	}
+
+	if cmd == "decr" && !signedDeltas {
+		return m, errors.New("decr requires a server that parses signed gauge deltas, like statsd or dogstatsd agent -signed-gauge-deltas; confirm with -signed-gauge-deltas")
 	}
 
-	name, args = args[0], args[1:]
+	m.Name, args = args[0], args[1:]
 
 	switch cmd {
-	case "add":
+	case "add", "incr", "decr":
+		// The value is optional and defaults to 1.
 		if len(args) == 0 {
-			value = 1.0
-		} else if value, err = strconv.ParseFloat(args[0], 64); err != nil {
-			errorf("bad metric value: %s", args[0])
-		} else {
-			args = args[1:]
+			m.Value = 1.0
+		} else if m.Value, err = strconv.ParseFloat(args[0], 64); err != nil {
+			return m, fmt.Errorf("bad metric value: %s", args[0])
 		}
 
-	case "set":
+	case "unique":
+		// Set members are arbitrary strings, sent as they are.
 		if len(args) == 0 {
-			errorf("missing metric value")
-		} else if value, err = strconv.ParseFloat(args[0], 64); err != nil {
-			errorf("bad metric value: %s", args[0])
-		} else {
-			args = args[1:]
+			return m, errors.New("missing metric value")
+		} else if m.Value, err = strconv.ParseFloat(args[0], 64); err != nil {
+			m.Member, err = args[0], nil
 		}
+
+	case "set", "observe", "dist":
+		if len(args) == 0 {
+			return m, errors.New("missing metric value")
+		} else if m.Value, err = strconv.ParseFloat(args[0], 64); err != nil {
+			return m, fmt.Errorf("bad metric value: %s", args[0])
+		}
+	}
+
+	switch cmd {
+	case "add":
+		m.Type = datadog.Counter
+	case "set":
+		m.Type = datadog.Gauge
+	case "incr":
+		m.Type, m.Delta = datadog.Gauge, true
+	case "decr":
+		m.Type, m.Delta, m.Value = datadog.Gauge, true, -m.Value
+	case "observe":
+		m.Type = datadog.Histogram
+	case "dist":
+		m.Type = datadog.Distribution
+	case "unique":
+		m.Type = datadog.Set
+	}
+
+	m.Rate = 1
+	return m, nil
+}
+
+func event(args ...string) {
+	var fset = flag.NewFlagSet("dogstatsd event [options...] title text", flag.ExitOnError)
+	var tags tags
+	var addr string
+	var e datadog.Event
+	var priority string
+	var alertType string
+
+	fset.StringVar(&addr, "addr", "localhost:8125", "The network address where a dogstatsd server is listening for incoming UDP datagrams")
+	fset.Var(&tags, "tags", "A comma-separated list of tags to set on the event")
+	fset.StringVar(&e.Hostname, "host", "", "The host name that the event is related to")
+	fset.StringVar(&e.AggregationKey, "aggregation-key", "", "The key used to group the event with others")
+	fset.StringVar(&e.SourceTypeName, "source-type", "", "The type of source that produced the event")
+	fset.StringVar(&priority, "priority", "", "The priority of the event (normal or low)")
+	fset.StringVar(&alertType, "alert-type", "", "The alert type of the event (error, warning, info or success)")
+	fset.Parse(args)
+	args = fset.Args()
+
+	switch len(args) {
+	case 0:
+		errorf("missing event title")
+	case 1:
+		errorf("missing event text")
+	}
+
+	switch p := datadog.EventPriority(priority); p {
+	case "", datadog.EventPriorityNormal, datadog.EventPriorityLow:
+		e.Priority = p
+	default:
+		errorf("bad event priority: %s", priority)
 	}
 
+	switch t := datadog.EventAlertType(alertType); t {
+	case "", datadog.EventAlertError, datadog.EventAlertWarning, datadog.EventAlertInfo, datadog.EventAlertSuccess:
+		e.AlertType = t
+	default:
+		errorf("bad event alert type: %s", alertType)
+	}
+
+	e.Title = args[0]
+	e.Text = strings.Join(args[1:], " ")
+	e.Tags = tags
+
 	dd := datadog.NewClient(addr)
 	defer dd.Close()
+	dd.Event(e)
+}
 
-	switch cmd {
-	case "add":
-		stats.Add(name, value, tags...)
+func check(args ...string) {
+	var fset = flag.NewFlagSet("dogstatsd check [options...] name status [message]", flag.ExitOnError)
+	var tags tags
+	var addr string
+	var sc datadog.ServiceCheck
 
-	case "set":
-		stats.Set(name, value, tags...)
+	fset.StringVar(&addr, "addr", "localhost:8125", "The network address where a dogstatsd server is listening for incoming UDP datagrams")
+	fset.Var(&tags, "tags", "A comma-separated list of tags to set on the service check")
+	fset.StringVar(&sc.Hostname, "host", "", "The host name that the service check is related to")
+	fset.Parse(args)
+	args = fset.Args()
 
-	case "time":
-		clock := stats.Time(name, time.Now(), tags...)
-		run(extra...)
-		clock.Stop()
+	switch len(args) {
+	case 0:
+		errorf("missing service check name")
+	case 1:
+		errorf("missing service check status")
+	}
+
+	switch status := args[1]; status {
+	case "ok", "0":
+		sc.Status = datadog.ServiceCheckOK
+	case "warning", "1":
+		sc.Status = datadog.ServiceCheckWarning
+	case "critical", "2":
+		sc.Status = datadog.ServiceCheckCritical
+	case "unknown", "3":
+		sc.Status = datadog.ServiceCheckUnknown
+	default:
+		errorf("bad service check status: %s", status)
 	}
+
+	sc.Name = args[0]
+	sc.Message = strings.Join(args[2:], " ")
+	sc.Tags = tags
+
+	dd := datadog.NewClient(addr)
+	defer dd.Close()
+	dd.ServiceCheck(sc)
 }
 
 func server(args ...string) {
 	var fset = flag.NewFlagSet("dogstatsd agent [options...]", flag.ExitOnError)
 	var bind string
+	var promAddr string
+	var upstreams addresses
+	var bufferSize int
+	var aggregate time.Duration
+	var rel = &relay{random: rand.Float64}
+	var srv = &datadog.Server{Handler: rel}
+	var handlers multiHandler
 
 	fset.StringVar(&bind, "bind", ":8125", "The network address to listen on for incoming UDP datagrams")
+	fset.StringVar(&promAddr, "prometheus", "", "The network address to expose the received metrics on as a prometheus endpoint, instead of logging them")
+	fset.Var(&upstreams, "forward", "The address of a dogstatsd server to forward the received metrics to instead of logging them, may be repeated")
+	fset.IntVar(&bufferSize, "buffer-size", 0, "The size of the datagrams sent to upstream servers (defaults to the client setting)")
+	fset.DurationVar(&aggregate, "aggregate", 0, "The interval at which counters and gauges are aggregated before being relayed (disabled when zero)")
+	fset.Var((*tags)(&rel.tags), "tags", "A comma-separated list of tags to set on the received metrics, overriding tags with the same name")
+	fset.Float64Var(&rel.sampleRate, "sample-rate", 1, "The fraction of counters and histograms that are relayed")
+	fset.Var((*patterns)(&rel.include), "include", "A glob pattern of the metric names to relay, may be repeated")
+	fset.Var((*patterns)(&rel.exclude), "exclude", "A glob pattern of the metric names to drop, may be repeated")
+	fset.Var((*patterns)(&rel.strip), "strip-tags", "A glob pattern of the tag names to remove from the received metrics, may be repeated")
+	fset.IntVar(&srv.Concurrency, "concurrency", 0, "The number of goroutines reading datagrams (defaults to GOMAXPROCS)")
+	fset.IntVar(&srv.ReadBufferSize, "read-buffer-size", 0, "The size of the socket receive buffer (defaults to the system setting)")
+	fset.BoolVar(&srv.SignedGaugeDeltas, "signed-gauge-deltas", false, "Treat gauge values with a leading '-' as decrements (as sent by decr) instead of absolute values")
 	fset.Parse(args)
-	log.Printf("listening for incoming UDP datagram on %s", bind)
 
-	datadog.ListenAndServe(bind, datadog.HandlerFunc(func(metric datadog.Metric, from net.Addr) {
-		log.Print(metric)
-	}))
-}
+	if rel.sampleRate <= 0 || rel.sampleRate > 1 {
+		errorf("the sample rate must be between 0 and 1: %g", rel.sampleRate)
+	}
 
-func run(args ...string) {
-	if len(args) == 0 {
-		errorf("missing command line")
+	if len(upstreams) != 0 {
+		fwd := &forwarder{}
+		defer fwd.Close()
+
+		for _, addr := range upstreams {
+			c, err := datadog.DialConfig(datadog.ConnConfig{Address: addr, BufferSize: bufferSize})
+			if err != nil {
+				errorf("%s", err)
+			}
+			log.Printf("forwarding metrics to %s", addr)
+			fwd.conns = append(fwd.conns, c)
+		}
+
+		handlers = append(handlers, fwd)
+	}
+
+	if len(promAddr) != 0 {
+		eng := stats.NewEngine("")
+		exp := &prometheus.Handler{}
+		eng.Register(exp)
+		handlers = append(handlers, &datadog.EngineHandler{Engine: eng})
+
+		go func() {
+			log.Printf("exposing prometheus metrics on %s", promAddr)
+			if err := http.ListenAndServe(promAddr, exp); err != nil {
+				errorf("%s", err)
+			}
+		}()
+	}
+
+	switch len(handlers) {
+	case 0:
+		rel.handler = logHandler{}
+	case 1:
+		rel.handler = handlers[0]
+	default:
+		rel.handler = handlers
 	}
 
-	cmd := exec.Command(args[0], args[1:]...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	if aggregate > 0 {
+		rel.aggregated = make(map[string]*datadog.Metric)
+		done := make(chan struct{})
+		join := make(chan struct{})
+
+		go func() {
+			defer close(join)
+			rel.run(aggregate, done)
+		}()
+
+		defer func() {
+			close(done)
+			<-join
+		}()
+	}
+
+	log.Printf("listening for incoming UDP datagram on %s", bind)
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		<-sigchan
+		signal.Stop(sigchan)
 
-	if err := cmd.Run(); err != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	if err := srv.ListenAndServe(bind); err != datadog.ErrServerClosed {
 		errorf("%s", err)
 	}
+
+	s := srv.Stats()
+	log.Printf("received %d packets, %d bytes, %d lines (%d parse errors)", s.Packets, s.Bytes, s.Lines, s.ParseErrors)
+}
+
+// logHandler is the handler used by the agent, it logs the metrics, events and
+// service checks that it receives.
+type logHandler struct{}
+
+func (logHandler) HandleMetric(m datadog.Metric, from net.Addr) {
+	log.Print(m)
+}
+
+func (logHandler) HandleEvent(e datadog.Event, from net.Addr) {
+	log.Print(e)
+}
+
+func (logHandler) HandleServiceCheck(sc datadog.ServiceCheck, from net.Addr) {
+	log.Print(sc)
 }
 
 func errorf(msg string, args ...interface{}) {
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats/datadog"
+)
+
+func TestClientMetricDecr(t *testing.T) {
+	if _, err := clientMetric("decr", []string{"x", "1"}, false); err == nil {
+		t.Error("decr must fail without -signed-gauge-deltas")
+	}
+
+	m, err := clientMetric("decr", []string{"x", "2"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != datadog.Gauge || !m.Delta || m.Value != -2 {
+		t.Errorf("bad metric: %#v", m)
+	}
+}
+
+func TestClientMetricRoundTrip(t *testing.T) {
+	tests := []struct {
+		scenario string
+		cmd      string
+		signed   bool
+		value    float64
+		delta    bool
+	}{
+		{scenario: "incr is a delta for a default server", cmd: "incr", value: 1, delta: true},
+		{scenario: "set is absolute for a default server", cmd: "set", value: 1},
+		{scenario: "decr is a delta for a server parsing signed deltas", cmd: "decr", signed: true, value: -1, delta: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			m, err := clientMetric(test.cmd, []string{"x", "1"}, test.signed)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recv := roundTrip(t, &datadog.Server{SignedGaugeDeltas: test.signed}, m)
+
+			if recv.Value != test.value || recv.Delta != test.delta {
+				t.Errorf("bad metric received: value = %g, delta = %t", recv.Value, recv.Delta)
+			}
+		})
+	}
+}
+
+func TestClientMetricDecrDefaultServer(t *testing.T) {
+	// This is the reason why decr requires -signed-gauge-deltas: a default
+	// server reads the decrement as an absolute value.
+	m, err := clientMetric("decr", []string{"x", "1"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if recv := roundTrip(t, &datadog.Server{}, m); recv.Delta || recv.Value != -1 {
+		t.Errorf("bad metric received: value = %g, delta = %t", recv.Value, recv.Delta)
+	}
+}
+
+func roundTrip(t *testing.T, srv *datadog.Server, m datadog.Metric) datadog.Metric {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	recv := make(chan datadog.Metric, 1)
+	srv.Handler = datadog.HandlerFunc(func(m datadog.Metric, _ net.Addr) { recv <- m })
+	go srv.Serve(conn)
+
+	dd := datadog.NewClient(conn.LocalAddr().String())
+	dd.Send(m)
+	dd.Close()
+
+	select {
+	case m = <-recv:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for the metric")
+	}
+	return m
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/stats/datadog"
+)
+
+func pipe(args ...string) {
+	var fset = flag.NewFlagSet("dogstatsd pipe [options...] < metrics", flag.ExitOnError)
+	var config = datadog.ClientConfig{}
+	var tags tags
+
+	fset.StringVar(&config.Address, "addr", "localhost:8125", "The network address where a dogstatsd server is listening for incoming UDP datagrams")
+	fset.IntVar(&config.BufferSize, "buffer-size", datadog.DefaultBufferSize, "The size of the datagrams sent to the server")
+	fset.DurationVar(&config.FlushInterval, "flush-interval", time.Second, "The interval at which buffered metrics are sent to the server")
+	fset.Var(&tags, "tags", "A comma-separated list of tags to set on all metrics")
+	fset.Parse(args)
+
+	dd := datadog.NewClientWith(config)
+	defer dd.Close()
+
+	s := bufio.NewScanner(os.Stdin)
+	n := 0
+	failed := 0
+
+	for s.Scan() {
+		n++
+
+		m, ok, err := parsePipeLine(s.Text())
+		if err != nil {
+			log.Printf("line %d: %s", n, err)
+			failed++
+			continue
+		}
+
+		if ok {
+			m.Tags = append(m.Tags, tags...)
+			dd.Send(m)
+		}
+	}
+
+	if err := s.Err(); err != nil {
+		dd.Close()
+		errorf("%s", err)
+	}
+
+	if failed != 0 {
+		dd.Close()
+		errorf("%d malformed lines", failed)
+	}
+}
+
+// parsePipeLine parses a line of the form "name value [type] [tags]", where the
+// type defaults to counter and tags are a comma-separated list of name:value
+// pairs. Gauge values with a leading '+' are sent as deltas, negative values set
+// the gauge since the datadog agent doesn't parse a leading '-' as a decrement.
+//
+// Empty lines and lines starting with '#' are skipped, ok is false for those.
+func parsePipeLine(line string) (m datadog.Metric, ok bool, err error) {
+	fields := strings.Fields(line)
+
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return
+	}
+
+	if len(fields) < 2 {
+		err = errors.New("missing metric value")
+		return
+	}
+
+	if len(fields) > 4 {
+		err = fmt.Errorf("too many fields: %q", line)
+		return
+	}
+
+	m.Name = fields[0]
+	m.Type = datadog.Counter
+	m.Rate = 1
+
+	if m.Value, err = strconv.ParseFloat(fields[1], 64); err != nil {
+		err = fmt.Errorf("bad metric value: %s", fields[1])
+		return
+	}
+
+	if len(fields) > 2 {
+		if m.Type, err = parsePipeType(fields[2]); err != nil {
+			return
+		}
+	}
+
+	if len(fields) > 3 {
+		var t tags
+		t.Set(fields[3])
+		m.Tags = t
+	}
+
+	m.Delta = m.Type == datadog.Gauge && fields[1][0] == '+'
+	ok = true
+	return
+}
+
+func parsePipeType(s string) (datadog.MetricType, error) {
+	switch s {
+	case "c", "counter":
+		return datadog.Counter, nil
+	case "g", "gauge":
+		return datadog.Gauge, nil
+	case "h", "histogram":
+		return datadog.Histogram, nil
+	case "d", "distribution":
+		return datadog.Distribution, nil
+	case "ms", "timer":
+		return datadog.Timer, nil
+	case "s", "set":
+		return datadog.Set, nil
+	default:
+		return datadog.Unknown, fmt.Errorf("bad metric type: %s", s)
+	}
+}
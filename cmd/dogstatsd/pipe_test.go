@@ -0,0 +1,86 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/segmentio/stats"
+	"github.com/segmentio/stats/datadog"
+)
+
+func TestParsePipeLine(t *testing.T) {
+	tests := []struct {
+		line string
+		m    datadog.Metric
+		ok   bool
+	}{
+		{line: ""},
+		{line: "   "},
+		{line: "# comment"},
+		{
+			line: "requests 1",
+			m:    datadog.Metric{Type: datadog.Counter, Name: "requests", Value: 1, Rate: 1},
+			ok:   true,
+		},
+		{
+			line: "queue.size 10 gauge",
+			m:    datadog.Metric{Type: datadog.Gauge, Name: "queue.size", Value: 10, Rate: 1},
+			ok:   true,
+		},
+		{
+			line: "queue.size -2 g queue:jobs",
+			m:    datadog.Metric{Type: datadog.Gauge, Name: "queue.size", Value: -2, Rate: 1, Tags: []stats.Tag{{"queue", "jobs"}}},
+			ok:   true,
+		},
+		{
+			line: "queue.size -2 g",
+			m:    datadog.Metric{Type: datadog.Gauge, Name: "queue.size", Value: -2, Rate: 1},
+			ok:   true,
+		},
+		{
+			line: "queue.size +2 g",
+			m:    datadog.Metric{Type: datadog.Gauge, Name: "queue.size", Value: 2, Delta: true, Rate: 1},
+			ok:   true,
+		},
+		{
+			line: "  build.time\t12.5 d  step:test,os:linux  ",
+			m:    datadog.Metric{Type: datadog.Distribution, Name: "build.time", Value: 12.5, Rate: 1, Tags: []stats.Tag{{"step", "test"}, {"os", "linux"}}},
+			ok:   true,
+		},
+		{
+			line: "users 42 set",
+			m:    datadog.Metric{Type: datadog.Set, Name: "users", Value: 42, Rate: 1},
+			ok:   true,
+		},
+		{
+			line: "latency +3 ms",
+			m:    datadog.Metric{Type: datadog.Timer, Name: "latency", Value: 3, Rate: 1},
+			ok:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			m, ok, err := parsePipeLine(test.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != test.ok || !reflect.DeepEqual(m, test.m) {
+				t.Errorf("bad metric: %#v (ok = %t)", m, ok)
+			}
+		})
+	}
+}
+
+func TestParsePipeLineError(t *testing.T) {
+	for _, line := range []string{
+		"requests",
+		"requests one",
+		"requests 1 meter",
+		"requests 1 c a:b extra",
+	} {
+		if _, _, err := parsePipeLine(line); err == nil {
+			t.Errorf("%q: expected an error", line)
+		}
+	}
+}
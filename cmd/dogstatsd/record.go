@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/segmentio/stats/datadog"
+)
+
+func record(args ...string) {
+	var fset = flag.NewFlagSet("dogstatsd record [options...] -o file", flag.ExitOnError)
+	var bind string
+	var output string
+	var duration time.Duration
+
+	fset.StringVar(&bind, "bind", ":8125", "The network address to listen on for incoming UDP datagrams")
+	fset.StringVar(&output, "o", "", "The path to the file where datagrams are captured")
+	fset.DurationVar(&duration, "duration", 0, "Stop capturing after this duration (runs until interrupted when zero)")
+	fset.Parse(args)
+
+	if len(output) == 0 {
+		errorf("missing output file")
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		errorf("%s", err)
+	}
+	defer f.Close()
+
+	capture, err := newCaptureWriter(f, time.Now())
+	if err != nil {
+		errorf("%s", err)
+	}
+
+	conn, err := net.ListenPacket("udp", bind)
+	if err != nil {
+		errorf("%s", err)
+	}
+
+	// The server has no handler, it only reads the datagrams so they can be
+	// captured, and keeps track of the statistics.
+	srv := &datadog.Server{}
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+
+	var timeout <-chan time.Time
+	if duration > 0 {
+		timeout = time.After(duration)
+	}
+
+	go func() {
+		select {
+		case <-sigchan:
+		case <-timeout:
+		}
+		signal.Stop(sigchan)
+		srv.Shutdown(context.Background())
+	}()
+
+	log.Printf("capturing UDP datagrams received on %s to %s", conn.LocalAddr(), output)
+
+	if err := srv.Serve(&recordConn{PacketConn: conn, capture: capture}); err != datadog.ErrServerClosed {
+		errorf("%s", err)
+	}
+
+	if err := capture.flush(); err != nil {
+		errorf("%s", err)
+	}
+
+	s := srv.Stats()
+	log.Printf("captured %d datagrams, %d bytes", s.Packets, s.Bytes)
+}
+
+func replay(args ...string) {
+	var fset = flag.NewFlagSet("dogstatsd replay [options...] file", flag.ExitOnError)
+	var addr string
+	var speed float64
+	var fast bool
+	var bufferSize int
+	var rel = &relay{sampleRate: 1}
+
+	fset.StringVar(&addr, "addr", "localhost:8125", "The network address where a dogstatsd server is listening for incoming UDP datagrams")
+	fset.Float64Var(&speed, "speed", 1, "The speed factor at which datagrams are replayed, 2 replays twice as fast as they were captured")
+	fset.BoolVar(&fast, "fast", false, "Replay datagrams as fast as possible")
+	fset.IntVar(&bufferSize, "buffer-size", 65507, "The maximum size of the datagrams sent to the server")
+	fset.Var((*tags)(&rel.tags), "tags", "A comma-separated list of tags to set on the replayed metrics, overriding tags with the same name")
+	fset.Var((*patterns)(&rel.strip), "strip-tags", "A glob pattern of the tag names to remove from the replayed metrics, may be repeated")
+	fset.Parse(args)
+	args = fset.Args()
+
+	if len(args) == 0 {
+		errorf("missing capture file")
+	}
+
+	if fast {
+		speed = 0
+	} else if speed <= 0 {
+		errorf("the speed factor must be positive: %g", speed)
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		errorf("%s", err)
+	}
+	defer f.Close()
+
+	capture, err := newCaptureReader(f)
+	if err != nil {
+		errorf("%s: %s", args[0], err)
+	}
+
+	conn, err := datadog.DialConfig(datadog.ConnConfig{Address: addr, BufferSize: bufferSize})
+	if err != nil {
+		errorf("%s", err)
+	}
+	defer conn.Close()
+
+	src := &replayConn{capture: capture, speed: speed}
+	start := time.Now()
+
+	if len(rel.tags) == 0 && len(rel.strip) == 0 {
+		// Without rewrites the datagrams are sent exactly as they were
+		// captured.
+		b := make([]byte, 65536)
+
+		for {
+			n, _, err := src.ReadFrom(b)
+			if err != nil {
+				if err != io.EOF {
+					errorf("%s", err)
+				}
+				break
+			}
+			if _, err := conn.Write(b[:n]); err != nil {
+				log.Printf("replaying datagram failed: %s", err)
+			}
+			if err := conn.Flush(); err != nil {
+				log.Printf("replaying datagram failed: %s", err)
+			}
+		}
+	} else {
+		// Datagrams are parsed by a dogstatsd server so the metrics can be
+		// rewritten, then formatted and sent again.
+		rel.handler = &forwarder{conns: []*datadog.Conn{conn}}
+		srv := &datadog.Server{Handler: rel, Concurrency: 1}
+
+		if err := srv.Serve(src); err != nil {
+			errorf("%s", err)
+		}
+	}
+
+	log.Printf("replayed %d datagrams in %s", src.count, time.Since(start))
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/segmentio/stats"
+	"github.com/segmentio/stats/datadog"
+)
+
+// relay is the handler used by the agent to filter, sample, tag and aggregate
+// the metrics it receives before passing them to the next handler.
+type relay struct {
+	handler    datadog.Handler
+	tags       []stats.Tag // injected tags, overriding tags with the same name
+	strip      []string    // glob patterns of the tag names to remove
+	sampleRate float64     // fraction of counters and histograms that are kept
+	include    []string    // glob patterns of the metric names to keep
+	exclude    []string    // glob patterns of the metric names to drop
+	random     func() float64
+
+	// Counters and gauges aggregated since the last flush, synchronized on
+	// mutex, nil when aggregation is disabled.
+	mutex      sync.Mutex
+	aggregated map[string]*datadog.Metric
+	order      []string
+}
+
+// HandleMetric satisfies the datadog.Handler interface.
+func (r *relay) HandleMetric(m datadog.Metric, from net.Addr) {
+	r.HandleMetrics([]datadog.Metric{m}, from)
+}
+
+// HandleMetrics satisfies the datadog.BatchHandler interface.
+func (r *relay) HandleMetrics(metrics []datadog.Metric, from net.Addr) {
+	batch := make([]datadog.Metric, 0, len(metrics))
+
+	for _, m := range metrics {
+		if !r.match(m.Name) {
+			continue
+		}
+
+		if m.Rate <= 0 || m.Rate > 1 {
+			m.Rate = 1
+		}
+
+		if r.sampleRate < 1 && m.Type != datadog.Gauge && m.Type != datadog.Set {
+			if r.random() >= r.sampleRate {
+				continue
+			}
+			m.Rate *= r.sampleRate
+		}
+
+		if len(r.strip) != 0 {
+			m.Tags = stripTags(m.Tags, r.strip)
+		}
+
+		if len(r.tags) != 0 {
+			m.Tags = injectTags(m.Tags, r.tags)
+		}
+
+		if r.aggregated != nil && (m.Type == datadog.Counter || (m.Type == datadog.Gauge && !m.Delta)) {
+			r.aggregate(m)
+			continue
+		}
+
+		batch = append(batch, m)
+	}
+
+	if len(batch) != 0 {
+		handleMetrics(r.handler, batch, from)
+	}
+}
+
+// HandleEvent satisfies the datadog.EventHandler interface.
+func (r *relay) HandleEvent(e datadog.Event, from net.Addr) {
+	if h, ok := r.handler.(datadog.EventHandler); ok {
+		h.HandleEvent(e, from)
+	}
+}
+
+// HandleServiceCheck satisfies the datadog.ServiceCheckHandler interface.
+func (r *relay) HandleServiceCheck(sc datadog.ServiceCheck, from net.Addr) {
+	if h, ok := r.handler.(datadog.ServiceCheckHandler); ok {
+		h.HandleServiceCheck(sc, from)
+	}
+}
+
+func (r *relay) match(name string) bool {
+	if len(r.include) != 0 && !matchAny(r.include, name) {
+		return false
+	}
+	return !matchAny(r.exclude, name)
+}
+
+// aggregate merges m with the metrics received since the last flush, counters
+// are summed (and corrected by their sample rate) and gauges keep their last
+// value. Gauge deltas are never aggregated.
+func (r *relay) aggregate(m datadog.Metric) {
+	tags := append(make([]stats.Tag, 0, len(m.Tags)), m.Tags...)
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+
+	k := string(m.Type) + "|" + m.Name + "|" + tagsString(tags)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	a := r.aggregated[k]
+
+	if a == nil {
+		a = &datadog.Metric{
+			Type: m.Type,
+			Name: m.Name,
+			Rate: 1,
+			Tags: tags,
+		}
+		r.aggregated[k] = a
+		r.order = append(r.order, k)
+	}
+
+	if m.Type == datadog.Counter {
+		a.Value += m.Value / m.Rate
+	} else {
+		a.Value = m.Value
+	}
+}
+
+// flush passes the aggregated metrics to the next handler.
+func (r *relay) flush() {
+	r.mutex.Lock()
+	batch := make([]datadog.Metric, 0, len(r.order))
+
+	for _, k := range r.order {
+		batch = append(batch, *r.aggregated[k])
+		delete(r.aggregated, k)
+	}
+
+	r.order = r.order[:0]
+	r.mutex.Unlock()
+
+	if len(batch) != 0 {
+		handleMetrics(r.handler, batch, nil)
+	}
+}
+
+// run flushes the aggregated metrics at the given interval until done is
+// closed, then flushes one last time.
+func (r *relay) run(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.flush()
+		case <-done:
+			r.flush()
+			return
+		}
+	}
+}
+
+// forwarder is a handler which sends the metrics, events and service checks
+// it receives to upstream dogstatsd servers.
+type forwarder struct {
+	conns []*datadog.Conn
+}
+
+// HandleMetric satisfies the datadog.Handler interface.
+func (f *forwarder) HandleMetric(m datadog.Metric, from net.Addr) {
+	f.HandleMetrics([]datadog.Metric{m}, from)
+}
+
+// HandleMetrics satisfies the datadog.BatchHandler interface.
+func (f *forwarder) HandleMetrics(metrics []datadog.Metric, from net.Addr) {
+	for _, c := range f.conns {
+		for _, m := range metrics {
+			if _, err := fmt.Fprint(c, m); err != nil {
+				log.Printf("forwarding metric %s to %s failed: %s", m.Name, c.RemoteAddr(), err)
+			}
+		}
+		f.flush(c)
+	}
+}
+
+// HandleEvent satisfies the datadog.EventHandler interface.
+func (f *forwarder) HandleEvent(e datadog.Event, from net.Addr) {
+	for _, c := range f.conns {
+		if _, err := fmt.Fprint(c, e); err != nil {
+			log.Printf("forwarding event %q to %s failed: %s", e.Title, c.RemoteAddr(), err)
+		}
+		f.flush(c)
+	}
+}
+
+// HandleServiceCheck satisfies the datadog.ServiceCheckHandler interface.
+func (f *forwarder) HandleServiceCheck(sc datadog.ServiceCheck, from net.Addr) {
+	for _, c := range f.conns {
+		if _, err := fmt.Fprint(c, sc); err != nil {
+			log.Printf("forwarding service check %s to %s failed: %s", sc.Name, c.RemoteAddr(), err)
+		}
+		f.flush(c)
+	}
+}
+
+func (f *forwarder) flush(c *datadog.Conn) {
+	if err := c.Flush(); err != nil {
+		log.Printf("forwarding to %s failed: %s", c.RemoteAddr(), err)
+	}
+}
+
+// Close closes the connections to the upstream servers.
+func (f *forwarder) Close() error {
+	for _, c := range f.conns {
+		c.Close()
+	}
+	return nil
+}
+
+// multiHandler passes the metrics, events and service checks it receives to
+// each of its handlers.
+type multiHandler []datadog.Handler
+
+// HandleMetric satisfies the datadog.Handler interface.
+func (handlers multiHandler) HandleMetric(m datadog.Metric, from net.Addr) {
+	for _, h := range handlers {
+		h.HandleMetric(m, from)
+	}
+}
+
+// HandleMetrics satisfies the datadog.BatchHandler interface.
+func (handlers multiHandler) HandleMetrics(metrics []datadog.Metric, from net.Addr) {
+	for _, h := range handlers {
+		handleMetrics(h, metrics, from)
+	}
+}
+
+// HandleEvent satisfies the datadog.EventHandler interface.
+func (handlers multiHandler) HandleEvent(e datadog.Event, from net.Addr) {
+	for _, h := range handlers {
+		if eh, ok := h.(datadog.EventHandler); ok {
+			eh.HandleEvent(e, from)
+		}
+	}
+}
+
+// HandleServiceCheck satisfies the datadog.ServiceCheckHandler interface.
+func (handlers multiHandler) HandleServiceCheck(sc datadog.ServiceCheck, from net.Addr) {
+	for _, h := range handlers {
+		if ch, ok := h.(datadog.ServiceCheckHandler); ok {
+			ch.HandleServiceCheck(sc, from)
+		}
+	}
+}
+
+func handleMetrics(h datadog.Handler, metrics []datadog.Metric, from net.Addr) {
+	if bh, ok := h.(datadog.BatchHandler); ok {
+		bh.HandleMetrics(metrics, from)
+		return
+	}
+	for _, m := range metrics {
+		h.HandleMetric(m, from)
+	}
+}
+
+// injectTags returns a new slice of tags made of tags, where the values of the
+// tags present in inject are replaced, and the missing ones are appended.
+func injectTags(tags []stats.Tag, inject []stats.Tag) []stats.Tag {
+	t := make([]stats.Tag, 0, len(tags)+len(inject))
+	t = append(t, tags...)
+
+inject:
+	for _, tag := range inject {
+		for i := range t {
+			if t[i].Name == tag.Name {
+				t[i].Value = tag.Value
+				continue inject
+			}
+		}
+		t = append(t, tag)
+	}
+
+	return t
+}
+
+// stripTags returns a new slice of tags made of the tags which have a name that
+// doesn't match any of the patterns.
+func stripTags(tags []stats.Tag, patterns []string) []stats.Tag {
+	t := make([]stats.Tag, 0, len(tags))
+
+	for _, tag := range tags {
+		if !matchAny(patterns, tag.Name) {
+			t = append(t, tag)
+		}
+	}
+
+	return t
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// patterns is a flag value accumulating the patterns it is set to.
+type patterns []string
+
+func (p patterns) String() string {
+	return fmt.Sprint([]string(p))
+}
+
+func (p *patterns) Set(s string) error {
+	if _, err := path.Match(s, ""); err != nil {
+		return err
+	}
+	*p = append(*p, s)
+	return nil
+}
+
+// addresses is a flag value accumulating the addresses it is set to.
+type addresses []string
+
+func (a addresses) String() string {
+	return fmt.Sprint([]string(a))
+}
+
+func (a *addresses) Set(s string) error {
+	*a = append(*a, s)
+	return nil
+}
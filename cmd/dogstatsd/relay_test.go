@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+	"github.com/segmentio/stats/datadog"
+)
+
+type batchRecorder struct {
+	metrics []datadog.Metric
+	events  []datadog.Event
+}
+
+func (r *batchRecorder) HandleMetric(m datadog.Metric, from net.Addr) {
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *batchRecorder) HandleEvent(e datadog.Event, from net.Addr) {
+	r.events = append(r.events, e)
+}
+
+func TestRelay(t *testing.T) {
+	rec := &batchRecorder{}
+	random := 0.0
+
+	r := &relay{
+		handler:    rec,
+		tags:       []stats.Tag{{"env", "dev"}, {"host", "relay"}},
+		sampleRate: 0.5,
+		include:    []string{"app.*"},
+		exclude:    []string{"app.debug.*"},
+		random:     func() float64 { random += 0.3; return random - 0.3 },
+	}
+
+	r.HandleMetrics([]datadog.Metric{
+		{Type: datadog.Counter, Name: "app.requests", Value: 1, Tags: []stats.Tag{{"host", "a"}}},
+		{Type: datadog.Counter, Name: "app.requests", Value: 1},             // random = 0.3
+		{Type: datadog.Counter, Name: "app.requests", Value: 1},             // random = 0.6, dropped
+		{Type: datadog.Gauge, Name: "app.queue", Value: 4},                  // gauges aren't sampled
+		{Type: datadog.Counter, Name: "app.debug.calls", Value: 1},          // excluded
+		{Type: datadog.Counter, Name: "other.requests", Value: 1, Rate: 1},  // not included
+		{Type: datadog.Histogram, Name: "app.latency", Value: 1, Rate: 0.5}, // random = 0.9, dropped
+	}, nil)
+
+	r.HandleEvent(datadog.Event{Title: "deploy"}, nil)
+
+	expected := []datadog.Metric{
+		{Type: datadog.Counter, Name: "app.requests", Value: 1, Rate: 0.5, Tags: []stats.Tag{{"host", "relay"}, {"env", "dev"}}},
+		{Type: datadog.Counter, Name: "app.requests", Value: 1, Rate: 0.5, Tags: []stats.Tag{{"env", "dev"}, {"host", "relay"}}},
+		{Type: datadog.Gauge, Name: "app.queue", Value: 4, Rate: 1, Tags: []stats.Tag{{"env", "dev"}, {"host", "relay"}}},
+	}
+
+	if !reflect.DeepEqual(rec.metrics, expected) {
+		t.Errorf("bad metrics:\n- expected: %v\n- found:    %v", expected, rec.metrics)
+	}
+
+	if len(rec.events) != 1 {
+		t.Errorf("the event wasn't relayed")
+	}
+}
+
+func TestRelayAggregate(t *testing.T) {
+	rec := &batchRecorder{}
+
+	r := &relay{
+		handler:    rec,
+		sampleRate: 1,
+		aggregated: make(map[string]*datadog.Metric),
+	}
+
+	r.HandleMetrics([]datadog.Metric{
+		{Type: datadog.Counter, Name: "requests", Value: 1, Rate: 0.5, Tags: []stats.Tag{{"b", "2"}, {"a", "1"}}},
+		{Type: datadog.Counter, Name: "requests", Value: 3, Tags: []stats.Tag{{"a", "1"}, {"b", "2"}}},
+		{Type: datadog.Gauge, Name: "queue", Value: 1},
+		{Type: datadog.Gauge, Name: "queue", Value: 2},
+		{Type: datadog.Histogram, Name: "latency", Value: 1},
+		{Type: datadog.Gauge, Name: "workers", Value: 1, Delta: true},
+	}, nil)
+
+	if len(rec.metrics) != 2 || rec.metrics[0].Name != "latency" || rec.metrics[1].Name != "workers" {
+		t.Fatalf("only histograms and gauge deltas must be relayed before the flush: %v", rec.metrics)
+	}
+
+	rec.metrics = nil
+	r.flush()
+
+	expected := []datadog.Metric{
+		{Type: datadog.Counter, Name: "requests", Value: 5, Rate: 1, Tags: []stats.Tag{{"a", "1"}, {"b", "2"}}},
+		{Type: datadog.Gauge, Name: "queue", Value: 2, Rate: 1, Tags: []stats.Tag{}},
+	}
+
+	if !reflect.DeepEqual(rec.metrics, expected) {
+		t.Errorf("bad aggregated metrics:\n- expected: %v\n- found:    %v", expected, rec.metrics)
+	}
+
+	rec.metrics = nil
+	r.flush()
+
+	if len(rec.metrics) != 0 {
+		t.Errorf("metrics were relayed twice: %v", rec.metrics)
+	}
+}
+
+func TestForwarder(t *testing.T) {
+	var servers []*datadog.Server
+	var received []chan datadog.Metric
+	fwd := &forwarder{}
+
+	for i := 0; i != 2; i++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ch := make(chan datadog.Metric, 10)
+		srv := &datadog.Server{Handler: datadog.HandlerFunc(func(m datadog.Metric, _ net.Addr) { ch <- m })}
+		go srv.Serve(conn)
+
+		c, err := datadog.Dial(conn.LocalAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		servers = append(servers, srv)
+		received = append(received, ch)
+		fwd.conns = append(fwd.conns, c)
+	}
+
+	defer func() {
+		fwd.Close()
+		for _, srv := range servers {
+			srv.Shutdown(context.Background())
+		}
+	}()
+
+	multiHandler{fwd}.HandleMetrics([]datadog.Metric{
+		{Type: datadog.Counter, Name: "requests", Value: 1, Rate: 1, Tags: []stats.Tag{{"env", "dev"}}},
+		{Type: datadog.Gauge, Name: "queue", Value: 2, Rate: 1},
+	}, nil)
+
+	for i, ch := range received {
+		var names []string
+
+		for len(names) != 2 {
+			select {
+			case m := <-ch:
+				names = append(names, m.Name)
+			case <-time.After(time.Second):
+				t.Fatalf("server %d: timeout waiting for forwarded metrics (got %v)", i, names)
+			}
+		}
+
+		sort.Strings(names)
+
+		if !reflect.DeepEqual(names, []string{"queue", "requests"}) {
+			t.Errorf("server %d: bad forwarded metrics: %v", i, names)
+		}
+	}
+}
+
+func TestInjectTags(t *testing.T) {
+	tags := []stats.Tag{{"host", "a"}, {"region", "us"}}
+	inject := []stats.Tag{{"env", "dev"}, {"host", "b"}}
+
+	result := injectTags(tags, inject)
+
+	if !reflect.DeepEqual(result, []stats.Tag{{"host", "b"}, {"region", "us"}, {"env", "dev"}}) {
+		t.Errorf("bad tags: %v", result)
+	}
+
+	if tags[0].Value != "a" {
+		t.Error("the original tags were modified")
+	}
+}
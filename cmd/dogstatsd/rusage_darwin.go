@@ -0,0 +1,5 @@
+package main
+
+// maxrssScale converts the max RSS reported by the system to bytes, darwin
+// reports it in bytes.
+const maxrssScale = 1
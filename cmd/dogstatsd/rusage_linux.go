@@ -0,0 +1,5 @@
+package main
+
+// maxrssScale converts the max RSS reported by the system to bytes, linux
+// reports it in kilobytes.
+const maxrssScale = 1024
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package main
+
+import "os"
+
+func getRusage(ps *os.ProcessState) (usage rusage, ok bool) {
+	return
+}
+
+func exitCode(ps *os.ProcessState) int {
+	if code := ps.ExitCode(); code >= 0 {
+		return code
+	}
+	return 1
+}
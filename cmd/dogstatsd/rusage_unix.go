@@ -0,0 +1,34 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+func getRusage(ps *os.ProcessState) (usage rusage, ok bool) {
+	ru, ok := ps.SysUsage().(*syscall.Rusage)
+	if !ok || ru == nil {
+		return
+	}
+
+	usage = rusage{
+		user:        time.Duration(ru.Utime.Nano()),
+		system:      time.Duration(ru.Stime.Nano()),
+		maxRSS:      int64(ru.Maxrss) * maxrssScale,
+		minorFaults: int64(ru.Minflt),
+		majorFaults: int64(ru.Majflt),
+	}
+	return usage, true
+}
+
+func exitCode(ps *os.ProcessState) int {
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		// Follow the shell convention for processes killed by a signal.
+		return 128 + int(ws.Signal())
+	}
+	return ps.ExitCode()
+}
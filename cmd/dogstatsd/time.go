@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/segmentio/stats"
+	"github.com/segmentio/stats/datadog"
+)
+
+// rusage carries the resource usage of a child process.
+type rusage struct {
+	user        time.Duration
+	system      time.Duration
+	maxRSS      int64 // bytes
+	minorFaults int64
+	majorFaults int64
+}
+
+// timing carries the measures reported by dogstatsd time.
+type timing struct {
+	start    time.Duration // time spent starting the process
+	run      time.Duration // time spent waiting for the process to exit
+	exitCode int
+	usage    rusage
+	hasUsage bool
+}
+
+func timeCommand(args ...string) {
+	var fset = flag.NewFlagSet("dogstatsd time [options...] metric -- command [args...]", flag.ExitOnError)
+	var extra []string
+	var tags tags
+	var addr string
+
+	args, extra = split(args, "--")
+	fset.StringVar(&addr, "addr", "localhost:8125", "The network address where a dogstatsd server is listening for incoming UDP datagrams")
+	fset.Var(&tags, "tags", "A comma-separated list of tags to set on the metrics")
+	fset.Parse(args)
+	args = fset.Args()
+
+	if len(args) == 0 {
+		errorf("missing metric name")
+	}
+
+	if len(extra) == 0 {
+		errorf("missing command line")
+	}
+
+	// The signals are caught instead of terminating this process, so the
+	// measures can be reported after the child exits (see runTimed). They
+	// aren't ignored with signal.Ignore because the child would inherit it.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGHUP)
+
+	t := runTimed(signals, extra...)
+	signal.Stop(signals)
+
+	dd := datadog.NewClient(addr)
+
+	for _, m := range t.metrics(args[0], tags) {
+		dd.Send(m)
+	}
+
+	dd.Close()
+	os.Exit(t.exitCode)
+}
+
+// runTimed runs the command, it never fails, commands that can't be started
+// get the exit code 127 like they would in a shell.
+//
+// SIGTERM and SIGHUP received on the channel while the command is running are
+// sent to its process, other signals are discarded: SIGINT and SIGQUIT come
+// from the terminal, which already sends them to the whole process group, so
+// forwarding them would deliver them twice.
+func runTimed(signals <-chan os.Signal, args ...string) (t timing) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	start := time.Now()
+	err := cmd.Start()
+	t.start = time.Since(start)
+
+	if err != nil {
+		log.Print(err)
+		t.exitCode = 127
+		return
+	}
+
+	done := make(chan struct{})
+	join := make(chan struct{})
+
+	go func() {
+		defer close(join)
+		for {
+			select {
+			case sig := <-signals:
+				if sig == syscall.SIGTERM || sig == syscall.SIGHUP {
+					cmd.Process.Signal(sig)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	start = time.Now()
+	cmd.Wait()
+	t.run = time.Since(start)
+
+	close(done)
+	<-join
+
+	t.exitCode = exitCode(cmd.ProcessState)
+	t.usage, t.hasUsage = getRusage(cmd.ProcessState)
+	return
+}
+
+// metrics returns the metrics reporting t, all tagged with the exit code and
+// result of the command.
+func (t timing) metrics(name string, tags []stats.Tag) []datadog.Metric {
+	result := "success"
+	if t.exitCode != 0 {
+		result = "failure"
+	}
+
+	tags = append(append(make([]stats.Tag, 0, len(tags)+2), tags...),
+		stats.Tag{Name: "exit_code", Value: strconv.Itoa(t.exitCode)},
+		stats.Tag{Name: "result", Value: result},
+	)
+
+	metric := func(typ datadog.MetricType, suffix string, value float64) datadog.Metric {
+		return datadog.Metric{Type: typ, Name: name + suffix, Value: value, Rate: 1, Tags: tags}
+	}
+
+	metrics := []datadog.Metric{
+		metric(datadog.Histogram, "", (t.start + t.run).Seconds()),
+		metric(datadog.Histogram, ".start", t.start.Seconds()),
+		metric(datadog.Histogram, ".run", t.run.Seconds()),
+	}
+
+	if t.hasUsage {
+		metrics = append(metrics,
+			metric(datadog.Histogram, ".cpu.user", t.usage.user.Seconds()),
+			metric(datadog.Histogram, ".cpu.system", t.usage.system.Seconds()),
+			metric(datadog.Gauge, ".memory.max_rss", float64(t.usage.maxRSS)),
+			metric(datadog.Counter, ".page_faults.minor", float64(t.usage.minorFaults)),
+			metric(datadog.Counter, ".page_faults.major", float64(t.usage.majorFaults)),
+		)
+	}
+
+	return metrics
+}
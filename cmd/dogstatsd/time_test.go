@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+	"github.com/segmentio/stats/datadog"
+)
+
+func TestRunTimed(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test uses unix commands")
+	}
+
+	tests := []struct {
+		args     []string
+		exitCode int
+	}{
+		{[]string{"true"}, 0},
+		{[]string{"sh", "-c", "exit 3"}, 3},
+		{[]string{"sh", "-c", "kill -9 $$"}, 128 + 9},
+		{[]string{"dogstatsd-test-command-that-does-not-exist"}, 127},
+	}
+
+	for _, test := range tests {
+		t.Run(test.args[0], func(t *testing.T) {
+			timing := runTimed(nil, test.args...)
+
+			if timing.exitCode != test.exitCode {
+				t.Errorf("bad exit code: %d", timing.exitCode)
+			}
+
+			if test.exitCode != 127 {
+				if timing.run <= 0 {
+					t.Errorf("the run phase wasn't measured: %s", timing.run)
+				}
+				if (runtime.GOOS == "linux" || runtime.GOOS == "darwin") && (!timing.hasUsage || timing.usage.maxRSS <= 0) {
+					t.Errorf("the resource usage wasn't reported: %+v", timing.usage)
+				}
+			}
+		})
+	}
+}
+
+func TestRunTimedSignals(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test uses unix commands")
+	}
+
+	for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGHUP} {
+		signals := make(chan os.Signal, 1)
+		signals <- sig
+
+		timing := runTimed(signals, "sleep", "10")
+
+		if timing.exitCode != 128+int(sig) {
+			t.Errorf("%s: the signal was not forwarded, exit code: %d", sig, timing.exitCode)
+		}
+	}
+
+	// The terminal sends SIGINT and SIGQUIT to the child, they aren't
+	// forwarded.
+	signals := make(chan os.Signal, 2)
+	signals <- syscall.SIGINT
+	signals <- syscall.SIGQUIT
+
+	if timing := runTimed(signals, "sleep", "0.1"); timing.exitCode != 0 {
+		t.Errorf("the signals were forwarded, exit code: %d", timing.exitCode)
+	}
+}
+
+func TestTimingMetrics(t *testing.T) {
+	timing := timing{
+		start:    10 * time.Millisecond,
+		run:      2 * time.Second,
+		exitCode: 1,
+		usage: rusage{
+			user:        time.Second,
+			system:      500 * time.Millisecond,
+			maxRSS:      4096,
+			minorFaults: 10,
+			majorFaults: 2,
+		},
+		hasUsage: true,
+	}
+
+	tags := []stats.Tag{{"exit_code", "1"}, {"result", "failure"}}
+	userTags := []stats.Tag{{"job", "build"}}
+	withUserTags := append(append([]stats.Tag{}, userTags...), tags...)
+
+	expected := []datadog.Metric{
+		{Type: datadog.Histogram, Name: "job", Value: 2.01, Rate: 1, Tags: withUserTags},
+		{Type: datadog.Histogram, Name: "job.start", Value: 0.01, Rate: 1, Tags: withUserTags},
+		{Type: datadog.Histogram, Name: "job.run", Value: 2, Rate: 1, Tags: withUserTags},
+		{Type: datadog.Histogram, Name: "job.cpu.user", Value: 1, Rate: 1, Tags: withUserTags},
+		{Type: datadog.Histogram, Name: "job.cpu.system", Value: 0.5, Rate: 1, Tags: withUserTags},
+		{Type: datadog.Gauge, Name: "job.memory.max_rss", Value: 4096, Rate: 1, Tags: withUserTags},
+		{Type: datadog.Counter, Name: "job.page_faults.minor", Value: 10, Rate: 1, Tags: withUserTags},
+		{Type: datadog.Counter, Name: "job.page_faults.major", Value: 2, Rate: 1, Tags: withUserTags},
+	}
+
+	if metrics := timing.metrics("job", userTags); !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("bad metrics:\n- expected: %v\n- found:    %v", expected, metrics)
+	}
+
+	timing.exitCode, timing.hasUsage = 0, false
+
+	metrics := timing.metrics("job", nil)
+
+	if len(metrics) != 3 {
+		t.Errorf("bad number of metrics without resource usage: %d", len(metrics))
+	}
+
+	if !reflect.DeepEqual(metrics[0].Tags, []stats.Tag{{"exit_code", "0"}, {"result", "success"}}) {
+		t.Errorf("bad tags: %v", metrics[0].Tags)
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/segmentio/stats"
+	"github.com/segmentio/stats/datadog"
+)
+
+const (
+	// maxSlotValues is the number of values kept per second by each series to
+	// compute percentiles, values are sampled beyond this limit.
+	maxSlotValues = 1000
+)
+
+func top(args ...string) {
+	var fset = flag.NewFlagSet("dogstatsd top [options...]", flag.ExitOnError)
+	var bind string
+	var window time.Duration
+	var interval time.Duration
+	var sortBy string
+	var filter topFilter
+	var limit int
+	var once bool
+	var jsonOutput bool
+
+	fset.StringVar(&bind, "bind", ":8125", "The network address to listen on for incoming UDP datagrams")
+	fset.DurationVar(&window, "window", 10*time.Second, "The duration of the sliding window over which metrics are aggregated")
+	fset.DurationVar(&interval, "interval", 1*time.Second, "The interval at which the table is refreshed")
+	fset.StringVar(&sortBy, "sort", "rate", "The column to sort the table by (name, type, rate, count, last, p50, p90 or p99)")
+	fset.StringVar(&filter.pattern, "filter", "", "Only show metrics with a name matching this glob pattern, or containing this string")
+	fset.Var(&filter.tags, "tags", "Only show metrics with these tags, a tag without a value matches any value")
+	fset.IntVar(&limit, "n", 40, "The maximum number of rows to display, zero shows all rows")
+	fset.BoolVar(&once, "once", false, "Collect metrics for one window, print the table and exit")
+	fset.BoolVar(&jsonOutput, "json", false, "Print rows as JSON instead of rendering a table, implies non-interactive mode")
+	fset.Parse(args)
+
+	if window < time.Second {
+		errorf("the window must be at least one second: %s", window)
+	}
+
+	if _, ok := topColumns[sortBy]; !ok {
+		errorf("bad sort column: %s", sortBy)
+	}
+
+	conn, err := net.ListenPacket("udp", bind)
+	if err != nil {
+		errorf("%s", err)
+	}
+
+	w := newTopWindow(window)
+	srv := &datadog.Server{Handler: w}
+
+	go srv.Serve(conn)
+	defer srv.Shutdown(context.Background())
+
+	view := &topView{
+		window: w,
+		filter: filter,
+		sortBy: sortBy,
+		limit:  limit,
+	}
+
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+
+	if once {
+		select {
+		case <-time.After(window):
+		case <-sigchan:
+		}
+		if err := view.print(os.Stdout, time.Now(), jsonOutput); err != nil {
+			errorf("%s", err)
+		}
+		return
+	}
+
+	commands := make(chan string)
+
+	if !jsonOutput {
+		go readCommands(os.Stdin, commands)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if !jsonOutput {
+			fmt.Print("\033[H\033[2J")
+			fmt.Printf("dogstatsd top - listening on %s, %s window, sorted by %s", conn.LocalAddr(), window, view.sortBy)
+			if len(view.filter.pattern) != 0 {
+				fmt.Printf(", filter: %s", view.filter.pattern)
+			}
+			fmt.Print("\ncommands: s <column> (sort), / <pattern> (filter), q (quit)\n\n")
+		}
+
+		if err := view.print(os.Stdout, time.Now(), jsonOutput); err != nil {
+			errorf("%s", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-sigchan:
+			return
+		case cmd, ok := <-commands:
+			if !ok || !view.command(cmd) {
+				return
+			}
+		}
+	}
+}
+
+// readCommands reads the commands typed by the user, one per line.
+func readCommands(r io.Reader, commands chan<- string) {
+	defer close(commands)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		commands <- strings.TrimSpace(s.Text())
+	}
+}
+
+// topWindow aggregates the metrics received by the agent over a sliding window,
+// it is divided in one second slots.
+type topWindow struct {
+	mutex  sync.Mutex
+	size   int64 // number of slots
+	series map[string]*topSeries
+	now    func() time.Time
+}
+
+type topSeries struct {
+	name  string
+	mtype datadog.MetricType
+	tags  []stats.Tag
+	last  float64
+	slots []topSlot
+}
+
+type topSlot struct {
+	sec    int64     // the unix time of the slot
+	count  float64   // number of values, corrected by the sample rate
+	sum    float64   // sum of the values, corrected by the sample rate
+	seen   int       // number of values seen, used to sample values
+	values []float64 // sampled values used to compute percentiles
+}
+
+func newTopWindow(size time.Duration) *topWindow {
+	return &topWindow{
+		size:   int64(size / time.Second),
+		series: make(map[string]*topSeries),
+		now:    time.Now,
+	}
+}
+
+// HandleMetric satisfies the datadog.Handler interface.
+func (w *topWindow) HandleMetric(m datadog.Metric, from net.Addr) {
+	if m.Type == datadog.Set {
+		return // set members aren't numeric values
+	}
+
+	tags := append(make([]stats.Tag, 0, len(m.Tags)), m.Tags...)
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+
+	k := string(m.Type) + "|" + m.Name + "|" + tagsString(tags)
+	sec := w.now().Unix()
+
+	rate := m.Rate
+	if rate <= 0 || rate > 1 {
+		rate = 1
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	s := w.series[k]
+
+	if s == nil {
+		s = &topSeries{
+			name:  m.Name,
+			mtype: m.Type,
+			tags:  tags,
+			slots: make([]topSlot, w.size),
+		}
+		w.series[k] = s
+	}
+
+	slot := &s.slots[sec%w.size]
+
+	if slot.sec != sec {
+		*slot = topSlot{sec: sec, values: slot.values[:0]}
+	}
+
+	s.last = m.Value
+	slot.count += 1 / rate
+	slot.seen++
+
+	slot.sum += m.Value / rate
+
+	if len(slot.values) < maxSlotValues {
+		slot.values = append(slot.values, m.Value)
+	} else if i := rand.Intn(slot.seen); i < maxSlotValues {
+		slot.values[i] = m.Value
+	}
+}
+
+// topRow is a line of the table rendered by dogstatsd top.
+type topRow struct {
+	Name  string  `json:"name"`
+	Type  string  `json:"type"`
+	Tags  string  `json:"tags,omitempty"`
+	Rate  float64 `json:"rate"`
+	Count float64 `json:"count"`
+	Last  float64 `json:"last"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+}
+
+// MarshalJSON satisfies the json.Marshaler interface, non-finite values are
+// written as strings since they can't be represented as JSON numbers.
+func (r topRow) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Name  string      `json:"name"`
+		Type  string      `json:"type"`
+		Tags  string      `json:"tags,omitempty"`
+		Rate  interface{} `json:"rate"`
+		Count interface{} `json:"count"`
+		Last  interface{} `json:"last"`
+		P50   interface{} `json:"p50"`
+		P90   interface{} `json:"p90"`
+		P99   interface{} `json:"p99"`
+	}{
+		Name:  r.Name,
+		Type:  r.Type,
+		Tags:  r.Tags,
+		Rate:  jsonFloat(r.Rate),
+		Count: jsonFloat(r.Count),
+		Last:  jsonFloat(r.Last),
+		P50:   jsonFloat(r.P50),
+		P90:   jsonFloat(r.P90),
+		P99:   jsonFloat(r.P99),
+	})
+}
+
+func jsonFloat(v float64) interface{} {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return v
+}
+
+// rows returns the rows for the series of the window that are selected by f,
+// series which haven't received values during the window are removed.
+func (w *topWindow) rows(now time.Time, f topFilter) []topRow {
+	sec := now.Unix()
+	rows := []topRow{}
+	values := []float64{}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for k, s := range w.series {
+		var count, sum float64
+		values = values[:0]
+
+		for _, slot := range s.slots {
+			if slot.sec > sec-w.size && slot.sec <= sec {
+				count += slot.count
+				sum += slot.sum
+				values = append(values, slot.values...)
+			}
+		}
+
+		if count == 0 {
+			delete(w.series, k)
+			continue
+		}
+
+		if !f.match(s) {
+			continue
+		}
+
+		row := topRow{
+			Name:  s.name,
+			Type:  string(s.mtype),
+			Tags:  tagsString(s.tags),
+			Count: count,
+			Last:  s.last,
+		}
+
+		if s.mtype == datadog.Counter {
+			row.Rate = sum / float64(w.size)
+		} else {
+			row.Rate = count / float64(w.size)
+		}
+
+		sort.Float64s(values)
+		row.P50 = percentile(values, 0.5)
+		row.P90 = percentile(values, 0.9)
+		row.P99 = percentile(values, 0.99)
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(math.Ceil(p*float64(len(sorted))))-1]
+}
+
+// topColumns maps the names of the columns to functions comparing rows, names
+// are sorted in ascending order and numeric columns in descending order.
+var topColumns = map[string]func(r1, r2 *topRow) bool{
+	"name":  func(r1, r2 *topRow) bool { return r1.Name < r2.Name },
+	"type":  func(r1, r2 *topRow) bool { return r1.Type < r2.Type },
+	"rate":  func(r1, r2 *topRow) bool { return r1.Rate > r2.Rate },
+	"count": func(r1, r2 *topRow) bool { return r1.Count > r2.Count },
+	"last":  func(r1, r2 *topRow) bool { return r1.Last > r2.Last },
+	"p50":   func(r1, r2 *topRow) bool { return r1.P50 > r2.P50 },
+	"p90":   func(r1, r2 *topRow) bool { return r1.P90 > r2.P90 },
+	"p99":   func(r1, r2 *topRow) bool { return r1.P99 > r2.P99 },
+}
+
+func sortRows(rows []topRow, column string) {
+	less := topColumns[column]
+	sort.Slice(rows, func(i, j int) bool {
+		r1, r2 := &rows[i], &rows[j]
+		if less(r1, r2) {
+			return true
+		}
+		if less(r2, r1) {
+			return false
+		}
+		if r1.Name != r2.Name {
+			return r1.Name < r2.Name
+		}
+		return r1.Tags < r2.Tags
+	})
+}
+
+// topFilter selects the series displayed by dogstatsd top.
+type topFilter struct {
+	pattern string
+	tags    tags
+}
+
+func (f topFilter) match(s *topSeries) bool {
+	if len(f.pattern) != 0 && !strings.Contains(s.name, f.pattern) {
+		if ok, _ := path.Match(f.pattern, s.name); !ok {
+			return false
+		}
+	}
+
+	for _, tag := range f.tags {
+		found := false
+
+		for _, t := range s.tags {
+			if t.Name == tag.Name && (len(tag.Value) == 0 || t.Value == tag.Value) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// topView holds the display settings of dogstatsd top.
+type topView struct {
+	window *topWindow
+	filter topFilter
+	sortBy string
+	limit  int
+}
+
+// command applies a command typed by the user, it returns false if the program
+// must exit.
+func (v *topView) command(cmd string) bool {
+	switch {
+	case cmd == "q":
+		return false
+
+	case strings.HasPrefix(cmd, "s"):
+		if column := strings.TrimSpace(cmd[1:]); topColumns[column] != nil {
+			v.sortBy = column
+		}
+
+	case strings.HasPrefix(cmd, "/"):
+		v.filter.pattern = strings.TrimSpace(cmd[1:])
+	}
+
+	return true
+}
+
+func (v *topView) print(w io.Writer, now time.Time, jsonOutput bool) error {
+	rows := v.window.rows(now, v.filter)
+	sortRows(rows, v.sortBy)
+
+	if v.limit > 0 && len(rows) > v.limit {
+		rows = rows[:v.limit]
+	}
+
+	if jsonOutput {
+		b, err := json.Marshal(rows)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprint(tw, "NAME\tTYPE\tRATE/s\tCOUNT\tLAST\tP50\tP90\tP99\tTAGS\n")
+
+	for _, r := range rows {
+		fmt.Fprintf(tw, "%s\t%s\t%.2f\t%.0f\t%g\t%g\t%g\t%g\t%s\n",
+			r.Name, r.Type, r.Rate, r.Count, r.Last, r.P50, r.P90, r.P99, r.Tags)
+	}
+
+	return tw.Flush()
+}
+
+func tagsString(t []stats.Tag) string {
+	return tags(t).String()
+}
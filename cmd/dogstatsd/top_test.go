@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+	"github.com/segmentio/stats/datadog"
+)
+
+func TestTopWindow(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+
+	w := newTopWindow(10 * time.Second)
+	w.now = func() time.Time { return now }
+
+	for i := 1; i <= 100; i++ {
+		w.HandleMetric(datadog.Metric{Type: datadog.Histogram, Name: "latency", Value: float64(i), Rate: 1}, nil)
+	}
+
+	w.HandleMetric(datadog.Metric{Type: datadog.Counter, Name: "requests", Value: 5, Rate: 0.5, Tags: []stats.Tag{{"b", "2"}, {"a", "1"}}}, nil)
+	w.HandleMetric(datadog.Metric{Type: datadog.Counter, Name: "requests", Value: 10, Rate: 1, Tags: []stats.Tag{{"a", "1"}, {"b", "2"}}}, nil)
+	w.HandleMetric(datadog.Metric{Type: datadog.Gauge, Name: "queue.size", Value: 3, Tags: []stats.Tag{{"a", "2"}}}, nil)
+	w.HandleMetric(datadog.Metric{Type: datadog.Set, Name: "users", Value: 1}, nil)
+
+	rows := w.rows(now, topFilter{})
+	sortRows(rows, "name")
+
+	expected := []topRow{
+		{Name: "latency", Type: "h", Rate: 10, Count: 100, Last: 100, P50: 50, P90: 90, P99: 99},
+		{Name: "queue.size", Type: "g", Tags: "a:2", Rate: 0.1, Count: 1, Last: 3, P50: 3, P90: 3, P99: 3},
+		{Name: "requests", Type: "c", Tags: "a:1,b:2", Rate: 2, Count: 3, Last: 10, P50: 5, P90: 10, P99: 10},
+	}
+
+	if !reflect.DeepEqual(rows, expected) {
+		t.Errorf("bad rows:\n- expected: %+v\n- found:    %+v", expected, rows)
+	}
+
+	if rows := w.rows(now.Add(9*time.Second), topFilter{}); len(rows) != 3 {
+		t.Errorf("series expired before the end of the window: %+v", rows)
+	}
+
+	if rows := w.rows(now.Add(10*time.Second), topFilter{}); len(rows) != 0 {
+		t.Errorf("series didn't expire at the end of the window: %+v", rows)
+	}
+
+	if len(w.series) != 0 {
+		t.Errorf("expired series weren't removed: %d", len(w.series))
+	}
+}
+
+func TestTopFilter(t *testing.T) {
+	s := &topSeries{name: "http.requests", tags: []stats.Tag{{"method", "GET"}, {"status", "200"}}}
+
+	tests := []struct {
+		filter topFilter
+		match  bool
+	}{
+		{topFilter{}, true},
+		{topFilter{pattern: "requests"}, true},
+		{topFilter{pattern: "http.*"}, true},
+		{topFilter{pattern: "*.latency"}, false},
+		{topFilter{tags: tags{{"method", ""}}}, true},
+		{topFilter{tags: tags{{"method", "GET"}, {"status", "200"}}}, true},
+		{topFilter{tags: tags{{"status", "500"}}}, false},
+		{topFilter{tags: tags{{"host", ""}}}, false},
+	}
+
+	for _, test := range tests {
+		if match := test.filter.match(s); match != test.match {
+			t.Errorf("%+v: expected match to be %t", test.filter, test.match)
+		}
+	}
+}
+
+func TestTopView(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+
+	w := newTopWindow(time.Second)
+	w.now = func() time.Time { return now }
+	w.HandleMetric(datadog.Metric{Type: datadog.Counter, Name: "a", Value: 1}, nil)
+	w.HandleMetric(datadog.Metric{Type: datadog.Counter, Name: "b", Value: 2}, nil)
+	w.HandleMetric(datadog.Metric{Type: datadog.Counter, Name: "c", Value: 3}, nil)
+
+	v := &topView{window: w, sortBy: "rate", limit: 2}
+
+	if !v.command("s name") || v.sortBy != "name" {
+		t.Error("the sort command wasn't applied:", v.sortBy)
+	}
+
+	if !v.command("s unknown") || v.sortBy != "name" {
+		t.Error("an unknown sort column was applied:", v.sortBy)
+	}
+
+	if !v.command("/[ab]") || v.filter.pattern != "[ab]" {
+		t.Error("the filter command wasn't applied:", v.filter.pattern)
+	}
+
+	if v.command("q") {
+		t.Error("the quit command wasn't applied")
+	}
+
+	v.command("s rate")
+	v.command("/")
+
+	b := &bytes.Buffer{}
+	if err := v.print(b, now, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var rows []topRow
+	if err := json.Unmarshal(b.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 2 || rows[0].Name != "c" || rows[1].Name != "b" {
+		t.Errorf("bad rows: %+v", rows)
+	}
+
+	b.Reset()
+	if err := v.print(b, now, false); err != nil {
+		t.Fatal(err)
+	}
+
+	const table = `NAME  TYPE  RATE/s  COUNT  LAST  P50  P90  P99  TAGS
+c     c     3.00    1      3     3    3    3    
+b     c     2.00    1      2     2    2    2    
+`
+
+	if s := b.String(); s != table {
+		t.Errorf("bad table:\n%s", s)
+	}
+}
+
+func TestTopRowJSONNonFinite(t *testing.T) {
+	b, err := json.Marshal(topRow{Name: "a", Type: "g", Last: math.NaN(), P50: math.Inf(1), P90: math.Inf(-1), P99: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const expected = `{"name":"a","type":"g","rate":0,"count":0,"last":"NaN","p50":"+Inf","p90":"-Inf","p99":1}`
+
+	if s := string(b); s != expected {
+		t.Errorf("bad JSON row:\n- %s\n- %s", expected, s)
+	}
+}
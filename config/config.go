@@ -0,0 +1,590 @@
+// Package config sets up stats engines from configurations describing their
+// backends, tags, histogram buckets, sampling and collectors, which are loaded
+// from JSON, YAML or TOML documents, or environment variables.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config describes how to set up a stats engine: the backends that metrics are
+// sent to, the tags and histogram buckets applied to all metrics, and the
+// collectors producing metrics about the program.
+//
+// Configurations can be loaded from JSON, YAML or TOML documents, where fields
+// have the names of their JSON representation, or from environment variables
+// with FromEnv.
+type Config struct {
+	// Name is the name of the engine, which is the namespace of the metrics
+	// it produces.
+	Name string `json:"name"`
+
+	// Tags are set on all metrics.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	// StripTags is the list of tag names removed from all metrics, they are
+	// removed before Tags are added.
+	StripTags []string `json:"strip_tags,omitempty"`
+
+	// HistogramBuckets maps histogram names to the upper limits of their
+	// buckets, which must be sorted in ascending order.
+	HistogramBuckets map[string][]float64 `json:"histogram_buckets,omitempty"`
+
+	// SampleRate is the fraction of counter and histogram values that are
+	// passed to the backends, counters are scaled so their totals remain
+	// accurate. Gauges are never sampled. Zero means no sampling.
+	//
+	// Histograms are not scaled, the sample rate isn't carried by metrics so
+	// backends can't account for it: the distributions they report remain
+	// representative, but the counts and sums of histograms are reduced by
+	// the sample rate.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	// Backends is the list of backends that metrics are sent to.
+	Backends []Backend `json:"backends,omitempty"`
+
+	// Collectors configures the collection of metrics about the program.
+	Collectors Collectors `json:"collectors,omitempty"`
+}
+
+// Backend types supported in configurations.
+const (
+	Datadog    = "datadog"
+	Statsd     = "statsd"
+	Graphite   = "graphite"
+	InfluxDB   = "influxdb"
+	OTLP       = "otlp"
+	Prometheus = "prometheus"
+	EMF        = "emf"
+	Log        = "log"
+	Debug      = "debug"
+)
+
+// Backend describes a backend that metrics are sent to. Fields which don't
+// apply to the backend type must be left empty, the defaults of the backend
+// packages are used for fields that are not set.
+type Backend struct {
+	// Type is one of the backend type constants.
+	Type string `json:"type"`
+
+	// Address is the address of the server that metrics are sent to, or for
+	// the prometheus and debug backends, the address that their HTTP server
+	// listens on. The influxdb and otlp backends expect URLs.
+	Address string `json:"address,omitempty"`
+
+	// Path is the path that the prometheus (default /metrics) and debug
+	// (default /debug/stats) backends serve metrics on.
+	Path string `json:"path,omitempty"`
+
+	// FlushInterval is the interval at which buffered or aggregated metrics
+	// are sent.
+	FlushInterval Duration `json:"flush_interval,omitempty"`
+
+	// BufferSize is the size of the datagrams sent by the datadog and statsd
+	// backends.
+	BufferSize int `json:"buffer_size,omitempty"`
+
+	// Database, Organization, Bucket and Token configure the influxdb backend.
+	Database     string `json:"database,omitempty"`
+	Organization string `json:"organization,omitempty"`
+	Bucket       string `json:"bucket,omitempty"`
+	Token        string `json:"token,omitempty"`
+
+	// Format is the format of the log backend, json (the default) or logfmt.
+	Format string `json:"format,omitempty"`
+
+	// TagScheme is how the statsd backend encodes tags in metric names, none
+	// (the default), graphite or influxdb.
+	TagScheme string `json:"tag_scheme,omitempty"`
+}
+
+// Collectors configures the collection of metrics about the program.
+type Collectors struct {
+	// Go enables the collection of metrics about the Go runtime.
+	Go bool `json:"go,omitempty"`
+
+	// Process enables the collection of metrics about the process.
+	Process bool `json:"process,omitempty"`
+
+	// Interval is the interval at which metrics are collected, the default
+	// is to use the default of the procstats package.
+	Interval Duration `json:"interval,omitempty"`
+}
+
+// Duration is a time.Duration which is represented as a string like "1.5s" in
+// configuration documents. Numbers are also accepted and interpreted as seconds.
+type Duration time.Duration
+
+// MarshalJSON satisfies the json.Marshaler interface.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON satisfies the json.Unmarshaler interface.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	switch x := v.(type) {
+	case float64:
+		*d = Duration(x * float64(time.Second))
+		return nil
+	case string:
+		t, err := time.ParseDuration(x)
+		*d = Duration(t)
+		return err
+	default:
+		return fmt.Errorf("bad duration: %s", b)
+	}
+}
+
+// Error is a validation error of a configuration field.
+type Error struct {
+	Field  string
+	Reason string
+}
+
+// Error satisfies the error interface.
+func (e *Error) Error() string {
+	return "config: " + e.Field + ": " + e.Reason
+}
+
+// Errors is returned by Validate when a configuration has invalid fields.
+type Errors []*Error
+
+// Error satisfies the error interface.
+func (e Errors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// Parse parses a configuration from a JSON document and validates it.
+func Parse(data []byte) (Config, error) {
+	var c Config
+	d := json.NewDecoder(strings.NewReader(string(data)))
+	d.DisallowUnknownFields()
+
+	if err := d.Decode(&c); err != nil {
+		return c, fmt.Errorf("config: %s", err)
+	}
+
+	return c, c.Validate()
+}
+
+// Load reads and parses the configuration file at path, the format is chosen
+// from the file extension: .json, .yaml (or .yml) or .toml.
+func Load(path string) (Config, error) {
+	var parse func([]byte) (Config, error)
+
+	switch ext := filepath.Ext(path); ext {
+	case ".json":
+		parse = Parse
+	case ".yaml", ".yml":
+		parse = ParseYAML
+	case ".toml":
+		parse = ParseTOML
+	default:
+		return Config{}, fmt.Errorf("config: %s: unsupported file format %q, expected .json, .yaml, .yml or .toml", path, ext)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("config: %s", err)
+	}
+
+	c, err := parse(b)
+	if err != nil {
+		err = fmt.Errorf("%s: %s", path, err)
+	}
+	return c, err
+}
+
+// plainScalar is an unquoted YAML scalar, which is a string or a number
+// depending on the field it is assigned to.
+type plainScalar string
+
+// parseTree parses a configuration from the values decoded from a YAML or TOML
+// document. The values are converted to JSON, so the documents are subject to
+// the same decoding rules as JSON configurations.
+func parseTree(v interface{}) (Config, error) {
+	if v == nil {
+		v = map[string]interface{}{}
+	}
+
+	b, err := json.Marshal(convert(v, reflect.TypeOf(Config{})))
+	if err != nil {
+		return Config{}, fmt.Errorf("config: %s", err)
+	}
+
+	return Parse(b)
+}
+
+// convert resolves the plain scalars in v against the type t of the field
+// that v is assigned to.
+func convert(v interface{}, t reflect.Type) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(x))
+		for k, e := range x {
+			m[k] = convert(e, elemType(t, k))
+		}
+		return m
+
+	case []interface{}:
+		var et reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			et = t.Elem()
+		}
+		list := make([]interface{}, len(x))
+		for i, e := range x {
+			list[i] = convert(e, et)
+		}
+		return list
+
+	case plainScalar:
+		s := string(x)
+		if t != nil && t.Kind() == reflect.String {
+			return s
+		}
+		switch s {
+		case "", "~", "null", "Null", "NULL":
+			return nil
+		case "true", "True", "TRUE":
+			return true
+		case "false", "False", "FALSE":
+			return false
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil {
+			return f
+		}
+		return s
+
+	default:
+		return v
+	}
+}
+
+// elemType returns the type of the value at key k of a value of type t, or nil
+// if it's unknown.
+func elemType(t reflect.Type, k string) reflect.Type {
+	if t == nil {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Map:
+		return t.Elem()
+	case reflect.Struct:
+		for i := 0; i != t.NumField(); i++ {
+			f := t.Field(i)
+			if name := strings.Split(f.Tag.Get("json"), ",")[0]; name == k {
+				return f.Type
+			}
+		}
+	}
+
+	return nil
+}
+
+// FromEnv builds a configuration from the environment variables starting with
+// prefix, and validates it. The variables are:
+//
+//	<prefix>NAME               engine name
+//	<prefix>TAGS               global tags, "name:value,name:value"
+//	<prefix>STRIP_TAGS         tag names to strip, "name,name"
+//	<prefix>SAMPLE_RATE        sample rate
+//	<prefix>HISTOGRAM_BUCKETS  histogram buckets, "name=1,10,100;name=0.1,1"
+//	<prefix>BACKENDS           whitespace-separated list of backend URLs
+//	<prefix>COLLECTORS         collectors to enable, "go,process"
+//	<prefix>COLLECT_INTERVAL   collection interval
+//
+// Backends are written as URLs where the scheme is the backend type, and the
+// query parameters are the backend fields (with their JSON names):
+//
+//	datadog://localhost:8125?flush_interval=1s
+//	prometheus://:9090/metrics
+//	influxdb+http://localhost:8086?database=metrics
+//
+// A scheme of the form "type+scheme" sets the backend address to a URL with
+// the given scheme, the host and the path.
+func FromEnv(prefix string) (Config, error) {
+	return fromEnv(prefix, os.LookupEnv)
+}
+
+func fromEnv(prefix string, lookup func(string) (string, bool)) (c Config, err error) {
+	var errs Errors
+
+	get := func(name string) (string, bool) {
+		v, ok := lookup(prefix + name)
+		return strings.TrimSpace(v), ok && len(strings.TrimSpace(v)) != 0
+	}
+
+	fail := func(name string, reason string) {
+		errs = append(errs, &Error{Field: prefix + name, Reason: reason})
+	}
+
+	if v, ok := get("NAME"); ok {
+		c.Name = v
+	}
+
+	if v, ok := get("TAGS"); ok {
+		c.Tags = make(map[string]string)
+		for _, pair := range strings.Split(v, ",") {
+			if i := strings.IndexByte(pair, ':'); i < 0 {
+				fail("TAGS", fmt.Sprintf("malformed tag %q, expected name:value", pair))
+			} else {
+				c.Tags[strings.TrimSpace(pair[:i])] = strings.TrimSpace(pair[i+1:])
+			}
+		}
+	}
+
+	if v, ok := get("STRIP_TAGS"); ok {
+		for _, name := range strings.Split(v, ",") {
+			c.StripTags = append(c.StripTags, strings.TrimSpace(name))
+		}
+	}
+
+	if v, ok := get("SAMPLE_RATE"); ok {
+		if c.SampleRate, err = strconv.ParseFloat(v, 64); err != nil {
+			fail("SAMPLE_RATE", fmt.Sprintf("malformed number %q", v))
+		}
+	}
+
+	if v, ok := get("HISTOGRAM_BUCKETS"); ok {
+		c.HistogramBuckets = make(map[string][]float64)
+
+		for _, h := range strings.Split(v, ";") {
+			i := strings.IndexByte(h, '=')
+			if i < 0 {
+				fail("HISTOGRAM_BUCKETS", fmt.Sprintf("malformed buckets %q, expected name=limit,limit,...", h))
+				continue
+			}
+
+			name := strings.TrimSpace(h[:i])
+
+			for _, s := range strings.Split(h[i+1:], ",") {
+				f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+				if err != nil {
+					fail("HISTOGRAM_BUCKETS", fmt.Sprintf("malformed bucket limit %q of %s", s, name))
+					break
+				}
+				c.HistogramBuckets[name] = append(c.HistogramBuckets[name], f)
+			}
+		}
+	}
+
+	if v, ok := get("BACKENDS"); ok {
+		for _, s := range strings.Fields(v) {
+			b, err := parseBackendURL(s)
+			if err != nil {
+				fail("BACKENDS", err.Error())
+				continue
+			}
+			c.Backends = append(c.Backends, b)
+		}
+	}
+
+	if v, ok := get("COLLECTORS"); ok {
+		for _, name := range strings.Split(v, ",") {
+			switch strings.TrimSpace(name) {
+			case "go":
+				c.Collectors.Go = true
+			case "process":
+				c.Collectors.Process = true
+			default:
+				fail("COLLECTORS", fmt.Sprintf("unknown collector %q, expected go or process", name))
+			}
+		}
+	}
+
+	if v, ok := get("COLLECT_INTERVAL"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			fail("COLLECT_INTERVAL", fmt.Sprintf("malformed duration %q", v))
+		}
+		c.Collectors.Interval = Duration(d)
+	}
+
+	if len(errs) != 0 {
+		return c, errs
+	}
+
+	return c, c.Validate()
+}
+
+func parseBackendURL(s string) (b Backend, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return b, fmt.Errorf("malformed backend URL %q", s)
+	}
+
+	if len(u.Scheme) == 0 {
+		return b, fmt.Errorf("backend URL %q has no scheme", s)
+	}
+
+	if i := strings.IndexByte(u.Scheme, '+'); i < 0 {
+		b.Type = u.Scheme
+		b.Address = u.Host
+		b.Path = u.Path
+	} else {
+		b.Type = u.Scheme[:i]
+		b.Address = (&url.URL{Scheme: u.Scheme[i+1:], Host: u.Host, Path: u.Path}).String()
+	}
+
+	for name, values := range u.Query() {
+		v := values[len(values)-1]
+
+		switch name {
+		case "flush_interval":
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return b, fmt.Errorf("malformed flush interval %q in backend URL %q", v, s)
+			}
+			b.FlushInterval = Duration(d)
+		case "buffer_size":
+			if b.BufferSize, err = strconv.Atoi(v); err != nil {
+				return b, fmt.Errorf("malformed buffer size %q in backend URL %q", v, s)
+			}
+		case "database":
+			b.Database = v
+		case "organization":
+			b.Organization = v
+		case "bucket":
+			b.Bucket = v
+		case "token":
+			b.Token = v
+		case "format":
+			b.Format = v
+		case "tag_scheme":
+			b.TagScheme = v
+		default:
+			return b, fmt.Errorf("unknown parameter %q in backend URL %q", name, s)
+		}
+	}
+
+	return b, nil
+}
+
+// Validate checks that the configuration is valid, the returned error is of
+// type Errors and reports all invalid fields.
+func (c Config) Validate() error {
+	var errs Errors
+
+	fail := func(field string, format string, args ...interface{}) {
+		errs = append(errs, &Error{Field: field, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	for _, name := range sortedKeys(c.Tags) {
+		if len(name) == 0 {
+			fail("tags", "tag names must not be empty")
+		}
+	}
+
+	for i, name := range c.StripTags {
+		if len(name) == 0 {
+			fail(fmt.Sprintf("strip_tags[%d]", i), "tag names must not be empty")
+		}
+	}
+
+	names := make([]string, 0, len(c.HistogramBuckets))
+	for name := range c.HistogramBuckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if buckets := c.HistogramBuckets[name]; len(buckets) == 0 {
+			fail("histogram_buckets."+name, "at least one bucket limit must be set")
+		} else if !sort.Float64sAreSorted(buckets) {
+			fail("histogram_buckets."+name, "bucket limits must be sorted in ascending order")
+		}
+	}
+
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		fail("sample_rate", "must be between 0 and 1, got %g", c.SampleRate)
+	}
+
+	if c.Collectors.Interval < 0 {
+		fail("collectors.interval", "must not be negative")
+	}
+
+	listeners := make(map[string]int)
+
+	for i, b := range c.Backends {
+		field := fmt.Sprintf("backends[%d]", i)
+
+		switch b.Type {
+		case Datadog, Statsd, Graphite, EMF:
+		case InfluxDB:
+			if len(b.Database) == 0 && len(b.Bucket) == 0 {
+				fail(field, "influxdb backends require a database or a bucket")
+			}
+		case OTLP:
+			if len(b.Address) != 0 && !strings.HasPrefix(b.Address, "http://") && !strings.HasPrefix(b.Address, "https://") {
+				fail(field+".address", "otlp backends require an http or https URL, got %q", b.Address)
+			}
+		case Prometheus, Debug:
+			if len(b.Address) == 0 {
+				fail(field+".address", "%s backends require an address to listen on", b.Type)
+			} else if j, ok := listeners[b.Address]; ok {
+				fail(field+".address", "%s is already used by backends[%d]", b.Address, j)
+			} else {
+				listeners[b.Address] = i
+			}
+		case Log:
+			switch b.Format {
+			case "", "json", "logfmt":
+			default:
+				fail(field+".format", "unknown format %q, expected json or logfmt", b.Format)
+			}
+		case "":
+			fail(field+".type", "missing backend type")
+		default:
+			fail(field+".type", "unknown backend type %q", b.Type)
+		}
+
+		if b.Type != Statsd && len(b.TagScheme) != 0 {
+			fail(field+".tag_scheme", "only applies to statsd backends")
+		}
+
+		switch b.TagScheme {
+		case "", "none", "graphite", "influxdb":
+		default:
+			fail(field+".tag_scheme", "unknown tag scheme %q, expected none, graphite or influxdb", b.TagScheme)
+		}
+
+		if b.BufferSize < 0 {
+			fail(field+".buffer_size", "must not be negative")
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
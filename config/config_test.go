@@ -0,0 +1,336 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testConfig = Config{
+	Name:             "app",
+	Tags:             map[string]string{"env": "prod", "region": "us-west-2"},
+	StripTags:        []string{"host"},
+	HistogramBuckets: map[string][]float64{"http.latency": {0.01, 0.1, 1}},
+	SampleRate:       0.5,
+	Backends: []Backend{
+		{Type: Datadog, Address: "localhost:8125", FlushInterval: Duration(time.Second), BufferSize: 1432},
+		{Type: Prometheus, Address: ":9090"},
+		{Type: InfluxDB, Address: "http://localhost:8086", Database: "metrics", FlushInterval: Duration(10 * time.Second)},
+	},
+	Collectors: Collectors{Go: true, Process: true, Interval: Duration(10 * time.Second)},
+}
+
+func TestLoad(t *testing.T) {
+	for _, path := range []string{"testdata/config.json", "testdata/config.yaml", "testdata/config.toml"} {
+		t.Run(path, func(t *testing.T) {
+			c, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(c, testConfig) {
+				t.Errorf("bad config:\n- expected: %#v\n- found:    %#v", testConfig, c)
+			}
+		})
+	}
+}
+
+func TestLoadUnsupportedFormat(t *testing.T) {
+	for _, path := range []string{"stats.ini", "stats"} {
+		_, err := Load(path)
+		if err == nil || !strings.Contains(err.Error(), "unsupported file format") {
+			t.Errorf("%s: bad error: %v", path, err)
+		}
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	c, err := ParseYAML([]byte(`
+name: 'it''s'
+tags:
+  code: 200
+  list: a, b
+  enabled: true
+  "quoted: key": "a # b"
+strip_tags:
+- host
+- pod
+backends:
+-
+  type: statsd
+  tag_scheme: graphite
+collectors: {go: true, interval: 2.5}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Config{
+		Name:       "it's",
+		Tags:       map[string]string{"code": "200", "list": "a, b", "enabled": "true", "quoted: key": "a # b"},
+		StripTags:  []string{"host", "pod"},
+		Backends:   []Backend{{Type: Statsd, TagScheme: "graphite"}},
+		Collectors: Collectors{Go: true, Interval: Duration(2500 * time.Millisecond)},
+	}
+
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("bad config:\n- expected: %#v\n- found:    %#v", expected, c)
+	}
+}
+
+func TestParseTOML(t *testing.T) {
+	c, err := ParseTOML([]byte(`
+name = "a\tb\u00e9"
+tags = { env = "prod", "team.name" = 'core' }
+collectors.go = true
+backends = [
+  { type = "log", format = "logfmt" }, # trailing comma
+]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Config{
+		Name:       "a\tb\u00e9",
+		Tags:       map[string]string{"env": "prod", "team.name": "core"},
+		Backends:   []Backend{{Type: Log, Format: "logfmt"}},
+		Collectors: Collectors{Go: true},
+	}
+
+	if !reflect.DeepEqual(c, expected) {
+		t.Errorf("bad config:\n- expected: %#v\n- found:    %#v", expected, c)
+	}
+}
+
+func TestParseYAMLAndTOMLErrors(t *testing.T) {
+	tests := []struct {
+		parse  func([]byte) (Config, error)
+		config string
+		error  string
+	}{
+		{ParseYAML, "name: app\n  tags: {}", "config: line 2: unexpected indentation"},
+		{ParseYAML, "name: [app", "config: line 1: unterminated flow collection"},
+		{ParseYAML, "name: app\nname: app", `config: line 2: duplicate key "name"`},
+		{ParseYAML, "name: &a app", `config: line 1: unsupported YAML syntax '&'`},
+		{ParseYAML, "sample_rate: 2", "config: sample_rate: must be between 0 and 1, got 2"},
+		{ParseYAML, "backend: []", `config: json: unknown field "backend"`},
+		{ParseTOML, "name = app", `config: line 1: unsupported value "app"`},
+		{ParseTOML, "\nname = \"app", "config: line 2: unterminated string"},
+		{ParseTOML, "name = \"a\"\nname = \"b\"", `config: line 2: duplicate key "name"`},
+		{ParseTOML, "name = \"a\" tags = {}", `config: line 1: unexpected 't' at the end of the line`},
+		{ParseTOML, "[[backends]]\ntype = \"carbon\"", `config: backends[0].type: unknown backend type "carbon"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.config, func(t *testing.T) {
+			_, err := test.parse([]byte(test.config))
+			if err == nil {
+				t.Fatal("no error returned")
+			}
+			if s := err.Error(); s != test.error {
+				t.Errorf("bad error:\n- expected: %s\n- found:    %s", test.error, s)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		config string
+		error  string
+	}{
+		{
+			config: `{"name": "app", "backend": []}`,
+			error:  `config: json: unknown field "backend"`,
+		},
+		{
+			config: `{"backends": [{"type": "datadog", "flush_interval": "1 second"}]}`,
+			error:  `config: time: unknown unit " second" in duration "1 second"`,
+		},
+		{
+			config: `{"sample_rate": 2, "backends": [{"type": "carbon"}, {}]}`,
+			error: `config: sample_rate: must be between 0 and 1, got 2
+config: backends[0].type: unknown backend type "carbon"
+config: backends[1].type: missing backend type`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.config, func(t *testing.T) {
+			_, err := Parse([]byte(test.config))
+			if err == nil {
+				t.Fatal("no error returned")
+			}
+			if s := err.Error(); s != test.error {
+				t.Errorf("bad error:\n- expected: %s\n- found:    %s", test.error, s)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		config Config
+		errors []string
+	}{
+		{
+			config: testConfig,
+		},
+		{
+			config: Config{Tags: map[string]string{"": "x"}, StripTags: []string{"a", ""}},
+			errors: []string{"tags", "strip_tags[1]"},
+		},
+		{
+			config: Config{HistogramBuckets: map[string][]float64{"a": {}, "b": {2, 1}}},
+			errors: []string{"histogram_buckets.a", "histogram_buckets.b"},
+		},
+		{
+			config: Config{SampleRate: -1, Collectors: Collectors{Interval: -1}},
+			errors: []string{"sample_rate", "collectors.interval"},
+		},
+		{
+			config: Config{Backends: []Backend{
+				{Type: InfluxDB},
+				{Type: OTLP, Address: "localhost:4318"},
+				{Type: Prometheus},
+				{Type: Debug, Address: ":8080"},
+				{Type: Prometheus, Address: ":8080"},
+				{Type: Log, Format: "xml"},
+				{Type: Datadog, TagScheme: "graphite", BufferSize: -1},
+				{Type: Statsd, TagScheme: "dogstatsd"},
+			}},
+			errors: []string{
+				"backends[0]",
+				"backends[1].address",
+				"backends[2].address",
+				"backends[4].address",
+				"backends[5].format",
+				"backends[6].tag_scheme",
+				"backends[6].buffer_size",
+				"backends[7].tag_scheme",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		err := test.config.Validate()
+
+		if len(test.errors) == 0 {
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			continue
+		}
+
+		errs, ok := err.(Errors)
+		if !ok {
+			t.Errorf("bad error type: %#v", err)
+			continue
+		}
+
+		fields := make([]string, len(errs))
+		for i, e := range errs {
+			fields[i] = e.Field
+		}
+
+		if !reflect.DeepEqual(fields, test.errors) {
+			t.Errorf("bad error fields:\n- expected: %q\n- found:    %q\n%s", test.errors, fields, err)
+		}
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	env := map[string]string{
+		"STATS_NAME":              "app",
+		"STATS_TAGS":              "env:prod, region:us-west-2",
+		"STATS_STRIP_TAGS":        "host",
+		"STATS_SAMPLE_RATE":       "0.5",
+		"STATS_HISTOGRAM_BUCKETS": "http.latency=0.01,0.1,1",
+		"STATS_BACKENDS":          "datadog://localhost:8125?flush_interval=1s&buffer_size=1432 prometheus://:9090\n influxdb+http://localhost:8086?database=metrics&flush_interval=10s",
+		"STATS_COLLECTORS":        "go,process",
+		"STATS_COLLECT_INTERVAL":  "10s",
+		"OTHER_NAME":              "other",
+	}
+
+	c, err := fromEnv("STATS_", func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(c, testConfig) {
+		t.Errorf("bad config:\n- expected: %#v\n- found:    %#v", testConfig, c)
+	}
+}
+
+func TestFromEnvErrors(t *testing.T) {
+	env := map[string]string{
+		"STATS_TAGS":        "env",
+		"STATS_SAMPLE_RATE": "half",
+		"STATS_BACKENDS":    "datadog://localhost:8125?timeout=1s",
+		"STATS_COLLECTORS":  "go,runtime",
+	}
+
+	_, err := fromEnv("STATS_", func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	})
+
+	const expected = `config: STATS_TAGS: malformed tag "env", expected name:value
+config: STATS_SAMPLE_RATE: malformed number "half"
+config: STATS_BACKENDS: unknown parameter "timeout" in backend URL "datadog://localhost:8125?timeout=1s"
+config: STATS_COLLECTORS: unknown collector "runtime", expected go or process`
+
+	if err == nil || err.Error() != expected {
+		t.Errorf("bad error:\n- expected: %s\n- found:    %v", expected, err)
+	}
+}
+
+func TestParseBackendURL(t *testing.T) {
+	tests := []struct {
+		url     string
+		backend Backend
+	}{
+		{"datadog://localhost:8125", Backend{Type: Datadog, Address: "localhost:8125"}},
+		{"datadog+unixgram:///var/run/datadog/dsd.socket", Backend{Type: Datadog, Address: "unixgram:///var/run/datadog/dsd.socket"}},
+		{"statsd://localhost:8125?tag_scheme=influxdb", Backend{Type: Statsd, Address: "localhost:8125", TagScheme: "influxdb"}},
+		{"debug://:8080/stats", Backend{Type: Debug, Address: ":8080", Path: "/stats"}},
+		{"log://?format=logfmt", Backend{Type: Log, Format: "logfmt"}},
+		{"otlp+https://collector:4318/v1/metrics", Backend{Type: OTLP, Address: "https://collector:4318/v1/metrics"}},
+		{"influxdb+udp://localhost:8089?bucket=b&organization=o&token=t", Backend{Type: InfluxDB, Address: "udp://localhost:8089", Bucket: "b", Organization: "o", Token: "t"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			b, err := parseBackendURL(test.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(b, test.backend) {
+				t.Errorf("bad backend:\n- expected: %#v\n- found:    %#v", test.backend, b)
+			}
+		})
+	}
+}
+
+func TestDurationJSON(t *testing.T) {
+	b, err := Duration(1500 * time.Millisecond).MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `"1.5s"` {
+		t.Errorf("bad JSON: %s", b)
+	}
+
+	var d Duration
+	if err := d.UnmarshalJSON(b); err != nil {
+		t.Fatal(err)
+	}
+	if d != Duration(1500*time.Millisecond) {
+		t.Errorf("bad duration: %s", time.Duration(d))
+	}
+}
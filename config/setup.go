@@ -0,0 +1,495 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/segmentio/stats"
+	"github.com/segmentio/stats/datadog"
+	"github.com/segmentio/stats/debugstats"
+	"github.com/segmentio/stats/emf"
+	"github.com/segmentio/stats/graphite"
+	"github.com/segmentio/stats/influxdb"
+	"github.com/segmentio/stats/logstats"
+	"github.com/segmentio/stats/otlp"
+	"github.com/segmentio/stats/procstats"
+	"github.com/segmentio/stats/prometheus"
+	"github.com/segmentio/stats/statsd"
+)
+
+// Setup is a stats engine configured from a Config.
+//
+// The setup registers a single handler on its engine, which applies the tags,
+// buckets and sampling of the configuration and passes the metrics to the
+// backends. Reloading a setup replaces this handler without changing the
+// engine, so the metrics created from it remain valid.
+//
+//	setup, err := config.New(c)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer setup.Close()
+//
+//	stats.DefaultEngine = setup.Engine()
+type Setup struct {
+	eng *stats.Engine
+
+	// reload serializes calls to Reload and Close, mutex protects the fields
+	// used when handling metrics.
+	reload    sync.Mutex
+	mutex     sync.RWMutex
+	config    Config
+	chain     *chain
+	servers   map[string]*server
+	collector io.Closer
+	closed    bool
+}
+
+// New creates a setup from config, which is validated first.
+func New(config Config) (*Setup, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	s := &Setup{
+		eng:     stats.NewEngine(config.Name),
+		servers: make(map[string]*server),
+	}
+
+	c, servers, err := s.build(config)
+	if err != nil {
+		return nil, err
+	}
+
+	s.config = config
+	s.chain = c
+	s.servers = servers
+	s.collector = s.startCollector(config.Collectors)
+	s.eng.Register(s)
+	return s, nil
+}
+
+// Engine returns the engine of the setup.
+func (s *Setup) Engine() *stats.Engine {
+	return s.eng
+}
+
+// Config returns the configuration that the setup currently applies.
+func (s *Setup) Config() Config {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.config
+}
+
+// HandleMetric satisfies the stats.Handler interface.
+func (s *Setup) HandleMetric(m *stats.Metric) {
+	s.mutex.RLock()
+
+	if s.chain != nil {
+		s.chain.HandleMetric(m)
+	}
+
+	s.mutex.RUnlock()
+}
+
+// Flush satisfies the stats.Flusher interface.
+func (s *Setup) Flush() {
+	s.mutex.RLock()
+
+	if s.chain != nil {
+		s.chain.Flush()
+	}
+
+	s.mutex.RUnlock()
+}
+
+// Reload applies config to the setup, which is validated first. The name of
+// the engine cannot be changed.
+//
+// The backends of the previous configuration are flushed and closed after
+// the new ones were created. The HTTP servers of prometheus and debug
+// backends are kept, along with the state of the metrics they expose, when
+// the new configuration has a backend of the same type, address and path.
+//
+// New servers are started before the previous ones are closed, so moving an
+// address to a backend of another type requires two reloads.
+//
+// When an error is returned the setup keeps applying the previous
+// configuration.
+func (s *Setup) Reload(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	if config.Name != s.eng.Name() {
+		return Errors{{Field: "name", Reason: fmt.Sprintf("cannot be changed from %q to %q on reload", s.eng.Name(), config.Name)}}
+	}
+
+	s.reload.Lock()
+	defer s.reload.Unlock()
+
+	if s.closed {
+		return errors.New("config: reload of a closed setup")
+	}
+
+	c, servers, err := s.build(config)
+	if err != nil {
+		return err
+	}
+
+	if s.collector != nil {
+		s.collector.Close()
+	}
+
+	s.mutex.Lock()
+	oldChain, oldServers := s.chain, s.servers
+	s.config, s.chain, s.servers = config, c, servers
+	s.mutex.Unlock()
+
+	oldChain.Close()
+	closeServers(oldServers, servers)
+
+	s.collector = s.startCollector(config.Collectors)
+	return nil
+}
+
+// Close stops the collectors, then flushes and closes the backends.
+func (s *Setup) Close() error {
+	s.reload.Lock()
+	defer s.reload.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	s.closed = true
+
+	if s.collector != nil {
+		s.collector.Close()
+		s.collector = nil
+	}
+
+	s.mutex.Lock()
+	c, servers := s.chain, s.servers
+	s.chain, s.servers = nil, nil
+	s.mutex.Unlock()
+
+	c.Close()
+	closeServers(servers, nil)
+	return nil
+}
+
+func (s *Setup) startCollector(config Collectors) io.Closer {
+	var collectors []procstats.Collector
+
+	if config.Go {
+		collectors = append(collectors, procstats.NewGoMetricsWith(s.eng))
+	}
+
+	if config.Process {
+		collectors = append(collectors, procstats.NewProcMetricsWith(s.eng, os.Getpid()))
+	}
+
+	if len(collectors) == 0 {
+		return nil
+	}
+
+	return procstats.StartCollectorWith(procstats.Config{
+		Collector:       procstats.MultiCollector(collectors...),
+		CollectInterval: time.Duration(config.Interval),
+	})
+}
+
+// build creates the chain of handlers for config. The servers already running
+// for prometheus and debug backends are reused, the returned map holds the
+// servers used by the new chain.
+func (s *Setup) build(config Config) (*chain, map[string]*server, error) {
+	c := newChain(config)
+	servers := make(map[string]*server)
+
+	running := s.servers
+
+	for i, b := range config.Backends {
+		switch b.Type {
+		case Prometheus, Debug:
+			key := b.Type + " " + b.Address + " " + serverPath(b)
+			srv := running[key]
+
+			if srv == nil {
+				var err error
+				if srv, err = startServer(b); err != nil {
+					c.Close()
+					closeServers(servers, running)
+					return nil, nil, fmt.Errorf("config: backends[%d]: %s", i, err)
+				}
+			}
+
+			servers[key] = srv
+			c.handlers = append(c.handlers, srv.handler)
+
+		default:
+			h := s.newBackend(config, b)
+			c.handlers = append(c.handlers, h)
+
+			if closer, ok := h.(io.Closer); ok {
+				c.closers = append(c.closers, closer)
+			}
+		}
+	}
+
+	return c, servers, nil
+}
+
+func (s *Setup) newBackend(config Config, b Backend) stats.Handler {
+	flushInterval := time.Duration(b.FlushInterval)
+
+	switch b.Type {
+	case Datadog:
+		return datadog.NewClientWith(datadog.ClientConfig{
+			Address:       b.Address,
+			BufferSize:    b.BufferSize,
+			FlushInterval: flushInterval,
+		})
+
+	case Statsd:
+		var tags statsd.TagScheme
+
+		switch b.TagScheme {
+		case "graphite":
+			tags = statsd.GraphiteTags
+		case "influxdb":
+			tags = statsd.InfluxDBTags
+		}
+
+		return statsd.NewClientWith(statsd.ClientConfig{
+			Address:       b.Address,
+			BufferSize:    b.BufferSize,
+			FlushInterval: flushInterval,
+			Tags:          tags,
+		})
+
+	case Graphite:
+		return graphite.NewClientWith(graphite.ClientConfig{
+			Address:       b.Address,
+			FlushInterval: flushInterval,
+		})
+
+	case InfluxDB:
+		return influxdb.NewClientWith(influxdb.ClientConfig{
+			Address:       b.Address,
+			Database:      b.Database,
+			Organization:  b.Organization,
+			Bucket:        b.Bucket,
+			Token:         b.Token,
+			FlushInterval: flushInterval,
+		})
+
+	case OTLP:
+		// The exporter sets the global tags on the resource and removes them
+		// from the data points, it is given an engine carrying these tags so
+		// it can tell them apart.
+		return otlp.NewExporterWith(stats.NewEngine(config.Name, sortedTags(config.Tags)...), otlp.ExporterConfig{
+			Endpoint:       b.Address,
+			ExportInterval: flushInterval,
+		})
+
+	case EMF:
+		return emf.NewHandlerWith(emf.HandlerConfig{
+			FlushInterval: flushInterval,
+		})
+
+	case Log:
+		format := logstats.JSON
+
+		if b.Format == "logfmt" {
+			format = logstats.Logfmt
+		}
+
+		return logstats.NewHandlerWith(logstats.HandlerConfig{
+			Format:        format,
+			FlushInterval: flushInterval,
+		})
+
+	default:
+		panic("config: unsupported backend type: " + b.Type)
+	}
+}
+
+// chain is the handler applying a configuration to the metrics and passing
+// them to the backends.
+type chain struct {
+	strip    map[string]struct{}
+	tags     []stats.Tag
+	buckets  map[string][]float64
+	rate     float64
+	handlers []stats.Handler
+	closers  []io.Closer
+
+	mutex  sync.Mutex
+	random *rand.Rand
+}
+
+func newChain(config Config) *chain {
+	c := &chain{
+		tags:    sortedTags(config.Tags),
+		buckets: make(map[string][]float64, len(config.HistogramBuckets)),
+		rate:    config.SampleRate,
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	if len(config.StripTags) != 0 {
+		c.strip = make(map[string]struct{}, len(config.StripTags))
+
+		for _, name := range config.StripTags {
+			c.strip[name] = struct{}{}
+		}
+	}
+
+	for name, buckets := range config.HistogramBuckets {
+		c.buckets[name] = append([]float64(nil), buckets...)
+	}
+
+	return c
+}
+
+func (c *chain) HandleMetric(m *stats.Metric) {
+	if c.rate != 0 && c.rate != 1 && m.Type != stats.GaugeType {
+		c.mutex.Lock()
+		drop := c.random.Float64() >= c.rate
+		c.mutex.Unlock()
+
+		if drop {
+			return
+		}
+	}
+
+	metric := *m
+	metric.Tags = make([]stats.Tag, 0, len(m.Tags)+len(c.tags))
+
+	for _, tag := range m.Tags {
+		if _, strip := c.strip[tag.Name]; !strip && !c.hasTag(tag.Name) {
+			metric.Tags = append(metric.Tags, tag)
+		}
+	}
+
+	metric.Tags = append(metric.Tags, c.tags...)
+
+	// Histogram values can't be scaled without skewing the distributions,
+	// their counts are reduced by the sample rate (see Config.SampleRate).
+	if metric.Type == stats.CounterType && c.rate != 0 {
+		metric.Value /= c.rate
+	}
+
+	if buckets, ok := c.buckets[metric.Name]; ok && metric.Type == stats.HistogramType {
+		metric.Buckets = buckets
+	}
+
+	for _, h := range c.handlers {
+		h.HandleMetric(&metric)
+	}
+}
+
+func (c *chain) hasTag(name string) bool {
+	for _, tag := range c.tags {
+		if tag.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *chain) Flush() {
+	for _, h := range c.handlers {
+		if f, ok := h.(stats.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// Close closes the backends of the chain, which flushes them.
+func (c *chain) Close() {
+	for _, closer := range c.closers {
+		if err := closer.Close(); err != nil {
+			log.Printf("stats/config: closing backend: %s", err)
+		}
+	}
+}
+
+// server is the HTTP server of a prometheus or debug backend.
+type server struct {
+	handler stats.Handler
+	server  *http.Server
+}
+
+func startServer(b Backend) (*server, error) {
+	var handler interface {
+		stats.Handler
+		http.Handler
+	}
+
+	switch b.Type {
+	case Prometheus:
+		handler = &prometheus.Handler{}
+	default:
+		handler = &debugstats.Handler{}
+	}
+
+	lstn, err := net.Listen("tcp", b.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(serverPath(b), handler)
+
+	srv := &server{
+		handler: handler,
+		server:  &http.Server{Handler: mux},
+	}
+
+	go func() {
+		if err := srv.server.Serve(lstn); err != nil && err != http.ErrServerClosed {
+			log.Printf("stats/config: serving %s metrics on %s: %s", b.Type, lstn.Addr(), err)
+		}
+	}()
+
+	return srv, nil
+}
+
+func serverPath(b Backend) string {
+	switch {
+	case len(b.Path) != 0:
+		return b.Path
+	case b.Type == Prometheus:
+		return "/metrics"
+	default:
+		return "/debug/stats"
+	}
+}
+
+// closeServers closes the servers which are not in the keep map.
+func closeServers(servers map[string]*server, keep map[string]*server) {
+	for key, srv := range servers {
+		if keep[key] != srv {
+			srv.server.Close()
+		}
+	}
+}
+
+func sortedTags(m map[string]string) []stats.Tag {
+	tags := make([]stats.Tag, 0, len(m))
+
+	for _, name := range sortedKeys(m) {
+		tags = append(tags, stats.Tag{Name: name, Value: m[name]})
+	}
+
+	return tags
+}
@@ -0,0 +1,194 @@
+package config
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/segmentio/stats"
+)
+
+type testHandler struct {
+	metrics []stats.Metric
+}
+
+func (h *testHandler) HandleMetric(m *stats.Metric) {
+	c := *m
+	c.Tags = append([]stats.Tag(nil), m.Tags...)
+	h.metrics = append(h.metrics, c)
+}
+
+func TestChain(t *testing.T) {
+	h := &testHandler{}
+	c := newChain(Config{
+		Tags:             map[string]string{"env": "prod", "region": "us-west-2"},
+		StripTags:        []string{"host"},
+		HistogramBuckets: map[string][]float64{"latency": {0.1, 1}},
+	})
+	c.handlers = append(c.handlers, h)
+
+	eng := stats.NewEngine("app", stats.Tag{"host", "localhost"}, stats.Tag{"env", "dev"})
+	eng.Register(c)
+
+	eng.Incr("requests", stats.Tag{"status", "200"})
+	eng.Observe("latency", 0.5)
+	eng.Observe("size", 10)
+
+	expected := []stats.Metric{
+		{Namespace: "app", Type: stats.CounterType, Name: "requests", Value: 1, Tags: []stats.Tag{{"status", "200"}, {"env", "prod"}, {"region", "us-west-2"}}},
+		{Namespace: "app", Type: stats.HistogramType, Name: "latency", Value: 0.5, Tags: []stats.Tag{{"env", "prod"}, {"region", "us-west-2"}}, Buckets: []float64{0.1, 1}},
+		{Namespace: "app", Type: stats.HistogramType, Name: "size", Value: 10, Tags: []stats.Tag{{"env", "prod"}, {"region", "us-west-2"}}},
+	}
+
+	for i := range h.metrics {
+		h.metrics[i].Time = expected[i].Time
+	}
+
+	if !reflect.DeepEqual(h.metrics, expected) {
+		t.Errorf("bad metrics:\n- expected: %#v\n- found:    %#v", expected, h.metrics)
+	}
+}
+
+func TestChainSampling(t *testing.T) {
+	h := &testHandler{}
+	c := newChain(Config{SampleRate: 0.25})
+	c.handlers = append(c.handlers, h)
+
+	eng := stats.NewEngine("app")
+	eng.Register(c)
+
+	const n = 10000
+	for i := 0; i != n; i++ {
+		eng.Incr("requests")
+		eng.Set("queue.size", 1)
+	}
+
+	var counters, gauges int
+	var total float64
+
+	for _, m := range h.metrics {
+		switch m.Type {
+		case stats.CounterType:
+			counters++
+			total += m.Value
+		case stats.GaugeType:
+			gauges++
+		}
+	}
+
+	if gauges != n {
+		t.Errorf("gauges must not be sampled: %d/%d", gauges, n)
+	}
+
+	if counters < n/8 || counters > n*3/8 {
+		t.Errorf("bad number of sampled counters: %d/%d", counters, n)
+	}
+
+	if total != 4*float64(counters) {
+		t.Errorf("sampled counters were not scaled: %g for %d counters", total, counters)
+	}
+}
+
+func TestSetup(t *testing.T) {
+	addr := freeAddress(t)
+
+	s, err := New(Config{
+		Name:     "app",
+		Tags:     map[string]string{"env": "test"},
+		Backends: []Backend{{Type: Debug, Address: addr}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	eng := s.Engine()
+	eng.Incr("requests")
+
+	if names := fetchMetrics(t, addr, "/debug/stats"); !reflect.DeepEqual(names, []string{"requests"}) {
+		t.Errorf("bad metrics: %q", names)
+	}
+
+	// The debug server is kept on reload, along with the metrics it exposes.
+	if err := s.Reload(Config{
+		Name:     "app",
+		Backends: []Backend{{Type: Debug, Address: addr}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	eng.Incr("errors")
+
+	if names := fetchMetrics(t, addr, "/debug/stats"); !reflect.DeepEqual(names, []string{"errors", "requests"}) {
+		t.Errorf("bad metrics after reload: %q", names)
+	}
+
+	// Invalid configurations are rejected and the previous one remains.
+	if err := s.Reload(Config{Name: "other"}); err == nil {
+		t.Error("no error returned when changing the engine name")
+	}
+
+	if err := s.Reload(Config{Name: "app", SampleRate: 2}); err == nil {
+		t.Error("no error returned for an invalid configuration")
+	}
+
+	if c := s.Config(); len(c.Backends) != 1 {
+		t.Errorf("bad configuration after failed reloads: %#v", c)
+	}
+
+	// New servers are started before the previous ones are closed, so an
+	// address cannot move to a backend of another type in a single reload.
+	if err := s.Reload(Config{
+		Name:     "app",
+		Backends: []Backend{{Type: Prometheus, Address: addr, Path: "/metrics"}},
+	}); err == nil {
+		t.Error("no error returned when the address is already in use")
+	}
+
+	if names := fetchMetrics(t, addr, "/debug/stats"); len(names) != 2 {
+		t.Errorf("bad metrics after failed reload: %q", names)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+
+	if err := s.Reload(Config{Name: "app"}); err == nil {
+		t.Error("no error returned when reloading a closed setup")
+	}
+}
+
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func fetchMetrics(t *testing.T, addr string, path string) []string {
+	res, err := http.Get("http://" + addr + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		Metrics []struct {
+			Name string `json:"name"`
+		} `json:"metrics"`
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, len(body.Metrics))
+	for i, m := range body.Metrics {
+		names[i] = m.Name
+	}
+	return names
+}
@@ -0,0 +1,378 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This file contains a decoder for the subset of TOML used by configuration
+// files: tables, arrays of tables, dotted keys, basic and literal strings,
+// numbers, booleans, arrays and inline tables. Multi-line strings and dates
+// are not supported.
+
+// ParseTOML parses a configuration from a TOML document and validates it.
+func ParseTOML(data []byte) (Config, error) {
+	p := &tomlParser{s: string(data), num: 1}
+
+	v, err := p.parse()
+	if err != nil {
+		return Config{}, fmt.Errorf("config: line %d: %s", p.num, err)
+	}
+
+	return parseTree(v)
+}
+
+type tomlParser struct {
+	s   string
+	i   int
+	num int
+}
+
+func (p *tomlParser) parse() (map[string]interface{}, error) {
+	root := map[string]interface{}{}
+	table := root
+
+	for {
+		p.skip(true)
+
+		if p.i == len(p.s) {
+			return root, nil
+		}
+
+		var err error
+
+		if strings.HasPrefix(p.s[p.i:], "[[") {
+			table, err = p.parseArrayTable(root)
+		} else if p.s[p.i] == '[' {
+			table, err = p.parseTable(root)
+		} else {
+			err = p.parseKeyValue(table)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.endOfLine(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// skip skips spaces and comments, and newlines as well when newlines is true.
+func (p *tomlParser) skip(newlines bool) {
+	for p.i < len(p.s) {
+		switch p.s[p.i] {
+		case ' ', '\t', '\r':
+		case '\n':
+			if !newlines {
+				return
+			}
+			p.num++
+		case '#':
+			for p.i < len(p.s) && p.s[p.i] != '\n' {
+				p.i++
+			}
+			continue
+		default:
+			return
+		}
+		p.i++
+	}
+}
+
+func (p *tomlParser) endOfLine() error {
+	p.skip(false)
+
+	if p.i < len(p.s) && p.s[p.i] != '\n' {
+		return fmt.Errorf("unexpected %q at the end of the line", p.s[p.i])
+	}
+
+	return nil
+}
+
+func (p *tomlParser) parseTable(root map[string]interface{}) (map[string]interface{}, error) {
+	p.i++ // [
+
+	keys, err := p.parseKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.i == len(p.s) || p.s[p.i] != ']' {
+		return nil, fmt.Errorf("expected ']' after table name")
+	}
+	p.i++
+
+	return lookupTable(root, keys)
+}
+
+func (p *tomlParser) parseArrayTable(root map[string]interface{}) (map[string]interface{}, error) {
+	p.i += 2 // [[
+
+	keys, err := p.parseKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(p.s[p.i:], "]]") {
+		return nil, fmt.Errorf("expected ']]' after array of tables name")
+	}
+	p.i += 2
+
+	parent, err := lookupTable(root, keys[:len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	name := keys[len(keys)-1]
+	list, _ := parent[name].([]interface{})
+
+	if _, ok := parent[name]; ok && list == nil {
+		return nil, fmt.Errorf("%s is not an array of tables", name)
+	}
+
+	table := map[string]interface{}{}
+	parent[name] = append(list, table)
+	return table, nil
+}
+
+// lookupTable returns the table at keys, creating it if it doesn't exist. The
+// last element of arrays of tables is used when they are found on the path.
+func lookupTable(table map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	for _, k := range keys {
+		switch v := table[k].(type) {
+		case nil:
+			t := map[string]interface{}{}
+			table[k], table = t, t
+		case map[string]interface{}:
+			table = v
+		case []interface{}:
+			t, ok := v[len(v)-1].(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s is not a table", k)
+			}
+			table = t
+		default:
+			return nil, fmt.Errorf("%s is not a table", k)
+		}
+	}
+	return table, nil
+}
+
+func (p *tomlParser) parseKeyValue(table map[string]interface{}) error {
+	keys, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+
+	if p.i == len(p.s) || p.s[p.i] != '=' {
+		return fmt.Errorf("expected '=' after key")
+	}
+	p.i++
+
+	v, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+
+	if table, err = lookupTable(table, keys[:len(keys)-1]); err != nil {
+		return err
+	}
+
+	name := keys[len(keys)-1]
+	if _, dup := table[name]; dup {
+		return fmt.Errorf("duplicate key %q", name)
+	}
+
+	table[name] = v
+	return nil
+}
+
+// parseKey parses a dotted key, and the spaces that follow it.
+func (p *tomlParser) parseKey() ([]string, error) {
+	var keys []string
+
+	for {
+		p.skip(false)
+
+		if p.i == len(p.s) {
+			return nil, fmt.Errorf("expected a key")
+		}
+
+		if c := p.s[p.i]; c == '"' || c == '\'' {
+			s, err := p.parseString()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, s)
+		} else {
+			start := p.i
+			for p.i < len(p.s) && isBareKeyChar(p.s[p.i]) {
+				p.i++
+			}
+			if p.i == start {
+				return nil, fmt.Errorf("unexpected %q in key", p.s[p.i])
+			}
+			keys = append(keys, p.s[start:p.i])
+		}
+
+		p.skip(false)
+
+		if p.i == len(p.s) || p.s[p.i] != '.' {
+			return keys, nil
+		}
+		p.i++
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '-'
+}
+
+func (p *tomlParser) parseValue() (interface{}, error) {
+	p.skip(false)
+
+	if p.i == len(p.s) {
+		return nil, fmt.Errorf("expected a value")
+	}
+
+	switch c := p.s[p.i]; {
+	case c == '"' || c == '\'':
+		return p.parseString()
+	case c == '[':
+		return p.parseArray()
+	case c == '{':
+		return p.parseInlineTable()
+	}
+
+	start := p.i
+	for p.i < len(p.s) && !strings.ContainsRune(" \t\r\n,]}#", rune(p.s[p.i])) {
+		p.i++
+	}
+
+	switch s := p.s[start:p.i]; s {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	default:
+		f, err := strconv.ParseFloat(strings.Replace(s, "_", "", -1), 64)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported value %q", s)
+		}
+		return f, nil
+	}
+}
+
+func (p *tomlParser) parseString() (string, error) {
+	if strings.HasPrefix(p.s[p.i:], `"""`) || strings.HasPrefix(p.s[p.i:], `'''`) {
+		return "", fmt.Errorf("multi-line strings are not supported")
+	}
+
+	quote := p.s[p.i]
+	var b strings.Builder
+
+	for p.i++; p.i < len(p.s); p.i++ {
+		switch c := p.s[p.i]; {
+		case c == quote:
+			p.i++
+			return b.String(), nil
+		case c == '\n':
+			return "", fmt.Errorf("unterminated string")
+		case c == '\\' && quote == '"':
+			if p.i++; p.i == len(p.s) {
+				return "", fmt.Errorf("unterminated string")
+			}
+			switch e := p.s[p.i]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\\':
+				b.WriteByte(e)
+			case 'u', 'U':
+				n := 4
+				if e == 'U' {
+					n = 8
+				}
+				if p.i+n >= len(p.s) {
+					return "", fmt.Errorf("unterminated string")
+				}
+				r, err := strconv.ParseUint(p.s[p.i+1:p.i+1+n], 16, 32)
+				if err != nil {
+					return "", fmt.Errorf("malformed escape sequence \\%c%s", e, p.s[p.i+1:p.i+1+n])
+				}
+				b.WriteRune(rune(r))
+				p.i += n
+			default:
+				return "", fmt.Errorf("unsupported escape sequence \\%c", e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", fmt.Errorf("unterminated string")
+}
+
+func (p *tomlParser) parseArray() (interface{}, error) {
+	list := []interface{}{}
+	p.i++ // [
+
+	for {
+		p.skip(true)
+
+		if p.i < len(p.s) && p.s[p.i] == ']' {
+			p.i++
+			return list, nil
+		}
+
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+
+		p.skip(true)
+
+		switch {
+		case p.i < len(p.s) && p.s[p.i] == ',':
+			p.i++
+		case p.i < len(p.s) && p.s[p.i] == ']':
+		default:
+			return nil, fmt.Errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+func (p *tomlParser) parseInlineTable() (interface{}, error) {
+	table := map[string]interface{}{}
+	p.i++ // {
+
+	for {
+		p.skip(false)
+
+		if p.i < len(p.s) && p.s[p.i] == '}' {
+			p.i++
+			return table, nil
+		}
+
+		if err := p.parseKeyValue(table); err != nil {
+			return nil, err
+		}
+
+		p.skip(false)
+
+		switch {
+		case p.i < len(p.s) && p.s[p.i] == ',':
+			p.i++
+		case p.i < len(p.s) && p.s[p.i] == '}':
+		default:
+			return nil, fmt.Errorf("expected ',' or '}' in inline table")
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// This file contains a decoder for the subset of YAML used by configuration
+// files: block mappings and sequences, flow sequences and mappings written on
+// a single line, quoted and plain scalars, and comments. Anchors, aliases,
+// tags, block scalars and multi-document streams are not supported.
+//
+// Plain scalars are decoded as plainScalar values, their type is resolved
+// against the configuration field they are assigned to (see convert), so that
+// a tag like `code: 200` is a string while `buffer_size: 1432` is a number.
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+// ParseYAML parses a configuration from a YAML document and validates it.
+func ParseYAML(data []byte) (Config, error) {
+	lines, err := splitYAML(string(data))
+	if err != nil {
+		return Config{}, fmt.Errorf("config: %s", err)
+	}
+
+	p := &yamlParser{lines: lines}
+	var v interface{}
+
+	if len(lines) != 0 {
+		if v, err = p.parseNode(lines[0].indent); err != nil {
+			return Config{}, fmt.Errorf("config: %s", err)
+		}
+		if p.i != len(lines) {
+			return Config{}, fmt.Errorf("config: line %d: unexpected indentation", lines[p.i].num)
+		}
+	}
+
+	return parseTree(v)
+}
+
+func splitYAML(s string) ([]yamlLine, error) {
+	var lines []yamlLine
+
+	for i, ln := range strings.Split(s, "\n") {
+		ln = strings.TrimRight(stripComment(ln), " \t\r")
+		text := strings.TrimLeft(ln, " ")
+
+		switch {
+		case len(text) == 0:
+			continue
+		case text[0] == '\t':
+			return nil, fmt.Errorf("line %d: tabs must not be used for indentation", i+1)
+		case text == "---" && len(lines) == 0:
+			continue
+		case text == "---" || text == "...":
+			return nil, fmt.Errorf("line %d: only one document is supported", i+1)
+		}
+
+		lines = append(lines, yamlLine{num: i + 1, indent: len(ln) - len(text), text: text})
+	}
+
+	return lines, nil
+}
+
+// stripComment removes the comment at the end of ln, if any. Comments start
+// with a '#' at the beginning of the line or after a space, outside of quoted
+// strings.
+func stripComment(ln string) string {
+	var quote byte
+
+	for i := 0; i < len(ln); i++ {
+		switch c := ln[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || ln[i-1] == ' ' || ln[i-1] == '\t'):
+			return ln[:i]
+		}
+	}
+
+	return ln
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	i     int
+}
+
+func (p *yamlParser) parseNode(indent int) (interface{}, error) {
+	ln := p.lines[p.i]
+
+	if isSequenceItem(ln.text) {
+		return p.parseSequence(indent)
+	}
+
+	if _, _, ok, err := splitMappingKey(ln); err != nil {
+		return nil, err
+	} else if ok {
+		return p.parseMapping(indent)
+	}
+
+	p.i++
+	return parseFlow(ln)
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	list := []interface{}{}
+
+	for p.i < len(p.lines) {
+		ln := p.lines[p.i]
+
+		if ln.indent < indent || (ln.indent == indent && !isSequenceItem(ln.text)) {
+			break
+		}
+		if ln.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", ln.num)
+		}
+
+		rest := strings.TrimLeft(ln.text[1:], " ")
+		var v interface{}
+		var err error
+
+		if len(rest) == 0 {
+			p.i++
+			if p.i < len(p.lines) && p.lines[p.i].indent > indent {
+				v, err = p.parseNode(p.lines[p.i].indent)
+			}
+		} else {
+			// The content of the item is parsed as if it started on its own
+			// line, which lets mappings continue on the following lines.
+			col := ln.indent + len(ln.text) - len(rest)
+			p.lines[p.i] = yamlLine{num: ln.num, indent: col, text: rest}
+			v, err = p.parseNode(col)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+
+	return list, nil
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	m := map[string]interface{}{}
+
+	for p.i < len(p.lines) {
+		ln := p.lines[p.i]
+
+		if ln.indent < indent {
+			break
+		}
+		if ln.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", ln.num)
+		}
+
+		key, value, ok, err := splitMappingKey(ln)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected a key followed by ':'", ln.num)
+		}
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", ln.num, key)
+		}
+
+		p.i++
+		var v interface{}
+
+		if len(value) != 0 {
+			v, err = parseFlow(yamlLine{num: ln.num, text: value})
+		} else if p.i < len(p.lines) {
+			// Sequences may be written at the indentation of their key.
+			switch next := p.lines[p.i]; {
+			case next.indent > indent:
+				v, err = p.parseNode(next.indent)
+			case next.indent == indent && isSequenceItem(next.text):
+				v, err = p.parseSequence(indent)
+			}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+
+	return m, nil
+}
+
+func isSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitMappingKey splits a "key: value" line, ok is false if the line is not
+// a mapping entry.
+func splitMappingKey(ln yamlLine) (key string, value string, ok bool, err error) {
+	text := ln.text
+
+	if text[0] == '"' || text[0] == '\'' {
+		s, n, err := parseQuoted(text, ln.num)
+		if err != nil {
+			return "", "", false, err
+		}
+		rest := strings.TrimLeft(text[n:], " ")
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", false, nil
+		}
+		return s, strings.TrimSpace(rest[1:]), true, nil
+	}
+
+	if text[0] == '[' || text[0] == '{' {
+		return "", "", false, nil
+	}
+
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return strings.TrimRight(text[:i], " "), strings.TrimSpace(text[i+1:]), true, nil
+		}
+	}
+
+	return "", "", false, nil
+}
+
+// parseFlow parses the value written on a single line.
+func parseFlow(ln yamlLine) (interface{}, error) {
+	p := flowParser{s: ln.text, num: ln.num}
+
+	// Outside of flow collections, plain scalars span the whole line.
+	if !strings.ContainsRune("[{\"'|>&*!%@`", rune(ln.text[0])) {
+		return plainScalar(ln.text), nil
+	}
+
+	v, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpaces()
+	if p.i != len(p.s) {
+		return nil, fmt.Errorf("line %d: unexpected %q after value", ln.num, p.s[p.i:])
+	}
+
+	return v, nil
+}
+
+type flowParser struct {
+	s   string
+	i   int
+	num int
+}
+
+func (p *flowParser) skipSpaces() {
+	for p.i < len(p.s) && p.s[p.i] == ' ' {
+		p.i++
+	}
+}
+
+func (p *flowParser) parseValue() (interface{}, error) {
+	p.skipSpaces()
+
+	if p.i == len(p.s) {
+		return nil, nil
+	}
+
+	switch c := p.s[p.i]; c {
+	case '[':
+		return p.parseSequence()
+	case '{':
+		return p.parseMapping()
+	case '"', '\'':
+		s, n, err := parseQuoted(p.s[p.i:], p.num)
+		p.i += n
+		return s, err
+	case '|', '>', '&', '*', '!', '%', '@', '`':
+		return nil, fmt.Errorf("line %d: unsupported YAML syntax %q", p.num, c)
+	}
+
+	// Plain scalars end at the end of the line, or at the delimiters of the
+	// flow collection they are in.
+	start := p.i
+	for p.i < len(p.s) && !strings.ContainsRune(",]}", rune(p.s[p.i])) {
+		p.i++
+	}
+	return plainScalar(strings.TrimRight(p.s[start:p.i], " ")), nil
+}
+
+func (p *flowParser) parseSequence() (interface{}, error) {
+	list := []interface{}{}
+	p.i++ // [
+
+	for {
+		p.skipSpaces()
+
+		if p.i == len(p.s) {
+			return nil, fmt.Errorf("line %d: unterminated flow sequence", p.num)
+		}
+		if p.s[p.i] == ']' {
+			p.i++
+			return list, nil
+		}
+
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+
+		if err := p.parseSeparator(']'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *flowParser) parseMapping() (interface{}, error) {
+	m := map[string]interface{}{}
+	p.i++ // {
+
+	for {
+		p.skipSpaces()
+
+		if p.i == len(p.s) {
+			return nil, fmt.Errorf("line %d: unterminated flow mapping", p.num)
+		}
+		if p.s[p.i] == '}' {
+			p.i++
+			return m, nil
+		}
+
+		k, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+
+		p.skipSpaces()
+		if p.i == len(p.s) || p.s[p.i] != ':' {
+			// Plain keys stop at the ':' as part of their value.
+			s, ok := k.(plainScalar)
+			j := strings.Index(string(s), ": ")
+			if !ok || j < 0 {
+				return nil, fmt.Errorf("line %d: expected a key followed by ':' in flow mapping", p.num)
+			}
+			p.i -= len(s) - j
+			k = plainScalar(strings.TrimRight(string(s[:j]), " "))
+		}
+		p.i++ // :
+
+		key := fmt.Sprint(k)
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", p.num, key)
+		}
+
+		if m[key], err = p.parseValue(); err != nil {
+			return nil, err
+		}
+
+		if err := p.parseSeparator('}'); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *flowParser) parseSeparator(end byte) error {
+	p.skipSpaces()
+
+	switch {
+	case p.i == len(p.s):
+		return fmt.Errorf("line %d: unterminated flow collection", p.num)
+	case p.s[p.i] == ',':
+		p.i++
+		return nil
+	case p.s[p.i] == end:
+		return nil
+	default:
+		return fmt.Errorf("line %d: expected ',' or '%c' in flow collection", p.num, end)
+	}
+}
+
+// parseQuoted parses the quoted string at the beginning of s, returning its
+// value and the number of bytes it spans.
+func parseQuoted(s string, num int) (string, int, error) {
+	quote := s[0]
+	var b strings.Builder
+
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case c == quote && quote == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\\' && quote == '"':
+			if i+1 == len(s) {
+				return "", 0, fmt.Errorf("line %d: unterminated string", num)
+			}
+			i++
+			switch e := s[i]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '0':
+				b.WriteByte(0)
+			case '"', '\\', '/':
+				b.WriteByte(e)
+			default:
+				return "", 0, fmt.Errorf("line %d: unsupported escape sequence \\%c", num, e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", 0, fmt.Errorf("line %d: unterminated string", num)
+}
@@ -2,6 +2,8 @@ package datadog
 
 import (
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/segmentio/stats"
 )
@@ -13,24 +15,139 @@ func appendMetric(b []byte, m Metric) []byte {
 	}
 
 	b = append(b, m.Name...)
-	b = append(b, ':')
-	b = strconv.AppendFloat(b, m.Value, 'g', -1, 64)
+
+	if len(m.Values) == 0 {
+		if m.Type == Set && len(m.Member) != 0 {
+			b = append(b, ':')
+			b = append(b, m.Member...)
+		} else if m.Delta && m.Type == Gauge && m.Value >= 0 {
+			b = append(b, ':', '+')
+			b = strconv.AppendFloat(b, m.Value, 'g', -1, 64)
+		} else {
+			b = appendValue(b, m.Value)
+		}
+	} else {
+		for _, v := range m.Values {
+			b = appendValue(b, v)
+		}
+	}
+
 	b = append(b, '|')
 	b = append(b, m.Type...)
+	b = appendMetricSuffix(b, m.Rate, m.Tags)
+	b = appendStringField(b, "c:", m.ContainerID)
 
-	if m.Rate != 0 && m.Rate != 1 {
+	if !m.Timestamp.IsZero() {
+		b = append(b, '|', 'T')
+		b = strconv.AppendInt(b, m.Timestamp.Unix(), 10)
+	}
+
+	return append(b, '\n')
+}
+
+func appendValue(b []byte, v float64) []byte {
+	b = append(b, ':')
+	return strconv.AppendFloat(b, v, 'g', -1, 64)
+}
+
+func appendMetricSuffix(b []byte, rate float64, tags []stats.Tag) []byte {
+	if rate != 0 && rate != 1 {
 		b = append(b, '|', '@')
-		b = strconv.AppendFloat(b, m.Rate, 'g', -1, 64)
+		b = strconv.AppendFloat(b, rate, 'g', -1, 64)
+	}
+
+	if len(tags) != 0 {
+		b = append(b, '|', '#')
+		b = appendTags(b, tags)
 	}
 
-	if n := len(m.Tags); n != 0 {
+	return b
+}
+
+func appendEvent(b []byte, e Event) []byte {
+	title := escapeEventText(e.Title)
+	text := escapeEventText(e.Text)
+
+	b = append(b, "_e{"...)
+	b = strconv.AppendInt(b, int64(len(title)), 10)
+	b = append(b, ',')
+	b = strconv.AppendInt(b, int64(len(text)), 10)
+	b = append(b, "}:"...)
+	b = append(b, title...)
+	b = append(b, '|')
+	b = append(b, text...)
+
+	b = appendTimestampField(b, e.Timestamp)
+	b = appendStringField(b, "h:", e.Hostname)
+	b = appendStringField(b, "k:", e.AggregationKey)
+	b = appendStringField(b, "p:", string(e.Priority))
+	b = appendStringField(b, "s:", e.SourceTypeName)
+	b = appendStringField(b, "t:", string(e.AlertType))
+
+	if len(e.Tags) != 0 {
 		b = append(b, '|', '#')
-		b = appendTags(b, m.Tags)
+		b = appendTags(b, e.Tags)
 	}
 
 	return append(b, '\n')
 }
 
+func appendServiceCheck(b []byte, sc ServiceCheck) []byte {
+	b = append(b, "_sc|"...)
+	b = append(b, sc.Name...)
+	b = append(b, '|')
+	b = strconv.AppendInt(b, int64(sc.Status), 10)
+
+	b = appendTimestampField(b, sc.Timestamp)
+	b = appendStringField(b, "h:", sc.Hostname)
+
+	if len(sc.Tags) != 0 {
+		b = append(b, '|', '#')
+		b = appendTags(b, sc.Tags)
+	}
+
+	// The message must be the last field of a service check.
+	if len(sc.Message) != 0 {
+		b = append(b, "|m:"...)
+		b = append(b, escapeServiceCheckMessage(sc.Message)...)
+	}
+
+	return append(b, '\n')
+}
+
+func appendTimestampField(b []byte, t time.Time) []byte {
+	if !t.IsZero() {
+		b = append(b, "|d:"...)
+		b = strconv.AppendInt(b, t.Unix(), 10)
+	}
+	return b
+}
+
+func appendStringField(b []byte, prefix string, value string) []byte {
+	if len(value) != 0 {
+		b = append(b, '|')
+		b = append(b, prefix...)
+		b = append(b, value...)
+	}
+	return b
+}
+
+// Line breaks are not allowed in dogstatsd datagrams, they're represented by
+// the "\n" sequence in event titles and texts.
+var eventTextEscaper = strings.NewReplacer("\n", "\\n")
+
+func escapeEventText(s string) string {
+	return eventTextEscaper.Replace(s)
+}
+
+// Service check messages also need to escape "m:" since it's used to identify
+// the message field.
+var serviceCheckMessageEscaper = strings.NewReplacer("\n", "\\n", "m:", "m\\:")
+
+func escapeServiceCheckMessage(s string) string {
+	return serviceCheckMessageEscaper.Replace(s)
+}
+
 func appendTags(b []byte, tags []stats.Tag) []byte {
 	for i, t := range tags {
 		if t.Name == "http_req_path" {
@@ -0,0 +1,204 @@
+package datadog
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+// MaxSampleReplicas is the maximum number of times an EngineHandler observes a
+// histogram value to compensate for its sample rate, which bounds the work a
+// single metric with a tiny sample rate can cause.
+const MaxSampleReplicas = 100
+
+// EngineHandler is a dogstatsd server handler which reports the metrics it
+// receives on a stats engine, it is typically used to relay metrics from
+// programs that only support the statsd protocol to other handlers like the
+// prometheus exporter.
+//
+// Counters and gauges are reported as such. Histograms, distributions and
+// timers are reported as histograms, timers are expressed in milliseconds on
+// the wire and are reported in seconds on the engine. Sets have no equivalent
+// in the stats package and are discarded.
+//
+// Sample rates are honored by scaling the values of counters, and by observing
+// histogram values as many times as they were sampled, up to MaxSampleReplicas.
+//
+// Gauges received as deltas are added to the last value of the gauge with the
+// same name and tags. To bound its memory usage, the handler only retains the
+// values of gauges that received deltas, until they stop receiving updates for
+// GaugeTimeout, so a delta applies to zero on gauges that were only set so far
+// or that have been idle.
+type EngineHandler struct {
+	// Engine is the stats engine that received metrics are reported on, the
+	// default engine is used when nil.
+	Engine *stats.Engine
+
+	// AddrTag is the name of a tag set to the host address of the programs
+	// that sent the metrics. If empty, no tag is added.
+	AddrTag string
+
+	// GaugeTimeout defines how long the handler retains the value of gauges
+	// that aren't receiving updates.
+	//
+	// The default is to use a 2 minutes gauge timeout.
+	GaugeTimeout time.Duration
+
+	mutex   sync.Mutex
+	gauges  map[string]*gaugeState
+	key     []byte
+	cleaned time.Time
+	now     func() time.Time // for tests, time.Now when nil
+}
+
+type gaugeState struct {
+	value   float64
+	updated time.Time
+}
+
+// HandleMetric satisfies the Handler interface.
+func (h *EngineHandler) HandleMetric(m Metric, a net.Addr) {
+	var tags [16]stats.Tag
+	h.handle(h.engine(), m, h.tags(tags[:0], m, a))
+}
+
+// HandleMetrics satisfies the BatchHandler interface.
+func (h *EngineHandler) HandleMetrics(metrics []Metric, a net.Addr) {
+	var buf [16]stats.Tag
+	var eng = h.engine()
+	var tags = buf[:0]
+
+	for _, m := range metrics {
+		tags = h.tags(tags[:0], m, a)
+		h.handle(eng, m, tags)
+	}
+}
+
+func (h *EngineHandler) engine() *stats.Engine {
+	if h.Engine != nil {
+		return h.Engine
+	}
+	return stats.DefaultEngine
+}
+
+func (h *EngineHandler) tags(tags []stats.Tag, m Metric, a net.Addr) []stats.Tag {
+	tags = append(tags, m.Tags...)
+
+	if len(h.AddrTag) != 0 && a != nil {
+		tags = append(tags, stats.Tag{h.AddrTag, addrHost(a)})
+	}
+
+	return tags
+}
+
+func (h *EngineHandler) handle(eng *stats.Engine, m Metric, tags []stats.Tag) {
+	rate := m.Rate
+	if rate <= 0 || rate > 1 {
+		rate = 1
+	}
+
+	switch m.Type {
+	case Counter:
+		eng.Add(m.Name, m.Value/rate, tags...)
+
+	case Gauge:
+		eng.Set(m.Name, h.gauge(m, tags), tags...)
+
+	case Histogram, Distribution, Timer:
+		value := m.Value
+		if m.Type == Timer {
+			value /= 1000
+		}
+
+		for n := int(math.Min(math.Round(1/rate), MaxSampleReplicas)); n > 0; n-- {
+			eng.Observe(m.Name, value, tags...)
+		}
+	}
+}
+
+// gauge returns the value that the gauge m must be set to, applying deltas to
+// the last value of the gauge.
+func (h *EngineHandler) gauge(m Metric, tags []stats.Tag) float64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := time.Now
+	if h.now != nil {
+		now = h.now
+	}
+	t := now()
+	h.cleanup(t)
+
+	h.key = append(h.key[:0], m.Name...)
+	for _, tag := range tags {
+		h.key = append(h.key, 0)
+		h.key = append(h.key, tag.Name...)
+		h.key = append(h.key, 0)
+		h.key = append(h.key, tag.Value...)
+	}
+
+	state := h.gauges[string(h.key)]
+
+	if state == nil {
+		if !m.Delta {
+			return m.Value
+		}
+		if h.gauges == nil {
+			h.gauges = make(map[string]*gaugeState)
+		}
+		state = new(gaugeState)
+		h.gauges[string(h.key)] = state
+	}
+
+	if m.Delta {
+		state.value += m.Value
+	} else {
+		state.value = m.Value
+	}
+
+	state.updated = t
+	return state.value
+}
+
+// cleanup removes the gauges that haven't been updated for the gauge timeout,
+// the map is scanned at most once per timeout period.
+func (h *EngineHandler) cleanup(now time.Time) {
+	timeout := h.GaugeTimeout
+	if timeout == 0 {
+		timeout = 2 * time.Minute
+	}
+
+	if now.Sub(h.cleaned) < timeout {
+		return
+	}
+
+	for key, state := range h.gauges {
+		if now.Sub(state.updated) >= timeout {
+			delete(h.gauges, key)
+		}
+	}
+
+	h.cleaned = now
+}
+
+// addrHost returns the host part of a, the port of UDP addresses changes with
+// every connection and would create tags with an unbounded number of values.
+func addrHost(a net.Addr) string {
+	switch addr := a.(type) {
+	case *net.UDPAddr:
+		return addr.IP.String()
+	case *net.TCPAddr:
+		return addr.IP.String()
+	}
+
+	s := a.String()
+
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return host
+	}
+
+	return s
+}
@@ -0,0 +1,154 @@
+package datadog
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+func TestEngineHandler(t *testing.T) {
+	var metrics []stats.Metric
+
+	engine := stats.NewEngine("relay")
+	engine.Register(stats.HandlerFunc(func(m *stats.Metric) {
+		c := *m
+		c.Tags = append([]stats.Tag{}, m.Tags...)
+		metrics = append(metrics, c)
+	}))
+
+	handler := &EngineHandler{Engine: engine, AddrTag: "source"}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 54321}
+
+	handler.HandleMetrics([]Metric{
+		{Type: Counter, Name: "A", Value: 2, Rate: 0.5, Tags: []stats.Tag{{"a", "b"}}},
+		{Type: Gauge, Name: "B", Value: 3, Rate: 0.5},
+		{Type: Histogram, Name: "C", Value: 4, Rate: 0.5},
+		{Type: Timer, Name: "D", Value: 250, Rate: 1},
+		{Type: Set, Name: "E", Value: 42, Rate: 1},
+	}, addr)
+
+	source := stats.Tag{"source", "127.0.0.1"}
+	expected := []stats.Metric{
+		{Type: stats.CounterType, Namespace: "relay", Name: "A", Value: 4, Tags: []stats.Tag{{"a", "b"}, source}},
+		{Type: stats.GaugeType, Namespace: "relay", Name: "B", Value: 3, Tags: []stats.Tag{source}},
+		{Type: stats.HistogramType, Namespace: "relay", Name: "C", Value: 4, Tags: []stats.Tag{source}},
+		{Type: stats.HistogramType, Namespace: "relay", Name: "C", Value: 4, Tags: []stats.Tag{source}},
+		{Type: stats.HistogramType, Namespace: "relay", Name: "D", Value: 0.25, Tags: []stats.Tag{source}},
+	}
+
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("bad metrics:\n- %#v\n- %#v", expected, metrics)
+	}
+}
+
+func TestEngineHandlerGaugeDeltas(t *testing.T) {
+	var values []float64
+
+	engine := stats.NewEngine("relay")
+	engine.Register(stats.HandlerFunc(func(m *stats.Metric) {
+		values = append(values, m.Value)
+	}))
+
+	handler := &EngineHandler{Engine: engine}
+
+	for _, m := range []Metric{
+		{Type: Gauge, Name: "A", Value: 2, Delta: true},
+		{Type: Gauge, Name: "A", Value: 10},
+		{Type: Gauge, Name: "A", Value: 3, Delta: true},
+		{Type: Gauge, Name: "A", Value: -1, Delta: true, Tags: []stats.Tag{{"a", "b"}}},
+		{Type: Gauge, Name: "A", Value: -5, Delta: true},
+		{Type: Gauge, Name: "A", Value: -5},
+	} {
+		handler.HandleMetric(m, nil)
+	}
+
+	if expected := []float64{2, 10, 13, -1, 8, -5}; !reflect.DeepEqual(values, expected) {
+		t.Errorf("bad gauge values:\n- %v\n- %v", expected, values)
+	}
+}
+
+func TestEngineHandlerGaugeExpiration(t *testing.T) {
+	var values []float64
+
+	engine := stats.NewEngine("relay")
+	engine.Register(stats.HandlerFunc(func(m *stats.Metric) {
+		values = append(values, m.Value)
+	}))
+
+	now := time.Unix(1e9, 0)
+	handler := &EngineHandler{Engine: engine, GaugeTimeout: time.Minute}
+	handler.now = func() time.Time { return now }
+
+	for _, step := range []struct {
+		m       Metric
+		elapsed time.Duration
+	}{
+		{m: Metric{Type: Gauge, Name: "A", Value: 10}},             // not tracked
+		{m: Metric{Type: Gauge, Name: "A", Value: 1, Delta: true}}, // 0 + 1
+		{m: Metric{Type: Gauge, Name: "A", Value: 10}},             // tracked
+		{m: Metric{Type: Gauge, Name: "A", Value: 2, Delta: true}}, // 10 + 2
+		{m: Metric{Type: Gauge, Name: "B", Value: 5}, elapsed: 30 * time.Second},
+		{m: Metric{Type: Gauge, Name: "A", Value: 3, Delta: true}, elapsed: 2 * time.Minute}, // expired
+	} {
+		now = now.Add(step.elapsed)
+		handler.HandleMetric(step.m, nil)
+	}
+
+	if expected := []float64{10, 1, 10, 12, 5, 3}; !reflect.DeepEqual(values, expected) {
+		t.Errorf("bad gauge values:\n- %v\n- %v", expected, values)
+	}
+
+	if n := len(handler.gauges); n != 1 {
+		t.Errorf("bad number of tracked gauges: %d", n)
+	}
+}
+
+func TestEngineHandlerSampleReplicas(t *testing.T) {
+	var count int
+
+	engine := stats.NewEngine("relay")
+	engine.Register(stats.HandlerFunc(func(m *stats.Metric) { count++ }))
+
+	handler := &EngineHandler{Engine: engine}
+	handler.HandleMetric(Metric{Type: Histogram, Name: "A", Value: 1, Rate: 0.000000001}, nil)
+
+	if count != MaxSampleReplicas {
+		t.Errorf("bad number of observations: %d", count)
+	}
+}
+
+func TestEngineHandlerNoAddrTag(t *testing.T) {
+	var tags []stats.Tag
+
+	engine := stats.NewEngine("relay")
+	engine.Register(stats.HandlerFunc(func(m *stats.Metric) {
+		tags = append([]stats.Tag{}, m.Tags...)
+	}))
+
+	handler := &EngineHandler{Engine: engine}
+	handler.HandleMetric(Metric{Type: Counter, Name: "A", Value: 1, Tags: []stats.Tag{{"a", "b"}}}, &net.UDPAddr{})
+
+	if !reflect.DeepEqual(tags, []stats.Tag{{"a", "b"}}) {
+		t.Error("bad tags:", tags)
+	}
+}
+
+func TestAddrHost(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		host string
+	}{
+		{&net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 8125}, "10.0.0.1"},
+		{&net.UnixAddr{Name: "/var/run/dsd.socket", Net: "unixgram"}, "/var/run/dsd.socket"},
+		{redialAddr{network: "udp", address: "localhost:8125"}, "localhost"},
+	}
+
+	for _, test := range tests {
+		if host := addrHost(test.addr); host != test.host {
+			t.Errorf("%s: %q != %q", test.addr, test.host, host)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package datadog
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+// ServiceCheckStatus is an enumeration of the status that can be reported by
+// datadog service checks.
+type ServiceCheckStatus int
+
+const (
+	ServiceCheckOK       ServiceCheckStatus = 0
+	ServiceCheckWarning  ServiceCheckStatus = 1
+	ServiceCheckCritical ServiceCheckStatus = 2
+	ServiceCheckUnknown  ServiceCheckStatus = 3
+)
+
+// String satisfies the fmt.Stringer interface.
+func (s ServiceCheckStatus) String() string {
+	switch s {
+	case ServiceCheckOK:
+		return "ok"
+	case ServiceCheckWarning:
+		return "warning"
+	case ServiceCheckCritical:
+		return "critical"
+	default:
+		return "unknown"
+	}
+}
+
+// The ServiceCheck type is a representation of the service checks supported by
+// datadog.
+type ServiceCheck struct {
+	Name      string             // the name of the service check
+	Status    ServiceCheckStatus // the status reported by the check
+	Timestamp time.Time          // the time at which the check was run
+	Hostname  string             // the host name that the check is related to
+	Message   string             // a message describing the current status
+	Tags      []stats.Tag        // the list of tags set on the check
+}
+
+// String satisfies the fmt.Stringer interface.
+func (sc ServiceCheck) String() string {
+	return fmt.Sprint(sc)
+}
+
+// Format satisfies the fmt.Formatter interface.
+func (sc ServiceCheck) Format(f fmt.State, _ rune) {
+	buf := bufferPool.Get().(*buffer)
+	buf.b = appendServiceCheck(buf.b[:0], sc)
+	f.Write(buf.b)
+	bufferPool.Put(buf)
+}
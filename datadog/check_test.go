@@ -0,0 +1,99 @@
+package datadog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+var testServiceChecks = []struct {
+	s  string
+	sc ServiceCheck
+}{
+	{
+		s: "_sc|app.ok|0\n",
+		sc: ServiceCheck{
+			Name:   "app.ok",
+			Status: ServiceCheckOK,
+		},
+	},
+
+	{
+		s: "_sc|app.down|2|d:1500000000|h:host-1|#env:prod|m:connection refused\n",
+		sc: ServiceCheck{
+			Name:      "app.down",
+			Status:    ServiceCheckCritical,
+			Timestamp: time.Unix(1500000000, 0),
+			Hostname:  "host-1",
+			Message:   "connection refused",
+			Tags:      []stats.Tag{{"env", "prod"}},
+		},
+	},
+
+	{
+		s: "_sc|app.slow|1|m:latency\\nis high, m\\: 99th|p\n",
+		sc: ServiceCheck{
+			Name:    "app.slow",
+			Status:  ServiceCheckWarning,
+			Message: "latency\nis high, m: 99th|p",
+		},
+	},
+}
+
+func TestAppendServiceCheck(t *testing.T) {
+	for _, test := range testServiceChecks {
+		t.Run(test.sc.Name, func(t *testing.T) {
+			if s := string(appendServiceCheck(nil, test.sc)); s != test.s {
+				t.Errorf("\n<<< %#v\n>>> %#v", test.s, s)
+			}
+		})
+	}
+}
+
+func TestParseServiceCheckSuccess(t *testing.T) {
+	for _, test := range testServiceChecks {
+		t.Run(test.s, func(t *testing.T) {
+			if sc, err := parseServiceCheck(test.s); err != nil {
+				t.Error(err)
+			} else if !reflect.DeepEqual(sc, test.sc) {
+				t.Errorf("%#v:\n- %#v\n- %#v", test.s, test.sc, sc)
+			}
+		})
+	}
+}
+
+func TestParseServiceCheckFailure(t *testing.T) {
+	tests := []string{
+		"",
+		"_sc||0",         // missing name
+		"_sc|name",       // missing status
+		"_sc|name|4",     // bad status
+		"_sc|name|0|d:x", // malformed timestamp
+		"_sc|name|0|x:y", // unknown field
+	}
+
+	for _, test := range tests {
+		t.Run(test, func(t *testing.T) {
+			if _, err := parseServiceCheck(test); err == nil {
+				t.Errorf("%#v: expected parsing error", test)
+			}
+		})
+	}
+}
+
+func TestServiceCheckStatusString(t *testing.T) {
+	tests := map[ServiceCheckStatus]string{
+		ServiceCheckOK:       "ok",
+		ServiceCheckWarning:  "warning",
+		ServiceCheckCritical: "critical",
+		ServiceCheckUnknown:  "unknown",
+	}
+
+	for status, s := range tests {
+		if status.String() != s {
+			t.Errorf("%d: %q != %q", status, status.String(), s)
+		}
+	}
+}
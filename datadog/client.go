@@ -2,7 +2,9 @@ package datadog
 
 import (
 	"log"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/segmentio/stats"
@@ -18,29 +20,109 @@ const (
 	// DefaultBufferSize is the default size of the client buffer.
 	DefaultBufferSize = 1024
 
+	// DefaultUnixBufferSize is the default size of the client buffer when
+	// connecting to a dogstatsd server over a unix socket, which the agent
+	// accepts larger payloads on.
+	DefaultUnixBufferSize = 8192
+
 	// DefaultFlushInterval is the default interval at which clients flush
-	// metrics from their stats engine.
+	// the metrics they have buffered.
 	DefaultFlushInterval = 1 * time.Second
+
+	// DefaultRetryQueueSize is the default number of datagrams that clients
+	// retain while they are disconnected from the dogstatsd server.
+	DefaultRetryQueueSize = 128
+
+	// DefaultReconnectBackoff is the default delay that clients wait for
+	// before attempting to reconnect to a dogstatsd server.
+	DefaultReconnectBackoff = 100 * time.Millisecond
+
+	// DefaultMaxReconnectBackoff is the default upper bound of the delay
+	// between reconnection attempts.
+	DefaultMaxReconnectBackoff = 10 * time.Second
+
+	// DefaultResolveInterval is the default interval at which clients resolve
+	// the address of the dogstatsd server to detect DNS changes.
+	DefaultResolveInterval = 1 * time.Minute
 )
 
 // The ClientConfig type is used to configure datadog clients.
 type ClientConfig struct {
-	// Address of the dogstatsd agent to send metrics to.
+	// Address of the dogstatsd agent to send metrics to. Addresses prefixed
+	// with "unixgram://" or "unix://" connect to the agent over a unix socket,
+	// see ConnConfig for details.
 	Address string
 
 	// BufferSize is the size of the output buffer used by the client.
 	BufferSize int
+
+	// Shards is the number of output buffers used by the client, programs
+	// producing metrics from many goroutines concurrently should set it to a
+	// value greater than one to reduce contention, see ShardedConn for
+	// details. Zero or one means that a single buffer is used.
+	Shards int
+
+	// FlushInterval is the interval at which the client flushes its buffer in
+	// the background, so metrics don't wait for the buffer to fill up before
+	// being sent. Setting a negative value disables background flushes.
+	FlushInterval time.Duration
+
+	// RetryQueueSize is the maximum number of datagrams retained by the
+	// client while it's unable to send them to the agent, the oldest ones are
+	// dropped when the queue is full.
+	RetryQueueSize int
+
+	// ReconnectBackoff is the delay the client waits for before attempting to
+	// reconnect to the agent, it is doubled after every failed attempt up to
+	// MaxReconnectBackoff.
+	ReconnectBackoff    time.Duration
+	MaxReconnectBackoff time.Duration
+
+	// ResolveInterval is the interval at which the client resolves the
+	// address of the agent, and reconnects if it has changed.
+	ResolveInterval time.Duration
+
+	// PackHistograms enables packing the values of histograms on a single
+	// line (e.g. "name:1:2:3|h"), the values are then retained by the client
+	// until the next flush. Packed values are only understood by agents that
+	// support version 1.1 of the dogstatsd protocol.
+	PackHistograms bool
+
+	// ticker creates the source of the background flushes, for tests,
+	// time.NewTicker is used when nil.
+	ticker func(time.Duration) (<-chan time.Time, func())
+}
+
+// ClientStats carries the counters maintained by a datadog client.
+type ClientStats struct {
+	Sent       uint64 // datagrams sent to the agent
+	Dropped    uint64 // datagrams and metrics that were discarded
+	Errors     uint64 // errors that occurred when connecting or sending datagrams
+	Reconnects uint64 // connections re-established to the agent
 }
 
 // Client represents a datadog client that pulls metrics from a stats engine and
 // forward them to a dogstatsd agent.
+//
+// Clients recover from network errors by reconnecting to the agent in the
+// background, datagrams that couldn't be sent are retried once the connection
+// is re-established.
 type Client struct {
-	conn *Conn
-	once sync.Once
+	conn   bufferedConn
+	rconn  *redialConn
+	packer *packer // nil unless histogram values are packed
+	once   sync.Once
+	done   chan struct{}
+	join   chan struct{}
+
+	// Counters of the last call to ReportStats, synchronized on mutex.
+	mutex    sync.Mutex
+	reported ClientStats
 }
 
 // NewClient creates and returns a new datadog client publishing metrics to the
-// dogstatsd server listening for UDP datagram at addr.
+// dogstatsd server listening at addr, which is a UDP address unless prefixed
+// with a unix socket scheme.
 func NewClient(addr string) *Client {
 	return NewClientWith(ClientConfig{
 		Address: addr,
@@ -48,56 +130,260 @@ func NewClient(addr string) *Client {
 }
 
 // NewClientWith creates and returns a new datadog client configured with config.
+//
+// If the connection to the agent cannot be established the client keeps
+// attempting to connect in the background.
 func NewClientWith(config ClientConfig) *Client {
-	conn, err := DialConfig(ConnConfig{
-		Address:    config.Address,
-		BufferSize: config.BufferSize,
-	})
+	config = setClientConfigDefaults(config)
+	network, address := splitNetworkAddress(config.Address)
+
+	rconn, bufsize, err := newRedialConn(network, address, config)
 
 	if err != nil {
 		log.Printf("stats/datadog: opening a connection to %s failed: %s", config.Address, err)
 	} else {
-		log.Printf("stats/datadog: connection opened to %s with a buffer size of %d B", config.Address, cap(conn.b))
+		log.Printf("stats/datadog: connection opened to %s with a buffer size of %d B", config.Address, bufsize)
+	}
+
+	var conn bufferedConn
+
+	if config.Shards > 1 {
+		c := NewShardedConn(rconn, config.Shards, bufsize)
+		if network == "unix" {
+			c.setStream()
+		}
+		conn = c
+	} else {
+		c := NewConn(rconn, make([]byte, 0, bufsize))
+		if network == "unix" {
+			c.setStream()
+		}
+		conn = c
+	}
+
+	c := &Client{
+		conn:  conn,
+		rconn: rconn,
+		done:  make(chan struct{}),
+		join:  make(chan struct{}),
+	}
+
+	if config.PackHistograms {
+		limit := bufsize
+		if network == "unix" {
+			limit -= 4 // length prefix of stream messages
+		}
+		c.packer = newPacker(limit)
 	}
 
-	return &Client{
-		conn: conn,
+	if config.FlushInterval > 0 {
+		ticker := config.ticker
+		if ticker == nil {
+			ticker = newTicker
+		}
+		ticks, stop := ticker(config.FlushInterval)
+		go c.run(ticks, stop)
+	} else {
+		close(c.join)
+	}
+
+	return c
+}
+
+// bufferedConn is the interface implemented by Conn and ShardedConn, which the
+// client uses to buffer metrics.
+type bufferedConn interface {
+	net.Conn
+	Flush() error
+}
+
+func newTicker(d time.Duration) (<-chan time.Time, func()) {
+	t := time.NewTicker(d)
+	return t.C, t.Stop
+}
+
+// run flushes the client on every tick until it is closed, then calls stop.
+func (c *Client) run(ticks <-chan time.Time, stop func()) {
+	defer close(c.join)
+	defer stop()
+
+	for {
+		select {
+		case <-ticks:
+			c.Flush()
+		case <-c.done:
+			return
+		}
 	}
 }
 
+func setClientConfigDefaults(config ClientConfig) ClientConfig {
+	if len(config.Address) == 0 {
+		config.Address = DefaultAddress
+	}
+
+	if config.BufferSize == 0 {
+		switch network, _ := splitNetworkAddress(config.Address); network {
+		case "unix", "unixgram":
+			config.BufferSize = DefaultUnixBufferSize
+		default:
+			config.BufferSize = DefaultBufferSize
+		}
+	}
+
+	if config.FlushInterval == 0 {
+		config.FlushInterval = DefaultFlushInterval
+	}
+
+	if config.RetryQueueSize == 0 {
+		config.RetryQueueSize = DefaultRetryQueueSize
+	}
+
+	if config.ReconnectBackoff == 0 {
+		config.ReconnectBackoff = DefaultReconnectBackoff
+	}
+
+	if config.MaxReconnectBackoff == 0 {
+		config.MaxReconnectBackoff = DefaultMaxReconnectBackoff
+	}
+
+	if config.MaxReconnectBackoff < config.ReconnectBackoff {
+		config.MaxReconnectBackoff = config.ReconnectBackoff
+	}
+
+	if config.ResolveInterval == 0 {
+		config.ResolveInterval = DefaultResolveInterval
+	}
+
+	return config
+}
+
 // Close satisfies the io.Closer interface.
+//
+// The method stops the background flushes and sends the metrics remaining in
+// the client buffer before closing the connection.
 func (c *Client) Close() (err error) {
 	c.once.Do(func() {
-		if c.conn != nil {
-			err = c.conn.Close()
-		}
+		close(c.done)
+		<-c.join
+		c.flushPacked()
+		err = c.conn.Close()
 	})
 	return
 }
 
 // Flsuh satisfies the stats.Flusher interface.
 func (c *Client) Flush() {
-	if c.conn != nil {
-		if err := c.conn.Flush(); err != nil {
-			log.Printf("stats/datadog: sending metrics to %s failed: %s", c.conn.RemoteAddr(), err)
-		}
+	c.flushPacked()
+
+	if err := c.conn.Flush(); err != nil {
+		log.Printf("stats/datadog: sending metrics to %s failed: %s", c.conn.RemoteAddr(), err)
 	}
 }
 
 // HandleMetric satisfies the stats.Handler interface.
 func (c *Client) HandleMetric(m *stats.Metric) {
-	if c.conn != nil {
-		buf := bufferPool.Get().(*buffer)
-		buf.b = appendMetric(buf.b[:0], Metric{
-			Type:      metricType(m),
-			Namespace: m.Namespace,
-			Name:      m.Name,
-			Value:     m.Value,
-			Tags:      m.Tags,
-		})
-		if _, err := c.conn.Write(buf.b); err != nil {
-			log.Printf("stats/datadog: sending metric %s to %s failed: %s", m.Name, c.conn.RemoteAddr(), err)
+	buf := bufferPool.Get().(*buffer)
+
+	if c.packer != nil && m.Type == stats.HistogramType {
+		if buf.b = c.packer.add(m, buf.b[:0]); len(buf.b) != 0 {
+			c.writePacked(buf.b)
 		}
 		bufferPool.Put(buf)
+		return
+	}
+
+	buf.b = appendMetric(buf.b[:0], Metric{
+		Type:      metricType(m),
+		Namespace: m.Namespace,
+		Name:      m.Name,
+		Value:     m.Value,
+		Tags:      m.Tags,
+	})
+	if _, err := c.conn.Write(buf.b); err != nil {
+		atomic.AddUint64(&c.rconn.stats.Dropped, 1)
+		log.Printf("stats/datadog: sending metric %s to %s failed: %s", m.Name, c.conn.RemoteAddr(), err)
 	}
+	bufferPool.Put(buf)
+}
+
+func (c *Client) flushPacked() {
+	if c.packer != nil {
+		c.packer.flush(c.writePacked)
+	}
+}
+
+func (c *Client) writePacked(b []byte) {
+	if _, err := c.conn.Write(b); err != nil {
+		atomic.AddUint64(&c.rconn.stats.Dropped, 1)
+		log.Printf("stats/datadog: sending packed metric values to %s failed: %s", c.conn.RemoteAddr(), err)
+	}
+}
+
+// Event sends e to the dogstatsd server.
+//
+// Events are buffered like metrics, they're sent on the next flush of the
+// client.
+func (c *Client) Event(e Event) {
+	buf := bufferPool.Get().(*buffer)
+	buf.b = appendEvent(buf.b[:0], e)
+	if _, err := c.conn.Write(buf.b); err != nil {
+		atomic.AddUint64(&c.rconn.stats.Dropped, 1)
+		log.Printf("stats/datadog: sending event %q to %s failed: %s", e.Title, c.conn.RemoteAddr(), err)
+	}
+	bufferPool.Put(buf)
+}
+
+// ServiceCheck sends sc to the dogstatsd server.
+//
+// Service checks are buffered like metrics, they're sent on the next flush of
+// the client.
+func (c *Client) ServiceCheck(sc ServiceCheck) {
+	buf := bufferPool.Get().(*buffer)
+	buf.b = appendServiceCheck(buf.b[:0], sc)
+	if _, err := c.conn.Write(buf.b); err != nil {
+		atomic.AddUint64(&c.rconn.stats.Dropped, 1)
+		log.Printf("stats/datadog: sending service check %s to %s failed: %s", sc.Name, c.conn.RemoteAddr(), err)
+	}
+	bufferPool.Put(buf)
+}
+
+// Send sends m to the dogstatsd server, it makes it possible to use the metric
+// types of the dogstatsd protocol which have no equivalent in the stats
+// package, like distributions, sets or gauge deltas.
+//
+// Metrics sent with this method are buffered like the others, they're sent on
+// the next flush of the client.
+func (c *Client) Send(m Metric) {
+	buf := bufferPool.Get().(*buffer)
+	buf.b = appendMetric(buf.b[:0], m)
+	if _, err := c.conn.Write(buf.b); err != nil {
+		atomic.AddUint64(&c.rconn.stats.Dropped, 1)
+		log.Printf("stats/datadog: sending metric %s to %s failed: %s", m.Name, c.conn.RemoteAddr(), err)
+	}
+	bufferPool.Put(buf)
+}
+
+// Stats returns the current values of the counters maintained by the client.
+func (c *Client) Stats() ClientStats {
+	return c.rconn.Stats()
+}
+
+// ReportStats produces metrics on eng for the counters maintained by the client,
+// only the changes since the last call to ReportStats are reported.
+//
+// The method is intended to be called periodically, for example by a collector
+// of the procstats package.
+func (c *Client) ReportStats(eng *stats.Engine) {
+	s := c.Stats()
+
+	c.mutex.Lock()
+	r := c.reported
+	c.reported = s
+	c.mutex.Unlock()
+
+	eng.Add("datadog.client.sent", float64(s.Sent-r.Sent))
+	eng.Add("datadog.client.dropped", float64(s.Dropped-r.Dropped))
+	eng.Add("datadog.client.errors", float64(s.Errors-r.Errors))
+	eng.Add("datadog.client.reconnects", float64(s.Reconnects-r.Reconnects))
 }
@@ -3,6 +3,7 @@ package datadog
 import (
 	"net"
 	"testing"
+	"time"
 
 	"github.com/segmentio/stats"
 )
@@ -35,3 +36,131 @@ func BenchmarkClient(b *testing.B) {
 		engine.Flush()
 	})
 }
+
+// testTicker is a source of background flushes driven by tests.
+type testTicker struct {
+	interval time.Duration
+	ticks    chan time.Time
+	stopped  chan struct{}
+}
+
+func newTestTicker() *testTicker {
+	return &testTicker{
+		ticks:   make(chan time.Time),
+		stopped: make(chan struct{}),
+	}
+}
+
+func (t *testTicker) start(d time.Duration) (<-chan time.Time, func()) {
+	t.interval = d
+	return t.ticks, func() { close(t.stopped) }
+}
+
+func TestClientFlushInterval(t *testing.T) {
+	received := make(chan Metric, 10)
+	addr, closer := startTestServer(t, HandlerFunc(func(m Metric, a net.Addr) {
+		received <- m
+	}))
+	defer closer.Close()
+
+	ticker := newTestTicker()
+	client := NewClientWith(ClientConfig{
+		Address:       addr,
+		FlushInterval: 10 * time.Second,
+		ticker:        ticker.start,
+	})
+	defer client.Close()
+
+	if ticker.interval != 10*time.Second {
+		t.Error("bad flush interval:", ticker.interval)
+	}
+
+	engine := stats.NewEngine("datadog.test")
+	engine.Register(client)
+	engine.Incr("A")
+
+	if s := client.Stats(); s.Sent != 0 {
+		t.Error("the metric was sent before the flush interval elapsed:", s.Sent)
+	}
+
+	ticker.ticks <- time.Now()
+
+	select {
+	case m := <-received:
+		if m.Name != "datadog.test.A" {
+			t.Error("bad metric name:", m.Name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the metric was not flushed in the background")
+	}
+}
+
+func TestClientCloseStopsFlushing(t *testing.T) {
+	ticker := newTestTicker()
+	client := NewClientWith(ClientConfig{
+		Address: "127.0.0.1:0",
+		ticker:  ticker.start,
+	})
+
+	// The flush goroutine consumes ticks until the client is closed.
+	ticker.ticks <- time.Now()
+
+	select {
+	case <-ticker.stopped:
+		t.Fatal("the ticker was stopped before closing the client")
+	default:
+	}
+
+	if err := client.Close(); err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case <-ticker.stopped:
+	default:
+		t.Error("the ticker wasn't stopped when closing the client")
+	}
+
+	select {
+	case ticker.ticks <- time.Now():
+		t.Error("the flush goroutine is still running after closing the client")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Closing the client multiple times must be safe.
+	client.Close()
+}
+
+func TestClientSend(t *testing.T) {
+	received := make(chan Metric, 10)
+	addr, closer := startTestServer(t, HandlerFunc(func(m Metric, a net.Addr) {
+		m.Tags = append([]stats.Tag{}, m.Tags...)
+		received <- m
+	}))
+	defer closer.Close()
+
+	client := NewClient(addr)
+
+	metrics := []Metric{
+		{Type: Distribution, Name: "request.size", Value: 512, Rate: 1, Tags: []stats.Tag{{"path", "/"}}},
+		{Type: Set, Name: "users", Value: 42, Rate: 1},
+		{Type: Gauge, Name: "queue.size", Value: 1, Delta: true, Rate: 1},
+	}
+
+	for _, m := range metrics {
+		client.Send(m)
+	}
+
+	client.Close()
+
+	for _, expected := range metrics {
+		select {
+		case m := <-received:
+			if m.String() != expected.String() || m.Delta != expected.Delta {
+				t.Errorf("bad metric:\n- expected: %s- found:    %s", expected, m)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for metrics")
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package datadog
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -13,15 +15,35 @@ import (
 // ConnConfig carries the configuration options that can be set when creating a
 // connection.
 type ConnConfig struct {
-	Address    string
+	// Address of the dogstatsd server, it may be prefixed with a scheme to
+	// select the network used by the connection:
+	//
+	//	udp://host:port          (the default when no scheme is set)
+	//	unixgram:///path/to/sock (unix datagram socket)
+	//	unix:///path/to/sock     (unix stream socket)
+	//
+	Address string
+
+	// BufferSize is the size of the datagrams produced by the connection, on
+	// stream sockets it is the maximum size of each message sent.
 	BufferSize int
+
+	// WrapConn, when set, is called with the network connection once it is
+	// established, the connection it returns is the one that datagrams are
+	// written to. It is typically used to instrument the connection.
+	WrapConn func(net.Conn) net.Conn
 }
 
-// A Conn represents a UDP connection to a dogstatsd server.
+// A Conn represents a connection to a dogstatsd server.
 type Conn struct {
 	m sync.Mutex
 	c net.Conn
 	b []byte
+
+	// When writing to a stream socket each message needs to be prefixed with
+	// its length so the server can figure out where messages end, the first
+	// off bytes of b are reserved for this header.
+	off int
 }
 
 // Dial opens a new dogstatsd connection to address.
@@ -40,15 +62,31 @@ func DialConfig(config ConnConfig) (conn *Conn, err error) {
 		config.Address = DefaultAddress
 	}
 
+	network, address := splitNetworkAddress(config.Address)
+
 	if config.BufferSize == 0 {
-		config.BufferSize = DefaultBufferSize
+		switch network {
+		case "unix", "unixgram":
+			config.BufferSize = DefaultUnixBufferSize
+		default:
+			config.BufferSize = DefaultBufferSize
+		}
 	}
 
-	if c, n, err = dial(config.Address, config.BufferSize); err != nil {
+	if c, n, err = dial(network, address, config.BufferSize); err != nil {
 		return
 	}
 
+	if config.WrapConn != nil {
+		c = config.WrapConn(c)
+	}
+
 	conn = NewConn(c, make([]byte, 0, n))
+
+	if network == "unix" {
+		conn.setStream()
+	}
+
 	return
 }
 
@@ -60,6 +98,11 @@ func NewConn(conn net.Conn, buff []byte) *Conn {
 	}
 }
 
+func (c *Conn) setStream() {
+	c.off = 4
+	c.b = c.b[:c.off]
+}
+
 // Close satisfies the net.Conn interface.
 func (c *Conn) Close() (err error) {
 	err = c.Flush()
@@ -75,10 +118,14 @@ func (c *Conn) Read(b []byte) (int, error) {
 // Write satisfies the net.Conn interface.
 func (c *Conn) Write(b []byte) (n int, err error) {
 	c.m.Lock()
+	n, err = c.write(b)
+	c.m.Unlock()
+	return
+}
 
-	if n = len(b); n > cap(c.b) {
-		c.m.Unlock()
-		return 0, fmt.Errorf("discarded because it doesn't fit in the output buffer (size = %d, max = %d)", n, cap(c.b))
+func (c *Conn) write(b []byte) (n int, err error) {
+	if n = len(b); n > (cap(c.b) - c.off) {
+		return 0, fmt.Errorf("discarded because it doesn't fit in the output buffer (size = %d, max = %d)", n, cap(c.b)-c.off)
 	}
 
 	if n > (cap(c.b) - len(c.b)) {
@@ -86,7 +133,6 @@ func (c *Conn) Write(b []byte) (n int, err error) {
 	}
 
 	c.b = append(c.b, b...)
-	c.m.Unlock()
 	return
 }
 
@@ -115,7 +161,8 @@ func (c *Conn) SetWriteDeadline(t time.Time) error {
 	return c.c.SetWriteDeadline(t)
 }
 
-// Flush sends a UDP datagram containing all buffered data.
+// Flush sends a datagram containing all buffered data, or a length-prefixed
+// message when the connection is established on a stream socket.
 func (c *Conn) Flush() (err error) {
 	c.m.Lock()
 	err = c.flush()
@@ -124,28 +171,57 @@ func (c *Conn) Flush() (err error) {
 }
 
 func (c *Conn) flush() (err error) {
-	if len(c.b) != 0 {
+	if len(c.b) > c.off {
+		if c.off != 0 {
+			binary.LittleEndian.PutUint32(c.b[:c.off], uint32(len(c.b)-c.off))
+		}
 		_, err = c.c.Write(c.b)
-		c.b = c.b[:0]
+		c.b = c.b[:c.off]
 	}
 	return
 }
 
-func dial(address string, sizehint int) (conn net.Conn, bufsize int, err error) {
+// splitNetworkAddress splits the scheme off of address, returning the network
+// that it represents and the remaining part of the address. When address has
+// no scheme the network defaults to "udp".
+func splitNetworkAddress(address string) (network string, addr string) {
+	if i := strings.Index(address, "://"); i >= 0 {
+		return address[:i], address[i+3:]
+	}
+	return "udp", address
+}
+
+func dial(network string, address string, sizehint int) (conn net.Conn, bufsize int, err error) {
+	switch network {
+	case "udp", "udp4", "udp6", "unixgram":
+	case "unix":
+		// Stream sockets don't limit the size of the messages, the size hint
+		// can be used as is.
+		if conn, err = net.Dial(network, address); err == nil {
+			bufsize = sizehint
+		}
+		return
+	default:
+		err = fmt.Errorf("unsupported network: %s", network)
+		return
+	}
+
 	var f *os.File
 
-	if conn, err = net.Dial("udp", address); err != nil {
+	if conn, err = net.Dial(network, address); err != nil {
 		return
 	}
 
-	if f, err = conn.(*net.UDPConn).File(); err != nil {
+	if f, err = conn.(interface {
+		File() (*os.File, error)
+	}).File(); err != nil {
 		conn.Close()
 		return
 	}
 	defer f.Close()
 	fd := int(f.Fd())
 
-	// The kernel refuses to send UDP datagrams that are larger than the size of
+	// The kernel refuses to send datagrams that are larger than the size of
 	// the size of the socket send buffer. To maximize the number of metrics
 	// sent in one batch we attempt to attempt to adjust the kernel buffer size
 	// to accept larger datagrams, or fallback to the default socket buffer size
@@ -170,7 +246,8 @@ func dial(address string, sizehint int) (conn net.Conn, bufsize int, err error)
 
 	// Even tho the buffer agrees to support a bigger size it shouldn't be
 	// possible to send datagrams larger than 65 KB on an IPv4 socket, so let's
-	// enforce the max size.
+	// enforce the max size. Unix datagram sockets don't have this limit but
+	// dogstatsd servers don't accept larger datagrams either.
 	if bufsize > MaxBufferSize {
 		bufsize = MaxBufferSize
 	}
@@ -0,0 +1,150 @@
+package datadog
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSplitNetworkAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		network string
+		addr    string
+	}{
+		{
+			address: "localhost:8125",
+			network: "udp",
+			addr:    "localhost:8125",
+		},
+
+		{
+			address: "udp://localhost:8125",
+			network: "udp",
+			addr:    "localhost:8125",
+		},
+
+		{
+			address: "unixgram:///var/run/datadog/dsd.socket",
+			network: "unixgram",
+			addr:    "/var/run/datadog/dsd.socket",
+		},
+
+		{
+			address: "unix:///var/run/datadog/dsd.socket",
+			network: "unix",
+			addr:    "/var/run/datadog/dsd.socket",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			network, addr := splitNetworkAddress(test.address)
+
+			if network != test.network {
+				t.Error("bad network:", network)
+			}
+
+			if addr != test.addr {
+				t.Error("bad address:", addr)
+			}
+		})
+	}
+}
+
+func TestDialUnsupportedNetwork(t *testing.T) {
+	if _, err := Dial("tcp://localhost:8125"); err == nil {
+		t.Error("expected an error when dialing an unsupported network")
+	}
+}
+
+func TestConnUnixStream(t *testing.T) {
+	path, cleanup := tempSocketPath(t)
+	defer cleanup()
+
+	lstn, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lstn.Close()
+
+	conn, err := DialConfig(ConnConfig{Address: "unix://" + path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if n := cap(conn.b); n != DefaultUnixBufferSize {
+		t.Error("bad buffer size:", n)
+	}
+
+	server, err := lstn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	conn.Write([]byte("A:1|c\n"))
+	conn.Write([]byte("B:2|g\n"))
+	conn.Flush()
+
+	var size uint32
+	if err := binary.Read(server, binary.LittleEndian, &size); err != nil {
+		t.Fatal(err)
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(server, b); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := string(b); s != "A:1|c\nB:2|g\n" {
+		t.Errorf("bad message: %q", s)
+	}
+}
+
+func TestConnWrapConn(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	w := &countConn{}
+	conn, err := DialConfig(ConnConfig{
+		Address:  server.LocalAddr().String(),
+		WrapConn: func(c net.Conn) net.Conn { w.Conn = c; return w },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("A:1|c\n"))
+	conn.Flush()
+
+	if w.writes != 1 {
+		t.Error("bad number of writes to the wrapped connection:", w.writes)
+	}
+}
+
+type countConn struct {
+	net.Conn
+	writes int
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	c.writes++
+	return c.Conn.Write(b)
+}
+
+func tempSocketPath(t *testing.T) (path string, cleanup func()) {
+	dir, err := os.MkdirTemp("", "datadog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "dsd.socket"), func() { os.RemoveAll(dir) }
+}
@@ -0,0 +1,57 @@
+package datadog
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+// EventPriority is an enumeration of the priorities that can be set on datadog
+// events.
+type EventPriority string
+
+const (
+	EventPriorityNormal EventPriority = "normal"
+	EventPriorityLow    EventPriority = "low"
+)
+
+// EventAlertType is an enumeration of the alert types that can be set on
+// datadog events.
+type EventAlertType string
+
+const (
+	EventAlertError   EventAlertType = "error"
+	EventAlertWarning EventAlertType = "warning"
+	EventAlertInfo    EventAlertType = "info"
+	EventAlertSuccess EventAlertType = "success"
+)
+
+// The Event type is a representation of the events supported by datadog.
+//
+// Only the Title and Text fields are required, the other fields are omitted
+// from the dogstatsd representation of the event when they're zero-values.
+type Event struct {
+	Title          string         // the event title
+	Text           string         // the event text, may contain line breaks
+	Timestamp      time.Time      // the time at which the event occurred
+	Hostname       string         // the host name that the event is related to
+	AggregationKey string         // key used to group events together
+	Priority       EventPriority  // the event priority
+	SourceTypeName string         // the type of source that produced the event
+	AlertType      EventAlertType // the alert type of the event
+	Tags           []stats.Tag    // the list of tags set on the event
+}
+
+// String satisfies the fmt.Stringer interface.
+func (e Event) String() string {
+	return fmt.Sprint(e)
+}
+
+// Format satisfies the fmt.Formatter interface.
+func (e Event) Format(f fmt.State, _ rune) {
+	buf := bufferPool.Get().(*buffer)
+	buf.b = appendEvent(buf.b[:0], e)
+	f.Write(buf.b)
+	bufferPool.Put(buf)
+}
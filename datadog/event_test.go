@@ -0,0 +1,102 @@
+package datadog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+var testEvents = []struct {
+	s string
+	e Event
+}{
+	{
+		s: "_e{5,11}:hello|hello world\n",
+		e: Event{
+			Title: "hello",
+			Text:  "hello world",
+		},
+	},
+
+	{
+		s: "_e{13,14}:deploy\\nstart|line 1\\nline 2\n",
+		e: Event{
+			Title: "deploy\nstart",
+			Text:  "line 1\nline 2",
+		},
+	},
+
+	{
+		s: "_e{6,6}:deploy|v1.2.3|d:1500000000|h:host-1|k:deploys|p:low|s:git|t:success|#env:prod,service:api\n",
+		e: Event{
+			Title:          "deploy",
+			Text:           "v1.2.3",
+			Timestamp:      time.Unix(1500000000, 0),
+			Hostname:       "host-1",
+			AggregationKey: "deploys",
+			Priority:       EventPriorityLow,
+			SourceTypeName: "git",
+			AlertType:      EventAlertSuccess,
+			Tags:           []stats.Tag{{"env", "prod"}, {"service", "api"}},
+		},
+	},
+
+	{
+		s: "_e{7,7}:a|b|c:d|e|f|g:h|h:host-1\n",
+		e: Event{
+			Title:    "a|b|c:d",
+			Text:     "e|f|g:h",
+			Hostname: "host-1",
+		},
+	},
+}
+
+func TestAppendEvent(t *testing.T) {
+	for _, test := range testEvents {
+		t.Run(test.e.Title, func(t *testing.T) {
+			if s := string(appendEvent(nil, test.e)); s != test.s {
+				t.Errorf("\n<<< %#v\n>>> %#v", test.s, s)
+			}
+		})
+	}
+}
+
+func TestParseEventSuccess(t *testing.T) {
+	for _, test := range testEvents {
+		t.Run(test.s, func(t *testing.T) {
+			if e, err := parseEvent(test.s); err != nil {
+				t.Error(err)
+			} else if !reflect.DeepEqual(e, test.e) {
+				t.Errorf("%#v:\n- %#v\n- %#v", test.s, test.e, e)
+			}
+		})
+	}
+}
+
+func TestParseEventFailure(t *testing.T) {
+	tests := []string{
+		"",
+		"_e{}:|",              // missing lengths
+		"_e{1,x}:a|b",         // malformed text length
+		"_e{1,1:a|b",          // malformed header
+		"_e{2,1}:a|b",         // title longer than the datagram
+		"_e{1,2}:a|b",         // text longer than the datagram
+		"_e{1,1}:a|bc",        // text shorter than the datagram
+		"_e{1,1}:a|b|d:abc",   // malformed timestamp
+		"_e{1,1}:a|b|x:value", // unknown field
+		"_e{-1,1}:a|b",        // negative title length
+		"_e{1,-1}:a|b",        // negative text length
+		"_e{9223372036854775807,9223372036854775807}:a|b", // overflowing lengths
+		"_e{1,9223372036854775807}:a|b",                   // overflowing text length
+	}
+
+	for _, test := range tests {
+		t.Run(test, func(t *testing.T) {
+			if _, err := parseEvent(test); err == nil {
+				t.Errorf("%#v: expected parsing error", test)
+			}
+		})
+	}
+}
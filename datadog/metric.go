@@ -3,6 +3,7 @@ package datadog
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/segmentio/stats"
 )
@@ -12,20 +13,38 @@ import (
 type MetricType string
 
 const (
-	Counter   MetricType = "c"
-	Gauge     MetricType = "g"
-	Histogram MetricType = "h"
-	Unknown   MetricType = "?"
+	Counter      MetricType = "c"
+	Gauge        MetricType = "g"
+	Histogram    MetricType = "h"
+	Distribution MetricType = "d"
+	Timer        MetricType = "ms"
+	Set          MetricType = "s"
+	Unknown      MetricType = "?"
 )
 
 // The Metric type is a representation of the metrics supported by datadog.
+//
+// The ContainerID, Timestamp and Values fields are extensions introduced in
+// version 1.1 of the dogstatsd protocol, they are omitted from the serialized
+// representation of the metric when they're zero-values.
+//
+// Gauges with the Delta field set are serialized with an explicit sign on their
+// value, which tells the server to add it to the current value of the gauge
+// instead of replacing it. Negative values are always serialized with a '-'
+// sign, servers only treat them as decrements when they were configured to
+// (see Server.SignedGaugeDeltas), otherwise they set the gauge to the value.
 type Metric struct {
-	Type      MetricType  // the metric type
-	Namespace string      // the metric namespace (never populated by parsing operations)
-	Name      string      // the metric name
-	Value     float64     // the metric value
-	Rate      float64     // sample rate, a value between 0 and 1
-	Tags      []stats.Tag // the list of tags set on the metric
+	Type        MetricType  // the metric type
+	Namespace   string      // the metric namespace (never populated by parsing operations)
+	Name        string      // the metric name
+	Value       float64     // the metric value
+	Values      []float64   // all values of the metric when more than one were packed together
+	Delta       bool        // for gauges, whether the value is a change of the current value
+	Member      string      // for sets, the member when it isn't a number (Value is then ignored)
+	Rate        float64     // sample rate, a value between 0 and 1
+	Tags        []stats.Tag // the list of tags set on the metric
+	ContainerID string      // the identifier of the container that produced the metric
+	Timestamp   time.Time   // the time at which the metric was produced
 }
 
 // String satisfies the fmt.Stringer interface.
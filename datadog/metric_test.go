@@ -2,6 +2,7 @@ package datadog
 
 import (
 	"testing"
+	"time"
 
 	"github.com/segmentio/stats"
 )
@@ -119,6 +120,74 @@ var testMetrics = []struct {
 			Tags:  []stats.Tag{{"country", "china"}},
 		},
 	},
+
+	{
+		s: "request.latency:0.1:0.25:3|h|#path:/\n",
+		m: Metric{
+			Type:   Histogram,
+			Name:   "request.latency",
+			Value:  0.1,
+			Values: []float64{0.1, 0.25, 3},
+			Rate:   1,
+			Tags:   []stats.Tag{{"path", "/"}},
+		},
+	},
+
+	{
+		s: "requests.count:1|c|@0.5|#service:api|c:83c5e2a2f9b1|T1500000000\n",
+		m: Metric{
+			Type:        Counter,
+			Name:        "requests.count",
+			Value:       1,
+			Rate:        0.5,
+			Tags:        []stats.Tag{{"service", "api"}},
+			ContainerID: "83c5e2a2f9b1",
+			Timestamp:   time.Unix(1500000000, 0),
+		},
+	},
+
+	{
+		s: "queue.size:+2|g\n",
+		m: Metric{
+			Type:  Gauge,
+			Name:  "queue.size",
+			Value: 2,
+			Delta: true,
+			Rate:  1,
+		},
+	},
+
+	{
+		s: "queue.size:-0.5|g|#queue:jobs\n",
+		m: Metric{
+			Type:  Gauge,
+			Name:  "queue.size",
+			Value: -0.5,
+			Rate:  1,
+			Tags:  []stats.Tag{{"queue", "jobs"}},
+		},
+	},
+
+	{
+		s: "users:alice|s\n",
+		m: Metric{
+			Type:   Set,
+			Name:   "users",
+			Member: "alice",
+			Rate:   1,
+		},
+	},
+
+	{
+		s: "urls:http://example.com|s|#env:prod\n",
+		m: Metric{
+			Type:   Set,
+			Name:   "urls",
+			Member: "http://example.com",
+			Rate:   1,
+			Tags:   []stats.Tag{{"env", "prod"}},
+		},
+	},
 }
 
 func TestMetricString(t *testing.T) {
@@ -0,0 +1,97 @@
+package datadog
+
+import (
+	"sync"
+
+	"github.com/segmentio/stats"
+)
+
+// packer accumulates the values of histograms in order to pack them on a single
+// line, which is supported by dogstatsd since version 1.1 of the protocol and
+// cuts the amount of bandwidth used by programs producing many observations of
+// the same metric.
+type packer struct {
+	mutex sync.Mutex
+	lines map[string]*packedLine
+	limit int // maximum length of a line
+	key   []byte
+}
+
+// packedLine represents a line of packed values, the values are stored in
+// their serialized form (each prefixed with a ':' separator).
+type packedLine struct {
+	name   string
+	suffix string // type, rate and tags
+	values []byte
+}
+
+func newPacker(limit int) *packer {
+	return &packer{
+		lines: make(map[string]*packedLine),
+		limit: limit,
+	}
+}
+
+// add packs the value of m with the other values of the same metric. If the
+// line was full it is returned to the caller, which must write it before
+// calling add again.
+func (p *packer) add(m *stats.Metric, full []byte) []byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	k := p.key[:0]
+	if len(m.Namespace) != 0 {
+		k = append(k, m.Namespace...)
+		k = append(k, '.')
+	}
+	k = append(k, m.Name...)
+	n := len(k)
+	k = append(k, '|')
+	k = append(k, Histogram...)
+	k = appendMetricSuffix(k, 1, m.Tags)
+	k = append(k, '\n')
+	p.key = k
+
+	line := p.lines[string(k)]
+
+	if line == nil {
+		line = &packedLine{
+			name:   string(k[:n]),
+			suffix: string(k[n:]),
+		}
+		p.lines[string(k)] = line
+	}
+
+	size := len(line.values)
+	line.values = appendValue(line.values, m.Value)
+
+	if size != 0 && len(line.name)+len(line.values)+len(line.suffix) > p.limit {
+		// The new value doesn't fit, the line is returned with the values
+		// it had before and restarted with only the new value.
+		full = line.append(full, line.values[:size])
+		line.values = line.values[:copy(line.values, line.values[size:])]
+	}
+
+	return full
+}
+
+// flush passes all the lines of packed values to write and resets the packer.
+func (p *packer) flush(write func([]byte)) {
+	buf := bufferPool.Get().(*buffer)
+	p.mutex.Lock()
+
+	for k, line := range p.lines {
+		buf.b = line.append(buf.b[:0], line.values)
+		write(buf.b)
+		delete(p.lines, k)
+	}
+
+	p.mutex.Unlock()
+	bufferPool.Put(buf)
+}
+
+func (line *packedLine) append(b []byte, values []byte) []byte {
+	b = append(b, line.name...)
+	b = append(b, values...)
+	return append(b, line.suffix...)
+}
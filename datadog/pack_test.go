@@ -0,0 +1,121 @@
+package datadog
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+func TestPacker(t *testing.T) {
+	p := newPacker(30)
+	m := &stats.Metric{
+		Type:      stats.HistogramType,
+		Namespace: "test",
+		Name:      "H",
+		Tags:      []stats.Tag{{"a", "b"}},
+	}
+
+	var lines []string
+
+	for _, v := range []float64{1, 2, 3, 4, 5, 6, 7, 8, 9} {
+		m.Value = v
+		if full := p.add(m, nil); len(full) != 0 {
+			lines = append(lines, string(full))
+		}
+	}
+
+	p.flush(func(b []byte) { lines = append(lines, string(b)) })
+
+	expected := []string{
+		"test.H:1:2:3:4:5:6:7:8|h|#a:b\n",
+		"test.H:9|h|#a:b\n",
+	}
+
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("bad lines:\n- %q\n- %q", expected, lines)
+	}
+
+	if len(p.lines) != 0 {
+		t.Error("the packer was not reset after being flushed")
+	}
+}
+
+func TestClientPackHistograms(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := NewClientWith(ClientConfig{
+		Address:        conn.LocalAddr().String(),
+		FlushInterval:  -1,
+		PackHistograms: true,
+	})
+	defer client.Close()
+
+	engine := stats.NewEngine("datadog.test")
+	engine.Register(client)
+	engine.Observe("H", 1)
+	engine.Observe("H", 2)
+	engine.Observe("H", 3)
+	engine.Observe("H", 4, stats.Tag{"a", "b"})
+	engine.Incr("C")
+	engine.Flush()
+
+	b := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(string(b[:n]), "\n"), "\n")
+	sort.Strings(lines)
+
+	expected := []string{
+		"datadog.test.C:1|c",
+		"datadog.test.H:1:2:3|h",
+		"datadog.test.H:4|h|#a:b",
+	}
+
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("bad datagram:\n- %q\n- %q", expected, lines)
+	}
+}
+
+func TestServerPackedValues(t *testing.T) {
+	values := make(chan float64, 3)
+	addr, closer := startTestServer(t, HandlerFunc(func(m Metric, _ net.Addr) {
+		if m.Values != nil {
+			t.Error("packed values were not expanded:", m)
+		}
+		values <- m.Value
+	}))
+	defer closer.Close()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("H:1:2:3|h\n"))
+
+	for _, expected := range []float64{1, 2, 3} {
+		select {
+		case v := <-values:
+			if v != expected {
+				t.Errorf("bad value: %g != %g", expected, v)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for packed values")
+		}
+	}
+}
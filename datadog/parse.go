@@ -4,22 +4,45 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/segmentio/stats"
 )
 
-func parseMetric(s string) (m Metric, err error) {
+func parseMetric(s string) (Metric, error) {
+	var p metricParser
+	return p.parse(s)
+}
+
+// metricParser parses metrics while reusing the memory of the tags and values
+// of the previous metrics it parsed, which makes it possible to parse metrics
+// without allocating memory on the heap.
+//
+// The Tags and Values fields of the metrics returned by a parser share their
+// backing arrays, they are only valid until the parser is reset.
+//
+// Only gauge values with a leading '+' are parsed as deltas, unless
+// signedDeltas is set, in which case a leading '-' also marks a delta.
+type metricParser struct {
+	tags         []stats.Tag
+	values       []float64
+	signedDeltas bool
+}
+
+func (p *metricParser) reset() {
+	p.tags = p.tags[:0]
+	p.values = p.values[:0]
+}
+
+func (p *metricParser) parse(s string) (m Metric, err error) {
 	var next = strings.TrimSpace(s)
 	var name string
 	var val string
 	var typ string
-	var rate string
-	var tags string
 
 	val, next = nextToken(next, '|')
 	typ, next = nextToken(next, '|')
-	rate, tags = nextToken(next, '|')
-	name, val = split(val, ':')
+	name, val = nextToken(val, ':')
 
 	if len(name) == 0 {
 		err = fmt.Errorf("datadog: %#v is missing a metric name", s)
@@ -36,70 +59,285 @@ func parseMetric(s string) (m Metric, err error) {
 		return
 	}
 
-	if len(rate) != 0 {
-		switch rate[0] {
-		case '#': // no sample rate, just tags
-			rate, tags = "", rate
-		case '@':
-			rate = rate[1:]
-		default:
-			err = fmt.Errorf("datadog: %#v has a malformed sample rate", s)
-			return
+	m = Metric{
+		Type: MetricType(typ),
+		Name: name,
+		Rate: 1,
+	}
+
+	if m.Type == Set && !maybeNumber(val) {
+		// Set members are arbitrary strings, they are detected before parsing
+		// the value to avoid allocating a parsing error.
+		m.Member = val
+	} else if strings.IndexByte(val, ':') < 0 {
+		if m.Value, err = strconv.ParseFloat(val, 64); err != nil {
+			if m.Type != Set {
+				err = fmt.Errorf("datadog: %#v has a malformed value", s)
+				return
+			}
+			m.Value, m.Member, err = 0, val, nil
+		}
+		m.Delta = m.Type == Gauge && (val[0] == '+' || (val[0] == '-' && p.signedDeltas))
+	} else {
+		// Multiple values packed on the same line (dogstatsd v1.1).
+		start := len(p.values)
+		packed := val
+
+		for {
+			var v = val
+			var f float64
+			var i = strings.IndexByte(val, ':')
+
+			if i >= 0 {
+				v, val = val[:i], val[i+1:]
+			}
+
+			if f, err = strconv.ParseFloat(v, 64); err != nil {
+				if m.Type != Set {
+					err = fmt.Errorf("datadog: %#v has a malformed value", s)
+					return
+				}
+				// A set member which isn't a number and contains ':'.
+				p.values = p.values[:start]
+				m.Member, err = packed, nil
+				break
+			}
+
+			if p.values = append(p.values, f); i < 0 {
+				break
+			}
+		}
+
+		if len(m.Member) == 0 {
+			m.Values = p.values[start:len(p.values):len(p.values)]
+			m.Value = m.Values[0]
 		}
 	}
 
-	if len(tags) != 0 {
-		switch tags[0] {
-		case '#':
-			tags = tags[1:]
+	for len(next) != 0 {
+		var field string
+
+		if field, next = nextToken(next, '|'); len(field) == 0 {
+			continue
+		}
+
+		switch {
+		case field[0] == '@':
+			if m.Rate, err = strconv.ParseFloat(field[1:], 64); err != nil {
+				err = fmt.Errorf("datadog: %#v has a malformed sample rate", s)
+				return
+			}
+			if m.Rate == 0 {
+				m.Rate = 1
+			}
+		case field[0] == '#':
+			start := len(p.tags)
+			p.tags = appendParsedTags(p.tags, field[1:])
+			m.Tags = p.tags[start:len(p.tags):len(p.tags)]
+		case strings.HasPrefix(field, "c:"):
+			m.ContainerID = field[2:]
+		case field[0] == 'T':
+			if m.Timestamp, err = parseTimestamp(field[1:]); err != nil {
+				err = fmt.Errorf("datadog: %#v has a malformed timestamp", s)
+				return
+			}
 		default:
-			err = fmt.Errorf("datadog: %#v has malformed tags", s)
+			err = fmt.Errorf("datadog: %#v has a malformed field: %#v", s, field)
 			return
 		}
 	}
 
-	var value float64
-	var sampleRate float64
+	return
+}
+
+// maybeNumber returns false if s can't be parsed by strconv.ParseFloat, which
+// is based on its first byte only.
+func maybeNumber(s string) bool {
+	switch c := s[0]; {
+	case c >= '0' && c <= '9':
+	case c == '+' || c == '-' || c == '.':
+	case c == 'i' || c == 'I' || c == 'n' || c == 'N': // inf and nan
+	default:
+		return false
+	}
+	return true
+}
+
+func parseEvent(s string) (e Event, err error) {
+	var next = strings.TrimSpace(s)
+	var header string
+	var titleLen int
+	var textLen int
+
+	if !strings.HasPrefix(next, "_e{") {
+		err = fmt.Errorf("datadog: %#v is not an event", s)
+		return
+	}
+
+	if header, next = nextToken(next[3:], ':'); !strings.HasSuffix(header, "}") {
+		err = fmt.Errorf("datadog: %#v has a malformed event header", s)
+		return
+	}
+
+	titleLenStr, textLenStr := split(header[:len(header)-1], ',')
+
+	if titleLen, err = strconv.Atoi(titleLenStr); err != nil || titleLen < 0 {
+		err = fmt.Errorf("datadog: %#v has a malformed event title length", s)
+		return
+	}
 
-	if value, err = strconv.ParseFloat(val, 64); err != nil {
-		err = fmt.Errorf("datadog: %#v has a malformed value", s)
+	if textLen, err = strconv.Atoi(textLenStr); err != nil || textLen < 0 {
+		err = fmt.Errorf("datadog: %#v has a malformed event text length", s)
 		return
 	}
 
-	if len(rate) != 0 {
-		if sampleRate, err = strconv.ParseFloat(rate, 64); err != nil {
-			err = fmt.Errorf("datadog: %#v has a malformed sample rate", s)
+	// The lengths are compared one at a time so huge values in the header
+	// cannot overflow when added.
+	if titleLen >= len(next) || textLen > len(next)-titleLen-1 || next[titleLen] != '|' {
+		err = fmt.Errorf("datadog: %#v has an event title or text that doesn't match the header", s)
+		return
+	}
+
+	e.Title = unescapeEventText(next[:titleLen])
+	e.Text = unescapeEventText(next[titleLen+1 : titleLen+1+textLen])
+	next = next[titleLen+1+textLen:]
+
+	if len(next) != 0 {
+		if next[0] != '|' {
+			err = fmt.Errorf("datadog: %#v has an event text that doesn't match the header", s)
 			return
 		}
+		next = next[1:]
 	}
 
-	if sampleRate == 0 {
-		sampleRate = 1
+	for len(next) != 0 {
+		var field string
+
+		if field, next = nextToken(next, '|'); len(field) == 0 {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(field, "d:"):
+			if e.Timestamp, err = parseTimestamp(field[2:]); err != nil {
+				err = fmt.Errorf("datadog: %#v has a malformed event timestamp", s)
+				return
+			}
+		case strings.HasPrefix(field, "h:"):
+			e.Hostname = field[2:]
+		case strings.HasPrefix(field, "k:"):
+			e.AggregationKey = field[2:]
+		case strings.HasPrefix(field, "p:"):
+			e.Priority = EventPriority(field[2:])
+		case strings.HasPrefix(field, "s:"):
+			e.SourceTypeName = field[2:]
+		case strings.HasPrefix(field, "t:"):
+			e.AlertType = EventAlertType(field[2:])
+		case field[0] == '#':
+			e.Tags = parseTags(field[1:])
+		default:
+			err = fmt.Errorf("datadog: %#v has an unknown event field: %#v", s, field)
+			return
+		}
 	}
 
-	m = Metric{
-		Type:  MetricType(typ),
-		Name:  name,
-		Value: value,
-		Rate:  sampleRate,
+	return
+}
+
+func parseServiceCheck(s string) (sc ServiceCheck, err error) {
+	var next = strings.TrimSpace(s)
+	var status string
+
+	if !strings.HasPrefix(next, "_sc|") {
+		err = fmt.Errorf("datadog: %#v is not a service check", s)
+		return
+	}
+
+	sc.Name, next = nextToken(next[4:], '|')
+	status, next = nextToken(next, '|')
+
+	if len(sc.Name) == 0 {
+		err = fmt.Errorf("datadog: %#v is missing a service check name", s)
+		return
 	}
 
-	if len(tags) != 0 {
-		m.Tags = make([]stats.Tag, 0, count(tags, ',')+1)
+	switch status {
+	case "0", "1", "2", "3":
+		sc.Status = ServiceCheckStatus(status[0] - '0')
+	default:
+		err = fmt.Errorf("datadog: %#v has a malformed service check status", s)
+		return
+	}
 
-		for len(tags) != 0 {
-			var tag string
+	for len(next) != 0 {
+		var field string
 
-			if tag, tags = nextToken(tags, ','); len(tag) != 0 {
-				name, value := split(tag, ':')
-				m.Tags = append(m.Tags, stats.Tag{name, value})
+		// The message is always the last field and may contain '|'.
+		if strings.HasPrefix(next, "m:") {
+			sc.Message = unescapeServiceCheckMessage(next[2:])
+			break
+		}
+
+		if field, next = nextToken(next, '|'); len(field) == 0 {
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(field, "d:"):
+			if sc.Timestamp, err = parseTimestamp(field[2:]); err != nil {
+				err = fmt.Errorf("datadog: %#v has a malformed service check timestamp", s)
+				return
 			}
+		case strings.HasPrefix(field, "h:"):
+			sc.Hostname = field[2:]
+		case field[0] == '#':
+			sc.Tags = parseTags(field[1:])
+		default:
+			err = fmt.Errorf("datadog: %#v has an unknown service check field: %#v", s, field)
+			return
 		}
 	}
 
 	return
 }
 
+func parseTimestamp(s string) (t time.Time, err error) {
+	var sec int64
+	if sec, err = strconv.ParseInt(s, 10, 64); err == nil {
+		t = time.Unix(sec, 0)
+	}
+	return
+}
+
+func parseTags(s string) []stats.Tag {
+	return appendParsedTags(make([]stats.Tag, 0, count(s, ',')+1), s)
+}
+
+func appendParsedTags(tags []stats.Tag, s string) []stats.Tag {
+	for len(s) != 0 {
+		var tag string
+
+		if tag, s = nextToken(s, ','); len(tag) != 0 {
+			name, value := split(tag, ':')
+			tags = append(tags, stats.Tag{name, value})
+		}
+	}
+
+	return tags
+}
+
+var eventTextUnescaper = strings.NewReplacer("\\n", "\n")
+
+func unescapeEventText(s string) string {
+	return eventTextUnescaper.Replace(s)
+}
+
+var serviceCheckMessageUnescaper = strings.NewReplacer("\\n", "\n", "m\\:", "m:")
+
+func unescapeServiceCheckMessage(s string) string {
+	return serviceCheckMessageUnescaper.Replace(s)
+}
+
 func nextToken(s string, b byte) (token string, next string) {
 	if off := strings.IndexByte(s, b); off >= 0 {
 		token, next = s[:off], s[off+1:]
@@ -28,6 +28,9 @@ func TestParseMetricFailure(t *testing.T) {
 		"name:1|c|???",      // malformed sample rate
 		"name:1|c|@abc",     // malformed sample rate
 		"name:1|c|@0.5|???", // malformed tags
+		"name:1:x|h",        // malformed packed value
+		"name:1:|h",         // empty packed value
+		"name:1|c|Tabc",     // malformed timestamp
 	}
 
 	for _, test := range tests {
@@ -39,6 +42,43 @@ func TestParseMetricFailure(t *testing.T) {
 	}
 }
 
+func TestParseSignedGaugeDeltas(t *testing.T) {
+	tests := []struct {
+		s            string
+		signedDeltas bool
+		delta        bool
+	}{
+		{"queue.size:-2|g", false, false},
+		{"queue.size:-2|g", true, true},
+		{"queue.size:+2|g", false, true},
+		{"queue.size:2|g", true, false},
+		{"requests:-2|c", true, false},
+	}
+
+	for _, test := range tests {
+		p := metricParser{signedDeltas: test.signedDeltas}
+
+		if m, err := p.parse(test.s); err != nil {
+			t.Error(err)
+		} else if m.Delta != test.delta {
+			t.Errorf("%#v (signed deltas: %t): expected delta=%t", test.s, test.signedDeltas, test.delta)
+		}
+	}
+}
+
+func TestMetricParserAllocs(t *testing.T) {
+	var p metricParser
+
+	for _, test := range testMetrics {
+		if n := testing.AllocsPerRun(100, func() {
+			p.reset()
+			p.parse(test.s)
+		}); n != 0 {
+			t.Errorf("%#v: %g allocations", test.s, n)
+		}
+	}
+}
+
 func BenchmarkParseMetric(b *testing.B) {
 	for _, test := range testMetrics {
 		b.Run(test.m.Name, func(b *testing.B) {
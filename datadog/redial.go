@@ -0,0 +1,368 @@
+package datadog
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// redialConn is the net.Conn implementation used by clients to send datagrams
+// to a dogstatsd server.
+//
+// When a write fails the connection is closed and re-established in the
+// background, with an exponential backoff between attempts. Datagrams that
+// couldn't be sent in the meantime are kept in a bounded queue and retried once
+// the connection is back, the oldest datagrams are dropped when the queue is
+// full.
+//
+// The address is also resolved periodically so the connection follows DNS
+// changes, which is a common situation when the agent is restarted on a
+// different host.
+type redialConn struct {
+	// Counters updated with atomic operations, placed first to guarantee 64
+	// bits alignment on 32 bits platforms.
+	stats ClientStats
+
+	// immutable
+	network         string
+	address         string
+	sizehint        int
+	queueSize       int
+	minBackoff      time.Duration
+	maxBackoff      time.Duration
+	resolveInterval time.Duration
+
+	// mutable, synchronized on mutex
+	mutex sync.Mutex
+	conn  net.Conn
+	queue [][]byte
+
+	lost chan struct{}
+	done chan struct{}
+	join chan struct{}
+	once sync.Once
+}
+
+func newRedialConn(network string, address string, config ClientConfig) (c *redialConn, bufsize int, err error) {
+	c = &redialConn{
+		network:         network,
+		address:         address,
+		sizehint:        config.BufferSize,
+		queueSize:       config.RetryQueueSize,
+		minBackoff:      config.ReconnectBackoff,
+		maxBackoff:      config.MaxReconnectBackoff,
+		resolveInterval: config.ResolveInterval,
+		lost:            make(chan struct{}, 1),
+		done:            make(chan struct{}),
+		join:            make(chan struct{}),
+	}
+
+	if c.conn, bufsize, err = dial(network, address, config.BufferSize); err != nil {
+		// The buffer size can only be negotiated with the kernel once the
+		// socket exists, we fallback to using the size hint for datagrams
+		// produced until the connection is established.
+		if bufsize = config.BufferSize; bufsize > MaxBufferSize && network != "unix" {
+			bufsize = MaxBufferSize
+		}
+		atomic.AddUint64(&c.stats.Errors, 1)
+		c.lost <- struct{}{}
+	}
+
+	go c.run()
+	return
+}
+
+// Stats returns a snapshot of the counters of c.
+func (c *redialConn) Stats() ClientStats {
+	return ClientStats{
+		Sent:       atomic.LoadUint64(&c.stats.Sent),
+		Dropped:    atomic.LoadUint64(&c.stats.Dropped),
+		Errors:     atomic.LoadUint64(&c.stats.Errors),
+		Reconnects: atomic.LoadUint64(&c.stats.Reconnects),
+	}
+}
+
+// Close satisfies the net.Conn interface.
+func (c *redialConn) Close() (err error) {
+	c.once.Do(func() {
+		close(c.done)
+		<-c.join
+
+		c.mutex.Lock()
+		if c.conn != nil {
+			err = c.conn.Close()
+			c.conn = nil
+		}
+		atomic.AddUint64(&c.stats.Dropped, uint64(len(c.queue)))
+		c.queue = nil
+		c.mutex.Unlock()
+	})
+	return
+}
+
+// Read satisfies the net.Conn interface.
+func (c *redialConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+// Write satisfies the net.Conn interface.
+//
+// The method never returns an error, if the datagram couldn't be sent it is
+// queued to be retried after the connection has been re-established.
+//
+// The datagram is written without holding the mutex, so a write blocking on a
+// full socket buffer doesn't stall the other goroutines, nor the background
+// goroutine which needs the mutex to replace the connection.
+func (c *redialConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	conn := c.conn
+
+	if conn == nil || len(c.queue) != 0 {
+		c.enqueue(b)
+		c.mutex.Unlock()
+		return len(b), nil
+	}
+
+	c.mutex.Unlock()
+
+	_, err := conn.Write(b)
+	if err == nil {
+		atomic.AddUint64(&c.stats.Sent, 1)
+		return len(b), nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn == conn {
+		c.lose(err)
+	} else if c.conn != nil && len(c.queue) == 0 && c.send(b) {
+		// The connection was replaced while the datagram was written to
+		// the previous one, it was sent on the new connection.
+		return len(b), nil
+	}
+
+	c.enqueue(b)
+	return len(b), nil
+}
+
+// LocalAddr satisfies the net.Conn interface.
+func (c *redialConn) LocalAddr() net.Addr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn != nil {
+		return c.conn.LocalAddr()
+	}
+
+	return redialAddr{}
+}
+
+// RemoteAddr satisfies the net.Conn interface.
+func (c *redialConn) RemoteAddr() net.Addr {
+	return redialAddr{network: c.network, address: c.address}
+}
+
+// SetDeadline satisfies the net.Conn interface, deadlines are not supported.
+func (c *redialConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline satisfies the net.Conn interface, deadlines are not
+// supported.
+func (c *redialConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline satisfies the net.Conn interface, deadlines are not
+// supported.
+func (c *redialConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// send writes b to the connection, returning false and closing the connection
+// if it failed. The mutex must be held by the caller.
+func (c *redialConn) send(b []byte) bool {
+	if _, err := c.conn.Write(b); err != nil {
+		c.lose(err)
+		return false
+	}
+
+	atomic.AddUint64(&c.stats.Sent, 1)
+	return true
+}
+
+// lose closes the connection after a write failed with err, and notifies the
+// background goroutine that it must be re-established. The mutex must be held
+// by the caller.
+func (c *redialConn) lose(err error) {
+	log.Printf("stats/datadog: connection to %s lost: %s", c.address, err)
+	atomic.AddUint64(&c.stats.Errors, 1)
+	c.conn.Close()
+	c.conn = nil
+
+	select {
+	case c.lost <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue adds a copy of b to the retry queue, dropping the oldest datagram if
+// the queue is full. The mutex must be held by the caller.
+func (c *redialConn) enqueue(b []byte) {
+	var buf []byte
+
+	if len(c.queue) >= c.queueSize {
+		if c.queueSize <= 0 {
+			atomic.AddUint64(&c.stats.Dropped, 1)
+			return
+		}
+		buf = c.queue[0][:0]
+		copy(c.queue, c.queue[1:])
+		c.queue = c.queue[:len(c.queue)-1]
+		atomic.AddUint64(&c.stats.Dropped, 1)
+	}
+
+	c.queue = append(c.queue, append(buf, b...))
+}
+
+// drain sends the datagrams of the retry queue, stopping on the first failure.
+// The mutex must be held by the caller, it is kept for the whole drain so that
+// the queued datagrams are sent before the ones written in the meantime.
+func (c *redialConn) drain() {
+	i := 0
+
+	for i != len(c.queue) && c.conn != nil && c.send(c.queue[i]) {
+		c.queue[i] = nil
+		i++
+	}
+
+	c.queue = c.queue[:copy(c.queue, c.queue[i:])]
+}
+
+func (c *redialConn) run() {
+	defer close(c.join)
+
+	ticker := time.NewTicker(c.resolveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+
+		case <-c.lost:
+			if !c.reconnect() {
+				return
+			}
+
+		case <-ticker.C:
+			if c.addressChanged() {
+				c.redial()
+			}
+		}
+	}
+}
+
+// reconnect attempts to re-establish the connection until it succeeds or the
+// connection is closed, in which case the method returns false.
+func (c *redialConn) reconnect() bool {
+	backoff := c.minBackoff
+
+	for {
+		timer := time.NewTimer(backoff)
+
+		select {
+		case <-c.done:
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+
+		if c.redial() {
+			return true
+		}
+
+		if backoff *= 2; backoff > c.maxBackoff {
+			backoff = c.maxBackoff
+		}
+	}
+}
+
+// redial opens a new connection to replace the current one, returning true if
+// it succeeded.
+func (c *redialConn) redial() bool {
+	conn, _, err := dial(c.network, c.address, c.sizehint)
+
+	if err != nil {
+		atomic.AddUint64(&c.stats.Errors, 1)
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.conn != nil {
+		c.conn.Close()
+	}
+
+	log.Printf("stats/datadog: connection to %s re-established", c.address)
+	atomic.AddUint64(&c.stats.Reconnects, 1)
+	c.conn = conn
+	c.drain()
+	return c.conn != nil
+}
+
+// addressChanged resolves the host name of the address the connection was
+// opened to, and returns true if the remote IP address is not part of the
+// resolved addresses anymore.
+func (c *redialConn) addressChanged() bool {
+	switch c.network {
+	case "udp", "udp4", "udp6":
+	default:
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(c.address)
+	if err != nil || net.ParseIP(host) != nil {
+		return false
+	}
+
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return false
+	}
+
+	c.mutex.Lock()
+	conn := c.conn
+	c.mutex.Unlock()
+
+	if conn == nil {
+		return false
+	}
+
+	remote, ok := conn.RemoteAddr().(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, addr := range addrs {
+		if remote.IP.Equal(net.ParseIP(addr)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+type redialAddr struct {
+	network string
+	address string
+}
+
+func (a redialAddr) Network() string { return a.network }
+
+func (a redialAddr) String() string { return a.address }
@@ -0,0 +1,195 @@
+package datadog
+
+import (
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+func TestClientReconnect(t *testing.T) {
+	path, cleanup := tempSocketPath(t)
+	defer cleanup()
+
+	var n uint32
+	handler := HandlerFunc(func(m Metric, _ net.Addr) {
+		atomic.AddUint32(&n, uint32(m.Value))
+	})
+
+	server := listenUnixgram(t, path)
+	go Serve(server, handler)
+
+	client := NewClientWith(ClientConfig{
+		Address:          "unixgram://" + path,
+		ReconnectBackoff: 10 * time.Millisecond,
+	})
+	defer client.Close()
+
+	engine := stats.NewEngine("datadog.test")
+	engine.Register(client)
+	engine.Add("A", 1)
+	engine.Flush()
+
+	// Wait for the server to receive the first metric before closing it.
+	if !waitUntil(func() bool { return atomic.LoadUint32(&n) == 1 }) {
+		t.Fatal("the server did not receive the first metric")
+	}
+
+	// Restart the server, the client should lose its connection, queue the
+	// metrics it could not send, and flush them after reconnecting.
+	server.Close()
+	os.Remove(path)
+
+	engine.Add("A", 2)
+	engine.Flush()
+
+	server = listenUnixgram(t, path)
+	defer server.Close()
+	go Serve(server, handler)
+
+	engine.Add("A", 3)
+	engine.Flush()
+
+	// Wait for the client to reconnect and the server to receive the metrics.
+	waitUntil(func() bool { return atomic.LoadUint32(&n) == 6 })
+
+	if n := atomic.LoadUint32(&n); n != 6 {
+		t.Error("datadog.test.A: bad value:", n)
+	}
+
+	s := client.Stats()
+
+	if s.Reconnects == 0 {
+		t.Error("the client did not reconnect")
+	}
+
+	if s.Errors == 0 {
+		t.Error("the client did not report errors")
+	}
+
+	if s.Dropped != 0 {
+		t.Error("the client dropped datagrams:", s.Dropped)
+	}
+
+	if s.Sent != 3 {
+		t.Error("bad number of datagrams sent:", s.Sent)
+	}
+}
+
+func TestClientRetryQueueFull(t *testing.T) {
+	path, cleanup := tempSocketPath(t)
+	defer cleanup()
+
+	client := NewClientWith(ClientConfig{
+		Address:          "unixgram://" + path,
+		RetryQueueSize:   2,
+		ReconnectBackoff: time.Hour,
+	})
+	defer client.Close()
+
+	engine := stats.NewEngine("datadog.test")
+	engine.Register(client)
+
+	for i := 0; i != 5; i++ {
+		engine.Add("A", 1)
+		engine.Flush()
+	}
+
+	s := client.Stats()
+
+	if s.Dropped != 3 {
+		t.Error("bad number of dropped datagrams:", s.Dropped)
+	}
+
+	if s.Errors != 1 {
+		t.Error("bad number of errors:", s.Errors)
+	}
+
+	if s.Sent != 0 {
+		t.Error("bad number of datagrams sent:", s.Sent)
+	}
+}
+
+func TestClientReportStats(t *testing.T) {
+	path, cleanup := tempSocketPath(t)
+	defer cleanup()
+
+	server := listenUnixgram(t, path)
+	defer server.Close()
+	go Serve(server, HandlerFunc(func(Metric, net.Addr) {}))
+
+	client := NewClient("unixgram://" + path)
+	defer client.Close()
+
+	reported := map[string]float64{}
+	eng := stats.NewEngine("test")
+	eng.Register(stats.HandlerFunc(func(m *stats.Metric) {
+		reported[m.Name] += m.Value
+	}))
+
+	client.conn.Write([]byte("A:1|c\n"))
+	client.Flush()
+	client.ReportStats(eng)
+
+	client.conn.Write([]byte("A:1|c\n"))
+	client.Flush()
+	client.ReportStats(eng)
+
+	if n := reported["datadog.client.sent"]; n != 2 {
+		t.Error("bad number of datagrams reported as sent:", n)
+	}
+
+	for _, name := range []string{"datadog.client.dropped", "datadog.client.errors", "datadog.client.reconnects"} {
+		if n, ok := reported[name]; !ok || n != 0 {
+			t.Errorf("bad value reported for %s: %g", name, n)
+		}
+	}
+}
+
+func TestRedialConnWriteDoesNotHoldMutex(t *testing.T) {
+	conn := &blockingConn{writing: make(chan struct{}), release: make(chan struct{})}
+	c := &redialConn{conn: conn, lost: make(chan struct{}, 1)}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Write([]byte("A:1|c\n"))
+	}()
+
+	// Wait for the write to be blocked on the connection, the mutex must be
+	// available to the other goroutines in the meantime.
+	<-conn.writing
+	c.mutex.Lock()
+	c.mutex.Unlock()
+
+	close(conn.release)
+	<-done
+
+	if s := c.Stats(); s.Sent != 1 {
+		t.Error("bad number of datagrams sent:", s.Sent)
+	}
+}
+
+// blockingConn is a net.Conn which blocks writes until release is closed.
+type blockingConn struct {
+	net.Conn
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingConn) Write(b []byte) (int, error) {
+	close(c.writing)
+	<-c.release
+	return len(b), nil
+}
+
+func listenUnixgram(t *testing.T, path string) *net.UnixConn {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
@@ -1,10 +1,14 @@
 package datadog
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"io"
 	"net"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,34 +29,128 @@ func (f HandlerFunc) HandleMetric(m Metric, a net.Addr) {
 	f(m, a)
 }
 
-// ListenAndServe starts a new dogstatsd server, listening for UDP datagrams on
-// addr and forwarding the metrics to handler.
-func ListenAndServe(addr string, handler Handler) (err error) {
-	var conn net.PacketConn
+// EventHandler is an interface that may be implemented by the handlers of
+// dogstatsd servers to receive events.
+//
+// Events received by a server with a handler that doesn't implement this
+// interface are discarded.
+type EventHandler interface {
+	// HandleEvent is called when a dogstatsd server receives an event.
+	// The method receives the event and the address from which it was sent.
+	HandleEvent(Event, net.Addr)
+}
 
-	if conn, err = net.ListenPacket("udp", addr); err != nil {
-		return
-	}
+// BatchHandler is an interface that may be implemented by the handlers of
+// dogstatsd servers to receive all the metrics of a datagram in a single call,
+// instead of having HandleMetric called for each of them.
+type BatchHandler interface {
+	// HandleMetrics is called when a dogstatsd server receives a datagram
+	// containing metrics. The slice, and the Tags and Values fields of the
+	// metrics, are only valid until the method returns, which lets the server
+	// parse datagrams without allocating memory for each metric.
+	HandleMetrics([]Metric, net.Addr)
+}
 
-	err = Serve(conn, handler)
-	return
+// ServiceCheckHandler is an interface that may be implemented by the handlers
+// of dogstatsd servers to receive service checks.
+//
+// Service checks received by a server with a handler that doesn't implement
+// this interface are discarded.
+type ServiceCheckHandler interface {
+	// HandleServiceCheck is called when a dogstatsd server receives a service
+	// check. The method receives the service check and the address from which
+	// it was sent.
+	HandleServiceCheck(ServiceCheck, net.Addr)
 }
 
-// Serve runs a dogstatsd server, listening for datagrams on conn and forwarding
-// the metrics to handler.
-func Serve(conn net.PacketConn, handler Handler) (err error) {
+// ErrServerClosed is returned by the Serve and ListenAndServe methods of Server
+// after a call to Shutdown.
+var ErrServerClosed = errors.New("datadog: server closed")
+
+// ServerStats carries the counters maintained by a dogstatsd server.
+type ServerStats struct {
+	Packets     uint64 // datagrams received
+	Bytes       uint64 // bytes received
+	Lines       uint64 // lines (metrics, events and service checks) received
+	ParseErrors uint64 // lines that could not be parsed
+}
+
+// Server is a dogstatsd server, the zero-value is a valid server that discards
+// what it receives.
+type Server struct {
+	// Counters updated with atomic operations, placed first to guarantee 64
+	// bits alignment on 32 bits platforms.
+	stats ServerStats
+
+	// Handler is the handler that the server passes the metrics it receives
+	// to. It may also implement the BatchHandler, EventHandler and
+	// ServiceCheckHandler interfaces.
+	Handler Handler
+
+	// Concurrency is the number of goroutines reading datagrams from each
+	// connection served by the server, GOMAXPROCS is used when zero.
+	Concurrency int
+
+	// ReadBufferSize is the size of the receive buffer of the sockets served
+	// by the server, the system default is used when zero.
+	ReadBufferSize int
+
+	// SignedGaugeDeltas makes the server parse gauge values with a leading
+	// '-' as decrements, the way statsd does. By default only a leading '+'
+	// marks a delta, because clients like Client send negative gauge values
+	// to set the gauge.
+	SignedGaugeDeltas bool
+
+	mutex    sync.Mutex
+	conns    map[net.PacketConn]struct{}
+	serving  sync.WaitGroup
+	shutdown bool
+}
+
+// ListenAndServe listens for datagrams on addr and forwards the metrics to the
+// server handler. The method always returns a non-nil error, ErrServerClosed
+// after the server was shut down.
+//
+// The address may be prefixed with "unixgram://" to listen for datagrams on a
+// unix socket instead.
+func (s *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket(splitNetworkAddress(addr))
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// Serve runs the server on conn, which is closed when the method returns.
+//
+// Metrics carrying multiple packed values are passed to the handler as one
+// metric per value.
+func (s *Server) Serve(conn net.PacketConn) (err error) {
 	defer conn.Close()
 
-	concurrency := runtime.GOMAXPROCS(-1)
+	if !s.track(conn) {
+		return ErrServerClosed
+	}
+	defer s.untrack(conn)
+
+	if s.ReadBufferSize > 0 {
+		if c, ok := conn.(interface {
+			SetReadBuffer(int) error
+		}); ok {
+			c.SetReadBuffer(s.ReadBufferSize)
+		}
+	}
+
+	concurrency := s.Concurrency
 	if concurrency <= 0 {
-		concurrency = 1
+		concurrency = runtime.GOMAXPROCS(-1)
 	}
 
 	done := make(chan error, concurrency)
 	conn.SetDeadline(time.Time{})
 
 	for i := 0; i != concurrency; i++ {
-		go serve(conn, handler, done)
+		go s.serve(conn, done)
 	}
 
 	for i := 0; i != concurrency; i++ {
@@ -64,11 +162,82 @@ func Serve(conn net.PacketConn, handler Handler) (err error) {
 		conn.Close()
 	}
 
+	s.mutex.Lock()
+	if s.shutdown {
+		err = ErrServerClosed
+	}
+	s.mutex.Unlock()
 	return
 }
 
-func serve(conn net.PacketConn, handler Handler, done chan<- error) {
+// Shutdown stops the server, waiting for the datagrams being processed to be
+// passed to the handler. If ctx is canceled before that happens the method
+// returns the context error.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	s.shutdown = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.serving.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats returns a snapshot of the counters of the server.
+func (s *Server) Stats() ServerStats {
+	return ServerStats{
+		Packets:     atomic.LoadUint64(&s.stats.Packets),
+		Bytes:       atomic.LoadUint64(&s.stats.Bytes),
+		Lines:       atomic.LoadUint64(&s.stats.Lines),
+		ParseErrors: atomic.LoadUint64(&s.stats.ParseErrors),
+	}
+}
+
+func (s *Server) track(conn net.PacketConn) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.shutdown {
+		return false
+	}
+
+	if s.conns == nil {
+		s.conns = make(map[net.PacketConn]struct{})
+	}
+
+	s.conns[conn] = struct{}{}
+	s.serving.Add(1)
+	return true
+}
+
+func (s *Server) untrack(conn net.PacketConn) {
+	s.mutex.Lock()
+	delete(s.conns, conn)
+	s.mutex.Unlock()
+	s.serving.Done()
+}
+
+func (s *Server) serve(conn net.PacketConn, done chan<- error) {
 	b := make([]byte, 65536)
+	handler := s.Handler
+	batchHandler, _ := handler.(BatchHandler)
+	eventHandler, _ := handler.(EventHandler)
+	checkHandler, _ := handler.(ServiceCheckHandler)
+
+	var parser = metricParser{signedDeltas: s.SignedGaugeDeltas}
+	var batch []Metric
 
 	for {
 		n, a, err := conn.ReadFrom(b)
@@ -77,24 +246,99 @@ func serve(conn net.PacketConn, handler Handler, done chan<- error) {
 			return
 		}
 
-		for s := b[:n]; len(s) != 0; {
-			var ln []byte
-			var off int
+		atomic.AddUint64(&s.stats.Packets, 1)
+		atomic.AddUint64(&s.stats.Bytes, uint64(n))
 
-			if off = bytes.IndexByte(s, '\n'); off < 0 {
-				off = len(s)
-			} else {
-				off++
+		if handler == nil {
+			continue
+		}
+
+		// The datagram is converted to a string once, the metrics reference
+		// sub-strings of it which remain valid after the handler returns.
+		var lines uint64
+		var failed uint64
+
+		if batchHandler != nil {
+			parser.reset()
+		} else {
+			// Handlers that aren't aware of batches may retain the tags of
+			// the metrics they receive, the memory cannot be reused.
+			parser = metricParser{signedDeltas: s.SignedGaugeDeltas}
+		}
+		batch = batch[:0]
+
+		for p := string(b[:n]); len(p) != 0; {
+			var ln string
+
+			if ln, p = nextToken(p, '\n'); len(ln) == 0 {
+				continue
 			}
 
-			ln, s = s[:off], s[off:]
+			lines++
+
+			switch {
+			case strings.HasPrefix(ln, "_e{"):
+				if e, err := parseEvent(ln); err != nil {
+					failed++
+				} else if eventHandler != nil {
+					eventHandler.HandleEvent(e, a)
+				}
+				continue
 
-			m, err := parseMetric(string(ln))
+			case strings.HasPrefix(ln, "_sc|"):
+				if sc, err := parseServiceCheck(ln); err != nil {
+					failed++
+				} else if checkHandler != nil {
+					checkHandler.HandleServiceCheck(sc, a)
+				}
+				continue
+			}
+
+			m, err := parser.parse(ln)
 			if err != nil {
+				failed++
 				continue
 			}
 
-			handler.HandleMetric(m, a)
+			if values := m.Values; len(values) == 0 {
+				batch = append(batch, m)
+			} else {
+				m.Values = nil
+				for _, m.Value = range values {
+					batch = append(batch, m)
+				}
+			}
+		}
+
+		atomic.AddUint64(&s.stats.Lines, lines)
+		atomic.AddUint64(&s.stats.ParseErrors, failed)
+
+		if batchHandler != nil {
+			if len(batch) != 0 {
+				batchHandler.HandleMetrics(batch, a)
+			}
+		} else {
+			for _, m := range batch {
+				handler.HandleMetric(m, a)
+			}
 		}
 	}
 }
+
+// ListenAndServe starts a new dogstatsd server, listening for UDP datagrams on
+// addr and forwarding the metrics to handler.
+//
+// The address may be prefixed with "unixgram://" to listen for datagrams on a
+// unix socket instead.
+func ListenAndServe(addr string, handler Handler) error {
+	return (&Server{Handler: handler}).ListenAndServe(addr)
+}
+
+// Serve runs a dogstatsd server, listening for datagrams on conn and forwarding
+// the metrics to handler.
+//
+// Metrics carrying multiple packed values are passed to the handler as one
+// metric per value.
+func Serve(conn net.PacketConn, handler Handler) error {
+	return (&Server{Handler: handler}).Serve(conn)
+}
@@ -1,8 +1,10 @@
 package datadog
 
 import (
+	"context"
 	"io"
 	"net"
+	"reflect"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -71,6 +73,216 @@ func TestServer(t *testing.T) {
 	}
 }
 
+func TestServerUnixgram(t *testing.T) {
+	path, cleanup := tempSocketPath(t)
+	defer cleanup()
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var n uint32
+
+	go Serve(conn, HandlerFunc(func(m Metric, _ net.Addr) {
+		if m.Name == "datadog.test.A" {
+			atomic.AddUint32(&n, uint32(m.Value))
+		}
+	}))
+
+	client := NewClient("unixgram://" + path)
+	defer client.Close()
+
+	engine := stats.NewEngine("datadog.test")
+	engine.Register(client)
+	engine.Add("A", 1)
+	engine.Add("A", 2)
+	engine.Flush()
+
+	// Wait for the server to receive the metrics.
+	waitUntil(func() bool { return atomic.LoadUint32(&n) == 3 })
+
+	if n := atomic.LoadUint32(&n); n != 3 {
+		t.Error("datadog.test.A: bad value:", n)
+	}
+}
+
+type testEventHandler struct {
+	HandlerFunc
+	events chan Event
+	checks chan ServiceCheck
+}
+
+func (h testEventHandler) HandleEvent(e Event, _ net.Addr) { h.events <- e }
+
+func (h testEventHandler) HandleServiceCheck(sc ServiceCheck, _ net.Addr) { h.checks <- sc }
+
+func TestServerEventsAndServiceChecks(t *testing.T) {
+	handler := testEventHandler{
+		HandlerFunc: func(m Metric, _ net.Addr) { t.Error("unexpected metric:", m) },
+		events:      make(chan Event, 1),
+		checks:      make(chan ServiceCheck, 1),
+	}
+
+	addr, closer := startTestServer(t, handler)
+	defer closer.Close()
+
+	client := NewClient(addr)
+	defer client.Close()
+
+	event := Event{Title: "hello", Text: "world", Tags: []stats.Tag{{"a", "b"}}}
+	check := ServiceCheck{Name: "app", Status: ServiceCheckWarning, Message: "slow"}
+
+	client.Event(event)
+	client.ServiceCheck(check)
+	client.Flush()
+
+	select {
+	case e := <-handler.events:
+		if !reflect.DeepEqual(e, event) {
+			t.Errorf("bad event:\n- %#v\n- %#v", event, e)
+		}
+	case <-time.After(time.Second):
+		t.Error("timeout waiting for the event")
+	}
+
+	select {
+	case sc := <-handler.checks:
+		if !reflect.DeepEqual(sc, check) {
+			t.Errorf("bad service check:\n- %#v\n- %#v", check, sc)
+		}
+	case <-time.After(time.Second):
+		t.Error("timeout waiting for the service check")
+	}
+}
+
+type testBatchHandler struct {
+	HandlerFunc
+	batches chan []Metric
+}
+
+func (h testBatchHandler) HandleMetrics(metrics []Metric, _ net.Addr) {
+	batch := make([]Metric, len(metrics))
+	copy(batch, metrics)
+	h.batches <- batch
+}
+
+func TestServerBatchHandler(t *testing.T) {
+	handler := testBatchHandler{
+		HandlerFunc: func(m Metric, _ net.Addr) { t.Error("unexpected call to HandleMetric:", m) },
+		batches:     make(chan []Metric, 1),
+	}
+
+	addr, closer := startTestServer(t, handler)
+	defer closer.Close()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("A:1|c\nB:2:3|h\n"))
+
+	select {
+	case batch := <-handler.batches:
+		expected := []Metric{
+			{Type: Counter, Name: "A", Value: 1, Rate: 1},
+			{Type: Histogram, Name: "B", Value: 2, Rate: 1},
+			{Type: Histogram, Name: "B", Value: 3, Rate: 1},
+		}
+		if !reflect.DeepEqual(batch, expected) {
+			t.Errorf("bad batch:\n- %#v\n- %#v", expected, batch)
+		}
+	case <-time.After(time.Second):
+		t.Error("timeout waiting for the batch of metrics")
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	received := make(chan Metric, 2)
+	server := &Server{Handler: HandlerFunc(func(m Metric, _ net.Addr) { received <- m })}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(conn)
+	defer server.Shutdown(context.Background())
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	datagram := "A:1|c\n???\nB:2|g\n"
+	client.Write([]byte(datagram))
+
+	for i := 0; i != 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for metrics")
+		}
+	}
+
+	expected := ServerStats{
+		Packets:     1,
+		Bytes:       uint64(len(datagram)),
+		Lines:       3,
+		ParseErrors: 1,
+	}
+
+	if stats := server.Stats(); stats != expected {
+		t.Errorf("bad server stats:\n- %+v\n- %+v", expected, stats)
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	server := &Server{Handler: HandlerFunc(func(Metric, net.Addr) {})}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(conn) }()
+
+	// Wait for the server to start tracking the connection.
+	for i := 0; i != 100; i++ {
+		server.mutex.Lock()
+		n := len(server.conns)
+		server.mutex.Unlock()
+		if n != 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		t.Error("shutdown:", err)
+	}
+
+	select {
+	case err := <-served:
+		if err != ErrServerClosed {
+			t.Error("bad error returned by Serve:", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Serve did not return after the server was shut down")
+	}
+
+	if err := server.ListenAndServe("127.0.0.1:0"); err != ErrServerClosed {
+		t.Error("bad error returned by ListenAndServe after shutdown:", err)
+	}
+}
+
 func startTestServer(t *testing.T, handler Handler) (addr string, closer io.Closer) {
 	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
 
@@ -83,3 +295,15 @@ func startTestServer(t *testing.T, handler Handler) (addr string, closer io.Clos
 
 	return conn.LocalAddr().String(), conn
 }
+
+// waitUntil polls cond until it returns true, or gives up after a deadline
+// generous enough for slow test environments.
+func waitUntil(cond func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return true
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return cond()
+}
@@ -0,0 +1,239 @@
+package datadog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A ShardedConn is a connection to a dogstatsd server which distributes writes
+// across multiple buffers.
+//
+// A Conn serializes all writes on a single mutex, which becomes a contention
+// point in programs producing metrics from many goroutines. Writes to a
+// ShardedConn pick the first buffer that isn't in use by another goroutine,
+// and each buffer is flushed independently as a full datagram when it cannot
+// receive more data. Metrics are never split across datagrams.
+//
+// Buffers are still guarded by mutexes, but they are only acquired with
+// TryLock while looking for a buffer, so goroutines don't wait on each other
+// unless all buffers are in use. The mutexes are only held while copying the
+// metrics, full buffers are swapped with spare ones and sent to the server
+// after the mutex was released.
+type ShardedConn struct {
+	c      net.Conn
+	shards []connShard
+	hints  sync.Pool
+	next   uint32
+	spare  chan []byte // free list of buffers swapped out of shards
+}
+
+// connShard pads Conn values to prevent false sharing of CPU cache lines
+// between goroutines using different shards.
+type connShard struct {
+	Conn
+	_ [128]byte
+}
+
+// shardHint carries the index of the shard that writes start from. The hints
+// are cached in a sync.Pool, which keeps per-P caches of its values, so
+// goroutines running on different Ps tend to use different shards.
+type shardHint struct {
+	i int
+}
+
+// DialSharded opens a new dogstatsd connection using config, with the given
+// number of buffers. If shards is zero, the value of runtime.GOMAXPROCS is
+// used.
+func DialSharded(config ConnConfig, shards int) (*ShardedConn, error) {
+	conn, err := DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	c := NewShardedConn(conn.c, shards, cap(conn.b))
+	if conn.off != 0 {
+		c.setStream()
+	}
+	return c, nil
+}
+
+// NewShardedConn creates a new dogstatsd connection with conn, distributing
+// writes across the given number of buffers of bufferSize bytes. If shards is
+// zero, the value of runtime.GOMAXPROCS is used.
+func NewShardedConn(conn net.Conn, shards int, bufferSize int) *ShardedConn {
+	if shards <= 0 {
+		shards = runtime.GOMAXPROCS(0)
+	}
+
+	c := &ShardedConn{
+		c:      conn,
+		shards: make([]connShard, shards),
+		spare:  make(chan []byte, shards),
+	}
+
+	c.hints.New = func() interface{} {
+		return &shardHint{i: int(atomic.AddUint32(&c.next, 1) % uint32(shards))}
+	}
+
+	for i := range c.shards {
+		c.shards[i].c = conn
+		c.shards[i].b = make([]byte, 0, bufferSize)
+	}
+
+	return c
+}
+
+func (c *ShardedConn) setStream() {
+	for i := range c.shards {
+		c.shards[i].setStream()
+	}
+}
+
+// Close satisfies the net.Conn interface.
+func (c *ShardedConn) Close() (err error) {
+	err = c.Flush()
+	c.c.Close()
+	return
+}
+
+// Read satisfies the net.Conn interface.
+func (c *ShardedConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+// Write satisfies the net.Conn interface.
+//
+// The content of b is written to a single buffer, programs must call Write
+// with whole metrics only.
+func (c *ShardedConn) Write(b []byte) (n int, err error) {
+	shards := c.shards
+	hint := c.hints.Get().(*shardHint)
+	start := hint.i
+
+	for i := range shards {
+		j := (start + i) % len(shards)
+		s := &shards[j]
+
+		if s.m.TryLock() {
+			// Remember which shard was available, the next write on this P
+			// is likely to find it available again.
+			hint.i = j
+			c.hints.Put(hint)
+			return c.write(s, b)
+		}
+	}
+
+	// All buffers are in use, wait for the one we were originally assigned
+	// to be released.
+	c.hints.Put(hint)
+	s := &shards[start]
+	s.m.Lock()
+	return c.write(s, b)
+}
+
+// write appends b to the buffer of s, which must be locked by the caller, and
+// releases it. If the buffer was full it is sent once the lock was released.
+func (c *ShardedConn) write(s *connShard, b []byte) (n int, err error) {
+	if n = len(b); n > (cap(s.b) - s.off) {
+		s.m.Unlock()
+		return 0, fmt.Errorf("discarded because it doesn't fit in the output buffer (size = %d, max = %d)", n, cap(s.b)-s.off)
+	}
+
+	var full []byte
+
+	if n > (cap(s.b) - len(s.b)) {
+		full = c.swap(s)
+	}
+
+	s.b = append(s.b, b...)
+	s.m.Unlock()
+
+	if full != nil {
+		err = c.send(full, s.off)
+	}
+	return
+}
+
+// swap replaces the buffer of s, which must be locked by the caller, with a
+// spare one, returning nil if the buffer was empty.
+func (c *ShardedConn) swap(s *connShard) []byte {
+	if len(s.b) <= s.off {
+		return nil
+	}
+
+	full := s.b
+
+	select {
+	case s.b = <-c.spare:
+	default:
+		s.b = make([]byte, 0, cap(full))
+	}
+
+	s.b = s.b[:s.off]
+	return full
+}
+
+// send writes the datagram or stream message in b to the connection, off is
+// the size of the message header of stream sockets. The buffer is then kept as
+// a spare.
+func (c *ShardedConn) send(b []byte, off int) (err error) {
+	if off != 0 {
+		binary.LittleEndian.PutUint32(b[:off], uint32(len(b)-off))
+	}
+
+	_, err = c.c.Write(b)
+
+	select {
+	case c.spare <- b[:0]:
+	default:
+	}
+	return
+}
+
+// LocalAddr satisfies the net.Conn interface.
+func (c *ShardedConn) LocalAddr() net.Addr {
+	return c.c.LocalAddr()
+}
+
+// RemoteAddr satisfies the net.Conn interface.
+func (c *ShardedConn) RemoteAddr() net.Addr {
+	return c.c.RemoteAddr()
+}
+
+// SetDeadline satisfies the net.Conn interface.
+func (c *ShardedConn) SetDeadline(t time.Time) error {
+	return c.c.SetDeadline(t)
+}
+
+// SetReadDeadline satisfies the net.Conn interface.
+func (c *ShardedConn) SetReadDeadline(t time.Time) error {
+	return c.c.SetReadDeadline(t)
+}
+
+// SetWriteDeadline satisfies the net.Conn interface.
+func (c *ShardedConn) SetWriteDeadline(t time.Time) error {
+	return c.c.SetWriteDeadline(t)
+}
+
+// Flush sends the data buffered in all shards of the connection, each shard
+// produces its own datagram. The first error that occurred is returned.
+func (c *ShardedConn) Flush() (err error) {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.m.Lock()
+		full := c.swap(s)
+		s.m.Unlock()
+
+		if full != nil {
+			if e := c.send(full, s.off); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,181 @@
+package datadog
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShardedConn(t *testing.T) {
+	const goroutines = 8
+	const writes = 1000
+	const bufferSize = 128
+
+	dst := &testConn{}
+	conn := NewShardedConn(dst, 4, bufferSize)
+
+	wg := sync.WaitGroup{}
+	wg.Add(goroutines)
+
+	for i := 0; i != goroutines; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j != writes; j++ {
+				conn.Write([]byte("metric." + strconv.Itoa(i) + ":" + strconv.Itoa(j) + "|c\n"))
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	conn.Flush()
+
+	lines := 0
+
+	for _, b := range dst.datagrams() {
+		if len(b) > bufferSize {
+			t.Errorf("datagram exceeds the buffer size: %d", len(b))
+		}
+
+		if !bytes.HasSuffix(b, []byte("\n")) {
+			t.Errorf("datagram contains a partial metric: %q", b)
+		}
+
+		for _, ln := range bytes.Split(b[:len(b)-1], []byte("\n")) {
+			if _, err := parseMetric(string(ln)); err != nil {
+				t.Error(err)
+			}
+			lines++
+		}
+	}
+
+	if lines != goroutines*writes {
+		t.Error("bad number of metrics:", lines)
+	}
+}
+
+func TestShardedConnStream(t *testing.T) {
+	dst := &testConn{}
+	conn := NewShardedConn(dst, 2, 64)
+	conn.setStream()
+
+	conn.Write([]byte("A:1|c\n"))
+	conn.Flush()
+
+	if d := dst.datagrams(); len(d) != 1 || string(d[0]) != "\x06\x00\x00\x00A:1|c\n" {
+		t.Errorf("bad messages: %q", d)
+	}
+}
+
+func TestShardedConnSendWithoutLock(t *testing.T) {
+	dst := &blockingConn{writing: make(chan struct{}), release: make(chan struct{})}
+	conn := NewShardedConn(dst, 1, 8)
+
+	conn.Write([]byte("A:1|c\n"))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.Write([]byte("B:2|c\n")) // the buffer is full, A is sent
+	}()
+
+	// The shard must be available while its previous buffer is being sent.
+	<-dst.writing
+	conn.shards[0].m.Lock()
+	if s := string(conn.shards[0].b); s != "B:2|c\n" {
+		t.Errorf("bad buffer content: %q", s)
+	}
+	conn.shards[0].m.Unlock()
+
+	close(dst.release)
+	<-done
+}
+
+func TestClientShards(t *testing.T) {
+	received := make(chan Metric, 100)
+	addr, closer := startTestServer(t, HandlerFunc(func(m Metric, _ net.Addr) {
+		received <- m
+	}))
+	defer closer.Close()
+
+	client := NewClientWith(ClientConfig{
+		Address: addr,
+		Shards:  4,
+	})
+	defer client.Close()
+
+	if _, ok := client.conn.(*ShardedConn); !ok {
+		t.Fatalf("bad client connection type: %T", client.conn)
+	}
+
+	for i := 0; i != 10; i++ {
+		client.conn.Write([]byte("A:1|c\n"))
+	}
+	client.Flush()
+
+	for i := 0; i != 10; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for metrics, received:", i)
+		}
+	}
+}
+
+func BenchmarkConnWrite(b *testing.B) {
+	metric := []byte("test.metric.common:1|c|#hello:world,answer:42\n")
+
+	conns := []struct {
+		name string
+		conn interface {
+			Write([]byte) (int, error)
+		}
+	}{
+		{"Conn", NewConn(&testConn{discard: true}, make([]byte, 0, DefaultBufferSize))},
+		{"ShardedConn", NewShardedConn(&testConn{discard: true}, 0, DefaultBufferSize)},
+	}
+
+	for _, c := range conns {
+		for _, goroutines := range []int{1, 8, 64} {
+			b.Run(fmt.Sprintf("%s/goroutines=%d", c.name, goroutines), func(b *testing.B) {
+				b.SetParallelism(goroutines)
+				b.RunParallel(func(pb *testing.PB) {
+					for pb.Next() {
+						c.conn.Write(metric)
+					}
+				})
+			})
+		}
+	}
+}
+
+// testConn is a net.Conn implementation which records the datagrams written
+// to it.
+type testConn struct {
+	net.Conn
+	mutex   sync.Mutex
+	written [][]byte
+	discard bool
+}
+
+func (c *testConn) Write(b []byte) (int, error) {
+	if !c.discard {
+		c.mutex.Lock()
+		c.written = append(c.written, append([]byte(nil), b...))
+		c.mutex.Unlock()
+	}
+	return len(b), nil
+}
+
+func (c *testConn) Close() error {
+	return nil
+}
+
+func (c *testConn) datagrams() [][]byte {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.written
+}
@@ -0,0 +1,264 @@
+package debugstats
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+// Handler is a stats handler which keeps the current state of all the metrics
+// it received and exposes it as JSON.
+//
+// Counters report their total since the handler was created, gauges their last
+// value, and histograms the count, sum, min and max of the values they
+// observed. NaN and infinite values are ignored since they can't be represented
+// in JSON.
+//
+// The handler satisfies the http.Handler interface, a program typically adds it
+// to its muxer under the /debug/stats path:
+//
+//	h := &debugstats.Handler{}
+//	stats.Register(h)
+//	http.Handle("/debug/stats", h)
+//
+// It also satisfies the expvar.Var interface so it can be published with the
+// other variables of the program:
+//
+//	expvar.Publish("stats", h)
+//
+// The zero-value is a valid handler.
+type Handler struct {
+	mutex   sync.Mutex
+	entries map[string]*Metric
+	key     []byte
+	tags    []stats.Tag
+}
+
+// Metric represents the state of a time series in the snapshots produced by a
+// Handler.
+type Metric struct {
+	Namespace string            `json:"namespace"`
+	Name      string            `json:"name"`
+	Type      string            `json:"type"`
+	Tags      map[string]string `json:"tags,omitempty"`
+
+	// Value is the total of counters, and the last value reported by gauges
+	// and histograms.
+	Value float64 `json:"value"`
+
+	// Histogram is only set on histograms.
+	Histogram *Histogram `json:"histogram,omitempty"`
+
+	// Time is the time of the last update.
+	Time time.Time `json:"time"`
+
+	tags []stats.Tag // sorted by name
+}
+
+// Histogram summarizes the values observed by a histogram.
+type Histogram struct {
+	Count int64   `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+}
+
+// Filter is used to select the metrics returned in snapshots.
+type Filter struct {
+	// Prefix selects metrics whose name, with or without their namespace,
+	// starts with the prefix. An empty prefix selects all metrics.
+	Prefix string
+
+	// Tags selects metrics which have all the tags, a tag with an empty value
+	// matches any value.
+	Tags []stats.Tag
+}
+
+// Match returns true if m is selected by the filter.
+func (f Filter) Match(m *Metric) bool {
+	if len(f.Prefix) != 0 && !strings.HasPrefix(m.Name, f.Prefix) {
+		if len(m.Namespace) == 0 || !strings.HasPrefix(m.Namespace+"."+m.Name, f.Prefix) {
+			return false
+		}
+	}
+
+	for _, tag := range f.Tags {
+		value, ok := m.Tags[tag.Name]
+		if !ok || (len(tag.Value) != 0 && tag.Value != value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// HandleMetric satisfies the stats.Handler interface.
+func (h *Handler) HandleMetric(m *stats.Metric) {
+	if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+		return
+	}
+
+	mtime := m.Time
+	if mtime.IsZero() {
+		mtime = time.Now()
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.tags = append(h.tags[:0], m.Tags...)
+	sort.SliceStable(h.tags, func(i, j int) bool { return h.tags[i].Name < h.tags[j].Name })
+
+	k := append(h.key[:0], byte(m.Type))
+	k = append(k, m.Namespace...)
+	k = append(k, 0)
+	k = append(k, m.Name...)
+
+	for _, tag := range h.tags {
+		k = append(k, 0)
+		k = append(k, tag.Name...)
+		k = append(k, 0)
+		k = append(k, tag.Value...)
+	}
+
+	h.key = k
+	e := h.entries[string(k)]
+
+	if e == nil {
+		if h.entries == nil {
+			h.entries = make(map[string]*Metric)
+		}
+
+		e = &Metric{
+			Namespace: m.Namespace,
+			Name:      m.Name,
+			Type:      m.Type.String(),
+			tags:      append([]stats.Tag{}, h.tags...),
+		}
+
+		if len(e.tags) != 0 {
+			e.Tags = make(map[string]string, len(e.tags))
+			for _, tag := range e.tags {
+				e.Tags[tag.Name] = tag.Value
+			}
+		}
+
+		if m.Type == stats.HistogramType {
+			e.Histogram = &Histogram{Min: m.Value, Max: m.Value}
+		}
+
+		h.entries[string(k)] = e
+	}
+
+	switch m.Type {
+	case stats.CounterType:
+		e.Value += m.Value
+
+	case stats.HistogramType:
+		e.Value = m.Value
+		e.Histogram.Count++
+		e.Histogram.Sum += m.Value
+		e.Histogram.Min = math.Min(e.Histogram.Min, m.Value)
+		e.Histogram.Max = math.Max(e.Histogram.Max, m.Value)
+
+	default:
+		e.Value = m.Value
+	}
+
+	e.Time = mtime
+}
+
+// Snapshot returns the state of the metrics selected by filter, sorted by
+// namespace, name, type and tags.
+func (h *Handler) Snapshot(filter Filter) []Metric {
+	h.mutex.Lock()
+	metrics := make([]Metric, 0, len(h.entries))
+
+	for _, e := range h.entries {
+		if filter.Match(e) {
+			m := *e
+			if m.Histogram != nil {
+				s := *m.Histogram
+				m.Histogram = &s
+			}
+			metrics = append(metrics, m)
+		}
+	}
+
+	h.mutex.Unlock()
+
+	sort.Slice(metrics, func(i, j int) bool { return lessMetric(&metrics[i], &metrics[j]) })
+	return metrics
+}
+
+// ServeHTTP satisfies the http.Handler interface.
+//
+// The response is a JSON object with a "metrics" array. The metrics can be
+// filtered with the "prefix" query parameter and with "tag" parameters of the
+// form "name:value" or "name", which may be repeated.
+func (h *Handler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		res.Header().Set("Allow", "GET, HEAD")
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := req.URL.Query()
+	filter := Filter{Prefix: query.Get("prefix")}
+
+	for _, tag := range query["tag"] {
+		if i := strings.IndexByte(tag, ':'); i < 0 {
+			filter.Tags = append(filter.Tags, stats.Tag{Name: tag})
+		} else {
+			filter.Tags = append(filter.Tags, stats.Tag{Name: tag[:i], Value: tag[i+1:]})
+		}
+	}
+
+	b, _ := json.Marshal(struct {
+		Metrics []Metric `json:"metrics"`
+	}{h.Snapshot(filter)})
+
+	res.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if req.Method != "HEAD" {
+		res.Write(append(b, '\n'))
+	}
+}
+
+// String satisfies the expvar.Var interface, it returns the state of all
+// metrics as a JSON array.
+func (h *Handler) String() string {
+	b, _ := json.Marshal(h.Snapshot(Filter{}))
+	return string(b)
+}
+
+func lessMetric(m1 *Metric, m2 *Metric) bool {
+	if m1.Namespace != m2.Namespace {
+		return m1.Namespace < m2.Namespace
+	}
+
+	if m1.Name != m2.Name {
+		return m1.Name < m2.Name
+	}
+
+	if m1.Type != m2.Type {
+		return m1.Type < m2.Type
+	}
+
+	for i := 0; i != len(m1.tags) && i != len(m2.tags); i++ {
+		if t1, t2 := m1.tags[i], m2.tags[i]; t1 != t2 {
+			if t1.Name != t2.Name {
+				return t1.Name < t2.Name
+			}
+			return t1.Value < t2.Value
+		}
+	}
+
+	return len(m1.tags) < len(m2.tags)
+}
@@ -0,0 +1,147 @@
+package debugstats
+
+import (
+	"encoding/json"
+	"expvar"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+var testTime = time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+
+func newTestHandler() *Handler {
+	h := &Handler{}
+
+	for _, m := range []stats.Metric{
+		{Type: stats.CounterType, Namespace: "app", Name: "http.requests", Value: 1, Tags: []stats.Tag{{"status", "200"}, {"method", "GET"}}},
+		{Type: stats.CounterType, Namespace: "app", Name: "http.requests", Value: 2, Tags: []stats.Tag{{"method", "GET"}, {"status", "200"}}},
+		{Type: stats.CounterType, Namespace: "app", Name: "http.requests", Value: 1, Tags: []stats.Tag{{"method", "GET"}, {"status", "500"}}},
+		{Type: stats.GaugeType, Namespace: "app", Name: "queue.size", Value: 4},
+		{Type: stats.GaugeType, Namespace: "app", Name: "queue.size", Value: 2},
+		{Type: stats.GaugeType, Namespace: "app", Name: "queue.size", Value: math.NaN()},
+		{Type: stats.HistogramType, Namespace: "app", Name: "http.latency", Value: 0.5},
+		{Type: stats.HistogramType, Namespace: "app", Name: "http.latency", Value: 0.25},
+		{Type: stats.HistogramType, Namespace: "app", Name: "http.latency", Value: 1},
+	} {
+		m.Time = testTime
+		h.HandleMetric(&m)
+	}
+
+	return h
+}
+
+func TestHandlerSnapshot(t *testing.T) {
+	h := newTestHandler()
+
+	metrics := h.Snapshot(Filter{})
+
+	for i := range metrics {
+		metrics[i].tags = nil
+	}
+
+	expected := []Metric{
+		{Namespace: "app", Name: "http.latency", Type: "histogram", Value: 1, Histogram: &Histogram{Count: 3, Sum: 1.75, Min: 0.25, Max: 1}, Time: testTime},
+		{Namespace: "app", Name: "http.requests", Type: "counter", Value: 3, Tags: map[string]string{"method": "GET", "status": "200"}, Time: testTime},
+		{Namespace: "app", Name: "http.requests", Type: "counter", Value: 1, Tags: map[string]string{"method": "GET", "status": "500"}, Time: testTime},
+		{Namespace: "app", Name: "queue.size", Type: "gauge", Value: 2, Time: testTime},
+	}
+
+	if !reflect.DeepEqual(metrics, expected) {
+		t.Errorf("bad snapshot:\n- expected: %#v\n- found:    %#v", expected, metrics)
+	}
+}
+
+func TestHandlerServeHTTP(t *testing.T) {
+	server := httptest.NewServer(newTestHandler())
+	defer server.Close()
+
+	tests := []struct {
+		query string
+		names []string
+	}{
+		{"", []string{"http.latency", "http.requests", "http.requests", "queue.size"}},
+		{"?prefix=http.", []string{"http.latency", "http.requests", "http.requests"}},
+		{"?prefix=app.queue", []string{"queue.size"}},
+		{"?prefix=nope", []string{}},
+		{"?tag=method", []string{"http.requests", "http.requests"}},
+		{"?tag=method:GET&tag=status:500", []string{"http.requests"}},
+		{"?prefix=http.&tag=status:404", []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			res, err := http.Get(server.URL + test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+
+			if ct := res.Header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+				t.Error("bad content type:", ct)
+			}
+
+			var body struct {
+				Metrics []Metric `json:"metrics"`
+			}
+
+			if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+
+			names := []string{}
+			for _, m := range body.Metrics {
+				names = append(names, m.Name)
+			}
+
+			if !reflect.DeepEqual(names, test.names) {
+				t.Errorf("bad metrics: %v", names)
+			}
+		})
+	}
+}
+
+func TestHandlerServeHTTPMethodNotAllowed(t *testing.T) {
+	res := httptest.NewRecorder()
+	newTestHandler().ServeHTTP(res, httptest.NewRequest("POST", "/debug/stats", nil))
+
+	if res.Code != http.StatusMethodNotAllowed {
+		t.Error("bad status:", res.Code)
+	}
+}
+
+func TestHandlerExpvar(t *testing.T) {
+	h := newTestHandler()
+	expvar.Publish("debugstats-test", h)
+
+	var metrics []Metric
+
+	if err := json.Unmarshal([]byte(expvar.Get("debugstats-test").String()), &metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(metrics) != 4 {
+		t.Errorf("bad number of metrics published with expvar: %d", len(metrics))
+	}
+}
+
+func TestHandlerEngine(t *testing.T) {
+	h := &Handler{}
+
+	eng := stats.NewEngine("app", stats.Tag{"env", "test"})
+	eng.Register(h)
+
+	eng.Incr("events")
+	eng.Incr("events")
+
+	metrics := h.Snapshot(Filter{Tags: []stats.Tag{{"env", "test"}}})
+
+	if len(metrics) != 1 || metrics[0].Value != 2 || metrics[0].Time.IsZero() {
+		t.Errorf("bad snapshot: %#v", metrics)
+	}
+}
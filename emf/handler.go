@@ -0,0 +1,388 @@
+package emf
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+const (
+	// DefaultNamespace is the CloudWatch namespace of metrics that have no
+	// namespace.
+	DefaultNamespace = "stats"
+
+	// DefaultFlushInterval is the default interval at which handlers write
+	// the metrics they aggregated.
+	DefaultFlushInterval = 1 * time.Minute
+
+	// MaxMetrics is the maximum number of metrics in an EMF document, and
+	// the maximum number of values of a single metric.
+	MaxMetrics = 100
+
+	// MaxDimensions is the maximum number of dimensions of a metric, extra
+	// tags are written as properties of the document.
+	MaxDimensions = 30
+
+	// MaxHistogramValues is the maximum number of distinct values that a
+	// histogram aggregates over a flush interval, values observed once the
+	// limit is reached are counted with the closest value already aggregated.
+	MaxHistogramValues = 1000
+)
+
+// The HandlerConfig type is used to configure EMF handlers.
+type HandlerConfig struct {
+	// Output is where EMF documents are written, one per line. The default
+	// is to write to os.Stdout, which is where AWS Lambda expects them.
+	Output io.Writer
+
+	// Namespace is the CloudWatch namespace of metrics that have no
+	// namespace, DefaultNamespace is used when empty.
+	Namespace string
+
+	// FlushInterval is the interval at which the handler writes the metrics
+	// it aggregated. Setting a negative value disables background flushes,
+	// metrics are then only written when the handler is flushed.
+	FlushInterval time.Duration
+}
+
+// Handler is a stats handler which aggregates metrics and writes them in the
+// CloudWatch embedded metric format (EMF).
+//
+// Metrics are grouped by namespace and tags, the tag names are the dimensions
+// of the metrics. When a metric has multiple tags with the same name, the last
+// one is used. Counters are summed and gauges report their last value over the
+// flush interval, histograms report the distinct values that were observed and
+// how many times, as EMF Values and Counts.
+//
+// Tags and metrics are both members of EMF documents, tags which have the name
+// of a metric of their group are prefixed with "tag." to avoid overwriting the
+// metric value.
+//
+// Documents are limited to 100 metrics, and histograms to 100 values per
+// document, larger groups are split into multiple documents.
+type Handler struct {
+	output    io.Writer
+	namespace string
+	now       func() time.Time
+
+	// aggregated metrics, synchronized on mutex
+	mutex  sync.Mutex
+	groups map[string]*group
+	key    []byte
+	tags   []stats.Tag
+
+	wmutex sync.Mutex // serializes writes to output
+
+	once sync.Once
+	done chan struct{}
+	join chan struct{}
+}
+
+// group is the set of metrics of a namespace with the same tags.
+type group struct {
+	namespace string
+	tags      []stats.Tag // sorted by name
+	metrics   map[string]*aggregate
+}
+
+type aggregate struct {
+	typ    stats.MetricType
+	value  float64   // sum of counters, last value of gauges
+	values []float64 // distinct observed values of histograms, sorted
+	counts []uint64  // number of observations of values
+}
+
+// observe adds v to the values of a histogram.
+func (a *aggregate) observe(v float64) {
+	i := sort.SearchFloat64s(a.values, v)
+
+	switch {
+	case i < len(a.values) && a.values[i] == v:
+	case len(a.values) < MaxHistogramValues:
+		a.values = append(a.values, 0)
+		a.counts = append(a.counts, 0)
+		copy(a.values[i+1:], a.values[i:])
+		copy(a.counts[i+1:], a.counts[i:])
+		a.values[i], a.counts[i] = v, 0
+	case i == len(a.values) || (i != 0 && v-a.values[i-1] < a.values[i]-v):
+		i--
+	}
+
+	a.counts[i]++
+}
+
+// NewHandler creates and returns a new EMF handler writing to w.
+func NewHandler(w io.Writer) *Handler {
+	return NewHandlerWith(HandlerConfig{
+		Output: w,
+	})
+}
+
+// NewHandlerWith creates and returns a new EMF handler configured with config.
+func NewHandlerWith(config HandlerConfig) *Handler {
+	if config.Output == nil {
+		config.Output = os.Stdout
+	}
+
+	if len(config.Namespace) == 0 {
+		config.Namespace = DefaultNamespace
+	}
+
+	if config.FlushInterval == 0 {
+		config.FlushInterval = DefaultFlushInterval
+	}
+
+	h := &Handler{
+		output:    config.Output,
+		namespace: config.Namespace,
+		now:       time.Now,
+		groups:    make(map[string]*group),
+		done:      make(chan struct{}),
+		join:      make(chan struct{}),
+	}
+
+	if config.FlushInterval > 0 {
+		go h.run(config.FlushInterval)
+	} else {
+		close(h.join)
+	}
+
+	return h
+}
+
+func (h *Handler) run(flushInterval time.Duration) {
+	defer close(h.join)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.Flush()
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// Close satisfies the io.Closer interface.
+//
+// The method stops the background flushes and writes the metrics aggregated
+// since the last flush.
+func (h *Handler) Close() error {
+	h.once.Do(func() {
+		close(h.done)
+		<-h.join
+		h.Flush()
+	})
+	return nil
+}
+
+// HandleMetric satisfies the stats.Handler interface.
+func (h *Handler) HandleMetric(m *stats.Metric) {
+	// JSON has no representation for NaN and infinities, a single one would
+	// fail the encoding of the whole document it is part of.
+	if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	namespace := m.Namespace
+	if len(namespace) == 0 {
+		namespace = h.namespace
+	}
+
+	h.tags = uniqueTags(append(h.tags[:0], m.Tags...))
+
+	k := append(h.key[:0], namespace...)
+	for _, tag := range h.tags {
+		k = append(k, 0)
+		k = append(k, tag.Name...)
+		k = append(k, 0)
+		k = append(k, tag.Value...)
+	}
+	h.key = k
+
+	g := h.groups[string(k)]
+
+	if g == nil {
+		g = &group{
+			namespace: namespace,
+			tags:      append([]stats.Tag{}, h.tags...),
+			metrics:   make(map[string]*aggregate),
+		}
+		h.groups[string(k)] = g
+	}
+
+	a := g.metrics[m.Name]
+
+	if a == nil || a.typ != m.Type {
+		a = &aggregate{typ: m.Type}
+		g.metrics[m.Name] = a
+	}
+
+	switch m.Type {
+	case stats.GaugeType:
+		a.value = m.Value
+	case stats.HistogramType:
+		a.observe(m.Value)
+	default:
+		a.value += m.Value
+	}
+}
+
+// Flush satisfies the stats.Flusher interface, it writes the documents for the
+// metrics aggregated since the last flush.
+func (h *Handler) Flush() {
+	h.mutex.Lock()
+	groups := h.groups
+	h.groups = make(map[string]*group, len(groups))
+	h.mutex.Unlock()
+
+	if len(groups) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h.wmutex.Lock()
+	defer h.wmutex.Unlock()
+
+	timestamp := h.now().UnixNano() / int64(time.Millisecond)
+
+	for _, k := range keys {
+		for _, doc := range groups[k].documents(timestamp) {
+			b, err := json.Marshal(doc)
+			if err != nil {
+				log.Printf("stats/emf: encoding document failed: %s", err)
+				continue
+			}
+			if _, err := h.output.Write(append(b, '\n')); err != nil {
+				log.Printf("stats/emf: writing document failed: %s", err)
+				return
+			}
+		}
+	}
+}
+
+// documents returns the EMF documents for the metrics of g.
+func (g *group) documents(timestamp int64) []map[string]interface{} {
+	names := make([]string, 0, len(g.metrics))
+	for name := range g.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Names of the tags in the documents, the tags which collide with a
+	// metric are prefixed until their name is not used by any member.
+	tags := make([]string, len(g.tags))
+	taken := make(map[string]bool, len(g.tags))
+	collides := func(name string) bool { return name == "_aws" || g.metrics[name] != nil }
+
+	for i, tag := range g.tags {
+		if !collides(tag.Name) {
+			tags[i], taken[tag.Name] = tag.Name, true
+		}
+	}
+
+	for i, tag := range g.tags {
+		if collides(tag.Name) {
+			name := "tag." + tag.Name
+			for collides(name) || taken[name] {
+				name = "tag." + name
+			}
+			tags[i], taken[name] = name, true
+		}
+	}
+
+	dimensions := tags
+	if len(dimensions) > MaxDimensions {
+		dimensions = dimensions[:MaxDimensions]
+	}
+
+	var docs []map[string]interface{}
+	var metrics [][]map[string]string
+
+	// add places the value of a metric in the first document which has room
+	// for it and doesn't already carry a value for the metric.
+	add := func(name string, value interface{}) {
+		for i, doc := range docs {
+			if _, exists := doc[name]; !exists && len(metrics[i]) < MaxMetrics {
+				doc[name] = value
+				metrics[i] = append(metrics[i], map[string]string{"Name": name})
+				return
+			}
+		}
+
+		doc := map[string]interface{}{name: value}
+		for i, tag := range g.tags {
+			doc[tags[i]] = tag.Value
+		}
+		docs = append(docs, doc)
+		metrics = append(metrics, []map[string]string{{"Name": name}})
+	}
+
+	for _, name := range names {
+		a := g.metrics[name]
+
+		if a.typ != stats.HistogramType {
+			add(name, a.value)
+			continue
+		}
+
+		for values, counts := a.values, a.counts; len(values) != 0; {
+			n := len(values)
+			if n > MaxMetrics {
+				n = MaxMetrics
+			}
+			add(name, map[string]interface{}{"Values": values[:n], "Counts": counts[:n]})
+			values, counts = values[n:], counts[n:]
+		}
+	}
+
+	for i, doc := range docs {
+		doc["_aws"] = map[string]interface{}{
+			"Timestamp": timestamp,
+			"CloudWatchMetrics": []map[string]interface{}{{
+				"Namespace":  g.namespace,
+				"Dimensions": [][]string{dimensions},
+				"Metrics":    metrics[i],
+			}},
+		}
+	}
+
+	return docs
+}
+
+// uniqueTags sorts tags by name and removes the tags which have the same name
+// as a tag that comes after them, the returned slice shares the backing array
+// of tags.
+func uniqueTags(tags []stats.Tag) []stats.Tag {
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+
+	n := 0
+	for _, tag := range tags {
+		if n != 0 && tags[n-1].Name == tag.Name {
+			tags[n-1] = tag
+		} else {
+			tags[n] = tag
+			n++
+		}
+	}
+
+	return tags[:n]
+}
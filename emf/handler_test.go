@@ -0,0 +1,235 @@
+package emf
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+var update = flag.Bool("update", false, "update the golden files of EMF tests")
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		golden  string
+		metrics func(h *Handler)
+	}{
+		{
+			golden: "basic",
+			metrics: func(h *Handler) {
+				h.HandleMetric(&stats.Metric{Type: stats.CounterType, Namespace: "app", Name: "requests", Value: 1, Tags: []stats.Tag{{"status", "200"}, {"host", "a"}}})
+				h.HandleMetric(&stats.Metric{Type: stats.CounterType, Namespace: "app", Name: "requests", Value: 2, Tags: []stats.Tag{{"host", "a"}, {"status", "200"}}})
+				h.HandleMetric(&stats.Metric{Type: stats.CounterType, Namespace: "app", Name: "requests", Value: 1, Tags: []stats.Tag{{"host", "a"}, {"status", "500"}}})
+				h.HandleMetric(&stats.Metric{Type: stats.GaugeType, Namespace: "app", Name: "queue.size", Value: 4, Tags: []stats.Tag{{"host", "a"}, {"status", "200"}}})
+				h.HandleMetric(&stats.Metric{Type: stats.GaugeType, Namespace: "app", Name: "queue.size", Value: 2, Tags: []stats.Tag{{"host", "a"}, {"status", "200"}}})
+				h.HandleMetric(&stats.Metric{Type: stats.HistogramType, Namespace: "app", Name: "latency", Value: 0.5, Tags: []stats.Tag{{"host", "a"}, {"status", "200"}}})
+				h.HandleMetric(&stats.Metric{Type: stats.HistogramType, Namespace: "app", Name: "latency", Value: 1.5, Tags: []stats.Tag{{"host", "a"}, {"status", "200"}}})
+				h.HandleMetric(&stats.Metric{Type: stats.HistogramType, Namespace: "app", Name: "latency", Value: 0.5, Tags: []stats.Tag{{"host", "a"}, {"status", "200"}}})
+				h.HandleMetric(&stats.Metric{Type: stats.CounterType, Name: "starts", Value: 1})
+			},
+		},
+		{
+			golden: "split-metrics",
+			metrics: func(h *Handler) {
+				for i := 0; i != 150; i++ {
+					h.HandleMetric(&stats.Metric{Type: stats.CounterType, Namespace: "app", Name: fmt.Sprintf("m%03d", i), Value: 1})
+				}
+			},
+		},
+		{
+			golden: "split-values",
+			metrics: func(h *Handler) {
+				for i := 0; i != 250; i++ {
+					h.HandleMetric(&stats.Metric{Type: stats.HistogramType, Namespace: "app", Name: "latency", Value: float64(i)})
+				}
+				h.HandleMetric(&stats.Metric{Type: stats.CounterType, Namespace: "app", Name: "requests", Value: 250})
+			},
+		},
+		{
+			golden: "tag-collisions",
+			metrics: func(h *Handler) {
+				tags := []stats.Tag{{"host", "a"}, {"status", "200"}, {"tag.host", "b"}, {"_aws", "c"}, {"status", "500"}}
+				h.HandleMetric(&stats.Metric{Type: stats.GaugeType, Namespace: "app", Name: "host", Value: 1, Tags: tags})
+				h.HandleMetric(&stats.Metric{Type: stats.CounterType, Namespace: "app", Name: "tag.host", Value: 2, Tags: tags})
+			},
+		},
+		{
+			golden: "non-finite",
+			metrics: func(h *Handler) {
+				h.HandleMetric(&stats.Metric{Type: stats.CounterType, Namespace: "app", Name: "requests", Value: 1})
+				h.HandleMetric(&stats.Metric{Type: stats.GaugeType, Namespace: "app", Name: "ratio", Value: math.NaN()})
+				h.HandleMetric(&stats.Metric{Type: stats.GaugeType, Namespace: "app", Name: "queue.size", Value: 3})
+				h.HandleMetric(&stats.Metric{Type: stats.CounterType, Namespace: "app", Name: "requests", Value: math.Inf(1)})
+				h.HandleMetric(&stats.Metric{Type: stats.HistogramType, Namespace: "app", Name: "latency", Value: math.Inf(-1)})
+				h.HandleMetric(&stats.Metric{Type: stats.HistogramType, Namespace: "app", Name: "latency", Value: 0.5})
+			},
+		},
+		{
+			golden: "max-dimensions",
+			metrics: func(h *Handler) {
+				tags := make([]stats.Tag, 35)
+				for i := range tags {
+					tags[i] = stats.Tag{Name: fmt.Sprintf("tag%02d", i), Value: fmt.Sprint(i)}
+				}
+				h.HandleMetric(&stats.Metric{Type: stats.CounterType, Namespace: "app", Name: "requests", Value: 1, Tags: tags})
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.golden, func(t *testing.T) {
+			b := &bytes.Buffer{}
+			h := NewHandlerWith(HandlerConfig{
+				Output:        b,
+				FlushInterval: -1,
+			})
+			h.now = func() time.Time { return time.Unix(1500000000, 0) }
+
+			test.metrics(h)
+			h.Close()
+
+			path := filepath.Join("testdata", test.golden+".golden")
+
+			if *update {
+				if err := os.WriteFile(path, b.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			golden, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(b.Bytes(), golden) {
+				t.Errorf("output doesn't match %s:\n%s", path, b.String())
+			}
+
+			for _, line := range bytes.Split(bytes.TrimSpace(golden), []byte("\n")) {
+				checkDocument(t, line)
+			}
+		})
+	}
+}
+
+// checkDocument verifies that a document respects the EMF specification limits
+// and that every metric and dimension it declares has a value.
+func checkDocument(t *testing.T, b []byte) {
+	var doc map[string]interface{}
+
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	aws := doc["_aws"].(map[string]interface{})
+	directive := aws["CloudWatchMetrics"].([]interface{})[0].(map[string]interface{})
+
+	metrics := directive["Metrics"].([]interface{})
+	if len(metrics) > MaxMetrics {
+		t.Errorf("too many metrics in document: %d", len(metrics))
+	}
+
+	for _, m := range metrics {
+		name := m.(map[string]interface{})["Name"].(string)
+		switch v := doc[name].(type) {
+		case float64:
+		case map[string]interface{}:
+			values, _ := v["Values"].([]interface{})
+			counts, _ := v["Counts"].([]interface{})
+			if len(values) > MaxMetrics {
+				t.Errorf("too many values for %s: %d", name, len(values))
+			}
+			if len(values) == 0 || len(values) != len(counts) {
+				t.Errorf("bad values and counts for %s: %v", name, v)
+			}
+		default:
+			t.Errorf("missing value for metric %s", name)
+		}
+	}
+
+	for _, dims := range directive["Dimensions"].([]interface{}) {
+		dims := dims.([]interface{})
+		if len(dims) > MaxDimensions {
+			t.Errorf("too many dimensions in document: %d", len(dims))
+		}
+		seen := make(map[string]bool)
+		for _, d := range dims {
+			if _, ok := doc[d.(string)].(string); !ok {
+				t.Errorf("missing value for dimension %s", d)
+			}
+			if seen[d.(string)] {
+				t.Errorf("duplicate dimension %s", d)
+			}
+			seen[d.(string)] = true
+		}
+	}
+}
+
+func TestAggregateObserveMaxHistogramValues(t *testing.T) {
+	a := &aggregate{typ: stats.HistogramType}
+
+	for i := 0; i != MaxHistogramValues; i++ {
+		a.observe(float64(10 * i))
+	}
+	a.observe(10)  // existing value
+	a.observe(-1)  // below the first value
+	a.observe(24)  // closer to 20
+	a.observe(26)  // closer to 30
+	a.observe(1e9) // above the last value
+
+	if len(a.values) != MaxHistogramValues {
+		t.Fatalf("bad number of distinct values: %d", len(a.values))
+	}
+
+	for i, n := range map[int]uint64{0: 2, 1: 2, 2: 2, 3: 2, MaxHistogramValues - 1: 2, 4: 1} {
+		if a.counts[i] != n {
+			t.Errorf("bad count of %g: %d != %d", a.values[i], n, a.counts[i])
+		}
+	}
+}
+
+func TestHandlerFlushInterval(t *testing.T) {
+	b := &syncBuffer{}
+	h := NewHandlerWith(HandlerConfig{
+		Output:        b,
+		FlushInterval: 10 * time.Millisecond,
+	})
+	defer h.Close()
+
+	eng := stats.NewEngine("app")
+	eng.Register(h)
+	eng.Incr("requests")
+
+	for i := 0; i != 100 && b.Len() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if b.Len() == 0 {
+		t.Error("no documents were written by the background flush")
+	}
+}
+
+type syncBuffer struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buf.Len()
+}
@@ -0,0 +1,80 @@
+package graphite
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+// appendPath appends the graphite path of a metric to b.
+//
+// When tagged is true the tags are encoded as graphite 1.1 tagged series
+// (path;tag=value), otherwise each tag is added to the path as two components,
+// its name and value (path.tag.value).
+func appendPath(b []byte, namespace string, name string, tags []stats.Tag, tagged bool) []byte {
+	return appendTags(appendName(b, namespace, name), tags, tagged)
+}
+
+// appendName appends the name part of a graphite path to b, which is where
+// suffixes like the ones of histograms go when tags are set as tagged series.
+func appendName(b []byte, namespace string, name string) []byte {
+	if len(namespace) != 0 {
+		b = appendSanitized(b, namespace, false)
+		b = append(b, '.')
+	}
+
+	return appendSanitized(b, name, false)
+}
+
+// appendTags appends the tags part of a graphite path to b.
+func appendTags(b []byte, tags []stats.Tag, tagged bool) []byte {
+	for _, tag := range tags {
+		if len(tag.Name) == 0 || len(tag.Value) == 0 {
+			continue
+		}
+		if tagged {
+			b = append(b, ';')
+			b = appendSanitized(b, tag.Name, true)
+			b = append(b, '=')
+			b = appendSanitized(b, tag.Value, true)
+		} else {
+			b = append(b, '.')
+			b = appendSanitized(b, tag.Name, true)
+			b = append(b, '.')
+			b = appendSanitized(b, tag.Value, true)
+		}
+	}
+
+	return b
+}
+
+// appendSanitized appends s to b, replacing the characters that have a special
+// meaning in graphite paths with underscores. Dots are only replaced when s is
+// a single path component.
+func appendSanitized(b []byte, s string, component bool) []byte {
+	for i := 0; i != len(s); i++ {
+		switch c := s[i]; c {
+		case ' ', '\t', '\n', ';', '=', '~', '!', '^':
+			b = append(b, '_')
+		case '.':
+			if component {
+				c = '_'
+			}
+			b = append(b, c)
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+// appendLine appends a metric in the plaintext protocol format to b.
+func appendLine(b []byte, path string, value float64, t time.Time) []byte {
+	b = append(b, path...)
+	b = append(b, ' ')
+	b = strconv.AppendFloat(b, value, 'g', -1, 64)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, t.Unix(), 10)
+	return append(b, '\n')
+}
@@ -0,0 +1,42 @@
+package graphite
+
+import (
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+func TestAppendPath(t *testing.T) {
+	tags := []stats.Tag{{"host", "a.b"}, {"empty", ""}, {"path", "/a b"}}
+
+	tests := []struct {
+		namespace string
+		name      string
+		tagged    bool
+		path      string
+	}{
+		{"", "requests", false, "requests"},
+		{"app", "requests.count", false, "app.requests.count.host.a_b.path./a_b"},
+		{"app", "requests.count", true, "app.requests.count;host=a_b;path=/a_b"},
+		{"my app", "x;y", true, "my_app.x_y;host=a_b;path=/a_b"},
+	}
+
+	for _, test := range tests {
+		var tt []stats.Tag
+		if len(test.namespace) != 0 {
+			tt = tags
+		}
+		if s := string(appendPath(nil, test.namespace, test.name, tt, test.tagged)); s != test.path {
+			t.Errorf("\n<<< %#v\n>>> %#v", test.path, s)
+		}
+	}
+}
+
+func TestAppendLine(t *testing.T) {
+	s := string(appendLine(nil, "app.requests", 0.5, time.Unix(1500000000, 0)))
+
+	if s != "app.requests 0.5 1500000000\n" {
+		t.Errorf("bad line: %#v", s)
+	}
+}
@@ -0,0 +1,320 @@
+package graphite
+
+import (
+	"log"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+const (
+	// DefaultAddress is the default address of the carbon plaintext receiver.
+	DefaultAddress = "localhost:2003"
+
+	// DefaultFlushInterval is the default interval at which clients send the
+	// metrics they aggregated to carbon.
+	DefaultFlushInterval = 10 * time.Second
+
+	// DefaultDialTimeout is the default timeout for establishing connections
+	// to carbon.
+	DefaultDialTimeout = 5 * time.Second
+
+	// DefaultWriteTimeout is the default timeout for sending metrics to
+	// carbon.
+	DefaultWriteTimeout = 10 * time.Second
+
+	// DefaultPickleBatchSize is the default maximum number of data points
+	// sent in a single pickle payload.
+	DefaultPickleBatchSize = 500
+)
+
+// The ClientConfig type is used to configure graphite clients.
+type ClientConfig struct {
+	// Address of the carbon receiver to send metrics to, it must be the
+	// address of the pickle receiver when Pickle is true (port 2004 by
+	// default).
+	Address string
+
+	// FlushInterval is the interval at which the client sends the metrics
+	// it aggregated. Setting a negative value disables background flushes,
+	// metrics are then only sent when the client is flushed.
+	FlushInterval time.Duration
+
+	// DialTimeout and WriteTimeout bound the time spent connecting and
+	// sending metrics to carbon.
+	DialTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// TaggedSeries enables the tagged series of graphite 1.1, tags are set
+	// on the metric paths with the ;tag=value syntax. When false the tag
+	// names and values are added as path components.
+	TaggedSeries bool
+
+	// Pickle selects the pickle protocol instead of the plaintext protocol,
+	// data points are sent in batches of at most PickleBatchSize.
+	Pickle          bool
+	PickleBatchSize int
+}
+
+// Client represents a graphite client that pulls metrics from a stats engine
+// and forward them to carbon.
+//
+// Metrics are aggregated by the client and sent once per flush interval, or
+// when the client is flushed. Counters are summed, gauges report their last
+// value, and histograms report the count, sum, min, max and mean of the
+// values observed during the interval, as path suffixes (.count, .sum, ...).
+//
+// Metrics are only reported when they changed since the last flush, gauges
+// that weren't set during an interval are evicted and stop being reported.
+type Client struct {
+	config ClientConfig
+
+	// aggregated metrics, synchronized on mutex
+	mutex   sync.Mutex
+	metrics map[string]*aggregate
+	path    []byte
+
+	// connection to carbon, synchronized on smutex
+	smutex sync.Mutex
+	conn   net.Conn
+	buffer []byte
+	points []point
+
+	once sync.Once
+	done chan struct{}
+	join chan struct{}
+}
+
+type aggregate struct {
+	path  string
+	name  int // length of the part of path that suffixes are added to
+	typ   stats.MetricType
+	count uint64
+	value float64 // sum of counters and histograms, last value of gauges
+	min   float64
+	max   float64
+}
+
+// suffixed returns the path of a with suffix added to the name, before the tags
+// of tagged series.
+func (a *aggregate) suffixed(suffix string) string {
+	return a.path[:a.name] + suffix + a.path[a.name:]
+}
+
+// NewClient creates and returns a new graphite client publishing metrics to the
+// carbon plaintext receiver listening at addr.
+func NewClient(addr string) *Client {
+	return NewClientWith(ClientConfig{
+		Address: addr,
+	})
+}
+
+// NewClientWith creates and returns a new graphite client configured with
+// config.
+//
+// The connection to carbon is established lazily and re-established when it
+// breaks, metrics that could not be sent are discarded.
+func NewClientWith(config ClientConfig) *Client {
+	if len(config.Address) == 0 {
+		config.Address = DefaultAddress
+	}
+
+	if config.FlushInterval == 0 {
+		config.FlushInterval = DefaultFlushInterval
+	}
+
+	if config.DialTimeout == 0 {
+		config.DialTimeout = DefaultDialTimeout
+	}
+
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = DefaultWriteTimeout
+	}
+
+	if config.PickleBatchSize <= 0 {
+		config.PickleBatchSize = DefaultPickleBatchSize
+	}
+
+	c := &Client{
+		config:  config,
+		metrics: make(map[string]*aggregate),
+		done:    make(chan struct{}),
+		join:    make(chan struct{}),
+	}
+
+	if config.FlushInterval > 0 {
+		go c.run(config.FlushInterval)
+	} else {
+		close(c.join)
+	}
+
+	return c
+}
+
+func (c *Client) run(flushInterval time.Duration) {
+	defer close(c.join)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.Flush()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Close satisfies the io.Closer interface.
+//
+// The method stops the background flushes and sends the metrics aggregated
+// since the last flush before closing the connection.
+func (c *Client) Close() (err error) {
+	c.once.Do(func() {
+		close(c.done)
+		<-c.join
+		c.Flush()
+
+		c.smutex.Lock()
+		if c.conn != nil {
+			err = c.conn.Close()
+			c.conn = nil
+		}
+		c.smutex.Unlock()
+	})
+	return
+}
+
+// HandleMetric satisfies the stats.Handler interface.
+func (c *Client) HandleMetric(m *stats.Metric) {
+	c.mutex.Lock()
+
+	c.path = appendName(c.path[:0], m.Namespace, m.Name)
+	name := len(c.path)
+	c.path = appendTags(c.path, m.Tags, c.config.TaggedSeries)
+
+	// Without tagged series, tags are path components which the suffixes go
+	// after.
+	if !c.config.TaggedSeries {
+		name = len(c.path)
+	}
+
+	a := c.metrics[string(c.path)]
+
+	if a == nil || a.typ != m.Type {
+		a = &aggregate{path: string(c.path), name: name, typ: m.Type}
+		c.metrics[a.path] = a
+	}
+
+	switch a.count++; m.Type {
+	case stats.GaugeType:
+		a.value = m.Value
+
+	case stats.HistogramType:
+		if a.count == 1 {
+			a.min, a.max = m.Value, m.Value
+		} else {
+			a.min, a.max = math.Min(a.min, m.Value), math.Max(a.max, m.Value)
+		}
+		a.value += m.Value
+
+	default:
+		a.value += m.Value
+	}
+
+	c.mutex.Unlock()
+}
+
+// Flush satisfies the stats.Flusher interface.
+func (c *Client) Flush() {
+	c.smutex.Lock()
+	defer c.smutex.Unlock()
+
+	now := time.Now()
+	c.points = c.collect(c.points[:0])
+
+	if len(c.points) == 0 {
+		return
+	}
+
+	if c.config.Pickle {
+		for points := c.points; len(points) != 0; {
+			n := len(points)
+			if n > c.config.PickleBatchSize {
+				n = c.config.PickleBatchSize
+			}
+			c.buffer = appendPickle(c.buffer[:0], points[:n], now)
+			c.send(c.buffer, n)
+			points = points[n:]
+		}
+	} else {
+		c.buffer = c.buffer[:0]
+		for _, p := range c.points {
+			c.buffer = appendLine(c.buffer, p.path, p.value, now)
+		}
+		c.send(c.buffer, len(c.points))
+	}
+}
+
+// collect appends the data points of the aggregated metrics to points, and
+// resets all aggregates.
+func (c *Client) collect(points []point) []point {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for path, a := range c.metrics {
+		switch a.typ {
+		case stats.HistogramType:
+			points = append(points,
+				point{a.suffixed(".count"), float64(a.count)},
+				point{a.suffixed(".sum"), a.value},
+				point{a.suffixed(".min"), a.min},
+				point{a.suffixed(".max"), a.max},
+				point{a.suffixed(".mean"), a.value / float64(a.count)},
+			)
+
+		default:
+			points = append(points, point{path, a.value})
+		}
+
+		delete(c.metrics, path)
+	}
+
+	sort.Slice(points, func(i, j int) bool { return points[i].path < points[j].path })
+	return points
+}
+
+// send writes b to the connection, reconnecting once if the write failed. The
+// smutex must be held by the caller.
+//
+// A connection closed by carbon is only detected when a write fails, the data
+// written before the peer responded with a reset may be lost.
+func (c *Client) send(b []byte, n int) {
+	var err error
+
+	for attempt := 0; attempt != 2; attempt++ {
+		if c.conn == nil {
+			if c.conn, err = net.DialTimeout("tcp", c.config.Address, c.config.DialTimeout); err != nil {
+				c.conn = nil
+				continue
+			}
+		}
+
+		c.conn.SetWriteDeadline(time.Now().Add(c.config.WriteTimeout))
+
+		if _, err = c.conn.Write(b); err == nil {
+			return
+		}
+
+		c.conn.Close()
+		c.conn = nil
+	}
+
+	log.Printf("stats/graphite: discarding %d data points, sending to %s failed: %s", n, c.config.Address, err)
+}
@@ -0,0 +1,150 @@
+package graphite
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+// startTestServer starts a TCP server which sends the lines it receives to the
+// returned channel, connections are closed after a single read when once is
+// true.
+func startTestServer(t *testing.T, once bool) (string, <-chan string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(chan string, 100)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					ln, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					lines <- strings.TrimSuffix(ln, "\n")
+					if once && r.Buffered() == 0 {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String(), lines, func() { l.Close() }
+}
+
+func receive(t *testing.T, lines <-chan string, n int) []string {
+	var received []string
+
+	for i := 0; i != n; i++ {
+		select {
+		case ln := <-lines:
+			// Strip the timestamp, it's not predictable.
+			received = append(received, ln[:strings.LastIndexByte(ln, ' ')])
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for lines, received %q", received)
+		}
+	}
+
+	sort.Strings(received)
+	return received
+}
+
+func TestClient(t *testing.T) {
+	addr, lines, stop := startTestServer(t, false)
+	defer stop()
+
+	client := NewClientWith(ClientConfig{
+		Address:       addr,
+		FlushInterval: -1,
+		TaggedSeries:  true,
+	})
+	defer client.Close()
+
+	engine := stats.NewEngine("app")
+	engine.Register(client)
+	engine.Add("requests", 1, stats.Tag{"status", "200"})
+	engine.Add("requests", 2, stats.Tag{"status", "200"})
+	engine.Set("queue", 5)
+	engine.Set("queue", 3)
+	engine.Observe("rtt", 1)
+	engine.Observe("rtt", 3)
+	engine.Observe("rtt", 2, stats.Tag{"host", "a"})
+	engine.Flush()
+
+	expected := []string{
+		"app.queue 3",
+		"app.requests;status=200 3",
+		"app.rtt.count 2",
+		"app.rtt.count;host=a 1",
+		"app.rtt.max 3",
+		"app.rtt.max;host=a 2",
+		"app.rtt.mean 2",
+		"app.rtt.mean;host=a 2",
+		"app.rtt.min 1",
+		"app.rtt.min;host=a 2",
+		"app.rtt.sum 4",
+		"app.rtt.sum;host=a 2",
+	}
+
+	if received := receive(t, lines, len(expected)); !reflect.DeepEqual(received, expected) {
+		t.Errorf("bad lines:\n- %q\n- %q", expected, received)
+	}
+
+	// Nothing is reported when nothing changed, gauges included.
+	engine.Flush()
+
+	select {
+	case ln := <-lines:
+		t.Errorf("unexpected line after second flush: %q", ln)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	addr, lines, stop := startTestServer(t, true)
+	defer stop()
+
+	client := NewClientWith(ClientConfig{
+		Address:       addr,
+		FlushInterval: -1,
+	})
+	defer client.Close()
+
+	for i := 0; i != 3; i++ {
+		// The first write after the server closed the connection may be lost,
+		// the next one fails and reconnects.
+		var received []string
+
+		for attempt := 0; attempt != 2 && len(received) == 0; attempt++ {
+			client.HandleMetric(&stats.Metric{Type: stats.CounterType, Name: "A", Value: 1})
+			client.Flush()
+
+			select {
+			case ln := <-lines:
+				received = append(received, ln[:strings.LastIndexByte(ln, ' ')])
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+
+		if !reflect.DeepEqual(received, []string{"A 1"}) {
+			t.Errorf("bad lines after reconnecting %d times: %q", i, received)
+		}
+	}
+}
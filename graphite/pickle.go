@@ -0,0 +1,62 @@
+package graphite
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// This file contains a minimal encoder for the payloads of the pickle protocol
+// of carbon, which carry a list of (path, (timestamp, value)) tuples serialized
+// with the version 2 of the python pickle protocol, prefixed with their length
+// as a 32 bits big-endian integer.
+//
+// [1] https://graphite.readthedocs.io/en/latest/feeding-carbon.html#the-pickle-protocol
+
+const (
+	pickleProto      = 0x80
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleAppends    = 'e'
+	pickleBinUnicode = 'X'
+	pickleLong1      = 0x8a
+	pickleBinFloat   = 'G'
+	pickleTuple2     = 0x86
+	pickleStop       = '.'
+)
+
+// point is a single data point sent to carbon.
+type point struct {
+	path  string
+	value float64
+}
+
+// appendPickle appends the pickle protocol payload for points to b.
+func appendPickle(b []byte, points []point, t time.Time) []byte {
+	off := len(b)
+	b = append(b, 0, 0, 0, 0) // length, set once the payload is complete
+	b = append(b, pickleProto, 2, pickleEmptyList)
+
+	if len(points) != 0 {
+		b = append(b, pickleMark)
+
+		for _, p := range points {
+			b = append(b, pickleBinUnicode)
+			b = binary.LittleEndian.AppendUint32(b, uint32(len(p.path)))
+			b = append(b, p.path...)
+			// LONG1 with 8 bytes holds any unix timestamp, BININT would
+			// overflow in 2038.
+			b = append(b, pickleLong1, 8)
+			b = binary.LittleEndian.AppendUint64(b, uint64(t.Unix()))
+			b = append(b, pickleBinFloat)
+			b = binary.BigEndian.AppendUint64(b, math.Float64bits(p.value))
+			b = append(b, pickleTuple2, pickleTuple2)
+		}
+
+		b = append(b, pickleAppends)
+	}
+
+	b = append(b, pickleStop)
+	binary.BigEndian.PutUint32(b[off:], uint32(len(b)-off-4))
+	return b
+}
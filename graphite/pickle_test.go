@@ -0,0 +1,36 @@
+package graphite
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestAppendPickle(t *testing.T) {
+	b := appendPickle(nil, []point{{"a.b", 1.5}}, time.Unix(1500000000, 0))
+
+	// Decodes to [('a.b', (1500000000, 1.5))] with pickle.loads, prefixed
+	// with its length as carbon expects.
+	expected := []byte{
+		0x00, 0x00, 0x00, 0x23, // length
+		0x80, 0x02, // PROTO 2
+		']', '(', // EMPTY_LIST, MARK
+		'X', 0x03, 0x00, 0x00, 0x00, 'a', '.', 'b', // BINUNICODE
+		0x8a, 0x08, 0x00, 0x2f, 0x68, 0x59, 0x00, 0x00, 0x00, 0x00, // LONG1
+		'G', 0x3f, 0xf8, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, // BINFLOAT
+		0x86, 0x86, // TUPLE2, TUPLE2
+		'e', '.', // APPENDS, STOP
+	}
+
+	if !bytes.Equal(b, expected) {
+		t.Errorf("bad pickle payload:\n- % x\n- % x", expected, b)
+	}
+}
+
+func TestAppendPickleEmpty(t *testing.T) {
+	b := appendPickle(nil, nil, time.Unix(0, 0))
+
+	if !bytes.Equal(b, []byte{0, 0, 0, 4, 0x80, 0x02, ']', '.'}) {
+		t.Errorf("bad pickle payload: % x", b)
+	}
+}
@@ -0,0 +1,76 @@
+package influxdb
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+// appendMetric appends the line protocol representation of m to b.
+//
+// The metric namespace is used as measurement and the name as field key, the
+// field key is "value" and the name is used as measurement when the namespace
+// is empty. Counters are written as integer fields, fractional increments are
+// rounded to the nearest integer, and other metrics as float fields. InfluxDB
+// rejects writes that change the type of a field, so the type only depends on
+// the kind of metric.
+//
+// The line protocol cannot represent NaN and infinite values, the caller must
+// discard the metrics that have one.
+func appendMetric(b []byte, m *stats.Metric, t time.Time, precision Precision) []byte {
+	measurement, field := m.Namespace, m.Name
+
+	if len(measurement) == 0 {
+		measurement, field = m.Name, "value"
+	}
+
+	b = appendEscaped(b, measurement, false)
+
+	for _, tag := range m.Tags {
+		if len(tag.Name) != 0 && len(tag.Value) != 0 {
+			b = append(b, ',')
+			b = appendEscaped(b, tag.Name, true)
+			b = append(b, '=')
+			b = appendEscaped(b, tag.Value, true)
+		}
+	}
+
+	b = append(b, ' ')
+	b = appendEscaped(b, field, true)
+	b = append(b, '=')
+
+	if m.Type == stats.CounterType {
+		b = strconv.AppendInt(b, int64(math.Round(m.Value)), 10)
+		b = append(b, 'i')
+	} else {
+		b = strconv.AppendFloat(b, m.Value, 'g', -1, 64)
+	}
+
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, t.UnixNano()/int64(precision.duration()), 10)
+	return append(b, '\n')
+}
+
+// appendEscaped appends s to b, escaping the characters that have a special
+// meaning in the line protocol. Equal signs only need to be escaped in keys and
+// tag values, which is what the key argument indicates.
+func appendEscaped(b []byte, s string, key bool) []byte {
+	for i := 0; i != len(s); i++ {
+		switch c := s[i]; c {
+		case ',', ' ':
+			b = append(b, '\\', c)
+		case '=':
+			if key {
+				b = append(b, '\\')
+			}
+			b = append(b, c)
+		case '\n', '\r':
+			b = append(b, '_')
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
@@ -0,0 +1,66 @@
+package influxdb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+func TestAppendMetric(t *testing.T) {
+	now := time.Unix(1500000000, 123456789)
+
+	tests := []struct {
+		m         stats.Metric
+		precision Precision
+		s         string
+	}{
+		{
+			m:         stats.Metric{Type: stats.CounterType, Namespace: "app", Name: "requests", Value: 2},
+			precision: Nanosecond,
+			s:         "app requests=2i 1500000000123456789\n",
+		},
+		{
+			m:         stats.Metric{Type: stats.CounterType, Namespace: "app", Name: "requests", Value: 1.6},
+			precision: Nanosecond,
+			s:         "app requests=2i 1500000000123456789\n",
+		},
+		{
+			m:         stats.Metric{Type: stats.GaugeType, Namespace: "app", Name: "queue", Value: 0.5, Tags: []stats.Tag{{"host", "a"}, {"empty", ""}}},
+			precision: Millisecond,
+			s:         "app,host=a queue=0.5 1500000000123\n",
+		},
+		{
+			m:         stats.Metric{Type: stats.HistogramType, Name: "rtt", Value: 1.5},
+			precision: Second,
+			s:         "rtt value=1.5 1500000000\n",
+		},
+		{
+			m:         stats.Metric{Type: stats.HistogramType, Namespace: "my app,v=1", Name: "a b=c", Value: 1, Tags: []stats.Tag{{"k=1", "v 1,2"}}},
+			precision: Microsecond,
+			s:         "my\\ app\\,v=1,k\\=1=v\\ 1\\,2 a\\ b\\=c=1 1500000000123456\n",
+		},
+	}
+
+	for _, test := range tests {
+		if s := string(appendMetric(nil, &test.m, now, test.precision)); s != test.s {
+			t.Errorf("\n<<< %#v\n>>> %#v", test.s, s)
+		}
+	}
+}
+
+func BenchmarkAppendMetric(b *testing.B) {
+	buffer := make([]byte, 4096)
+	now := time.Now()
+	m := &stats.Metric{
+		Type:      stats.CounterType,
+		Namespace: "app",
+		Name:      "requests",
+		Value:     1,
+		Tags:      []stats.Tag{{"host", "localhost"}, {"status", "200"}},
+	}
+
+	for i := 0; i != b.N; i++ {
+		appendMetric(buffer[:0], m, now, Nanosecond)
+	}
+}
@@ -0,0 +1,499 @@
+package influxdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+const (
+	// DefaultAddress is the default address of the InfluxDB server.
+	DefaultAddress = "http://localhost:8086"
+
+	// DefaultBatchSize is the default maximum number of lines sent to the
+	// server in a single request.
+	DefaultBatchSize = 1000
+
+	// DefaultFlushInterval is the default interval at which clients send the
+	// metrics they have buffered.
+	DefaultFlushInterval = 1 * time.Second
+
+	// DefaultMaxRetries is the default number of times a request is retried
+	// when the server is unavailable.
+	DefaultMaxRetries = 3
+
+	// DefaultTimeout is the default timeout of HTTP requests.
+	DefaultTimeout = 10 * time.Second
+
+	// DefaultQueueSize is the default number of batches waiting to be sent
+	// before clients start discarding metrics.
+	DefaultQueueSize = 8
+
+	// DefaultUDPPayloadSize is the default maximum size of the datagrams sent
+	// to a UDP listener, datagrams of this size fit in the MTU of most
+	// networks.
+	DefaultUDPPayloadSize = 1432
+)
+
+// Precision is an enumeration of the time precisions supported by InfluxDB.
+type Precision string
+
+const (
+	Nanosecond  Precision = "ns"
+	Microsecond Precision = "us"
+	Millisecond Precision = "ms"
+	Second      Precision = "s"
+)
+
+func (p Precision) duration() time.Duration {
+	switch p {
+	case Microsecond:
+		return time.Microsecond
+	case Millisecond:
+		return time.Millisecond
+	case Second:
+		return time.Second
+	default:
+		return time.Nanosecond
+	}
+}
+
+// v1 returns the value of the precision parameter of the /write endpoint of
+// InfluxDB 1.x, which uses different symbols than the 2.x API.
+func (p Precision) v1() string {
+	switch p {
+	case Microsecond:
+		return "u"
+	case Millisecond:
+		return "ms"
+	case Second:
+		return "s"
+	default:
+		return "n"
+	}
+}
+
+// The ClientConfig type is used to configure InfluxDB clients.
+type ClientConfig struct {
+	// Address of the InfluxDB server, either an HTTP URL or a UDP address
+	// prefixed with "udp://".
+	Address string
+
+	// Database is the database that metrics are written to, used with the
+	// /write endpoint of InfluxDB 1.x.
+	Database string
+
+	// Organization and Bucket that metrics are written to with the
+	// /api/v2/write endpoint, which is used when Bucket is set.
+	Organization string
+	Bucket       string
+
+	// Token is sent in the Authorization header of requests when not empty.
+	Token string
+
+	// Precision of the timestamps sent to the server, the default is to use
+	// nanoseconds.
+	Precision Precision
+
+	// BatchSize is the maximum number of lines sent to the server at once.
+	BatchSize int
+
+	// FlushInterval is the interval at which the client sends the metrics it
+	// has buffered. Setting a negative value disables background flushes.
+	FlushInterval time.Duration
+
+	// Gzip enables compression of the request bodies.
+	Gzip bool
+
+	// MaxRetries is the number of times a request is retried when it failed
+	// with a network error, a 429 or a 5xx response.
+	MaxRetries int
+
+	// Timeout of HTTP requests.
+	Timeout time.Duration
+
+	// Transport is the HTTP transport used by the client, the default
+	// transport is used when nil.
+	Transport http.RoundTripper
+
+	// QueueSize is the number of full batches waiting to be sent before the
+	// client starts discarding metrics.
+	QueueSize int
+
+	// UDPPayloadSize is the maximum size of the datagrams sent when the
+	// address is a UDP address.
+	UDPPayloadSize int
+}
+
+// Client represents an InfluxDB client that pulls metrics from a stats engine
+// and forward them to an InfluxDB server.
+//
+// Each metric is written as a point of the measurement named after the metric
+// namespace, its name is the field key and its tags are the point tags. Counters
+// are integer fields, other metrics are float fields.
+type Client struct {
+	config ClientConfig
+	url    string
+	client *http.Client
+	udp    net.Conn // only used by the sendLoop goroutine until the client is closed
+
+	// buffered lines, synchronized on mutex
+	mutex  sync.Mutex
+	batch  *batch
+	closed bool
+
+	queue chan *batch
+	pool  sync.Pool
+	once  sync.Once
+	done  chan struct{}
+	join  chan struct{}
+	sent  chan struct{}
+}
+
+type batch struct {
+	b     []byte
+	lines int
+	done  chan struct{}
+}
+
+// NewClient creates and returns a new InfluxDB client writing metrics to the
+// database of the InfluxDB 1.x server at addr.
+func NewClient(addr string, database string) *Client {
+	return NewClientWith(ClientConfig{
+		Address:  addr,
+		Database: database,
+	})
+}
+
+// NewClientWith creates and returns a new InfluxDB client configured with
+// config.
+func NewClientWith(config ClientConfig) *Client {
+	config = setClientConfigDefaults(config)
+
+	c := &Client{
+		config: config,
+		queue:  make(chan *batch, config.QueueSize),
+		done:   make(chan struct{}),
+		join:   make(chan struct{}),
+		sent:   make(chan struct{}),
+	}
+	c.pool.New = func() interface{} { return &batch{} }
+	c.batch = c.pool.Get().(*batch)
+
+	if strings.HasPrefix(config.Address, "udp://") {
+		// Failing to open the connection is not fatal, it's opened again
+		// when the next batch is sent.
+		c.udp, _ = c.dialUDP()
+	} else {
+		c.url = writeURL(config)
+		c.client = &http.Client{
+			Transport: config.Transport,
+			Timeout:   config.Timeout,
+		}
+	}
+
+	go c.sendLoop()
+
+	if config.FlushInterval > 0 {
+		go c.run(config.FlushInterval)
+	} else {
+		close(c.join)
+	}
+
+	return c
+}
+
+func setClientConfigDefaults(config ClientConfig) ClientConfig {
+	if len(config.Address) == 0 {
+		config.Address = DefaultAddress
+	}
+
+	if len(config.Precision) == 0 {
+		config.Precision = Nanosecond
+	}
+
+	if config.BatchSize <= 0 {
+		config.BatchSize = DefaultBatchSize
+	}
+
+	if config.FlushInterval == 0 {
+		config.FlushInterval = DefaultFlushInterval
+	}
+
+	if config.MaxRetries == 0 {
+		config.MaxRetries = DefaultMaxRetries
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = DefaultTimeout
+	}
+
+	if config.QueueSize <= 0 {
+		config.QueueSize = DefaultQueueSize
+	}
+
+	if config.UDPPayloadSize <= 0 {
+		config.UDPPayloadSize = DefaultUDPPayloadSize
+	}
+
+	return config
+}
+
+func writeURL(config ClientConfig) string {
+	query := url.Values{}
+	path := "/write"
+
+	if len(config.Bucket) != 0 {
+		path = "/api/v2/write"
+		query.Set("org", config.Organization)
+		query.Set("bucket", config.Bucket)
+		query.Set("precision", string(config.Precision))
+	} else {
+		query.Set("db", config.Database)
+		query.Set("precision", config.Precision.v1())
+	}
+
+	return strings.TrimSuffix(config.Address, "/") + path + "?" + query.Encode()
+}
+
+func (c *Client) run(flushInterval time.Duration) {
+	defer close(c.join)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.Flush()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Client) sendLoop() {
+	defer close(c.sent)
+
+	for b := range c.queue {
+		if err := c.send(b.b); err != nil {
+			log.Printf("stats/influxdb: discarding %d metrics, sending to %s failed: %s", b.lines, c.config.Address, err)
+		}
+
+		if b.done != nil {
+			close(b.done)
+		}
+
+		b.b, b.lines, b.done = b.b[:0], 0, nil
+		c.pool.Put(b)
+	}
+}
+
+// Close satisfies the io.Closer interface.
+//
+// The method stops the background flushes and sends the metrics remaining in
+// the client buffer before returning.
+func (c *Client) Close() (err error) {
+	c.once.Do(func() {
+		close(c.done)
+		<-c.join
+		c.Flush()
+
+		c.mutex.Lock()
+		c.closed = true
+		close(c.queue)
+		c.mutex.Unlock()
+
+		<-c.sent
+
+		if c.udp != nil {
+			err = c.udp.Close()
+		}
+	})
+	return
+}
+
+// Flush satisfies the stats.Flusher interface.
+//
+// The method returns after the buffered metrics were sent. They are discarded
+// if the queue of batches is full, like they are when the batches filled by
+// HandleMetric can't be queued, so the client never blocks the program.
+func (c *Client) Flush() {
+	c.mutex.Lock()
+
+	if c.closed || c.batch.lines == 0 {
+		c.mutex.Unlock()
+		return
+	}
+
+	b, done := c.batch, make(chan struct{})
+	b.done = done
+
+	select {
+	case c.queue <- b:
+		c.batch = c.pool.Get().(*batch)
+	default:
+		log.Printf("stats/influxdb: discarding %d metrics, the queue of batches is full", b.lines)
+		b.b, b.lines, b.done = b.b[:0], 0, nil
+		done = nil
+	}
+
+	c.mutex.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// HandleMetric satisfies the stats.Handler interface.
+func (c *Client) HandleMetric(m *stats.Metric) {
+	t := m.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	// The line protocol cannot represent these values, a line carrying one
+	// would cause the server to reject the whole batch.
+	if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	c.batch.b = appendMetric(c.batch.b, m, t, c.config.Precision)
+
+	if c.batch.lines++; c.batch.lines >= c.config.BatchSize {
+		select {
+		case c.queue <- c.batch:
+		default:
+			log.Printf("stats/influxdb: discarding %d metrics, the queue of batches is full", c.batch.lines)
+			c.batch.b, c.batch.lines = c.batch.b[:0], 0
+			return
+		}
+		c.batch = c.pool.Get().(*batch)
+	}
+}
+
+func (c *Client) send(b []byte) error {
+	if c.client == nil {
+		return c.sendUDP(b)
+	}
+
+	body := b
+
+	if c.config.Gzip {
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		zw.Write(b)
+		zw.Close()
+		body = buf.Bytes()
+	}
+
+	var err error
+	var backoff = 100 * time.Millisecond
+
+	for attempt := 0; attempt <= c.config.MaxRetries; attempt++ {
+		if attempt != 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+
+		var retry bool
+
+		if retry, err = c.post(body); err == nil || !retry {
+			break
+		}
+	}
+
+	return err
+}
+
+// post sends a write request with body, returning whether the request should
+// be retried when it failed.
+func (c *Client) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	if c.config.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	if len(c.config.Token) != 0 {
+		req.Header.Set("Authorization", "Token "+c.config.Token)
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 == 2 {
+		io.Copy(io.Discard, res.Body)
+		return false, nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	err = fmt.Errorf("%s: %s", res.Status, bytes.TrimSpace(msg))
+	retry = res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+	return
+}
+
+func (c *Client) dialUDP() (net.Conn, error) {
+	addr := strings.TrimPrefix(c.config.Address, "udp://")
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		log.Printf("stats/influxdb: opening a connection to %s failed: %s", addr, err)
+	}
+	return conn, err
+}
+
+// sendUDP writes the lines of b in datagrams of at most UDPPayloadSize bytes,
+// lines are never split across datagrams.
+func (c *Client) sendUDP(b []byte) (err error) {
+	if c.udp == nil {
+		if c.udp, err = c.dialUDP(); err != nil {
+			return
+		}
+	}
+
+	for len(b) != 0 {
+		n := len(b)
+
+		if n > c.config.UDPPayloadSize {
+			if n = bytes.LastIndexByte(b[:c.config.UDPPayloadSize], '\n') + 1; n == 0 {
+				// The first line is larger than the payload size, it is
+				// sent alone.
+				n = bytes.IndexByte(b, '\n') + 1
+			}
+		}
+
+		if _, e := c.udp.Write(b[:n]); e != nil && err == nil {
+			err = e
+		}
+
+		b = b[n:]
+	}
+
+	return
+}
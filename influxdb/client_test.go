@@ -0,0 +1,334 @@
+package influxdb
+
+import (
+	"compress/gzip"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+type testRequest struct {
+	path    string
+	query   string
+	headers http.Header
+	body    string
+}
+
+func startTestServer(t *testing.T, status ...int) (*httptest.Server, <-chan testRequest) {
+	var count int32
+	requests := make(chan testRequest, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body io.Reader = r.Body
+
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			body = zr
+		}
+
+		b, _ := io.ReadAll(body)
+		requests <- testRequest{
+			path:    r.URL.Path,
+			query:   r.URL.RawQuery,
+			headers: r.Header,
+			body:    string(b),
+		}
+
+		if i := int(atomic.AddInt32(&count, 1)) - 1; i < len(status) {
+			w.WriteHeader(status[i])
+		} else {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+
+	return server, requests
+}
+
+func TestClientV1(t *testing.T) {
+	server, requests := startTestServer(t)
+	defer server.Close()
+
+	client := NewClientWith(ClientConfig{
+		Address:       server.URL,
+		Database:      "test",
+		Precision:     Second,
+		FlushInterval: -1,
+	})
+	defer client.Close()
+
+	engine := stats.NewEngine("app")
+	engine.Register(client)
+	engine.Add("requests", 1, stats.Tag{"status", "200"})
+	engine.Set("queue", 2)
+	engine.Flush()
+
+	r := <-requests
+
+	if r.path != "/write" {
+		t.Error("bad path:", r.path)
+	}
+
+	if r.query != "db=test&precision=s" {
+		t.Error("bad query:", r.query)
+	}
+
+	lines := strings.Split(strings.TrimSpace(r.body), "\n")
+
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "app,status=200 requests=1i ") || !strings.HasPrefix(lines[1], "app queue=2 ") {
+		t.Errorf("bad body: %q", r.body)
+	}
+}
+
+func TestClientV2Gzip(t *testing.T) {
+	server, requests := startTestServer(t)
+	defer server.Close()
+
+	client := NewClientWith(ClientConfig{
+		Address:       server.URL,
+		Organization:  "org",
+		Bucket:        "bucket",
+		Token:         "secret",
+		Gzip:          true,
+		Precision:     Millisecond,
+		FlushInterval: -1,
+	})
+	defer client.Close()
+
+	client.HandleMetric(&stats.Metric{Type: stats.GaugeType, Name: "A", Value: 1, Time: time.Unix(1, 0)})
+	client.Flush()
+
+	r := <-requests
+
+	if r.path != "/api/v2/write" {
+		t.Error("bad path:", r.path)
+	}
+
+	if r.query != "bucket=bucket&org=org&precision=ms" {
+		t.Error("bad query:", r.query)
+	}
+
+	if auth := r.headers.Get("Authorization"); auth != "Token secret" {
+		t.Error("bad authorization header:", auth)
+	}
+
+	if r.body != "A value=1 1000\n" {
+		t.Errorf("bad body: %q", r.body)
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	server, requests := startTestServer(t, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	defer server.Close()
+
+	client := NewClientWith(ClientConfig{
+		Address:       server.URL,
+		Database:      "test",
+		FlushInterval: -1,
+	})
+	defer client.Close()
+
+	client.HandleMetric(&stats.Metric{Type: stats.CounterType, Name: "A", Value: 1})
+	client.Flush()
+
+	if n := len(requests); n != 3 {
+		t.Error("bad number of requests:", n)
+	}
+}
+
+func TestClientNoRetryOnBadRequest(t *testing.T) {
+	server, requests := startTestServer(t, http.StatusBadRequest)
+	defer server.Close()
+
+	client := NewClientWith(ClientConfig{
+		Address:       server.URL,
+		Database:      "test",
+		FlushInterval: -1,
+	})
+	defer client.Close()
+
+	client.HandleMetric(&stats.Metric{Type: stats.CounterType, Name: "A", Value: 1})
+	client.Flush()
+
+	if n := len(requests); n != 1 {
+		t.Error("bad number of requests:", n)
+	}
+}
+
+func TestClientBatchSize(t *testing.T) {
+	server, requests := startTestServer(t)
+	defer server.Close()
+
+	client := NewClientWith(ClientConfig{
+		Address:       server.URL,
+		Database:      "test",
+		BatchSize:     2,
+		FlushInterval: -1,
+	})
+	defer client.Close()
+
+	for i := 0; i != 5; i++ {
+		client.HandleMetric(&stats.Metric{Type: stats.CounterType, Name: "A", Value: 1})
+	}
+	client.Flush()
+
+	for _, n := range []int{2, 2, 1} {
+		select {
+		case r := <-requests:
+			if c := strings.Count(r.body, "\n"); c != n {
+				t.Errorf("bad batch size: %d != %d", n, c)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for batches")
+		}
+	}
+}
+
+func TestClientUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := NewClientWith(ClientConfig{
+		Address:        "udp://" + conn.LocalAddr().String(),
+		UDPPayloadSize: 30,
+		Precision:      Second,
+		FlushInterval:  -1,
+	})
+	defer client.Close()
+
+	for i := 0; i != 3; i++ {
+		client.HandleMetric(&stats.Metric{Type: stats.CounterType, Name: "A", Value: 1, Time: time.Unix(1, 0)})
+	}
+	client.Flush()
+
+	b := make([]byte, 1024)
+
+	// Each line is 13 bytes long, two of them fit in a datagram.
+	for _, expected := range []string{"A value=1i 1\nA value=1i 1\n", "A value=1i 1\n"} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := string(b[:n]); s != expected {
+			t.Errorf("bad datagram: %q", s)
+		}
+	}
+}
+
+func TestClientUDPRedial(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client := NewClientWith(ClientConfig{
+		Address:       "udp://" + conn.LocalAddr().String(),
+		Precision:     Second,
+		FlushInterval: -1,
+	})
+	defer client.Close()
+
+	// Simulates a connection that failed to be opened by the constructor.
+	client.udp.Close()
+	client.udp = nil
+
+	client.HandleMetric(&stats.Metric{Type: stats.GaugeType, Name: "A", Value: 1, Time: time.Unix(1, 0)})
+	client.Flush()
+
+	b := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	n, _, err := conn.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b[:n]); s != "A value=1 1\n" {
+		t.Errorf("bad datagram: %q", s)
+	}
+}
+
+func TestClientDiscardNonFinite(t *testing.T) {
+	server, requests := startTestServer(t)
+	defer server.Close()
+
+	client := NewClientWith(ClientConfig{
+		Address:       server.URL,
+		Database:      "test",
+		Precision:     Second,
+		FlushInterval: -1,
+	})
+	defer client.Close()
+
+	client.HandleMetric(&stats.Metric{Type: stats.GaugeType, Name: "A", Value: math.NaN(), Time: time.Unix(1, 0)})
+	client.HandleMetric(&stats.Metric{Type: stats.GaugeType, Name: "B", Value: math.Inf(1), Time: time.Unix(1, 0)})
+	client.HandleMetric(&stats.Metric{Type: stats.GaugeType, Name: "C", Value: 1, Time: time.Unix(1, 0)})
+	client.Flush()
+
+	if r := <-requests; r.body != "C value=1 1\n" {
+		t.Errorf("bad body: %q", r.body)
+	}
+}
+
+func TestClientFlushQueueFull(t *testing.T) {
+	received := make(chan struct{}, 10)
+	unblock := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-unblock
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	client := NewClientWith(ClientConfig{
+		Address:       server.URL,
+		Database:      "test",
+		BatchSize:     2,
+		QueueSize:     1,
+		FlushInterval: -1,
+	})
+	defer client.Close()
+	defer close(unblock)
+
+	metric := &stats.Metric{Type: stats.CounterType, Name: "A", Value: 1}
+
+	// The first batch is being sent and the second one fills the queue, the
+	// last metric is left in a partial batch.
+	client.HandleMetric(metric)
+	client.HandleMetric(metric)
+	<-received
+	client.HandleMetric(metric)
+	client.HandleMetric(metric)
+	client.HandleMetric(metric)
+
+	flushed := make(chan struct{})
+	go func() {
+		client.Flush()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+	case <-time.After(time.Second):
+		t.Error("flush blocked while the queue of batches was full")
+	}
+
+	// The metrics can be handled while the queue is full.
+	client.HandleMetric(metric)
+}
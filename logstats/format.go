@@ -0,0 +1,233 @@
+package logstats
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/segmentio/stats"
+)
+
+// Format is an enumeration of the formats in which metrics can be logged.
+type Format int
+
+const (
+	// JSON is the format writing each metric as a JSON object on its own line.
+	JSON Format = iota
+
+	// Logfmt is the format writing each metric as a line of key=value pairs,
+	// tags are written with a "tag." prefix on their names.
+	Logfmt
+)
+
+// String satisfies the fmt.Stringer interface.
+func (f Format) String() string {
+	switch f {
+	case JSON:
+		return "json"
+	case Logfmt:
+		return "logfmt"
+	default:
+		return "unknown"
+	}
+}
+
+const (
+	// tagPrefix is prepended to the names of tags in the logfmt format.
+	tagPrefix = "tag."
+)
+
+var (
+	errUnknownMetricType = errors.New("unknown metric type")
+)
+
+func parseMetricType(s string) (stats.MetricType, error) {
+	switch s {
+	case "counter":
+		return stats.CounterType, nil
+	case "gauge":
+		return stats.GaugeType, nil
+	case "histogram":
+		return stats.HistogramType, nil
+	default:
+		return 0, errUnknownMetricType
+	}
+}
+
+func appendMetric(b []byte, m *stats.Metric, f Format) []byte {
+	switch f {
+	case Logfmt:
+		b = appendLogfmt(b, m)
+	default:
+		b = appendJSON(b, m)
+	}
+	return append(b, '\n')
+}
+
+func appendJSON(b []byte, m *stats.Metric) []byte {
+	b = append(b, `{"time":`...)
+	b = appendJSONString(b, m.Time.Format(time.RFC3339Nano))
+
+	b = append(b, `,"namespace":`...)
+	b = appendJSONString(b, m.Namespace)
+
+	b = append(b, `,"name":`...)
+	b = appendJSONString(b, m.Name)
+
+	b = append(b, `,"type":`...)
+	b = appendJSONString(b, m.Type.String())
+
+	b = append(b, `,"value":`...)
+	b = appendJSONFloat(b, m.Value)
+
+	if len(m.Tags) != 0 {
+		b = append(b, `,"tags":{`...)
+
+		for i, tag := range m.Tags {
+			if i != 0 {
+				b = append(b, ',')
+			}
+			b = appendJSONString(b, tag.Name)
+			b = append(b, ':')
+			b = appendJSONString(b, tag.Value)
+		}
+
+		b = append(b, '}')
+	}
+
+	if len(m.Buckets) != 0 {
+		b = append(b, `,"buckets":[`...)
+
+		for i, v := range m.Buckets {
+			if i != 0 {
+				b = append(b, ',')
+			}
+			b = appendJSONFloat(b, v)
+		}
+
+		b = append(b, ']')
+	}
+
+	return append(b, '}')
+}
+
+// appendJSONFloat writes non-finite values as strings since they can't be
+// represented as JSON numbers.
+func appendJSONFloat(b []byte, v float64) []byte {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return appendJSONString(b, strconv.FormatFloat(v, 'g', -1, 64))
+	}
+	return strconv.AppendFloat(b, v, 'g', -1, 64)
+}
+
+func appendJSONString(b []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	b = append(b, '"')
+
+	for i := 0; i != len(s); {
+		c := s[i]
+
+		if c >= utf8.RuneSelf {
+			r, n := utf8.DecodeRuneInString(s[i:])
+			if r == utf8.RuneError && n == 1 {
+				b = append(b, `�`...)
+			} else {
+				b = append(b, s[i:i+n]...)
+			}
+			i += n
+			continue
+		}
+
+		switch {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c == '\n':
+			b = append(b, '\\', 'n')
+		case c == '\r':
+			b = append(b, '\\', 'r')
+		case c == '\t':
+			b = append(b, '\\', 't')
+		case c < 0x20 || c == 0x7f:
+			b = append(b, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+		default:
+			b = append(b, c)
+		}
+
+		i++
+	}
+
+	return append(b, '"')
+}
+
+func appendLogfmt(b []byte, m *stats.Metric) []byte {
+	b = append(b, "time="...)
+	b = m.Time.AppendFormat(b, time.RFC3339Nano)
+
+	b = append(b, " namespace="...)
+	b = appendLogfmtValue(b, m.Namespace)
+
+	b = append(b, " name="...)
+	b = appendLogfmtValue(b, m.Name)
+
+	b = append(b, " type="...)
+	b = append(b, m.Type.String()...)
+
+	b = append(b, " value="...)
+	b = strconv.AppendFloat(b, m.Value, 'g', -1, 64)
+
+	if len(m.Buckets) != 0 {
+		b = append(b, " buckets="...)
+
+		for i, v := range m.Buckets {
+			if i != 0 {
+				b = append(b, ',')
+			}
+			b = strconv.AppendFloat(b, v, 'g', -1, 64)
+		}
+	}
+
+	for _, tag := range m.Tags {
+		b = append(b, ' ')
+		b = appendLogfmtKey(b, tagPrefix+tag.Name)
+		b = append(b, '=')
+		b = appendLogfmtValue(b, tag.Value)
+	}
+
+	return b
+}
+
+// appendLogfmtKey replaces the characters that can't be part of keys with
+// underscores.
+func appendLogfmtKey(b []byte, s string) []byte {
+	for i := 0; i != len(s); i++ {
+		switch c := s[i]; {
+		case c <= ' ' || c == '=' || c == '"' || c == 0x7f:
+			b = append(b, '_')
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+func appendLogfmtValue(b []byte, s string) []byte {
+	if needsQuotes(s) {
+		return strconv.AppendQuote(b, s)
+	}
+	return append(b, s...)
+}
+
+func needsQuotes(s string) bool {
+	if len(s) == 0 {
+		return true
+	}
+	for i := 0; i != len(s); i++ {
+		switch c := s[i]; {
+		case c <= ' ' || c == '=' || c == '"' || c == '\\' || c >= 0x7f:
+			return true
+		}
+	}
+	return false
+}
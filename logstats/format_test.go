@@ -0,0 +1,75 @@
+package logstats
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+var testTime = time.Date(2017, 7, 14, 2, 40, 0, 123000000, time.UTC)
+
+func TestAppendMetric(t *testing.T) {
+	tests := []struct {
+		metric stats.Metric
+		json   string
+		logfmt string
+	}{
+		{
+			metric: stats.Metric{
+				Type:      stats.CounterType,
+				Namespace: "app",
+				Name:      "requests",
+				Value:     1,
+				Time:      testTime,
+			},
+			json:   `{"time":"2017-07-14T02:40:00.123Z","namespace":"app","name":"requests","type":"counter","value":1}`,
+			logfmt: `time=2017-07-14T02:40:00.123Z namespace=app name=requests type=counter value=1`,
+		},
+		{
+			metric: stats.Metric{
+				Type:      stats.GaugeType,
+				Namespace: "app",
+				Name:      "queue.size",
+				Value:     0.5,
+				Tags:      []stats.Tag{{"host", "a b"}, {"path", `"/"`}},
+				Time:      testTime,
+			},
+			json:   `{"time":"2017-07-14T02:40:00.123Z","namespace":"app","name":"queue.size","type":"gauge","value":0.5,"tags":{"host":"a b","path":"\"/\""}}`,
+			logfmt: `time=2017-07-14T02:40:00.123Z namespace=app name=queue.size type=gauge value=0.5 tag.host="a b" tag.path="\"/\""`,
+		},
+		{
+			metric: stats.Metric{
+				Type:    stats.HistogramType,
+				Name:    "latency",
+				Value:   1e-05,
+				Buckets: []float64{0.1, 1, 10},
+				Time:    testTime,
+			},
+			json:   `{"time":"2017-07-14T02:40:00.123Z","namespace":"","name":"latency","type":"histogram","value":1e-05,"buckets":[0.1,1,10]}`,
+			logfmt: `time=2017-07-14T02:40:00.123Z namespace="" name=latency type=histogram value=1e-05 buckets=0.1,1,10`,
+		},
+		{
+			metric: stats.Metric{
+				Type:  stats.GaugeType,
+				Name:  "ratio\n",
+				Value: math.Inf(+1),
+				Time:  testTime,
+			},
+			json:   `{"time":"2017-07-14T02:40:00.123Z","namespace":"","name":"ratio\n","type":"gauge","value":"+Inf"}`,
+			logfmt: `time=2017-07-14T02:40:00.123Z namespace="" name="ratio\n" type=gauge value=+Inf`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.metric.Name, func(t *testing.T) {
+			if s := string(appendMetric(nil, &test.metric, JSON)); s != test.json+"\n" {
+				t.Errorf("bad JSON line:\n- expected: %s\n- found:    %s", test.json, s)
+			}
+			if s := string(appendMetric(nil, &test.metric, Logfmt)); s != test.logfmt+"\n" {
+				t.Errorf("bad logfmt line:\n- expected: %s\n- found:    %s", test.logfmt, s)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package logstats
+
+import (
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+// The HandlerConfig type is used to configure log handlers.
+type HandlerConfig struct {
+	// Output is where metrics are written, os.Stderr is used when nil.
+	Output io.Writer
+
+	// Format is the format in which metrics are written, the default is JSON.
+	Format Format
+
+	// FlushInterval enables the aggregation of metrics when greater than zero.
+	// Counters are summed and gauges report their last value over the
+	// interval, histograms report each observed value. The metrics are then
+	// written when the interval expires or when the handler is flushed.
+	//
+	// When zero, every metric is written as soon as it is received.
+	FlushInterval time.Duration
+}
+
+// Handler is a stats handler which writes metrics to an io.Writer, one line
+// per metric.
+//
+// The lines written by handlers can be read back with a Reader, which makes
+// it possible to replay them into a stats engine.
+type Handler struct {
+	output io.Writer
+	format Format
+	now    func() time.Time
+
+	// aggregated metrics, synchronized on mutex
+	mutex     sync.Mutex
+	aggregate bool
+	buffer    []byte
+	metrics   map[string]*stats.Metric // counters and gauges by series
+	order     []*stats.Metric          // all metrics in the order they were reported
+	key       []byte
+	tags      []stats.Tag
+
+	once sync.Once
+	done chan struct{}
+	join chan struct{}
+}
+
+// NewHandler creates and returns a handler writing metrics to w in format f.
+func NewHandler(w io.Writer, f Format) *Handler {
+	return NewHandlerWith(HandlerConfig{
+		Output: w,
+		Format: f,
+	})
+}
+
+// NewHandlerWith creates and returns a handler configured with config.
+func NewHandlerWith(config HandlerConfig) *Handler {
+	if config.Output == nil {
+		config.Output = os.Stderr
+	}
+
+	h := &Handler{
+		output:  config.Output,
+		format:  config.Format,
+		now:     time.Now,
+		metrics: make(map[string]*stats.Metric),
+		done:    make(chan struct{}),
+		join:    make(chan struct{}),
+	}
+
+	if config.FlushInterval > 0 {
+		h.aggregate = true
+		go h.run(config.FlushInterval)
+	} else {
+		close(h.join)
+	}
+
+	return h
+}
+
+func (h *Handler) run(flushInterval time.Duration) {
+	defer close(h.join)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			h.Flush()
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// Close satisfies the io.Closer interface.
+//
+// The method stops the background flushes and writes the metrics aggregated
+// since the last flush.
+func (h *Handler) Close() error {
+	h.once.Do(func() {
+		close(h.done)
+		<-h.join
+		h.Flush()
+	})
+	return nil
+}
+
+// HandleMetric satisfies the stats.Handler interface.
+func (h *Handler) HandleMetric(m *stats.Metric) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.aggregate {
+		h.add(m)
+		return
+	}
+
+	c := *m
+	if c.Time.IsZero() {
+		c.Time = h.now()
+	}
+
+	h.buffer = appendMetric(h.buffer[:0], &c, h.format)
+	h.write(h.buffer)
+}
+
+// Flush satisfies the stats.Flusher interface, it writes the metrics that were
+// aggregated since the last flush.
+func (h *Handler) Flush() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if len(h.order) == 0 {
+		return
+	}
+
+	now := h.now()
+	b := h.buffer[:0]
+
+	for i, m := range h.order {
+		m.Time = now
+		b = appendMetric(b, m, h.format)
+		h.order[i] = nil
+	}
+
+	for k := range h.metrics {
+		delete(h.metrics, k)
+	}
+
+	h.order = h.order[:0]
+	h.buffer = b
+	h.write(b)
+}
+
+// add merges m into the metrics of the current interval. Histograms are never
+// merged since their values can't be combined without losing information.
+func (h *Handler) add(m *stats.Metric) {
+	var k []byte
+
+	if m.Type != stats.HistogramType {
+		h.tags = append(h.tags[:0], m.Tags...)
+		sort.SliceStable(h.tags, func(i, j int) bool { return h.tags[i].Name < h.tags[j].Name })
+
+		k = append(h.key[:0], byte(m.Type))
+		k = append(k, m.Namespace...)
+		k = append(k, 0)
+		k = append(k, m.Name...)
+
+		for _, tag := range h.tags {
+			k = append(k, 0)
+			k = append(k, tag.Name...)
+			k = append(k, 0)
+			k = append(k, tag.Value...)
+		}
+
+		h.key = k
+
+		if a := h.metrics[string(k)]; a != nil {
+			if m.Type == stats.CounterType {
+				a.Value += m.Value
+			} else {
+				a.Value = m.Value
+			}
+			return
+		}
+	}
+
+	a := &stats.Metric{
+		Type:      m.Type,
+		Namespace: m.Namespace,
+		Name:      m.Name,
+		Tags:      append([]stats.Tag{}, m.Tags...),
+		Value:     m.Value,
+		Buckets:   m.Buckets,
+	}
+
+	if k != nil {
+		h.metrics[string(k)] = a
+	}
+
+	h.order = append(h.order, a)
+}
+
+func (h *Handler) write(b []byte) {
+	if _, err := h.output.Write(b); err != nil {
+		log.Printf("stats/logstats: writing metrics failed: %s", err)
+	}
+}
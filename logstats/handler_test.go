@@ -0,0 +1,81 @@
+package logstats
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+func TestHandler(t *testing.T) {
+	b := &bytes.Buffer{}
+	h := NewHandler(b, Logfmt)
+	h.now = func() time.Time { return testTime }
+
+	eng := stats.NewEngine("app", stats.Tag{"env", "test"})
+	eng.Register(h)
+
+	eng.Incr("requests", stats.Tag{"status", "200"})
+	eng.Set("queue.size", 4)
+
+	const expected = `time=2017-07-14T02:40:00.123Z namespace=app name=requests type=counter value=1 tag.env=test tag.status=200
+time=2017-07-14T02:40:00.123Z namespace=app name=queue.size type=gauge value=4 tag.env=test
+`
+
+	if s := b.String(); s != expected {
+		t.Errorf("bad output:\n%s", s)
+	}
+}
+
+func TestHandlerAggregate(t *testing.T) {
+	b := &bytes.Buffer{}
+	h := NewHandlerWith(HandlerConfig{
+		Output:        b,
+		Format:        JSON,
+		FlushInterval: time.Hour,
+	})
+	h.now = func() time.Time { return testTime }
+	defer h.Close()
+
+	eng := stats.NewEngine("app")
+	eng.Register(h)
+
+	eng.Incr("requests", stats.Tag{"a", "1"}, stats.Tag{"b", "2"})
+	eng.Set("queue.size", 4)
+	eng.Observe("latency", 1)
+	eng.Incr("requests", stats.Tag{"b", "2"}, stats.Tag{"a", "1"})
+	eng.Set("queue.size", 2)
+	eng.Observe("latency", 2)
+
+	if b.Len() != 0 {
+		t.Fatalf("metrics were written before the handler was flushed:\n%s", b.String())
+	}
+
+	eng.Flush()
+
+	const expected = `{"time":"2017-07-14T02:40:00.123Z","namespace":"app","name":"requests","type":"counter","value":2,"tags":{"a":"1","b":"2"}}
+{"time":"2017-07-14T02:40:00.123Z","namespace":"app","name":"queue.size","type":"gauge","value":2}
+{"time":"2017-07-14T02:40:00.123Z","namespace":"app","name":"latency","type":"histogram","value":1}
+{"time":"2017-07-14T02:40:00.123Z","namespace":"app","name":"latency","type":"histogram","value":2}
+`
+
+	if s := b.String(); s != expected {
+		t.Errorf("bad output:\n%s", s)
+	}
+
+	b.Reset()
+	eng.Flush()
+
+	if b.Len() != 0 {
+		t.Errorf("metrics were written twice:\n%s", b.String())
+	}
+
+	eng.Incr("requests")
+	h.Close()
+
+	if s := b.String(); !strings.Contains(s, `"name":"requests"`) {
+		t.Errorf("metrics were not written when closing the handler:\n%s", s)
+	}
+}
@@ -0,0 +1,297 @@
+package logstats
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+// Reader reads metrics from lines written by a Handler.
+//
+// The format of each line is detected independently, so files in which JSON
+// and logfmt lines are mixed can be read. Empty lines are skipped.
+type Reader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+// NewReader returns a new Reader reading metrics from r.
+func NewReader(r io.Reader) *Reader {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 0, 4096), 1024*1024)
+	return &Reader{scanner: s}
+}
+
+// Read returns the next metric read from the underlying reader, or io.EOF
+// when the end of the input was reached.
+func (r *Reader) Read() (stats.Metric, error) {
+	for r.scanner.Scan() {
+		r.line++
+		b := bytes.TrimSpace(r.scanner.Bytes())
+
+		if len(b) == 0 {
+			continue
+		}
+
+		var m stats.Metric
+		var err error
+
+		if b[0] == '{' {
+			m, err = parseJSON(b)
+		} else {
+			m, err = parseLogfmt(string(b))
+		}
+
+		if err != nil {
+			err = fmt.Errorf("stats/logstats: line %d: %s", r.line, err)
+		}
+
+		return m, err
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return stats.Metric{}, err
+	}
+
+	return stats.Metric{}, io.EOF
+}
+
+// Replay reads all metrics from r and passes them to the handlers of eng. The
+// metrics are passed unmodified, which means they keep the namespace, tags and
+// time they were written with rather than the ones of eng.
+//
+// The function returns the number of metrics that were replayed, it stops on
+// the first error and returns it.
+func Replay(eng *stats.Engine, r io.Reader) (n int, err error) {
+	reader := NewReader(r)
+	handlers := eng.Handlers()
+
+	for {
+		m, err := reader.Read()
+
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return n, err
+		}
+
+		for _, h := range handlers {
+			c := m
+			c.Tags = append(make([]stats.Tag, 0, len(m.Tags)), m.Tags...)
+			h.HandleMetric(&c)
+		}
+
+		n++
+	}
+}
+
+type jsonMetric struct {
+	Time      time.Time   `json:"time"`
+	Namespace string      `json:"namespace"`
+	Name      string      `json:"name"`
+	Type      string      `json:"type"`
+	Value     jsonFloat   `json:"value"`
+	Tags      jsonTags    `json:"tags"`
+	Buckets   []jsonFloat `json:"buckets"`
+}
+
+func parseJSON(b []byte) (stats.Metric, error) {
+	var j jsonMetric
+
+	if err := json.Unmarshal(b, &j); err != nil {
+		return stats.Metric{}, err
+	}
+
+	typ, err := parseMetricType(j.Type)
+	if err != nil {
+		return stats.Metric{}, err
+	}
+
+	m := stats.Metric{
+		Type:      typ,
+		Namespace: j.Namespace,
+		Name:      j.Name,
+		Tags:      []stats.Tag(j.Tags),
+		Value:     float64(j.Value),
+		Time:      j.Time,
+	}
+
+	if len(j.Buckets) != 0 {
+		m.Buckets = make([]float64, len(j.Buckets))
+		for i, v := range j.Buckets {
+			m.Buckets[i] = float64(v)
+		}
+	}
+
+	return m, nil
+}
+
+// jsonFloat decodes numbers, and strings holding non-finite values.
+type jsonFloat float64
+
+func (f *jsonFloat) UnmarshalJSON(b []byte) error {
+	var v float64
+	var err error
+
+	if len(b) != 0 && b[0] == '"' {
+		var s string
+		if err = json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		v, err = strconv.ParseFloat(s, 64)
+		if err == nil && !(math.IsNaN(v) || math.IsInf(v, 0)) {
+			err = fmt.Errorf("number encoded as a string: %q", s)
+		}
+	} else {
+		err = json.Unmarshal(b, &v)
+	}
+
+	*f = jsonFloat(v)
+	return err
+}
+
+// jsonTags decodes a JSON object into a list of tags, preserving the order in
+// which they were written.
+type jsonTags []stats.Tag
+
+func (t *jsonTags) UnmarshalJSON(b []byte) error {
+	d := json.NewDecoder(bytes.NewReader(b))
+
+	tok, err := d.Token()
+	if err != nil {
+		return err
+	}
+
+	if tok == nil {
+		*t = nil
+		return nil
+	}
+
+	if tok != json.Delim('{') {
+		return errors.New("tags must be encoded as a JSON object")
+	}
+
+	tags := jsonTags{}
+
+	for d.More() {
+		var name, value string
+
+		if tok, err = d.Token(); err != nil {
+			return err
+		}
+		name = tok.(string)
+
+		if err = d.Decode(&value); err != nil {
+			return err
+		}
+
+		tags = append(tags, stats.Tag{Name: name, Value: value})
+	}
+
+	*t = tags
+	return nil
+}
+
+func parseLogfmt(s string) (m stats.Metric, err error) {
+	var hasType bool
+
+	for len(s) != 0 {
+		var key, value string
+
+		if key, value, s, err = parseLogfmtPair(s); err != nil {
+			return
+		}
+
+		switch {
+		case strings.HasPrefix(key, tagPrefix):
+			m.Tags = append(m.Tags, stats.Tag{Name: key[len(tagPrefix):], Value: value})
+
+		case key == "time":
+			m.Time, err = time.Parse(time.RFC3339Nano, value)
+
+		case key == "namespace":
+			m.Namespace = value
+
+		case key == "name":
+			m.Name = value
+
+		case key == "type":
+			m.Type, err = parseMetricType(value)
+			hasType = true
+
+		case key == "value":
+			m.Value, err = strconv.ParseFloat(value, 64)
+
+		case key == "buckets":
+			m.Buckets, err = parseBuckets(value)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	if !hasType {
+		err = errors.New("missing metric type")
+	}
+
+	return
+}
+
+func parseLogfmtPair(s string) (key, value, next string, err error) {
+	s = strings.TrimLeft(s, " ")
+
+	i := strings.IndexByte(s, '=')
+	if i < 0 {
+		err = fmt.Errorf("malformed key=value pair: %q", s)
+		return
+	}
+
+	key, s = s[:i], s[i+1:]
+
+	if strings.HasPrefix(s, `"`) {
+		var quoted string
+
+		if quoted, err = strconv.QuotedPrefix(s); err != nil {
+			err = fmt.Errorf("malformed quoted value of %s: %s", key, err)
+			return
+		}
+
+		value, _ = strconv.Unquote(quoted)
+		next = s[len(quoted):]
+		return
+	}
+
+	if i = strings.IndexByte(s, ' '); i < 0 {
+		value = s
+	} else {
+		value, next = s[:i], s[i+1:]
+	}
+
+	return
+}
+
+func parseBuckets(s string) ([]float64, error) {
+	parts := strings.Split(s, ",")
+	buckets := make([]float64, len(parts))
+
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil {
+			return nil, err
+		}
+		buckets[i] = v
+	}
+
+	return buckets, nil
+}
@@ -0,0 +1,121 @@
+package logstats
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/segmentio/stats"
+)
+
+func TestReader(t *testing.T) {
+	metrics := []stats.Metric{
+		{Type: stats.CounterType, Namespace: "app", Name: "requests", Value: 1, Tags: []stats.Tag{{"status", "200"}, {"host", "a b"}}, Time: testTime},
+		{Type: stats.GaugeType, Namespace: "app", Name: "queue.size", Value: -0.25, Time: testTime},
+		{Type: stats.HistogramType, Name: "latency", Value: 2, Buckets: []float64{0.1, 1, 10}, Time: testTime},
+		{Type: stats.GaugeType, Name: "weird \"name\"\t=", Value: math.Inf(-1), Tags: []stats.Tag{{"", ""}}, Time: testTime},
+	}
+
+	for _, format := range []Format{JSON, Logfmt} {
+		t.Run(format.String(), func(t *testing.T) {
+			var b []byte
+
+			for i := range metrics {
+				b = appendMetric(b, &metrics[i], format)
+				b = append(b, '\n') // empty lines are skipped
+			}
+
+			r := NewReader(bytes.NewReader(b))
+
+			for _, expected := range metrics {
+				m, err := r.Read()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !m.Time.Equal(expected.Time) {
+					t.Errorf("bad time: %s", m.Time)
+				}
+				m.Time = expected.Time
+				if !reflect.DeepEqual(m, expected) {
+					t.Errorf("bad metric:\n- expected: %#v\n- found:    %#v", expected, m)
+				}
+			}
+
+			if _, err := r.Read(); err != io.EOF {
+				t.Errorf("expected io.EOF but got %v", err)
+			}
+		})
+	}
+}
+
+func TestReaderError(t *testing.T) {
+	tests := []string{
+		`{"name":"requests","type":"counter","value":1`,
+		`{"name":"requests","type":"timer","value":1}`,
+		`{"name":"requests","type":"counter","value":"1"}`,
+		`{"name":"requests","type":"counter","value":1,"tags":["a"]}`,
+		`name=requests value=1`,
+		`name=requests type=counter value=one`,
+		`name="requests type=counter value=1`,
+		`name=requests type=counter value=1 buckets=1,,2`,
+		`name=requests type=counter value`,
+	}
+
+	for _, test := range tests {
+		t.Run(test, func(t *testing.T) {
+			r := NewReader(strings.NewReader("\n" + test + "\n"))
+
+			_, err := r.Read()
+			if err == nil || err == io.EOF {
+				t.Fatalf("expected a parse error but got %v", err)
+			}
+			if !strings.Contains(err.Error(), "line 2") {
+				t.Errorf("the error doesn't report the line number: %s", err)
+			}
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	b := &bytes.Buffer{}
+	h := NewHandler(b, JSON)
+
+	src := stats.NewEngine("app", stats.Tag{"env", "test"})
+	src.Register(h)
+	src.SetHistogramBuckets("latency", 1, 10)
+
+	src.Incr("requests")
+	src.Observe("latency", 2)
+
+	var handled []stats.Metric
+
+	dst := stats.NewEngine("replay")
+	dst.Register(stats.HandlerFunc(func(m *stats.Metric) {
+		handled = append(handled, *m)
+	}))
+
+	n, err := Replay(dst, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 2 || len(handled) != 2 {
+		t.Fatalf("bad number of replayed metrics: %d (handled %d)", n, len(handled))
+	}
+
+	for i := range handled {
+		handled[i].Time = testTime
+	}
+
+	expected := []stats.Metric{
+		{Type: stats.CounterType, Namespace: "app", Name: "requests", Value: 1, Tags: []stats.Tag{{"env", "test"}}, Time: testTime},
+		{Type: stats.HistogramType, Namespace: "app", Name: "latency", Value: 2, Tags: []stats.Tag{{"env", "test"}}, Buckets: []float64{1, 10}, Time: testTime},
+	}
+
+	if !reflect.DeepEqual(handled, expected) {
+		t.Errorf("bad replayed metrics:\n- expected: %#v\n- found:    %#v", expected, handled)
+	}
+}
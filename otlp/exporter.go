@@ -0,0 +1,552 @@
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+const (
+	// DefaultEndpoint is the default URL that metrics are exported to, the
+	// OTLP/HTTP receiver of a local collector.
+	DefaultEndpoint = "http://localhost:4318/v1/metrics"
+
+	// DefaultExportInterval is the default interval at which exporters send
+	// the metrics they aggregated.
+	DefaultExportInterval = 10 * time.Second
+
+	// DefaultTimeout is the default timeout of export requests.
+	DefaultTimeout = 10 * time.Second
+
+	// DefaultSeriesTimeout is the default duration after which series that
+	// aren't receiving updates stop being exported.
+	DefaultSeriesTimeout = 5 * time.Minute
+)
+
+// Temporality is an enumeration of the aggregation temporalities of OTLP sums
+// and histograms.
+type Temporality int
+
+const (
+	// Cumulative temporality reports the values accumulated since the series
+	// started on every export.
+	Cumulative Temporality = 2
+
+	// Delta temporality reports the values accumulated since the previous
+	// export.
+	Delta Temporality = 1
+)
+
+// The ExporterConfig type is used to configure OTLP exporters.
+type ExporterConfig struct {
+	// Endpoint is the URL of the OTLP/HTTP receiver that metrics are sent to.
+	Endpoint string
+
+	// Headers are set on the export requests, typically to authenticate
+	// with the receiver.
+	Headers map[string]string
+
+	// Temporality of the counters and histograms, the default is to use the
+	// cumulative temporality.
+	Temporality Temporality
+
+	// ExportInterval is the interval at which the exporter sends metrics.
+	// Setting a negative value disables background exports, metrics are then
+	// only sent when the exporter is flushed.
+	ExportInterval time.Duration
+
+	// Gzip enables compression of the request bodies.
+	Gzip bool
+
+	// Timeout of export requests.
+	Timeout time.Duration
+
+	// SeriesTimeout is the duration after which series that aren't receiving
+	// updates are removed from the exporter, they start over if they receive
+	// updates again. Setting a negative value retains series forever.
+	SeriesTimeout time.Duration
+
+	// Transport is the HTTP transport used by the exporter, the default
+	// transport is used when nil.
+	Transport http.RoundTripper
+}
+
+// Exporter is a stats handler which aggregates metrics and exports them to an
+// OTLP/HTTP receiver.
+//
+// Counters are exported as monotonic sums, or non-monotonic sums once a negative
+// value was added to them, gauges as gauges, and histograms as histograms with
+// explicit bounds set to the buckets configured on the engine.
+//
+// With the delta temporality, the values of series are only reset after they
+// were exported successfully, they are exported again with the values
+// accumulated since then by the next export otherwise. The min and max of
+// histograms then only cover the values observed since the last export.
+//
+// The name and tags of the engine that the exporter is created for are set as
+// the service.name and attributes of the resource, the engine tags are removed
+// from the attributes of the data points.
+type Exporter struct {
+	config   ExporterConfig
+	client   *http.Client
+	engine   string
+	tags     []stats.Tag
+	resource []byte
+
+	// aggregated series, synchronized on mutex
+	mutex  sync.Mutex
+	series map[string]*series
+	key    []byte
+
+	emutex sync.Mutex // serializes exports
+
+	once sync.Once
+	done chan struct{}
+	join chan struct{}
+}
+
+// series is the aggregated state of a time series.
+type series struct {
+	name    string
+	typ     stats.MetricType
+	attrs   []stats.Tag
+	start   time.Time
+	last    time.Time // time of the last update
+	updated bool
+	signed  bool // a negative value was added to the counter
+	count   uint64
+	value   float64 // sum of counters and histograms, last value of gauges
+	min     float64
+	max     float64
+	bounds  []float64
+	counts  []uint64
+
+	// Histogram values observed since the series was last exported with the
+	// delta temporality, they become the min and max of the series once the
+	// export succeeded.
+	fresh uint64
+	fmin  float64
+	fmax  float64
+}
+
+// NewExporter creates an exporter for the metrics produced by eng, sending them
+// to the OTLP/HTTP receiver at endpoint. The exporter must be registered on the
+// engine.
+func NewExporter(eng *stats.Engine, endpoint string) *Exporter {
+	return NewExporterWith(eng, ExporterConfig{
+		Endpoint: endpoint,
+	})
+}
+
+// NewExporterWith creates an exporter for the metrics produced by eng,
+// configured with config. The exporter must be registered on the engine.
+func NewExporterWith(eng *stats.Engine, config ExporterConfig) *Exporter {
+	if len(config.Endpoint) == 0 {
+		config.Endpoint = DefaultEndpoint
+	}
+
+	if config.Temporality == 0 {
+		config.Temporality = Cumulative
+	}
+
+	if config.ExportInterval == 0 {
+		config.ExportInterval = DefaultExportInterval
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = DefaultTimeout
+	}
+
+	if config.SeriesTimeout == 0 {
+		config.SeriesTimeout = DefaultSeriesTimeout
+	}
+
+	tags := eng.Tags()
+	attrs := make([]stats.Tag, 0, len(tags)+1)
+	attrs = append(attrs, stats.Tag{"service.name", eng.Name()})
+	attrs = append(attrs, tags...)
+
+	e := &Exporter{
+		config:   config,
+		client:   &http.Client{Transport: config.Transport, Timeout: config.Timeout},
+		engine:   eng.Name(),
+		tags:     tags,
+		resource: appendResource(nil, attrs),
+		series:   make(map[string]*series),
+		done:     make(chan struct{}),
+		join:     make(chan struct{}),
+	}
+
+	if config.ExportInterval > 0 {
+		go e.run(config.ExportInterval)
+	} else {
+		close(e.join)
+	}
+
+	return e
+}
+
+func (e *Exporter) run(interval time.Duration) {
+	defer close(e.join)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.Flush()
+		case <-e.done:
+			return
+		}
+	}
+}
+
+// Close satisfies the io.Closer interface.
+//
+// The method stops the background exports and sends the metrics aggregated
+// since the last export.
+func (e *Exporter) Close() error {
+	e.once.Do(func() {
+		close(e.done)
+		<-e.join
+		e.Flush()
+	})
+	return nil
+}
+
+// HandleMetric satisfies the stats.Handler interface.
+func (e *Exporter) HandleMetric(m *stats.Metric) {
+	now := m.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	attrs := e.attributes(m.Tags)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	k := append(e.key[:0], byte(m.Type))
+	k = append(k, m.Namespace...)
+	k = append(k, 0)
+	k = append(k, m.Name...)
+	for _, attr := range attrs {
+		k = append(k, 0)
+		k = append(k, attr.Name...)
+		k = append(k, 0)
+		k = append(k, attr.Value...)
+	}
+	e.key = k
+
+	s := e.series[string(k)]
+
+	if s == nil {
+		s = &series{
+			name:  e.metricName(m),
+			typ:   m.Type,
+			attrs: append([]stats.Tag{}, attrs...),
+			start: now,
+		}
+		e.series[string(k)] = s
+	}
+
+	if m.Type == stats.HistogramType && (s.counts == nil || !equalBounds(s.bounds, m.Buckets)) {
+		// The bounds changed, the counts are meaningless with the new
+		// buckets so a new series is started.
+		s.bounds = append(s.bounds[:0], m.Buckets...)
+		s.counts = make([]uint64, len(s.bounds)+1)
+		s.count, s.value, s.start, s.fresh = 0, 0, now, 0
+	}
+
+	s.updated = true
+	s.last = now
+
+	switch m.Type {
+	case stats.GaugeType:
+		s.value = m.Value
+
+	case stats.HistogramType:
+		s.min, s.max = observeMinMax(s.min, s.max, s.count, m.Value)
+		s.fmin, s.fmax = observeMinMax(s.fmin, s.fmax, s.fresh, m.Value)
+		s.count++
+		s.fresh++
+		s.value += m.Value
+		// Buckets are upper-inclusive, the first bucket with a bound
+		// greater or equal to the value is the one it falls into.
+		s.counts[sort.SearchFloat64s(s.bounds, m.Value)]++
+
+	default:
+		s.value += m.Value
+		s.signed = s.signed || m.Value < 0
+	}
+}
+
+// observeMinMax returns the min and max of count values updated with value.
+func observeMinMax(min, max float64, count uint64, value float64) (float64, float64) {
+	if count == 0 {
+		return value, value
+	}
+	return math.Min(min, value), math.Max(max, value)
+}
+
+// attributes returns tags without the engine tags that the engine sets first on
+// the metrics it produces.
+func (e *Exporter) attributes(tags []stats.Tag) []stats.Tag {
+	if len(tags) < len(e.tags) {
+		return tags
+	}
+	for i, tag := range e.tags {
+		if tags[i] != tag {
+			return tags
+		}
+	}
+	return tags[len(e.tags):]
+}
+
+// metricName returns the name of the OTLP metric, metrics produced by engines
+// derived from the one the exporter was created for (with stats.WithName for
+// example) are prefixed with their namespace.
+func (e *Exporter) metricName(m *stats.Metric) string {
+	if len(m.Namespace) == 0 || m.Namespace == e.engine {
+		return m.Name
+	}
+	return m.Namespace + "." + m.Name
+}
+
+// Flush satisfies the stats.Flusher interface, it exports the metrics that the
+// exporter has aggregated.
+func (e *Exporter) Flush() {
+	e.emutex.Lock()
+	defer e.emutex.Unlock()
+
+	now := time.Now()
+	b, sent := e.encode(now)
+
+	if b != nil {
+		err := e.export(b)
+		if err != nil {
+			log.Printf("stats/otlp: exporting metrics to %s failed: %s", e.config.Endpoint, err)
+		}
+		e.exported(sent, now, err == nil)
+	}
+}
+
+// encode produces the ExportMetricsServiceRequest for the aggregated series,
+// returning nil if there is nothing to export. With the delta temporality, the
+// snapshots of the exported series are returned as well, to be passed to
+// exported once the outcome of the export is known.
+func (e *Exporter) encode(now time.Time) ([]byte, []snapshot) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	delta := e.config.Temporality == Delta
+	list := make([]*series, 0, len(e.series))
+
+	for k, s := range e.series {
+		// Series that were idle for the timeout are removed, unless they
+		// still hold values that weren't exported.
+		if timeout := e.config.SeriesTimeout; timeout > 0 && !s.updated && now.Sub(s.last) >= timeout {
+			delete(e.series, k)
+			continue
+		}
+		if delta && s.typ != stats.GaugeType && !s.updated {
+			continue
+		}
+		list = append(list, s)
+	}
+
+	if len(list) == 0 {
+		return nil, nil
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].name != list[j].name {
+			return list[i].name < list[j].name
+		}
+		return list[i].typ < list[j].typ
+	})
+
+	var metrics []byte
+	var points []byte
+
+	for i := 0; i != len(list); {
+		j := i + 1
+		for j != len(list) && list[j].name == list[i].name && list[j].typ == list[i].typ {
+			j++
+		}
+
+		points = points[:0]
+
+		for _, s := range list[i:j] {
+			switch s.typ {
+			case stats.HistogramType:
+				points = appendProtoBytes(points, dataPoints, appendHistogramDataPoint(nil, s, now))
+			case stats.GaugeType:
+				points = appendProtoBytes(points, dataPoints, appendNumberDataPoint(nil, s, now, false))
+			default:
+				points = appendProtoBytes(points, dataPoints, appendNumberDataPoint(nil, s, now, true))
+			}
+		}
+
+		m := appendProtoString(nil, metricName, list[i].name)
+
+		switch list[i].typ {
+		case stats.GaugeType:
+			m = appendProtoBytes(m, metricGauge, points)
+		case stats.HistogramType:
+			points = appendProtoVarint(points, aggregationTemporality, uint64(e.config.Temporality))
+			m = appendProtoBytes(m, metricHistogram, points)
+		default:
+			points = appendProtoVarint(points, aggregationTemporality, uint64(e.config.Temporality))
+			if monotonic(list[i:j]) {
+				points = appendProtoVarint(points, sumIsMonotonic, 1)
+			}
+			m = appendProtoBytes(m, metricSum, points)
+		}
+
+		metrics = appendProtoBytes(metrics, scopeMetricsMetrics, m)
+		i = j
+	}
+
+	var sent []snapshot
+
+	for _, s := range list {
+		s.updated = false
+
+		if delta && s.typ != stats.GaugeType {
+			s.fresh = 0
+			sent = append(sent, snapshot{
+				series: s,
+				start:  s.start,
+				count:  s.count,
+				value:  s.value,
+				counts: append([]uint64(nil), s.counts...),
+			})
+		}
+	}
+
+	scope := appendProtoBytes(nil, scopeMetricsScope, appendProtoString(nil, scopeName, "github.com/segmentio/stats/otlp"))
+	scope = append(scope, metrics...)
+
+	rm := appendProtoBytes(nil, resourceMetricsResource, e.resource)
+	rm = appendProtoBytes(rm, resourceMetricsScopeMetrics, scope)
+
+	return appendProtoBytes(nil, requestResourceMetrics, rm), sent
+}
+
+// snapshot is the state of a series when it was exported with the delta
+// temporality.
+type snapshot struct {
+	*series
+	start  time.Time
+	count  uint64
+	value  float64
+	counts []uint64
+}
+
+// exported updates the series that were exported with the delta temporality.
+// When the export succeeded, the exported values are subtracted from the
+// series, which may have been updated in the meantime, and the min and max of
+// histograms are reset to those of the values observed since the export.
+// Otherwise the series are marked as updated so they are exported again.
+func (e *Exporter) exported(sent []snapshot, now time.Time, ok bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for _, x := range sent {
+		s := x.series
+
+		if !ok {
+			s.updated = true
+			continue
+		}
+
+		if !s.start.Equal(x.start) {
+			// The histogram bounds changed since the export, the series was
+			// restarted and holds none of the exported values.
+			continue
+		}
+
+		s.start = now
+		s.count -= x.count
+		s.value -= x.value
+		for i, n := range x.counts {
+			s.counts[i] -= n
+		}
+		if s.count == 0 {
+			s.min, s.max = 0, 0
+		} else {
+			s.min, s.max = s.fmin, s.fmax
+		}
+	}
+}
+
+// monotonic returns true if none of the counter series had negative values
+// added to them.
+func monotonic(list []*series) bool {
+	for _, s := range list {
+		if s.signed {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *Exporter) export(body []byte) error {
+	req, err := http.NewRequest("POST", e.config.Endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	if e.config.Gzip {
+		buf := &bytes.Buffer{}
+		zw := gzip.NewWriter(buf)
+		zw.Write(body)
+		zw.Close()
+		body = buf.Bytes()
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+
+	for name, value := range e.config.Headers {
+		req.Header.Set(name, value)
+	}
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", res.Status)
+	}
+
+	return nil
+}
+
+func equalBounds(a []float64, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,404 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+// message is a decoded protobuf message, fields are indexed by number and hold
+// the raw varint, fixed64 or length-delimited values.
+type message map[int][]field
+
+type field struct {
+	u uint64
+	b []byte
+}
+
+func decode(t *testing.T, b []byte) message {
+	m := message{}
+
+	for len(b) != 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatal("malformed key")
+		}
+		b = b[n:]
+
+		var f field
+
+		switch key & 7 {
+		case wireVarint:
+			f.u, n = binary.Uvarint(b)
+			b = b[n:]
+		case wireFixed64:
+			f.u = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireBytes:
+			size, n := binary.Uvarint(b)
+			f.b = b[n : n+int(size)]
+			b = b[n+int(size):]
+		default:
+			t.Fatal("unsupported wire type:", key&7)
+		}
+
+		m[int(key>>3)] = append(m[int(key>>3)], f)
+	}
+
+	return m
+}
+
+func (m message) msg(t *testing.T, num int) message {
+	return decode(t, m[num][0].b)
+}
+
+func (m message) msgs(t *testing.T, num int) []message {
+	var list []message
+	for _, f := range m[num] {
+		list = append(list, decode(t, f.b))
+	}
+	return list
+}
+
+func (m message) str(num int) string {
+	return string(m[num][0].b)
+}
+
+func (m message) double(num int) float64 {
+	return math.Float64frombits(m[num][0].u)
+}
+
+func attributes(t *testing.T, list []message) []string {
+	var attrs []string
+	for _, kv := range list {
+		attrs = append(attrs, kv.str(keyValueKey)+"="+kv.msg(t, keyValueValue).str(anyValueString))
+	}
+	return attrs
+}
+
+func startTestReceiver(t *testing.T) (*httptest.Server, <-chan []byte) {
+	requests := make(chan []byte, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-protobuf" {
+			t.Error("bad content type:", ct)
+		}
+		b, _ := io.ReadAll(r.Body)
+		requests <- b
+	}))
+
+	return server, requests
+}
+
+// metrics decodes the request and returns its metrics indexed by name.
+func metrics(t *testing.T, b []byte) (resource []string, metrics map[string]message) {
+	rm := decode(t, b).msg(t, requestResourceMetrics)
+	resource = attributes(t, rm.msg(t, resourceMetricsResource).msgs(t, resourceAttributes))
+	metrics = map[string]message{}
+
+	for _, m := range rm.msg(t, resourceMetricsScopeMetrics).msgs(t, scopeMetricsMetrics) {
+		metrics[m.str(metricName)] = m
+	}
+
+	return
+}
+
+func TestExporter(t *testing.T) {
+	server, requests := startTestReceiver(t)
+	defer server.Close()
+
+	engine := stats.NewEngine("test", stats.Tag{"env", "prod"})
+	engine.SetHistogramBuckets("rtt", 1, 2)
+
+	exporter := NewExporterWith(engine, ExporterConfig{
+		Endpoint:       server.URL,
+		ExportInterval: -1,
+	})
+	defer exporter.Close()
+	engine.Register(exporter)
+
+	engine.Add("requests", 1, stats.Tag{"status", "200"})
+	engine.Add("requests", 2, stats.Tag{"status", "200"})
+	engine.Set("queue", 5)
+	engine.Observe("rtt", 0.5)
+	engine.Observe("rtt", 1.5)
+	engine.Observe("rtt", 4)
+	engine.Flush()
+
+	resource, m := metrics(t, <-requests)
+
+	if !reflect.DeepEqual(resource, []string{"service.name=test", "env=prod"}) {
+		t.Error("bad resource attributes:", resource)
+	}
+
+	sum := m["requests"].msg(t, metricSum)
+	point := sum.msg(t, dataPoints)
+
+	if v := point.double(numberAsDouble); v != 3 {
+		t.Error("bad counter value:", v)
+	}
+
+	if attrs := attributes(t, point.msgs(t, numberAttributes)); !reflect.DeepEqual(attrs, []string{"status=200"}) {
+		t.Error("bad counter attributes:", attrs)
+	}
+
+	if temporality := sum[aggregationTemporality][0].u; temporality != uint64(Cumulative) {
+		t.Error("bad temporality:", temporality)
+	}
+
+	if monotonic := sum[sumIsMonotonic][0].u; monotonic != 1 {
+		t.Error("counters must be monotonic sums")
+	}
+
+	if v := m["queue"].msg(t, metricGauge).msg(t, dataPoints).double(numberAsDouble); v != 5 {
+		t.Error("bad gauge value:", v)
+	}
+
+	hist := m["rtt"].msg(t, metricHistogram).msg(t, dataPoints)
+
+	if count := hist[histogramCount][0].u; count != 3 {
+		t.Error("bad histogram count:", count)
+	}
+
+	if sum := hist.double(histogramSum); sum != 6 {
+		t.Error("bad histogram sum:", sum)
+	}
+
+	if min, max := hist.double(histogramMin), hist.double(histogramMax); min != 0.5 || max != 4 {
+		t.Error("bad histogram min/max:", min, max)
+	}
+
+	counts := hist[histogramBucketCounts][0].b
+	bounds := hist[histogramExplicitBounds][0].b
+
+	if s := fmt.Sprint(fixed64s(counts)); s != "[1 1 1]" {
+		t.Error("bad bucket counts:", s)
+	}
+
+	if s := fmt.Sprint(float64s(bounds)); s != "[1 2]" {
+		t.Error("bad explicit bounds:", s)
+	}
+
+	// Cumulative sums keep being exported.
+	engine.Add("requests", 1, stats.Tag{"status", "200"})
+	engine.Flush()
+
+	_, m = metrics(t, <-requests)
+
+	if v := m["requests"].msg(t, metricSum).msg(t, dataPoints).double(numberAsDouble); v != 4 {
+		t.Error("bad cumulative counter value:", v)
+	}
+}
+
+func TestExporterDelta(t *testing.T) {
+	server, requests := startTestReceiver(t)
+	defer server.Close()
+
+	engine := stats.NewEngine("test")
+	exporter := NewExporterWith(engine, ExporterConfig{
+		Endpoint:       server.URL,
+		Temporality:    Delta,
+		ExportInterval: -1,
+	})
+	defer exporter.Close()
+	engine.Register(exporter)
+
+	engine.Add("requests", 2)
+	engine.Flush()
+	engine.Add("requests", 3)
+	engine.Flush()
+
+	for _, expected := range []float64{2, 3} {
+		_, m := metrics(t, <-requests)
+		sum := m["requests"].msg(t, metricSum)
+
+		if v := sum.msg(t, dataPoints).double(numberAsDouble); v != expected {
+			t.Errorf("bad delta counter value: %g != %g", expected, v)
+		}
+
+		if temporality := sum[aggregationTemporality][0].u; temporality != uint64(Delta) {
+			t.Error("bad temporality:", temporality)
+		}
+	}
+
+	// Nothing changed, nothing is exported.
+	engine.Flush()
+
+	select {
+	case <-requests:
+		t.Error("unexpected export with no changes")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestExporterDeltaFailedExport(t *testing.T) {
+	requests := make(chan []byte, 10)
+	fail := true
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		if fail {
+			fail = false
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		requests <- b
+	}))
+	defer server.Close()
+
+	engine := stats.NewEngine("test")
+	exporter := NewExporterWith(engine, ExporterConfig{
+		Endpoint:       server.URL,
+		Temporality:    Delta,
+		ExportInterval: -1,
+	})
+	defer exporter.Close()
+	engine.Register(exporter)
+
+	engine.Add("requests", 2)
+	engine.Flush() // fails
+	engine.Add("requests", 3)
+	engine.Flush()
+
+	_, m := metrics(t, <-requests)
+
+	if v := m["requests"].msg(t, metricSum).msg(t, dataPoints).double(numberAsDouble); v != 5 {
+		t.Error("the values of the failed export were not exported again:", v)
+	}
+}
+
+func TestExporterDeltaHistogramMinMax(t *testing.T) {
+	server, requests := startTestReceiver(t)
+	defer server.Close()
+
+	engine := stats.NewEngine("test")
+	engine.SetHistogramBuckets("rtt", 1, 2)
+
+	exporter := NewExporterWith(engine, ExporterConfig{
+		Endpoint:       server.URL,
+		Temporality:    Delta,
+		ExportInterval: -1,
+	})
+	defer exporter.Close()
+	engine.Register(exporter)
+
+	engine.Observe("rtt", 1)
+	engine.Observe("rtt", 10)
+	engine.Flush()
+	engine.Observe("rtt", 5)
+	engine.Flush()
+
+	for _, expected := range [][2]float64{{1, 10}, {5, 5}} {
+		_, m := metrics(t, <-requests)
+		hist := m["rtt"].msg(t, metricHistogram).msg(t, dataPoints)
+
+		if min, max := hist.double(histogramMin), hist.double(histogramMax); min != expected[0] || max != expected[1] {
+			t.Errorf("bad histogram min/max: %g/%g != %g/%g", min, max, expected[0], expected[1])
+		}
+	}
+}
+
+func TestExporterSeriesTimeout(t *testing.T) {
+	server, requests := startTestReceiver(t)
+	defer server.Close()
+
+	engine := stats.NewEngine("test")
+	exporter := NewExporterWith(engine, ExporterConfig{
+		Endpoint:       server.URL,
+		ExportInterval: -1,
+		SeriesTimeout:  time.Minute,
+	})
+	defer exporter.Close()
+
+	exporter.HandleMetric(&stats.Metric{Type: stats.CounterType, Name: "idle", Value: 1, Time: time.Now().Add(-time.Hour)})
+	exporter.HandleMetric(&stats.Metric{Type: stats.CounterType, Name: "active", Value: 1})
+
+	// Series are exported at least once, even if they were idle for longer
+	// than the timeout.
+	for _, expected := range [][]string{{"active", "idle"}, {"active"}} {
+		exporter.Flush()
+		_, m := metrics(t, <-requests)
+
+		var names []string
+		for name := range m {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("bad exported series: %v != %v", names, expected)
+		}
+	}
+}
+
+func TestExporterNegativeCounter(t *testing.T) {
+	server, requests := startTestReceiver(t)
+	defer server.Close()
+
+	engine := stats.NewEngine("test")
+	exporter := NewExporterWith(engine, ExporterConfig{
+		Endpoint:       server.URL,
+		ExportInterval: -1,
+	})
+	defer exporter.Close()
+	engine.Register(exporter)
+
+	engine.Add("requests", 2)
+	engine.Flush()
+	engine.Add("requests", -1)
+	engine.Flush()
+
+	for _, monotonic := range []bool{true, false} {
+		_, m := metrics(t, <-requests)
+		sum := m["requests"].msg(t, metricSum)
+
+		if found := len(sum[sumIsMonotonic]) != 0 && sum[sumIsMonotonic][0].u == 1; found != monotonic {
+			t.Errorf("bad monotonic flag: %t != %t", monotonic, found)
+		}
+	}
+}
+
+func TestExporterMetricName(t *testing.T) {
+	server, requests := startTestReceiver(t)
+	defer server.Close()
+
+	engine := stats.NewEngine("test")
+	exporter := NewExporterWith(engine, ExporterConfig{
+		Endpoint:       server.URL,
+		ExportInterval: -1,
+	})
+	defer exporter.Close()
+	engine.Register(exporter)
+
+	engine.WithName("http").Incr("requests")
+	engine.Flush()
+
+	if _, m := metrics(t, <-requests); m["http.requests"] == nil {
+		t.Error("missing metric of derived engine")
+	}
+}
+
+func fixed64s(b []byte) []uint64 {
+	var v []uint64
+	for ; len(b) >= 8; b = b[8:] {
+		v = append(v, binary.LittleEndian.Uint64(b))
+	}
+	return v
+}
+
+func float64s(b []byte) []float64 {
+	var v []float64
+	for _, u := range fixed64s(b) {
+		v = append(v, math.Float64frombits(u))
+	}
+	return v
+}
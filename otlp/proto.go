@@ -0,0 +1,163 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+// This file contains a minimal encoder for the messages of the OTLP metrics
+// protocol, which is enough to produce ExportMetricsServiceRequest messages
+// without depending on a protobuf runtime.
+//
+// [1] https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/metrics/v1/metrics.proto
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// Field numbers of the OTLP messages.
+const (
+	// ExportMetricsServiceRequest
+	requestResourceMetrics = 1
+
+	// ResourceMetrics
+	resourceMetricsResource     = 1
+	resourceMetricsScopeMetrics = 2
+
+	// Resource
+	resourceAttributes = 1
+
+	// ScopeMetrics
+	scopeMetricsScope   = 1
+	scopeMetricsMetrics = 2
+
+	// InstrumentationScope
+	scopeName = 1
+
+	// KeyValue
+	keyValueKey   = 1
+	keyValueValue = 2
+
+	// AnyValue
+	anyValueString = 1
+
+	// Metric
+	metricName      = 1
+	metricGauge     = 5
+	metricSum       = 7
+	metricHistogram = 9
+
+	// Gauge, Sum and Histogram
+	dataPoints             = 1
+	aggregationTemporality = 2
+	sumIsMonotonic         = 3
+
+	// NumberDataPoint
+	numberStartTime  = 2
+	numberTime       = 3
+	numberAsDouble   = 4
+	numberAttributes = 7
+
+	// HistogramDataPoint
+	histogramStartTime      = 2
+	histogramTime           = 3
+	histogramCount          = 4
+	histogramSum            = 5
+	histogramBucketCounts   = 6
+	histogramExplicitBounds = 7
+	histogramAttributes     = 9
+	histogramMin            = 11
+	histogramMax            = 12
+)
+
+func appendResource(b []byte, attrs []stats.Tag) []byte {
+	for _, attr := range attrs {
+		b = appendProtoBytes(b, resourceAttributes, appendKeyValue(nil, attr))
+	}
+	return b
+}
+
+func appendKeyValue(b []byte, attr stats.Tag) []byte {
+	b = appendProtoString(b, keyValueKey, attr.Name)
+	return appendProtoBytes(b, keyValueValue, appendProtoString(nil, anyValueString, attr.Value))
+}
+
+func appendAttributes(b []byte, field int, attrs []stats.Tag) []byte {
+	for _, attr := range attrs {
+		b = appendProtoBytes(b, field, appendKeyValue(nil, attr))
+	}
+	return b
+}
+
+func appendNumberDataPoint(b []byte, s *series, now time.Time, withStart bool) []byte {
+	b = appendAttributes(b, numberAttributes, s.attrs)
+	if withStart {
+		b = appendProtoFixed64(b, numberStartTime, uint64(s.start.UnixNano()))
+	}
+	b = appendProtoFixed64(b, numberTime, uint64(now.UnixNano()))
+	return appendProtoDouble(b, numberAsDouble, s.value)
+}
+
+func appendHistogramDataPoint(b []byte, s *series, now time.Time) []byte {
+	b = appendAttributes(b, histogramAttributes, s.attrs)
+	b = appendProtoFixed64(b, histogramStartTime, uint64(s.start.UnixNano()))
+	b = appendProtoFixed64(b, histogramTime, uint64(now.UnixNano()))
+	b = appendProtoFixed64(b, histogramCount, s.count)
+	b = appendProtoDouble(b, histogramSum, s.value)
+
+	packed := make([]byte, 0, 8*len(s.counts))
+	for _, c := range s.counts {
+		packed = binary.LittleEndian.AppendUint64(packed, c)
+	}
+	b = appendProtoBytes(b, histogramBucketCounts, packed)
+
+	if len(s.bounds) != 0 {
+		packed = packed[:0]
+		for _, bound := range s.bounds {
+			packed = binary.LittleEndian.AppendUint64(packed, math.Float64bits(bound))
+		}
+		b = appendProtoBytes(b, histogramExplicitBounds, packed)
+	}
+
+	if s.count != 0 {
+		b = appendProtoDouble(b, histogramMin, s.min)
+		b = appendProtoDouble(b, histogramMax, s.max)
+	}
+
+	return b
+}
+
+func appendProtoKey(b []byte, field int, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wire))
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = appendProtoKey(b, field, wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoFixed64(b []byte, field int, v uint64) []byte {
+	b = appendProtoKey(b, field, wireFixed64)
+	return binary.LittleEndian.AppendUint64(b, v)
+}
+
+func appendProtoDouble(b []byte, field int, v float64) []byte {
+	return appendProtoFixed64(b, field, math.Float64bits(v))
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendProtoKey(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendProtoString(b []byte, field int, v string) []byte {
+	b = appendProtoKey(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
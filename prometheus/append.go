@@ -3,6 +3,7 @@ package prometheus
 import (
 	"strconv"
 	"strings"
+	"time"
 )
 
 func appendMetricName(b []byte, s string) []byte {
@@ -44,6 +45,72 @@ func appendMetric(b []byte, metric metric) []byte {
 	return append(b, '\n')
 }
 
+// appendOpenMetric is similar to appendMetric but produces the OpenMetrics
+// text representation of the metric. The header flag controls whether the
+// HELP and TYPE lines of the metric family are written.
+//
+// Counter samples are always suffixed with "_total" as required by the format,
+// counters and histograms that carry a creation time also get a "_created"
+// sample so scrapers can detect resets of the time series.
+func appendOpenMetric(b []byte, metric metric, header bool) []byte {
+	name, family := metric.name, metric.rootName()
+
+	if metric.mtype == counter {
+		family = strings.TrimSuffix(family, "_total")
+		name = family + "_total"
+	}
+
+	if header {
+		if len(metric.help) != 0 {
+			b = appendMetricHelp(b, metric.scope, family, metric.help)
+		}
+
+		if metric.mtype != untyped {
+			b = appendMetricType(b, metric.scope, family, metric.mtype.String())
+		}
+	}
+
+	b = appendMetricScopedName(b, metric.scope, name)
+	b = appendLabels(b, metric.labels...)
+	b = append(b, ' ')
+	b = strconv.AppendFloat(b, metric.value, 'g', -1, 64)
+	b = appendOpenMetricTimestamp(b, metric.time)
+
+	if !metric.created.IsZero() {
+		switch metric.mtype {
+		case counter, histogram:
+			b = appendMetricScopedName(b, metric.scope, family+"_created")
+			b = appendLabels(b, metric.labels...)
+			b = append(b, ' ')
+			b = appendOpenMetricTime(b, metric.created)
+			b = appendOpenMetricTimestamp(b, metric.time)
+		}
+	}
+
+	return b
+}
+
+func appendOpenMetricTimestamp(b []byte, t time.Time) []byte {
+	if !t.IsZero() {
+		b = append(b, ' ')
+		b = appendOpenMetricTime(b, t)
+	}
+	return append(b, '\n')
+}
+
+// OpenMetrics timestamps are expressed in seconds, we keep the millisecond
+// precision used by the prometheus text format.
+func appendOpenMetricTime(b []byte, t time.Time) []byte {
+	b = strconv.AppendInt(b, t.Unix(), 10)
+
+	if ms := t.Nanosecond() / 1e6; ms != 0 {
+		b = append(b, '.')
+		b = append(b, byte('0'+(ms/100)), byte('0'+(ms/10)%10), byte('0'+ms%10))
+	}
+
+	return b
+}
+
 func appendMetricHelp(b []byte, scope string, name string, help string) []byte {
 	b = append(b, "# HELP "...)
 	b = appendMetricScopedName(b, scope, name)
@@ -80,6 +80,77 @@ func TestAppendMetric(t *testing.T) {
 	}
 }
 
+func TestAppendOpenMetric(t *testing.T) {
+	now := time.Date(2017, 6, 4, 22, 12, 0, 0, time.UTC)
+
+	tests := []struct {
+		scenario string
+		metric   metric
+		header   bool
+		string   string
+	}{
+		{
+			scenario: "counter metric without creation time",
+			metric:   metric{mtype: counter, name: "hello_world", value: 42},
+			header:   true,
+			string: `# TYPE hello_world counter
+hello_world_total 42
+`,
+		},
+
+		{
+			scenario: "counter metric with a _total suffix and creation time",
+			metric: metric{
+				mtype:   counter,
+				scope:   "global",
+				name:    "requests_total",
+				value:   1,
+				labels:  labels{{"id", "123"}},
+				time:    now.Add(1500 * time.Millisecond),
+				created: now,
+			},
+			header: true,
+			string: `# TYPE global_requests counter
+global_requests_total{id="123"} 1 1496614321.500
+global_requests_created{id="123"} 1496614320 1496614321.500
+`,
+		},
+
+		{
+			scenario: "histogram count sample without header",
+			metric: metric{
+				mtype:   histogram,
+				name:    "latency_count",
+				value:   10,
+				created: now,
+			},
+			header: false,
+			string: `latency_count 10
+latency_created 1496614320
+`,
+		},
+
+		{
+			scenario: "gauge metric ignores creation time",
+			metric:   metric{mtype: gauge, name: "temperature", value: 21.5, created: now},
+			header:   true,
+			string: `# TYPE temperature gauge
+temperature 21.5
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			if s := string(appendOpenMetric(nil, test.metric, test.header)); s != test.string {
+				t.Error("bad metric representation:")
+				t.Log(test.string)
+				t.Log(s)
+			}
+		})
+	}
+}
+
 func BenchmarkAppendMetric(b *testing.B) {
 	a := make([]byte, 8192)
 
@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -19,7 +20,9 @@ import (
 // Typically, a program creates one Handler, registers it to the stats package,
 // and adds it to the muxer used by the application under the /metrics path.
 //
-// The handle ignores histograms that have no buckets set.
+// The handle ignores histograms that have no buckets set. When the buckets of a
+// histogram are changed (with stats.Engine.SetHistogramBuckets for example),
+// the counts of its time series are reset and the change is logged.
 type Handler struct {
 	// Setting this field will trim this prefix from metric namespaces of the
 	// metrics received by this handler.
@@ -56,10 +59,36 @@ type Handler struct {
 	// By default this flag is set to false to ensure correctness in every case.
 	UseUnsortedLabels bool
 
+	// Retention is called to determine whether the time series of a metric
+	// expire after MetricTimeout or are retained for the lifetime of the
+	// handler. The function receives the metric namespace (after trimming
+	// TrimPrefix) and name.
+	//
+	// Expiring a counter and seeing it come back later restarts it at zero,
+	// programs should retain counters that must never be reset spuriously.
+	//
+	// If nil, all metrics use the Expire policy.
+	Retention func(namespace string, name string) RetentionPolicy
+
 	opcount uint64
 	metrics metricStore
 }
 
+// RetentionPolicy is an enumeration of the policies that can be applied to the
+// time series of metrics exposed by a Handler.
+type RetentionPolicy int
+
+const (
+	// Expire removes time series that haven't been updated for longer than
+	// the handler's metric timeout. When served in the protobuf format, a
+	// staleness marker is produced for each expired time series by all the
+	// scrapes happening within the metric timeout after it expired.
+	Expire RetentionPolicy = iota
+
+	// Retain keeps time series forever.
+	Retain
+)
+
 // HandleMetric satisfies the stats.Handler interface.
 func (h *Handler) HandleMetric(m *stats.Metric) {
 	mtime := m.Time
@@ -90,10 +119,14 @@ func (h *Handler) HandleMetric(m *stats.Metric) {
 	// having memory leaks if the program has generated metrics for a pair of
 	// metric name and labels that won't be seen again.
 	if (atomic.AddUint64(&h.opcount, 1) % 10000) == 0 {
-		h.metrics.cleanup(time.Now().Add(-h.timeout()))
+		h.metrics.cleanup(time.Now().Add(-h.timeout()), h.retain)
 	}
 }
 
+func (h *Handler) retain(scope string, name string) bool {
+	return h.Retention != nil && h.Retention(scope, name) == Retain
+}
+
 func (h *Handler) timeout() time.Duration {
 	if timeout := h.MetricTimeout; timeout != 0 {
 		return timeout
@@ -102,6 +135,10 @@ func (h *Handler) timeout() time.Duration {
 }
 
 // ServeHTTP satsifies the http.Handler interface.
+//
+// The handler supports the prometheus text format, the OpenMetrics text format
+// and the prometheus protobuf format, the one used is negotiated based on the
+// Accept header of the request.
 func (h *Handler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case "GET", "HEAD":
@@ -110,11 +147,10 @@ func (h *Handler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	metrics := h.metrics.collect(make([]metric, 0, 10000))
-	sort.Sort(byNameAndLabels(metrics))
+	format := negotiateFormat(req.Header.Get("Accept"))
 
 	w := io.Writer(res)
-	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	res.Header().Set("Content-Type", format.contentType())
 
 	if acceptEncoding(req.Header.Get("Accept-Encoding"), "gzip") {
 		res.Header().Set("Content-Encoding", "gzip")
@@ -123,6 +159,20 @@ func (h *Handler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		w = zw
 	}
 
+	switch format {
+	case protobufFormat:
+		h.writeProtobuf(w, time.Now())
+	case openMetricsFormat:
+		h.writeOpenMetrics(w)
+	default:
+		h.writeText(w)
+	}
+}
+
+func (h *Handler) writeText(w io.Writer) {
+	metrics := h.metrics.collect(make([]metric, 0, 10000))
+	sort.Sort(byNameAndLabels(metrics))
+
 	b := make([]byte, 1024)
 
 	var lastMetricName string
@@ -145,6 +195,112 @@ func (h *Handler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	}
 }
 
+func (h *Handler) writeOpenMetrics(w io.Writer) {
+	metrics := h.metrics.collect(make([]metric, 0, 10000))
+	sort.Sort(byNameAndLabels(metrics))
+
+	b := make([]byte, 1024)
+
+	var lastMetricName string
+	for _, m := range metrics {
+		name := m.rootName()
+		w.Write(appendOpenMetric(b[:0], m, name != lastMetricName))
+		lastMetricName = name
+	}
+
+	io.WriteString(w, "# EOF\n")
+}
+
+// writeProtobuf writes the metrics in the protobuf format, which is the only
+// one able to represent staleness markers. The markers of expired time series
+// are written by every scrape happening within the metric timeout after they
+// expired, so they reach all the scrapers collecting the metrics.
+func (h *Handler) writeProtobuf(w io.Writer, now time.Time) {
+	stale := h.metrics.collectStale(now, h.timeout())
+	families := h.metrics.collectFamilies(make([]metricFamily, 0, 1000), stale, now)
+	sort.Sort(byFamilyName(families))
+
+	b := make([]byte, 0, 1024)
+	s := make([]byte, 0, 1024)
+
+	for _, f := range families {
+		sort.Sort(bySeriesLabels(f.series))
+		b, s = appendMetricFamily(b[:0], s, f)
+		w.Write(b)
+	}
+}
+
+type format int
+
+const (
+	textFormat format = iota
+	openMetricsFormat
+	protobufFormat
+)
+
+func (f format) contentType() string {
+	switch f {
+	case openMetricsFormat:
+		return "application/openmetrics-text; version=1.0.0; charset=utf-8"
+	case protobufFormat:
+		return "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"
+	default:
+		return "text/plain; version=0.0.4"
+	}
+}
+
+// negotiateFormat returns the exposition format with the highest quality value
+// in the Accept header, defaulting to the prometheus text format.
+func negotiateFormat(accept string) format {
+	best, bestq := textFormat, 0.0
+
+	for _, item := range strings.Split(accept, ",") {
+		var f format
+		var q = 1.0
+		var supported = true
+		var mediaType string
+		var params []string
+
+		parts := strings.Split(item, ";")
+		mediaType, params = strings.TrimSpace(parts[0]), parts[1:]
+
+		switch mediaType {
+		case "application/openmetrics-text":
+			f = openMetricsFormat
+		case "application/vnd.google.protobuf":
+			f = protobufFormat
+		case "text/plain":
+			f = textFormat
+		default:
+			continue
+		}
+
+		for _, param := range params {
+			name, value := param, ""
+			if i := strings.IndexByte(param, '='); i >= 0 {
+				name, value = param[:i], param[i+1:]
+			}
+
+			switch name, value = strings.TrimSpace(name), strings.TrimSpace(value); name {
+			case "q":
+				if v, err := strconv.ParseFloat(value, 64); err == nil {
+					q = v
+				}
+			case "proto":
+				supported = supported && (f != protobufFormat || value == "io.prometheus.client.MetricFamily")
+			case "encoding":
+				supported = supported && (f != protobufFormat || value == "delimited")
+			}
+		}
+
+		if supported && q > bestq {
+			best, bestq = f, q
+		}
+	}
+
+	return best
+}
+
 func acceptEncoding(accept string, check string) bool {
 	for _, coding := range strings.Split(accept, ",") {
 		if coding = strings.TrimSpace(coding); strings.HasPrefix(coding, check) {
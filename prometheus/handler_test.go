@@ -1,8 +1,11 @@
 package prometheus
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -112,6 +115,153 @@ C_sum 10.7 1496614320000
 	}
 }
 
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		format format
+	}{
+		{
+			accept: "",
+			format: textFormat,
+		},
+
+		{
+			accept: "text/plain;version=0.0.4;q=0.3,*/*;q=0.2",
+			format: textFormat,
+		},
+
+		{
+			accept: "application/openmetrics-text;version=1.0.0,application/openmetrics-text;version=0.0.1;q=0.75,text/plain;version=0.0.4;q=0.5,*/*;q=0.1",
+			format: openMetricsFormat,
+		},
+
+		{
+			accept: "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3",
+			format: protobufFormat,
+		},
+
+		{
+			accept: "application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=text;q=0.7,text/plain;version=0.0.4;q=0.3",
+			format: textFormat,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.accept, func(t *testing.T) {
+			if f := negotiateFormat(test.accept); f != test.format {
+				t.Error(f)
+			}
+		})
+	}
+}
+
+func TestServeHTTPOpenMetrics(t *testing.T) {
+	now := time.Date(2017, 6, 4, 22, 12, 0, 0, time.UTC)
+
+	handler := &Handler{}
+	handler.HandleMetric(&stats.Metric{Type: stats.CounterType, Name: "A", Value: 1, Time: now})
+	handler.HandleMetric(&stats.Metric{Type: stats.CounterType, Name: "A", Value: 2, Time: now.Add(time.Second)})
+	handler.HandleMetric(&stats.Metric{Type: stats.GaugeType, Name: "B", Value: 42, Time: now})
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	if contentType := res.Header().Get("Content-Type"); contentType != openMetricsFormat.contentType() {
+		t.Error("bad content type:", contentType)
+	}
+
+	const expects = `# TYPE A counter
+A_total 3 1496614321
+A_created 1496614320 1496614321
+# TYPE B gauge
+B 42 1496614320
+# EOF
+`
+
+	if s := res.Body.String(); s != expects {
+		t.Error("bad output:")
+		t.Log("expected:", expects)
+		t.Log("found:", s)
+	}
+}
+
+func TestServeHTTPProtobuf(t *testing.T) {
+	handler := &Handler{}
+	handler.HandleMetric(&stats.Metric{Type: stats.GaugeType, Name: "A", Value: 1})
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", protobufFormat.contentType())
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	if contentType := res.Header().Get("Content-Type"); contentType != protobufFormat.contentType() {
+		t.Error("bad content type:", contentType)
+	}
+
+	// The timestamp is set by the handler, it's only checked for presence.
+	b := res.Body.Bytes()
+
+	if len(b) < 20 {
+		t.Fatalf("output is too short: %#v", b)
+	}
+
+	if !bytes.HasPrefix(b[1:], []byte{
+		0x0a, 0x01, 'A', // name
+		0x18, protoGauge, // type
+	}) {
+		t.Errorf("bad metric family header: %#v", b)
+	}
+
+	if !bytes.Contains(b, []byte{0x12, 0x09, 0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f}) {
+		t.Errorf("gauge value not found: %#v", b)
+	}
+}
+
+func TestHandlerRetention(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+
+	handler := &Handler{
+		Retention: func(namespace string, name string) RetentionPolicy {
+			if name == "A" {
+				return Retain
+			}
+			return Expire
+		},
+	}
+
+	for i := 0; i != 10000; i++ {
+		handler.HandleMetric(&stats.Metric{Type: stats.CounterType, Name: "A", Value: 1, Time: old})
+		handler.HandleMetric(&stats.Metric{Type: stats.GaugeType, Name: "B", Value: 1, Time: old})
+	}
+
+	scrape := func(accept string) []byte {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Accept", accept)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res.Body.Bytes()
+	}
+
+	stale := make([]byte, 8)
+	binary.LittleEndian.PutUint64(stale, math.Float64bits(staleNaN))
+
+	// Scrapes in text formats must not consume the staleness markers, and
+	// every protobuf scrape must receive them.
+	scrape(textFormat.contentType())
+
+	for i := 0; i != 2; i++ {
+		if !bytes.Contains(scrape(protobufFormat.contentType()), stale) {
+			t.Errorf("scrape #%d: expected a staleness marker for the expired gauge", i+1)
+		}
+	}
+
+	if n := len(handler.metrics.collect(nil)); n != 1 {
+		t.Error("bad number of retained metrics:", n)
+	}
+}
+
 func BenchmarkHandleMetric(b *testing.B) {
 	now := time.Now()
 	tags := []stats.Tag{{"a", "1"}, {"b", "2"}}
@@ -1,12 +1,13 @@
 package prometheus
 
 import (
-	"reflect"
+	"log"
+	"math"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
-	"unsafe"
 
 	"github.com/segmentio/stats"
 )
@@ -57,13 +58,14 @@ type metricKey struct {
 }
 
 type metric struct {
-	mtype  metricType
-	scope  string
-	name   string
-	help   string
-	value  float64
-	time   time.Time
-	labels labels
+	mtype   metricType
+	scope   string
+	name    string
+	help    string
+	value   float64
+	time    time.Time
+	created time.Time
+	labels  labels
 }
 
 func (m metric) key() metricKey {
@@ -80,6 +82,18 @@ func (m metric) rootName() string {
 type metricStore struct {
 	mutex   sync.RWMutex
 	entries map[metricKey]*metricEntry
+
+	// States that were expired by calls to cleanup, they are kept around for
+	// a retention window so staleness markers can be produced for all the
+	// scrapers collecting metrics during that window.
+	staleMutex sync.Mutex
+	stale      []staleState
+}
+
+type staleState struct {
+	entry   *metricEntry
+	state   *metricState
+	expired time.Time
 }
 
 func (store *metricStore) lookup(mtype metricType, key metricKey, help string) *metricEntry {
@@ -111,7 +125,10 @@ func (store *metricStore) lookup(mtype metricType, key metricKey, help string) *
 func (store *metricStore) update(metric metric, buckets []float64) {
 	entry := store.lookup(metric.mtype, metric.key(), metric.help)
 	state := entry.lookup(metric.labels)
-	state.update(metric.mtype, metric.value, metric.time, buckets)
+
+	if state.update(metric.mtype, metric.value, metric.time, buckets) && entry.logReconfigured(buckets) {
+		log.Printf("stats/prometheus: buckets of histogram %s changed, starting a new time series", appendMetricScopedName(nil, metric.scope, metric.name))
+	}
 }
 
 func (store *metricStore) collect(metrics []metric) []metric {
@@ -125,17 +142,30 @@ func (store *metricStore) collect(metrics []metric) []metric {
 	return metrics
 }
 
-func (store *metricStore) cleanup(exp time.Time) {
+// The retain function, which may be nil, is called to determine whether the
+// states of a metric must be kept regardless of when they were last updated.
+func (store *metricStore) cleanup(exp time.Time, retain func(scope string, name string) bool) {
 	store.mutex.RLock()
 
 	for name, entry := range store.entries {
 		store.mutex.RUnlock()
 
-		entry.cleanup(exp, func() {
-			store.mutex.Lock()
-			delete(store.entries, name)
-			store.mutex.Unlock()
-		})
+		if retain == nil || !retain(entry.scope, entry.name) {
+			expired := entry.cleanup(exp, func() {
+				store.mutex.Lock()
+				delete(store.entries, name)
+				store.mutex.Unlock()
+			})
+
+			if len(expired) != 0 {
+				now := time.Now()
+				store.staleMutex.Lock()
+				for _, state := range expired {
+					store.stale = append(store.stale, staleState{entry: entry, state: state, expired: now})
+				}
+				store.staleMutex.Unlock()
+			}
+		}
 
 		store.mutex.RLock()
 	}
@@ -143,6 +173,30 @@ func (store *metricStore) cleanup(exp time.Time) {
 	store.mutex.RUnlock()
 }
 
+// collectStale returns the list of states that expired within window before
+// now, the states that expired earlier are discarded.
+func (store *metricStore) collectStale(now time.Time, window time.Duration) []staleState {
+	exp := now.Add(-window)
+	store.staleMutex.Lock()
+
+	i := 0
+	for _, s := range store.stale {
+		if s.expired.After(exp) {
+			store.stale[i] = s
+			i++
+		}
+	}
+
+	for j := i; j != len(store.stale); j++ {
+		store.stale[j] = staleState{}
+	}
+
+	store.stale = store.stale[:i]
+	stale := append([]staleState(nil), store.stale...)
+	store.staleMutex.Unlock()
+	return stale
+}
+
 type metricEntry struct {
 	mutex  sync.RWMutex
 	mtype  metricType
@@ -153,6 +207,27 @@ type metricEntry struct {
 	sum    string
 	count  string
 	states metricStateMap
+
+	// Limits of the buckets that the last reconfiguration of the histogram
+	// was logged for, so it's logged once instead of once per time series.
+	logMutex sync.Mutex
+	loggedLe string
+}
+
+// logReconfigured returns true if the change of the histogram buckets to the
+// given limits was not logged yet.
+func (entry *metricEntry) logReconfigured(buckets []float64) bool {
+	limits := le(buckets)
+
+	entry.logMutex.Lock()
+	defer entry.logMutex.Unlock()
+
+	if entry.loggedLe == limits {
+		return false
+	}
+
+	entry.loggedLe = limits
+	return true
 }
 
 func newMetricEntry(mtype metricType, scope string, name string, help string) *metricEntry {
@@ -211,7 +286,7 @@ func (entry *metricEntry) collect(metrics []metric) []metric {
 	return metrics
 }
 
-func (entry *metricEntry) cleanup(exp time.Time, empty func()) {
+func (entry *metricEntry) cleanup(exp time.Time, empty func()) (expired []*metricState) {
 	// TODO: there may be high contention on this mutex, maybe not, it would be
 	// a good idea to measure.
 	entry.mutex.Lock()
@@ -225,9 +300,11 @@ func (entry *metricEntry) cleanup(exp time.Time, empty func()) {
 
 			// We expire all entries that have been last updated before exp,
 			// they don't get copied back into the state slice.
-			if exp.Before(state.time) {
+			if exp.Before(state.lastUpdate()) {
 				states[i] = state
 				i++
+			} else {
+				expired = append(expired, state)
 			}
 
 			state.mutex.Unlock()
@@ -245,18 +322,18 @@ func (entry *metricEntry) cleanup(exp time.Time, empty func()) {
 	}
 
 	entry.mutex.Unlock()
+	return
 }
 
 type metricState struct {
 	// immutable
 	labels labels
 	// mutable
-	mutex   sync.Mutex
-	buckets metricBuckets
-	value   float64
-	sum     float64
-	count   uint64
-	time    time.Time
+	mutex     sync.Mutex
+	histogram atomic.Value // *histogramState
+	value     float64
+	time      time.Time
+	created   time.Time
 }
 
 func newMetricState(labels labels) *metricState {
@@ -265,7 +342,13 @@ func newMetricState(labels labels) *metricState {
 	}
 }
 
-func (state *metricState) update(mtype metricType, value float64, time time.Time, buckets []float64) {
+// update applies the value to the state, returning true if the histogram buckets
+// were reconfigured.
+func (state *metricState) update(mtype metricType, value float64, time time.Time, buckets []float64) (reconfigured bool) {
+	if mtype == histogram {
+		return state.observe(value, time, buckets)
+	}
+
 	state.mutex.Lock()
 
 	switch mtype {
@@ -274,25 +357,74 @@ func (state *metricState) update(mtype metricType, value float64, time time.Time
 
 	case gauge:
 		state.value = value
+	}
 
-	case histogram:
-		if len(state.buckets) != len(buckets) {
-			state.buckets = makeMetricBuckets(buckets, state.labels)
-		}
-		state.buckets.update(value)
-		state.sum += value
-		state.count++
+	if state.created.IsZero() {
+		state.created = time
 	}
 
 	state.time = time
 	state.mutex.Unlock()
+	return
+}
+
+// observe records a histogram value without acquiring the state mutex, unless
+// the buckets of the histogram need to be reconfigured.
+//
+// When the buckets of a histogram change the counts accumulated so far cannot be
+// redistributed, so a new generation of the time series is started: all counts
+// are reset and the creation time is moved to the time of the update, which
+// lets the exposition formats that support it signal the reset to scrapers.
+func (state *metricState) observe(value float64, time time.Time, buckets []float64) (reconfigured bool) {
+	h := state.loadHistogram()
+
+	if h == nil || !h.hasBuckets(buckets) {
+		state.mutex.Lock()
+
+		if h = state.loadHistogram(); h == nil || !h.hasBuckets(buckets) {
+			reconfigured = h != nil && h.count() != 0
+			h = newHistogramState(buckets, state.labels, time)
+			state.histogram.Store(h)
+		}
+
+		state.mutex.Unlock()
+	}
+
+	h.observe(value, time)
+	return
+}
+
+func (state *metricState) loadHistogram() *histogramState {
+	h, _ := state.histogram.Load().(*histogramState)
+	return h
+}
+
+// lastUpdate returns the time of the last update of the state, the state mutex
+// must be held by the caller.
+func (state *metricState) lastUpdate() time.Time {
+	if h := state.loadHistogram(); h != nil {
+		return h.lastUpdate()
+	}
+	return state.time
 }
 
 func (state *metricState) collect(metrics []metric, entry *metricEntry) []metric {
 	state.mutex.Lock()
 
 	switch entry.mtype {
-	case counter, gauge:
+	case counter:
+		metrics = append(metrics, metric{
+			mtype:   entry.mtype,
+			scope:   entry.scope,
+			name:    entry.name,
+			help:    entry.help,
+			value:   state.value,
+			time:    state.time,
+			created: state.created,
+			labels:  state.labels,
+		})
+
+	case gauge:
 		metrics = append(metrics, metric{
 			mtype:  entry.mtype,
 			scope:  entry.scope,
@@ -304,48 +436,157 @@ func (state *metricState) collect(metrics []metric, entry *metricEntry) []metric
 		})
 
 	case histogram:
-		// Prometheus' scraper expects for histogram buckets to be cumulative.
-		// [1] https://prometheus.io/docs/practices/histograms/#apdex-score
-		// [2] https://en.wikipedia.org/wiki/Histogram#Cumulative_histogram
-		var cumulativeCount uint64
-		for _, bucket := range state.buckets {
-			cumulativeCount += bucket.count
-			metrics = append(metrics, metric{
-				mtype:  entry.mtype,
-				scope:  entry.scope,
-				name:   entry.bucket,
-				help:   entry.help,
-				value:  float64(cumulativeCount),
-				time:   state.time,
-				labels: bucket.labels,
-			})
+		if h := state.loadHistogram(); h != nil {
+			metrics = h.collect(metrics, entry, state.labels)
 		}
-		metrics = append(metrics,
-			metric{
-				mtype:  entry.mtype,
-				scope:  entry.scope,
-				name:   entry.sum,
-				help:   entry.help,
-				value:  state.sum,
-				time:   state.time,
-				labels: state.labels,
-			},
-			metric{
-				mtype:  entry.mtype,
-				scope:  entry.scope,
-				name:   entry.count,
-				help:   entry.help,
-				value:  float64(state.count),
-				time:   state.time,
-				labels: state.labels,
-			},
-		)
 	}
 
 	state.mutex.Unlock()
 	return metrics
 }
 
+// metricFamily groups all the states of a metric, it is used by exposition
+// formats which represent a metric and its time series as a single unit
+// instead of a flat list of samples.
+type metricFamily struct {
+	mtype  metricType
+	scope  string
+	name   string
+	help   string
+	series []metricSeries
+}
+
+type metricSeries struct {
+	labels  labels
+	value   float64
+	sum     float64
+	count   uint64
+	buckets []metricSeriesBucket
+	time    time.Time
+	created time.Time
+	stale   bool
+}
+
+type metricSeriesBucket struct {
+	limit float64
+	count uint64 // cumulative
+}
+
+// collectFamilies appends the families of all metrics in the store to the
+// given slice. The series of stale states are merged in the families with a
+// stale flag set, unless the metric has received updates since it expired.
+//
+// Stale series are timestamped with now, prometheus would reject a staleness
+// marker with the same timestamp as the last sample of the series.
+func (store *metricStore) collectFamilies(families []metricFamily, stale []staleState, now time.Time) []metricFamily {
+	store.mutex.RLock()
+
+	for _, entry := range store.entries {
+		families = append(families, entry.collectFamily())
+	}
+
+	store.mutex.RUnlock()
+
+	if len(stale) != 0 {
+		index := make(map[metricKey]int, len(families))
+
+		for i, f := range families {
+			index[metricKey{scope: f.scope, name: f.name}] = i
+		}
+
+		for _, s := range stale {
+			key := metricKey{scope: s.entry.scope, name: s.entry.name}
+			series := s.state.series(s.entry.mtype)
+			series.stale = true
+			series.time = now
+
+			i, ok := index[key]
+			if !ok {
+				i = len(families)
+				index[key] = i
+				families = append(families, metricFamily{
+					mtype: s.entry.mtype,
+					scope: s.entry.scope,
+					name:  s.entry.name,
+					help:  s.entry.help,
+				})
+			}
+
+			f := &families[i]
+
+			if f.mtype != s.entry.mtype || f.hasSeries(series.labels) {
+				continue
+			}
+
+			f.series = append(f.series, series)
+		}
+	}
+
+	return families
+}
+
+func (entry *metricEntry) collectFamily() metricFamily {
+	entry.mutex.RLock()
+
+	family := metricFamily{
+		mtype:  entry.mtype,
+		scope:  entry.scope,
+		name:   entry.name,
+		help:   entry.help,
+		series: make([]metricSeries, 0, len(entry.states)),
+	}
+
+	for _, states := range entry.states {
+		for _, state := range states {
+			family.series = append(family.series, state.series(entry.mtype))
+		}
+	}
+
+	entry.mutex.RUnlock()
+	return family
+}
+
+func (state *metricState) series(mtype metricType) metricSeries {
+	state.mutex.Lock()
+
+	series := metricSeries{
+		labels:  state.labels,
+		value:   state.value,
+		time:    state.time,
+		created: state.created,
+	}
+
+	if h := state.loadHistogram(); mtype == histogram && h != nil {
+		series.sum = h.loadSum()
+		series.time = h.lastUpdate()
+		series.created = h.created
+		series.buckets = make([]metricSeriesBucket, len(h.buckets))
+
+		var cumulativeCount uint64
+		for i, bucket := range h.buckets {
+			cumulativeCount += atomic.LoadUint64(&h.counts[i])
+			series.buckets[i] = metricSeriesBucket{
+				limit: bucket.limit,
+				count: cumulativeCount,
+			}
+		}
+
+		series.count = cumulativeCount + atomic.LoadUint64(&h.counts[len(h.buckets)])
+	}
+
+	state.mutex.Unlock()
+	return series
+}
+
+func (f *metricFamily) hasSeries(labels labels) bool {
+	for i := range f.series {
+		if f.series[i].labels.equal(labels) {
+			return true
+		}
+	}
+	return false
+}
+
 type metricStateMap map[uint64][]*metricState
 
 func (m metricStateMap) put(key uint64, state *metricState) {
@@ -364,9 +605,154 @@ func (m metricStateMap) find(key uint64, labels labels) *metricState {
 	return nil
 }
 
+// histogramState is a generation of the state of a histogram.
+//
+// Observations are recorded with atomic operations so concurrent updates of a
+// histogram don't contend on a mutex, a new generation is installed on the
+// state when the histogram buckets change.
+//
+// Because observations are not applied atomically as a whole, collecting the
+// histogram while it receives updates may see a sum that doesn't match the
+// counts exactly. The total count is always derived from the bucket counts so
+// the cumulative counts of the buckets never exceed it.
+type histogramState struct {
+	// Fields accessed with atomic operations are placed first to guarantee
+	// 64 bits alignment on 32 bits platforms.
+	sum     uint64 // bits of a float64
+	updated int64  // unix time in nanoseconds, zero if unset
+
+	// immutable
+	source  *float64 // first element of the buckets slice the generation was created from
+	buckets metricBuckets
+	counts  []uint64 // one more than buckets, the last one counts values above all limits
+	created time.Time
+}
+
+func newHistogramState(buckets []float64, labels labels, created time.Time) *histogramState {
+	h := &histogramState{
+		buckets: makeMetricBuckets(buckets, labels),
+		counts:  make([]uint64, len(buckets)+1),
+		created: created,
+	}
+
+	if len(buckets) != 0 {
+		h.source = &buckets[0]
+	}
+
+	return h
+}
+
+// hasBuckets returns true if the histogram was created with buckets.
+//
+// The stats engine never modifies the slices of buckets it passes to handlers,
+// so seeing the same backing array with the same first and last limits is
+// enough to know that the buckets haven't changed, which avoids comparing all
+// the limits of histograms with many buckets. The first and last limits are
+// still checked to detect programs that modify their buckets in place.
+func (h *histogramState) hasBuckets(buckets []float64) bool {
+	n := len(buckets)
+
+	if n != len(h.buckets) {
+		return false
+	}
+
+	if n == 0 {
+		return true
+	}
+
+	if &buckets[0] == h.source && buckets[0] == h.buckets[0].limit && buckets[n-1] == h.buckets[n-1].limit {
+		return true
+	}
+
+	return h.buckets.hasLimits(buckets)
+}
+
+func (h *histogramState) observe(value float64, time time.Time) {
+	atomic.AddUint64(&h.counts[h.buckets.index(value)], 1)
+
+	for {
+		oldSum := atomic.LoadUint64(&h.sum)
+		newSum := math.Float64bits(math.Float64frombits(oldSum) + value)
+
+		if atomic.CompareAndSwapUint64(&h.sum, oldSum, newSum) {
+			break
+		}
+	}
+
+	var updated int64
+	if !time.IsZero() {
+		updated = time.UnixNano()
+	}
+	atomic.StoreInt64(&h.updated, updated)
+}
+
+func (h *histogramState) count() (n uint64) {
+	for i := range h.counts {
+		n += atomic.LoadUint64(&h.counts[i])
+	}
+	return
+}
+
+func (h *histogramState) loadSum() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.sum))
+}
+
+// lastUpdate returns the time of the last observation, expressed in UTC since
+// the time location isn't retained.
+func (h *histogramState) lastUpdate() time.Time {
+	if updated := atomic.LoadInt64(&h.updated); updated != 0 {
+		return time.Unix(0, updated).UTC()
+	}
+	return time.Time{}
+}
+
+func (h *histogramState) collect(metrics []metric, entry *metricEntry, labels labels) []metric {
+	time := h.lastUpdate()
+
+	// Prometheus' scraper expects for histogram buckets to be cumulative.
+	// [1] https://prometheus.io/docs/practices/histograms/#apdex-score
+	// [2] https://en.wikipedia.org/wiki/Histogram#Cumulative_histogram
+	var cumulativeCount uint64
+	for i, bucket := range h.buckets {
+		cumulativeCount += atomic.LoadUint64(&h.counts[i])
+		metrics = append(metrics, metric{
+			mtype:  entry.mtype,
+			scope:  entry.scope,
+			name:   entry.bucket,
+			help:   entry.help,
+			value:  float64(cumulativeCount),
+			time:   time,
+			labels: bucket.labels,
+		})
+	}
+
+	count := cumulativeCount + atomic.LoadUint64(&h.counts[len(h.buckets)])
+
+	return append(metrics,
+		metric{
+			mtype:  entry.mtype,
+			scope:  entry.scope,
+			name:   entry.sum,
+			help:   entry.help,
+			value:  h.loadSum(),
+			time:   time,
+			labels: labels,
+		},
+		metric{
+			mtype:   entry.mtype,
+			scope:   entry.scope,
+			name:    entry.count,
+			help:    entry.help,
+			value:   float64(count),
+			time:    time,
+			created: h.created,
+			labels:  labels,
+		},
+	)
+}
+
 type metricBucket struct {
 	limit  float64
-	count  uint64
 	labels labels
 }
 
@@ -386,13 +772,41 @@ func makeMetricBuckets(buckets []float64, labels labels) metricBuckets {
 	return b
 }
 
-func (m metricBuckets) update(value float64) {
+func (m metricBuckets) hasLimits(limits []float64) bool {
+	if len(m) != len(limits) {
+		return false
+	}
 	for i := range m {
-		if value <= m[i].limit {
-			m[i].count++
-			break
+		if m[i].limit != limits[i] {
+			return false
 		}
 	}
+	return true
+}
+
+// index returns the index of the first bucket with a limit greater or equal to
+// value, or len(m) if there are none.
+//
+// The buckets are sorted so a binary search is used, which keeps the cost of
+// observing values low on histograms with large numbers of buckets.
+func (m metricBuckets) index(value float64) int {
+	if value != value { // NaN
+		return len(m)
+	}
+
+	i, j := 0, len(m)
+
+	for i < j {
+		h := int(uint(i+j) >> 1)
+
+		if m[h].limit < value {
+			i = h + 1
+		} else {
+			j = h
+		}
+	}
+
+	return i
 }
 
 // This function builds a string of column-separated float representations of
@@ -401,6 +815,10 @@ func (m metricBuckets) update(value float64) {
 //
 // The intent is to keep the number of dynamic memory allocations constant
 // instead of increasing linearly with the number of buckets.
+//
+// The buffer is copied to a string instead of being converted with a
+// reflect.StringHeader, which doesn't keep the buffer alive: the garbage
+// collector could reclaim it while the label values still referenced it.
 func le(buckets []float64) string {
 	if len(buckets) == 0 {
 		return ""
@@ -415,10 +833,7 @@ func le(buckets []float64) string {
 		b = appendFloat(b, v)
 	}
 
-	return *(*string)(unsafe.Pointer(&reflect.StringHeader{
-		Data: uintptr(unsafe.Pointer(&b[0])),
-		Len:  len(b),
-	}))
+	return string(b)
 }
 
 func nextLe(s string) (head string, tail string) {
@@ -449,3 +864,33 @@ func (metrics byNameAndLabels) Less(i int, j int) bool {
 	m2 := &metrics[j]
 	return m1.name < m2.name || (m1.name == m2.name && m1.labels.less(m2.labels))
 }
+
+type byFamilyName []metricFamily
+
+func (families byFamilyName) Len() int {
+	return len(families)
+}
+
+func (families byFamilyName) Swap(i int, j int) {
+	families[i], families[j] = families[j], families[i]
+}
+
+func (families byFamilyName) Less(i int, j int) bool {
+	f1 := &families[i]
+	f2 := &families[j]
+	return f1.scope < f2.scope || (f1.scope == f2.scope && f1.name < f2.name)
+}
+
+type bySeriesLabels []metricSeries
+
+func (series bySeriesLabels) Len() int {
+	return len(series)
+}
+
+func (series bySeriesLabels) Swap(i int, j int) {
+	series[i], series[j] = series[j], series[i]
+}
+
+func (series bySeriesLabels) Less(i int, j int) bool {
+	return series[i].labels.less(series[j].labels)
+}
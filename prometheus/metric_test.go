@@ -1,9 +1,15 @@
 package prometheus
 
 import (
+	"bytes"
+	"fmt"
+	"log"
 	"math"
+	"os"
 	"reflect"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -135,7 +141,7 @@ func TestMetricStoreCleanup(t *testing.T) {
 	wg.Add(8)
 
 	cleanup := func(exp time.Time) {
-		store.cleanup(exp)
+		store.cleanup(exp, nil)
 		wg.Done()
 	}
 
@@ -159,10 +165,317 @@ func TestMetricStoreCleanup(t *testing.T) {
 	sort.Sort(byNameAndLabels(metrics))
 
 	if !reflect.DeepEqual(metrics, []metric{
-		{mtype: counter, name: "E", value: 1, time: now.Add(time.Second), labels: labels{}},
+		{mtype: counter, name: "E", value: 1, time: now.Add(time.Second), created: now.Add(time.Second), labels: labels{}},
 	}) {
 		t.Errorf("bad metrics: %#v", metrics)
 	}
+
+	if stale := store.collectStale(time.Now(), time.Minute); len(stale) != 4 {
+		t.Errorf("bad number of stale states: %d", len(stale))
+	}
+
+	// Stale states are reported by every collection within the window.
+	if stale := store.collectStale(time.Now(), time.Minute); len(stale) != 4 {
+		t.Errorf("stale states were consumed: %d", len(stale))
+	}
+
+	if stale := store.collectStale(time.Now().Add(time.Minute), time.Minute); len(stale) != 0 {
+		t.Errorf("stale states were not discarded after the window: %d", len(stale))
+	}
+}
+
+func TestMetricStoreCleanupRetain(t *testing.T) {
+	now := time.Now()
+
+	store := metricStore{}
+	store.update(metric{mtype: counter, name: "A", value: 1, time: now.Add(-time.Hour)}, nil)
+	store.update(metric{mtype: gauge, name: "B", value: 1, time: now.Add(-time.Hour)}, nil)
+
+	store.cleanup(now, func(scope string, name string) bool { return name == "A" })
+
+	metrics := store.collect(nil)
+
+	if !reflect.DeepEqual(metrics, []metric{
+		{mtype: counter, name: "A", value: 1, time: now.Add(-time.Hour), created: now.Add(-time.Hour), labels: labels{}},
+	}) {
+		t.Errorf("bad metrics: %#v", metrics)
+	}
+
+	// The series of the gauge comes back after expiring, it must not be
+	// reported as stale anymore.
+	stale := store.collectStale(time.Now(), time.Minute)
+	store.update(metric{mtype: gauge, name: "B", value: 2, time: now}, nil)
+
+	families := store.collectFamilies(nil, stale, now)
+	sort.Sort(byFamilyName(families))
+
+	if len(families) != 2 {
+		t.Fatalf("bad number of families: %d", len(families))
+	}
+
+	for _, f := range families {
+		if len(f.series) != 1 || f.series[0].stale {
+			t.Errorf("bad series of %s: %#v", f.name, f.series)
+		}
+	}
+}
+
+func TestMetricStoreCollectFamiliesStale(t *testing.T) {
+	now := time.Now()
+
+	store := metricStore{}
+	store.update(metric{mtype: gauge, name: "A", value: 1, time: now.Add(-time.Hour)}, nil)
+	store.update(metric{mtype: gauge, name: "A", value: 2, time: now, labels: labels{{"id", "1"}}}, nil)
+	store.cleanup(now.Add(-time.Minute), nil)
+
+	scrape := now.Add(time.Second)
+	families := store.collectFamilies(nil, store.collectStale(scrape, time.Minute), scrape)
+
+	if len(families) != 1 {
+		t.Fatalf("bad number of families: %d", len(families))
+	}
+
+	series := families[0].series
+	sort.Sort(bySeriesLabels(series))
+
+	if len(series) != 2 {
+		t.Fatalf("bad number of series: %d", len(series))
+	}
+
+	if !series[0].stale || series[0].value != 1 {
+		t.Errorf("expected the first series to be stale: %#v", series[0])
+	}
+
+	if !series[0].time.Equal(scrape) {
+		t.Errorf("the staleness marker must have the scrape time: %s", series[0].time)
+	}
+
+	if series[1].stale || series[1].value != 2 {
+		t.Errorf("expected the second series to be live: %#v", series[1])
+	}
+}
+
+func TestMetricStoreHistogramBucketsChange(t *testing.T) {
+	t0 := time.Date(2017, 6, 4, 22, 12, 0, 0, time.UTC)
+	t1 := t0.Add(time.Minute)
+
+	tests := []struct {
+		scenario string
+		buckets  []float64
+		expects  []metric
+	}{
+		{
+			scenario: "same buckets keep accumulating",
+			buckets:  []float64{1, 2},
+			expects: []metric{
+				{mtype: histogram, name: "C_bucket", value: 2, time: t1, labels: labels{{"le", "1"}}},
+				{mtype: histogram, name: "C_bucket", value: 3, time: t1, labels: labels{{"le", "2"}}},
+				{mtype: histogram, name: "C_count", value: 3, time: t1, created: t0, labels: labels{}},
+				{mtype: histogram, name: "C_sum", value: 2.5, time: t1, labels: labels{}},
+			},
+		},
+
+		{
+			scenario: "buckets with the same length but different limits start a new generation",
+			buckets:  []float64{0.5, 2},
+			expects: []metric{
+				{mtype: histogram, name: "C_bucket", value: 1, time: t1, labels: labels{{"le", "0.5"}}},
+				{mtype: histogram, name: "C_bucket", value: 1, time: t1, labels: labels{{"le", "2"}}},
+				{mtype: histogram, name: "C_count", value: 1, time: t1, created: t1, labels: labels{}},
+				{mtype: histogram, name: "C_sum", value: 0.5, time: t1, labels: labels{}},
+			},
+		},
+
+		{
+			scenario: "buckets with a different length start a new generation",
+			buckets:  []float64{0.5, 1, 2},
+			expects: []metric{
+				{mtype: histogram, name: "C_bucket", value: 1, time: t1, labels: labels{{"le", "0.5"}}},
+				{mtype: histogram, name: "C_bucket", value: 1, time: t1, labels: labels{{"le", "1"}}},
+				{mtype: histogram, name: "C_bucket", value: 1, time: t1, labels: labels{{"le", "2"}}},
+				{mtype: histogram, name: "C_count", value: 1, time: t1, created: t1, labels: labels{}},
+				{mtype: histogram, name: "C_sum", value: 0.5, time: t1, labels: labels{}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			store := metricStore{}
+			store.update(metric{mtype: histogram, name: "C", value: 0.5, time: t0}, []float64{1, 2})
+			store.update(metric{mtype: histogram, name: "C", value: 1.5, time: t0}, []float64{1, 2})
+			store.update(metric{mtype: histogram, name: "C", value: 0.5, time: t1}, test.buckets)
+
+			metrics := store.collect(nil)
+			sort.Sort(byNameAndLabels(metrics))
+
+			if !reflect.DeepEqual(metrics, test.expects) {
+				t.Error("bad metrics:")
+				t.Logf("expected: %v", test.expects)
+				t.Logf("found:    %v", metrics)
+			}
+		})
+	}
+}
+
+func TestMetricStoreHistogramBucketsChangedInPlace(t *testing.T) {
+	t0 := time.Date(2017, 6, 4, 22, 12, 0, 0, time.UTC)
+	buckets := []float64{1, 2}
+
+	store := metricStore{}
+	store.update(metric{mtype: histogram, name: "C", value: 1.5, time: t0}, buckets)
+
+	buckets[1] = 4
+	store.update(metric{mtype: histogram, name: "C", value: 3, time: t0}, buckets)
+
+	metrics := store.collect(nil)
+	sort.Sort(byNameAndLabels(metrics))
+
+	expects := []metric{
+		{mtype: histogram, name: "C_bucket", value: 0, time: t0, labels: labels{{"le", "1"}}},
+		{mtype: histogram, name: "C_bucket", value: 1, time: t0, labels: labels{{"le", "4"}}},
+		{mtype: histogram, name: "C_count", value: 1, time: t0, created: t0, labels: labels{}},
+		{mtype: histogram, name: "C_sum", value: 3, time: t0, labels: labels{}},
+	}
+
+	if !reflect.DeepEqual(metrics, expects) {
+		t.Error("bad metrics:")
+		t.Logf("expected: %v", expects)
+		t.Logf("found:    %v", metrics)
+	}
+}
+
+func TestMetricStoreHistogramBucketsChangeLoggedOnce(t *testing.T) {
+	b := &bytes.Buffer{}
+	log.SetOutput(b)
+	defer log.SetOutput(os.Stderr)
+
+	t0 := time.Date(2017, 6, 4, 22, 12, 0, 0, time.UTC)
+	store := metricStore{}
+
+	for _, buckets := range [][]float64{{1, 2}, {1, 2, 4}, {1, 2, 4}} {
+		for i := 0; i != 10; i++ {
+			store.update(metric{mtype: histogram, name: "C", value: 1, time: t0, labels: labels{{"id", strconv.Itoa(i)}}}, buckets)
+		}
+	}
+
+	if n := strings.Count(b.String(), "\n"); n != 1 {
+		t.Errorf("the bucket change must be logged once, found %d lines:\n%s", n, b.String())
+	}
+}
+
+func TestMetricBucketsIndex(t *testing.T) {
+	buckets := makeMetricBuckets([]float64{0.25, 0.5, 0.75, 1.0}, nil)
+
+	tests := []struct {
+		value float64
+		index int
+	}{
+		{value: math.Inf(-1), index: 0},
+		{value: 0, index: 0},
+		{value: 0.25, index: 0},
+		{value: 0.3, index: 1},
+		{value: 0.5, index: 1},
+		{value: 0.75, index: 2},
+		{value: 0.9, index: 3},
+		{value: 1, index: 3},
+		{value: 1.1, index: 4},
+		{value: math.Inf(+1), index: 4},
+		{value: math.NaN(), index: 4},
+	}
+
+	for _, test := range tests {
+		if i := buckets.index(test.value); i != test.index {
+			t.Errorf("%g: bad bucket index: %d != %d", test.value, test.index, i)
+		}
+	}
+
+	if i := metricBuckets(nil).index(1); i != 0 {
+		t.Errorf("bad bucket index of empty buckets: %d", i)
+	}
+}
+
+func TestMetricStateConcurrentObserve(t *testing.T) {
+	const goroutines = 8
+	const observations = 1000
+
+	buckets := []float64{1, 2, 3}
+	state := newMetricState(nil)
+
+	wg := sync.WaitGroup{}
+	wg.Add(goroutines)
+
+	for i := 0; i != goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j != observations; j++ {
+				state.update(histogram, float64(j%4)+0.5, time.Time{}, buckets)
+			}
+		}()
+	}
+
+	// The race detector should complain if collecting the state while it's
+	// receiving updates isn't properly synchronized.
+	for i := 0; i != 10; i++ {
+		state.collect(nil, &metricEntry{mtype: histogram})
+	}
+
+	wg.Wait()
+
+	series := state.series(histogram)
+
+	if series.count != goroutines*observations {
+		t.Error("bad count:", series.count)
+	}
+
+	if series.sum != goroutines*observations*2 {
+		t.Error("bad sum:", series.sum)
+	}
+
+	for i, b := range series.buckets {
+		if n := uint64(i+1) * goroutines * observations / 4; b.count != n {
+			t.Errorf("bad cumulative count of bucket %g: %d != %d", b.limit, n, b.count)
+		}
+	}
+}
+
+func BenchmarkMetricStateObserve(b *testing.B) {
+	for _, n := range []int{10, 50, 100, 200} {
+		buckets := make([]float64, n)
+
+		for i := range buckets {
+			buckets[i] = math.Pow(2, float64(i-n/2))
+		}
+
+		b.Run(fmt.Sprintf("buckets=%d", n), func(b *testing.B) {
+			state := newMetricState(nil)
+			now := time.Now()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					state.update(histogram, buckets[i%n]*0.9, now, buckets)
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkMetricBucketsIndex(b *testing.B) {
+	for _, n := range []int{10, 50, 100, 200} {
+		limits := make([]float64, n)
+
+		for i := range limits {
+			limits[i] = float64(i + 1)
+		}
+
+		buckets := makeMetricBuckets(limits, nil)
+
+		b.Run(fmt.Sprintf("buckets=%d", n), func(b *testing.B) {
+			for i := 0; i != b.N; i++ {
+				buckets.index(float64(i % (n + 1)))
+			}
+		})
+	}
 }
 
 func BenchmarkLE(b *testing.B) {
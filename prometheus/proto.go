@@ -0,0 +1,221 @@
+package prometheus
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// This file contains a minimal encoder for the protobuf exposition format of
+// prometheus, which represents metrics as a stream of length-delimited
+// io.prometheus.client.MetricFamily messages.
+//
+// The protobuf format is the only one able to carry staleness markers, which
+// are special NaN values telling prometheus that a time series has ended.
+//
+// [1] https://github.com/prometheus/client_model/blob/master/io/prometheus/client/metrics.proto
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+)
+
+// Field numbers of the io.prometheus.client messages.
+const (
+	// LabelPair
+	labelPairName  = 1
+	labelPairValue = 2
+
+	// MetricFamily
+	familyName   = 1
+	familyHelp   = 2
+	familyType   = 3
+	familyMetric = 4
+
+	// Metric
+	metricLabel       = 1
+	metricGauge       = 2
+	metricCounter     = 3
+	metricUntyped     = 5
+	metricTimestampMs = 6
+	metricHistogram   = 7
+
+	// Gauge, Counter and Untyped
+	valueValue = 1
+
+	// Counter
+	counterCreatedTimestamp = 3
+
+	// Histogram
+	histogramSampleCount      = 1
+	histogramSampleSum        = 2
+	histogramBucket           = 3
+	histogramSampleCountFloat = 4
+	histogramCreatedTimestamp = 15
+
+	// Bucket
+	bucketCumulativeCount      = 1
+	bucketUpperBound           = 2
+	bucketCumulativeCountFloat = 4
+
+	// Timestamp
+	timestampSeconds = 1
+	timestampNanos   = 2
+)
+
+// Values of the io.prometheus.client.MetricType enumeration.
+const (
+	protoCounter   = 0
+	protoGauge     = 1
+	protoSummary   = 2
+	protoUntyped   = 3
+	protoHistogram = 4
+)
+
+// staleNaN is the value used by prometheus to mark the end of a time series.
+var staleNaN = math.Float64frombits(0x7ff0000000000002)
+
+func protoTypeOf(t metricType) uint64 {
+	switch t {
+	case counter:
+		return protoCounter
+	case gauge:
+		return protoGauge
+	case histogram:
+		return protoHistogram
+	case summary:
+		return protoSummary
+	default:
+		return protoUntyped
+	}
+}
+
+// appendMetricFamily appends the length-delimited protobuf representation of
+// the metric family to b. The scratch buffer is used to encode nested messages
+// and is returned so it can be reused by the caller.
+func appendMetricFamily(b []byte, scratch []byte, family metricFamily) ([]byte, []byte) {
+	var m []byte
+	var name []byte
+
+	name = appendMetricScopedName(scratch[:0], family.scope, family.name)
+	m = appendProtoBytes(nil, familyName, name)
+
+	if len(family.help) != 0 {
+		m = appendProtoString(m, familyHelp, family.help)
+	}
+
+	m = appendProtoVarint(m, familyType, protoTypeOf(family.mtype))
+
+	for _, series := range family.series {
+		scratch = appendSeries(scratch[:0], family.mtype, series)
+		m = appendProtoBytes(m, familyMetric, scratch)
+	}
+
+	b = binary.AppendUvarint(b, uint64(len(m)))
+	b = append(b, m...)
+	return b, scratch
+}
+
+func appendSeries(b []byte, mtype metricType, series metricSeries) []byte {
+	var m []byte
+
+	for _, l := range series.labels {
+		m = m[:0]
+		m = appendProtoBytes(m, labelPairName, appendLabelName(nil, l.name))
+		m = appendProtoString(m, labelPairValue, l.value)
+		b = appendProtoBytes(b, metricLabel, m)
+	}
+
+	m = m[:0]
+
+	switch mtype {
+	case counter:
+		m = appendProtoDouble(m, valueValue, staleOr(series.stale, series.value))
+		if !series.created.IsZero() {
+			m = appendProtoBytes(m, counterCreatedTimestamp, appendTimestamp(nil, series.created))
+		}
+		b = appendProtoBytes(b, metricCounter, m)
+
+	case gauge:
+		m = appendProtoDouble(m, valueValue, staleOr(series.stale, series.value))
+		b = appendProtoBytes(b, metricGauge, m)
+
+	case histogram:
+		if series.stale {
+			m = appendProtoDouble(m, histogramSampleCountFloat, staleNaN)
+		} else {
+			m = appendProtoVarint(m, histogramSampleCount, series.count)
+		}
+
+		m = appendProtoDouble(m, histogramSampleSum, staleOr(series.stale, series.sum))
+
+		for _, bucket := range series.buckets {
+			var bm []byte
+			if series.stale {
+				bm = appendProtoDouble(bm, bucketCumulativeCountFloat, staleNaN)
+			} else {
+				bm = appendProtoVarint(bm, bucketCumulativeCount, bucket.count)
+			}
+			bm = appendProtoDouble(bm, bucketUpperBound, bucket.limit)
+			m = appendProtoBytes(m, histogramBucket, bm)
+		}
+
+		if !series.created.IsZero() {
+			m = appendProtoBytes(m, histogramCreatedTimestamp, appendTimestamp(nil, series.created))
+		}
+
+		b = appendProtoBytes(b, metricHistogram, m)
+
+	default:
+		m = appendProtoDouble(m, valueValue, staleOr(series.stale, series.value))
+		b = appendProtoBytes(b, metricUntyped, m)
+	}
+
+	if !series.time.IsZero() {
+		b = appendProtoVarint(b, metricTimestampMs, uint64(series.time.UnixNano()/1e6))
+	}
+
+	return b
+}
+
+func appendTimestamp(b []byte, t time.Time) []byte {
+	b = appendProtoVarint(b, timestampSeconds, uint64(t.Unix()))
+	if nanos := t.Nanosecond(); nanos != 0 {
+		b = appendProtoVarint(b, timestampNanos, uint64(nanos))
+	}
+	return b
+}
+
+func staleOr(stale bool, value float64) float64 {
+	if stale {
+		return staleNaN
+	}
+	return value
+}
+
+func appendProtoKey(b []byte, field int, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wire))
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	b = appendProtoKey(b, field, wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoDouble(b []byte, field int, v float64) []byte {
+	b = appendProtoKey(b, field, wireFixed64)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendProtoKey(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendProtoString(b []byte, field int, v string) []byte {
+	b = appendProtoKey(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
@@ -0,0 +1,91 @@
+package prometheus
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestAppendMetricFamily(t *testing.T) {
+	tests := []struct {
+		scenario string
+		family   metricFamily
+		bytes    []byte
+	}{
+		{
+			scenario: "gauge metric without labels",
+			family: metricFamily{
+				mtype:  gauge,
+				name:   "A",
+				series: []metricSeries{{value: 1}},
+			},
+			bytes: []byte{
+				0x12,            // length
+				0x0a, 0x01, 'A', // name
+				0x18, 0x01, // type
+				0x22, 0x0b, // metric
+				0x12, 0x09, // gauge
+				0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f, // value
+			},
+		},
+
+		{
+			scenario: "stale counter metric with a label and timestamp",
+			family: metricFamily{
+				mtype: counter,
+				scope: "x",
+				name:  "A",
+				series: []metricSeries{{
+					labels: labels{{"a", "b"}},
+					value:  1,
+					time:   time.Unix(1, 0),
+					stale:  true,
+				}},
+			},
+			bytes: []byte{
+				0x1f,                      // length
+				0x0a, 0x03, 'x', '_', 'A', // name
+				0x18, 0x00, // type
+				0x22, 0x16, // metric
+				0x0a, 0x06, 0x0a, 0x01, 'a', 0x12, 0x01, 'b', // label
+				0x1a, 0x09, // counter
+				0x09, 0x02, 0, 0, 0, 0, 0, 0xf0, 0x7f, // stale value
+				0x30, 0xe8, 0x07, // timestamp
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			b, _ := appendMetricFamily(nil, nil, test.family)
+
+			if !bytes.Equal(b, test.bytes) {
+				t.Error("bad protobuf representation:")
+				t.Logf("expected: %#v", test.bytes)
+				t.Logf("found:    %#v", b)
+			}
+		})
+	}
+}
+
+func BenchmarkAppendMetricFamily(b *testing.B) {
+	family := metricFamily{
+		mtype: histogram,
+		name:  "A",
+		series: []metricSeries{{
+			labels:  labels{{"a", "1"}, {"b", "2"}},
+			sum:     10,
+			count:   4,
+			buckets: []metricSeriesBucket{{0.25, 1}, {0.5, 2}, {1, 4}},
+			time:    time.Now(),
+			created: time.Now(),
+		}},
+	}
+
+	buf := make([]byte, 0, 1024)
+	tmp := make([]byte, 0, 1024)
+
+	for i := 0; i != b.N; i++ {
+		buf, tmp = appendMetricFamily(buf[:0], tmp, family)
+	}
+}
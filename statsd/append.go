@@ -0,0 +1,25 @@
+package statsd
+
+import "strconv"
+
+func appendMetric(b []byte, m Metric, tags TagScheme) []byte {
+	// A gauge value with a leading '-' decrements the gauge on statsd servers,
+	// which is avoided by resetting the gauge to zero first.
+	if m.Type == Gauge && m.Value < 0 {
+		b = tags.AppendName(b, m.Namespace, m.Name, m.Tags)
+		b = append(b, ":0|g\n"...)
+	}
+
+	b = tags.AppendName(b, m.Namespace, m.Name, m.Tags)
+	b = append(b, ':')
+	b = strconv.AppendFloat(b, m.Value, 'g', -1, 64)
+	b = append(b, '|')
+	b = append(b, m.Type...)
+
+	if m.Rate != 0 && m.Rate != 1 {
+		b = append(b, '|', '@')
+		b = strconv.AppendFloat(b, m.Rate, 'g', -1, 64)
+	}
+
+	return append(b, '\n')
+}
@@ -0,0 +1,54 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/segmentio/stats"
+)
+
+func TestAppendMetric(t *testing.T) {
+	for _, test := range testMetrics {
+		t.Run(test.s, func(t *testing.T) {
+			if s := string(appendMetric(nil, test.m, test.t)); s != test.s {
+				t.Errorf("\n<<< %#v\n>>> %#v", test.s, s)
+			}
+		})
+	}
+}
+
+func TestAppendMetricTagSchemes(t *testing.T) {
+	m := Metric{
+		Type:      Counter,
+		Namespace: "app",
+		Name:      "req:count",
+		Value:     1,
+		Tags:      []stats.Tag{{"host", "a;b,c"}, {"empty", ""}, {"path", "/a b"}},
+	}
+
+	tests := []struct {
+		t TagScheme
+		s string
+	}{
+		{NoTags, "app.req_count:1|c\n"},
+		{GraphiteTags, "app.req_count;host=a_b,c;path=/a_b:1|c\n"},
+		{InfluxDBTags, "app.req_count,host=a;b_c,path=/a_b:1|c\n"},
+	}
+
+	for _, test := range tests {
+		if s := string(appendMetric(nil, m, test.t)); s != test.s {
+			t.Errorf("\n<<< %#v\n>>> %#v", test.s, s)
+		}
+	}
+}
+
+func BenchmarkAppendMetric(b *testing.B) {
+	buffer := make([]byte, 4096)
+
+	for _, test := range testMetrics {
+		b.Run(test.m.Name, func(b *testing.B) {
+			for i := 0; i != b.N; i++ {
+				appendMetric(buffer[:0], test.m, test.t)
+			}
+		})
+	}
+}
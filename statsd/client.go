@@ -0,0 +1,188 @@
+package statsd
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+const (
+	// MaxBufferSize is a hard-limit on the max size of the datagram buffer.
+	MaxBufferSize = 65507
+
+	// DefaultAddress is the default address to which clients connection to.
+	DefaultAddress = "localhost:8125"
+
+	// DefaultBufferSize is the default size of the client buffer, datagrams
+	// of this size fit in the MTU of most networks.
+	DefaultBufferSize = 1432
+
+	// DefaultFlushInterval is the default interval at which clients flush
+	// the metrics they have buffered.
+	DefaultFlushInterval = 1 * time.Second
+)
+
+// The ClientConfig type is used to configure statsd clients.
+type ClientConfig struct {
+	// Address of the statsd server to send metrics to.
+	Address string
+
+	// BufferSize is the size of the output buffer used by the client.
+	BufferSize int
+
+	// FlushInterval is the interval at which the client flushes its buffer in
+	// the background. Setting a negative value disables background flushes.
+	FlushInterval time.Duration
+
+	// Tags is the scheme used to encode tags into metric names, the tags are
+	// discarded when nil.
+	Tags TagScheme
+
+	// HistogramType is the statsd type that histograms are reported as, the
+	// default is to use histograms (h) with the values as they were reported.
+	//
+	// When set to Timer (ms), for servers that don't support histograms, the
+	// values are expected to be durations in seconds (as reported by
+	// stats.ObserveDuration for example) and are converted to milliseconds.
+	HistogramType MetricType
+}
+
+// Client represents a statsd client that pulls metrics from a stats engine and
+// forward them to a statsd server.
+type Client struct {
+	conn *Conn
+	htyp MetricType
+	once sync.Once
+	done chan struct{}
+	join chan struct{}
+}
+
+// NewClient creates and returns a new statsd client publishing metrics to the
+// server listening at addr.
+func NewClient(addr string) *Client {
+	return NewClientWith(ClientConfig{
+		Address: addr,
+	})
+}
+
+// NewClientWith creates and returns a new statsd client configured with config.
+func NewClientWith(config ClientConfig) *Client {
+	if len(config.Address) == 0 {
+		config.Address = DefaultAddress
+	}
+
+	if config.FlushInterval == 0 {
+		config.FlushInterval = DefaultFlushInterval
+	}
+
+	if len(config.HistogramType) == 0 {
+		config.HistogramType = Histogram
+	}
+
+	conn, err := DialConfig(ConnConfig{
+		Address:    config.Address,
+		BufferSize: config.BufferSize,
+		Tags:       config.Tags,
+	})
+
+	if err != nil {
+		// UDP sockets only fail to be created when the address is invalid,
+		// the client discards its metrics in this case.
+		log.Printf("stats/statsd: opening a connection to %s failed: %s", config.Address, err)
+	} else {
+		log.Printf("stats/statsd: connection opened to %s with a buffer size of %d B", config.Address, cap(conn.b))
+	}
+
+	c := &Client{
+		conn: conn,
+		htyp: config.HistogramType,
+		done: make(chan struct{}),
+		join: make(chan struct{}),
+	}
+
+	if config.FlushInterval > 0 && conn != nil {
+		go c.run(config.FlushInterval)
+	} else {
+		close(c.join)
+	}
+
+	return c
+}
+
+func (c *Client) run(flushInterval time.Duration) {
+	defer close(c.join)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.Flush()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Close satisfies the io.Closer interface.
+//
+// The method stops the background flushes and sends the metrics remaining in
+// the client buffer before closing the connection.
+func (c *Client) Close() (err error) {
+	c.once.Do(func() {
+		close(c.done)
+		<-c.join
+		if c.conn != nil {
+			err = c.conn.Close()
+		}
+	})
+	return
+}
+
+// Flush satisfies the stats.Flusher interface.
+func (c *Client) Flush() {
+	if c.conn != nil {
+		if err := c.conn.Flush(); err != nil {
+			log.Printf("stats/statsd: sending metrics to %s failed: %s", c.conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// HandleMetric satisfies the stats.Handler interface.
+func (c *Client) HandleMetric(m *stats.Metric) {
+	if c.conn == nil {
+		return
+	}
+
+	typ := c.metricType(m)
+	value := m.Value
+
+	if typ == Timer {
+		value *= 1000
+	}
+
+	err := c.conn.WriteMetric(Metric{
+		Type:      typ,
+		Namespace: m.Namespace,
+		Name:      m.Name,
+		Value:     value,
+		Tags:      m.Tags,
+	})
+	if err != nil {
+		log.Printf("stats/statsd: sending metric %s to %s failed: %s", m.Name, c.conn.RemoteAddr(), err)
+	}
+}
+
+func (c *Client) metricType(m *stats.Metric) MetricType {
+	switch m.Type {
+	case stats.CounterType:
+		return Counter
+	case stats.GaugeType:
+		return Gauge
+	default:
+		return c.htyp
+	}
+}
@@ -0,0 +1,161 @@
+package statsd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnConfig carries the configuration options that can be set when creating a
+// connection.
+type ConnConfig struct {
+	// Address of the statsd server, metrics are sent as UDP datagrams.
+	Address string
+
+	// BufferSize is the size of the datagrams produced by the connection.
+	BufferSize int
+
+	// Tags is the scheme used to encode tags into metric names, NoTags is
+	// used when nil.
+	Tags TagScheme
+}
+
+// A Conn represents a connection to a statsd server.
+type Conn struct {
+	m sync.Mutex
+	c net.Conn
+	b []byte
+	t TagScheme
+}
+
+// Dial opens a new statsd connection to address.
+func Dial(address string) (conn *Conn, err error) {
+	return DialConfig(ConnConfig{
+		Address: address,
+	})
+}
+
+// DialConfig opens a new statsd connection using config.
+func DialConfig(config ConnConfig) (conn *Conn, err error) {
+	var c net.Conn
+
+	if len(config.Address) == 0 {
+		config.Address = DefaultAddress
+	}
+
+	if config.BufferSize <= 0 {
+		config.BufferSize = DefaultBufferSize
+	}
+
+	if config.BufferSize > MaxBufferSize {
+		config.BufferSize = MaxBufferSize
+	}
+
+	if c, err = net.Dial("udp", config.Address); err != nil {
+		return
+	}
+
+	conn = NewConn(c, make([]byte, 0, config.BufferSize))
+	conn.t = config.Tags
+	return
+}
+
+// NewConn creates a new statsd connection with conn and buff.
+func NewConn(conn net.Conn, buff []byte) *Conn {
+	return &Conn{
+		c: conn,
+		b: buff,
+	}
+}
+
+// WriteMetric writes m to the connection, tags are encoded into the metric
+// name with the tag scheme that the connection was configured with.
+func (c *Conn) WriteMetric(m Metric) (err error) {
+	buf := bufferPool.Get().(*buffer)
+	buf.b = appendMetric(buf.b[:0], m, c.tags())
+	_, err = c.Write(buf.b)
+	bufferPool.Put(buf)
+	return
+}
+
+func (c *Conn) tags() TagScheme {
+	if c.t != nil {
+		return c.t
+	}
+	return NoTags
+}
+
+// Close satisfies the net.Conn interface.
+func (c *Conn) Close() (err error) {
+	err = c.Flush()
+	c.c.Close()
+	return
+}
+
+// Read satisfies the net.Conn interface.
+func (c *Conn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+// Write satisfies the net.Conn interface.
+//
+// The content of b is buffered until the next flush, programs must call Write
+// with whole lines only.
+func (c *Conn) Write(b []byte) (n int, err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if n = len(b); n > cap(c.b) {
+		return 0, fmt.Errorf("discarded because it doesn't fit in the output buffer (size = %d, max = %d)", n, cap(c.b))
+	}
+
+	if n > (cap(c.b) - len(c.b)) {
+		err = c.flush()
+	}
+
+	c.b = append(c.b, b...)
+	return
+}
+
+// LocalAddr satisfies the net.Conn interface.
+func (c *Conn) LocalAddr() net.Addr {
+	return c.c.LocalAddr()
+}
+
+// RemoteAddr satisfies the net.Conn interface.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.c.RemoteAddr()
+}
+
+// SetDeadline satisfies the net.Conn interface.
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.c.SetDeadline(t)
+}
+
+// SetReadDeadline satisfies the net.Conn interface.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.c.SetReadDeadline(t)
+}
+
+// SetWriteDeadline satisfies the net.Conn interface.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.c.SetWriteDeadline(t)
+}
+
+// Flush sends a datagram containing all buffered data.
+func (c *Conn) Flush() (err error) {
+	c.m.Lock()
+	err = c.flush()
+	c.m.Unlock()
+	return
+}
+
+func (c *Conn) flush() (err error) {
+	if len(c.b) != 0 {
+		_, err = c.c.Write(c.b)
+		c.b = c.b[:0]
+	}
+	return
+}
@@ -0,0 +1,55 @@
+package statsd
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/segmentio/stats"
+)
+
+// MetricType is an enumeration providing symbols to represent the different
+// metric types supported by statsd.
+type MetricType string
+
+const (
+	Counter   MetricType = "c"
+	Gauge     MetricType = "g"
+	Timer     MetricType = "ms"
+	Histogram MetricType = "h"
+	Set       MetricType = "s"
+)
+
+// The Metric type is a representation of the metrics supported by statsd.
+//
+// The statsd protocol has no support for tags, they are encoded into the metric
+// names by a TagScheme.
+type Metric struct {
+	Type      MetricType  // the metric type
+	Namespace string      // the metric namespace (never populated by parsing operations)
+	Name      string      // the metric name
+	Value     float64     // the metric value
+	Rate      float64     // sample rate, a value between 0 and 1
+	Tags      []stats.Tag // the list of tags set on the metric
+}
+
+// String satisfies the fmt.Stringer interface.
+func (m Metric) String() string {
+	return fmt.Sprint(m)
+}
+
+// Format satisfies the fmt.Formatter interface, tags are formatted with the
+// InfluxDBTags scheme.
+func (m Metric) Format(f fmt.State, _ rune) {
+	buf := bufferPool.Get().(*buffer)
+	buf.b = appendMetric(buf.b[:0], m, InfluxDBTags)
+	f.Write(buf.b)
+	bufferPool.Put(buf)
+}
+
+type buffer struct {
+	b []byte
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return &buffer{make([]byte, 0, 512)} },
+}
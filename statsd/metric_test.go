@@ -0,0 +1,95 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/segmentio/stats"
+)
+
+var testMetrics = []struct {
+	s string
+	t TagScheme
+	m Metric
+}{
+	{
+		s: "page.views:1|c\n",
+		t: NoTags,
+		m: Metric{
+			Type:  Counter,
+			Name:  "page.views",
+			Value: 1,
+			Rate:  1,
+		},
+	},
+
+	{
+		s: "fuel.level:0.5|g\n",
+		t: NoTags,
+		m: Metric{
+			Type:  Gauge,
+			Name:  "fuel.level",
+			Value: 0.5,
+			Rate:  1,
+		},
+	},
+
+	{
+		s: "song.length:240|ms|@0.5\n",
+		t: NoTags,
+		m: Metric{
+			Type:  Timer,
+			Name:  "song.length",
+			Value: 240,
+			Rate:  0.5,
+		},
+	},
+
+	{
+		s: "users.uniques:1234|s\n",
+		t: NoTags,
+		m: Metric{
+			Type:  Set,
+			Name:  "users.uniques",
+			Value: 1234,
+			Rate:  1,
+		},
+	},
+
+	{
+		s: "users.online;country=china;host=a:1|c|@0.1\n",
+		t: GraphiteTags,
+		m: Metric{
+			Type:  Counter,
+			Name:  "users.online",
+			Value: 1,
+			Rate:  0.1,
+			Tags:  []stats.Tag{{"country", "china"}, {"host", "a"}},
+		},
+	},
+
+	{
+		s: "request.rtt,path=/,status=200:0.25|h\n",
+		t: InfluxDBTags,
+		m: Metric{
+			Type:  Histogram,
+			Name:  "request.rtt",
+			Value: 0.25,
+			Rate:  1,
+			Tags:  []stats.Tag{{"path", "/"}, {"status", "200"}},
+		},
+	},
+}
+
+func TestMetricString(t *testing.T) {
+	m := Metric{
+		Type:      Counter,
+		Namespace: "app",
+		Name:      "requests",
+		Value:     1,
+		Tags:      []stats.Tag{{"host", "a"}},
+	}
+
+	if s := m.String(); s != "app.requests,host=a:1|c\n" {
+		t.Error("bad metric string:", s)
+	}
+}
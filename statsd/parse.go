@@ -0,0 +1,77 @@
+package statsd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+func parseMetric(s string, tags TagScheme) (m Metric, err error) {
+	var next = strings.TrimSpace(s)
+	var name string
+	var val string
+	var typ string
+	var rate string
+
+	val, next = nextToken(next, '|')
+	typ, rate = nextToken(next, '|')
+	name, val = split(val, ':')
+
+	if len(name) == 0 {
+		err = fmt.Errorf("statsd: %#v is missing a metric name", s)
+		return
+	}
+
+	if len(val) == 0 {
+		err = fmt.Errorf("statsd: %#v is missing a metric value", s)
+		return
+	}
+
+	if len(typ) == 0 {
+		err = fmt.Errorf("statsd: %#v is missing a metric type", s)
+		return
+	}
+
+	m = Metric{
+		Type: MetricType(typ),
+		Rate: 1,
+	}
+
+	if m.Value, err = strconv.ParseFloat(val, 64); err != nil {
+		err = fmt.Errorf("statsd: %#v has a malformed value", s)
+		return
+	}
+
+	if len(rate) != 0 {
+		if rate[0] != '@' {
+			err = fmt.Errorf("statsd: %#v has a malformed sample rate", s)
+			return
+		}
+
+		if m.Rate, err = strconv.ParseFloat(rate[1:], 64); err != nil || m.Rate <= 0 || m.Rate > 1 {
+			err = fmt.Errorf("statsd: %#v has a malformed sample rate", s)
+			return
+		}
+	}
+
+	m.Name, m.Tags = tags.ParseName(name)
+	return
+}
+
+func nextToken(s string, b byte) (token string, next string) {
+	if off := strings.IndexByte(s, b); off >= 0 {
+		token, next = s[:off], s[off+1:]
+	} else {
+		token = s
+	}
+	return
+}
+
+func split(s string, b byte) (head string, tail string) {
+	if off := strings.LastIndexByte(s, b); off >= 0 {
+		head, tail = s[:off], s[off+1:]
+	} else {
+		head = s
+	}
+	return
+}
@@ -0,0 +1,40 @@
+package statsd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseMetricSuccess(t *testing.T) {
+	for _, test := range testMetrics {
+		t.Run(test.s, func(t *testing.T) {
+			if m, err := parseMetric(test.s, test.t); err != nil {
+				t.Error(err)
+			} else if !reflect.DeepEqual(m, test.m) {
+				t.Errorf("%#v:\n- %#v\n- %#v", test.s, test.m, m)
+			}
+		})
+	}
+}
+
+func TestParseMetricFailure(t *testing.T) {
+	tests := []string{
+		"",
+		":10|c",        // missing name
+		"name:|c",      // missing value
+		"name:abc|c",   // malformed value
+		"name:1",       // missing type
+		"name:1|",      // missing type
+		"name:1|c|???", // malformed sample rate
+		"name:1|c|@a",  // malformed sample rate
+		"name:1|c|@2",  // sample rate out of range
+	}
+
+	for _, test := range tests {
+		t.Run(test, func(t *testing.T) {
+			if _, err := parseMetric(test, NoTags); err == nil {
+				t.Errorf("%#v: expected parsing error", test)
+			}
+		})
+	}
+}
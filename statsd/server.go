@@ -0,0 +1,128 @@
+package statsd
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Handler defines the interface that types must satisfy to process metrics
+// received by a statsd server.
+type Handler interface {
+	// HandleMetric is called when a statsd server receives a metric.
+	// The method receives the metric and the address from which it was sent.
+	HandleMetric(Metric, net.Addr)
+}
+
+// HandlerFunc makes it possible for function types to be used as metric
+// handlers on statsd servers.
+type HandlerFunc func(Metric, net.Addr)
+
+// HandleMetric calls f(m, a).
+func (f HandlerFunc) HandleMetric(m Metric, a net.Addr) {
+	f(m, a)
+}
+
+// Server is a statsd server, the zero-value is a valid server that discards
+// what it receives.
+type Server struct {
+	// Handler is the handler that the server passes the metrics it receives
+	// to, they are discarded when nil.
+	Handler Handler
+
+	// Tags is the scheme used to decode tags from the metric names, the names
+	// are left untouched when nil.
+	Tags TagScheme
+}
+
+// ListenAndServe listens for UDP datagrams on addr and forwards the metrics to
+// the server handler.
+func (s *Server) ListenAndServe(addr string) (err error) {
+	var conn net.PacketConn
+
+	if conn, err = net.ListenPacket("udp", addr); err != nil {
+		return
+	}
+
+	err = s.Serve(conn)
+	return
+}
+
+// Serve runs the server on conn, which is closed when the method returns.
+func (s *Server) Serve(conn net.PacketConn) (err error) {
+	defer conn.Close()
+
+	concurrency := runtime.GOMAXPROCS(-1)
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	tags := s.Tags
+	if tags == nil {
+		tags = NoTags
+	}
+
+	handler := s.Handler
+	if handler == nil {
+		handler = HandlerFunc(func(Metric, net.Addr) {})
+	}
+
+	done := make(chan error, concurrency)
+	conn.SetDeadline(time.Time{})
+
+	for i := 0; i != concurrency; i++ {
+		go serve(conn, handler, tags, done)
+	}
+
+	for i := 0; i != concurrency; i++ {
+		switch e := <-done; e {
+		case nil, io.EOF, io.ErrClosedPipe, io.ErrUnexpectedEOF:
+		default:
+			err = e
+		}
+		conn.Close()
+	}
+
+	return
+}
+
+// ListenAndServe starts a new statsd server, listening for UDP datagrams on
+// addr and forwarding the metrics to handler.
+func ListenAndServe(addr string, handler Handler) error {
+	return (&Server{Handler: handler}).ListenAndServe(addr)
+}
+
+// Serve runs a statsd server, listening for datagrams on conn and forwarding
+// the metrics to handler.
+func Serve(conn net.PacketConn, handler Handler) error {
+	return (&Server{Handler: handler}).Serve(conn)
+}
+
+func serve(conn net.PacketConn, handler Handler, tags TagScheme, done chan<- error) {
+	b := make([]byte, 65536)
+
+	for {
+		n, a, err := conn.ReadFrom(b)
+		if err != nil {
+			done <- err
+			return
+		}
+
+		for s := string(b[:n]); len(s) != 0; {
+			var ln string
+
+			if ln, s = nextToken(s, '\n'); len(strings.TrimSpace(ln)) == 0 {
+				continue
+			}
+
+			m, err := parseMetric(ln, tags)
+			if err != nil {
+				continue
+			}
+
+			handler.HandleMetric(m, a)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package statsd
+
+import (
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/stats"
+)
+
+func TestServer(t *testing.T) {
+	metrics := make(chan Metric, 10)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	server := &Server{
+		Handler: HandlerFunc(func(m Metric, _ net.Addr) { metrics <- m }),
+		Tags:    InfluxDBTags,
+	}
+	go server.Serve(conn)
+
+	client := NewClientWith(ClientConfig{
+		Address:       conn.LocalAddr().String(),
+		FlushInterval: -1,
+		Tags:          InfluxDBTags,
+	})
+	defer client.Close()
+
+	engine := stats.NewEngine("statsd.test", stats.Tag{"service", "api"})
+	engine.Register(client)
+	engine.Add("A", 2)
+	engine.Set("B", 3)
+	engine.Observe("C", 4, stats.Tag{"path", "/"})
+	engine.Flush()
+
+	expected := []Metric{
+		{Type: Counter, Name: "statsd.test.A", Value: 2, Rate: 1, Tags: []stats.Tag{{"service", "api"}}},
+		{Type: Gauge, Name: "statsd.test.B", Value: 3, Rate: 1, Tags: []stats.Tag{{"service", "api"}}},
+		{Type: Histogram, Name: "statsd.test.C", Value: 4, Rate: 1, Tags: []stats.Tag{{"service", "api"}, {"path", "/"}}},
+	}
+
+	for _, m := range expected {
+		select {
+		case r := <-metrics:
+			if !reflect.DeepEqual(r, m) {
+				t.Errorf("bad metric:\n- %#v\n- %#v", m, r)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for metrics")
+		}
+	}
+}
+
+func TestServerTimersAndNegativeGauges(t *testing.T) {
+	metrics := make(chan Metric, 10)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	server := &Server{
+		Handler: HandlerFunc(func(m Metric, _ net.Addr) { metrics <- m }),
+	}
+	go server.Serve(conn)
+
+	client := NewClientWith(ClientConfig{
+		Address:       conn.LocalAddr().String(),
+		FlushInterval: -1,
+		HistogramType: Timer,
+	})
+	defer client.Close()
+
+	engine := stats.NewEngine("statsd.test")
+	engine.Register(client)
+	engine.ObserveDuration("A", 250*time.Millisecond)
+	engine.Set("B", -5)
+	engine.Flush()
+
+	expected := []Metric{
+		{Type: Timer, Name: "statsd.test.A", Value: 250, Rate: 1},
+		{Type: Gauge, Name: "statsd.test.B", Value: 0, Rate: 1},
+		{Type: Gauge, Name: "statsd.test.B", Value: -5, Rate: 1},
+	}
+
+	for _, m := range expected {
+		select {
+		case r := <-metrics:
+			if !reflect.DeepEqual(r, m) {
+				t.Errorf("bad metric:\n- %#v\n- %#v", m, r)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for metrics")
+		}
+	}
+}
+
+func TestServerNilHandler(t *testing.T) {
+	conn := &testPacketConn{datagrams: []string{"A:1|c\nB:2|g\n"}}
+
+	if err := (&Server{}).Serve(conn); err != nil {
+		t.Error(err)
+	}
+
+	if len(conn.datagrams) != 0 {
+		t.Error("the datagram was not read by the server")
+	}
+}
+
+// testPacketConn is a net.PacketConn returning a list of datagrams, then
+// io.EOF.
+type testPacketConn struct {
+	net.PacketConn
+	mutex     sync.Mutex
+	datagrams []string
+}
+
+func (c *testPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.datagrams) == 0 {
+		return 0, nil, io.EOF
+	}
+
+	n := copy(b, c.datagrams[0])
+	c.datagrams = c.datagrams[1:]
+	return n, &net.UDPAddr{}, nil
+}
+
+func (c *testPacketConn) SetDeadline(time.Time) error { return nil }
+
+func (c *testPacketConn) Close() error { return nil }
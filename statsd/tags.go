@@ -0,0 +1,109 @@
+package statsd
+
+import (
+	"strings"
+
+	"github.com/segmentio/stats"
+)
+
+// TagScheme is the interface implemented by the types that encode tags into
+// metric names, since the statsd protocol has no native support for tags.
+type TagScheme interface {
+	// AppendName appends the metric name, prefixed with namespace when it's
+	// not empty, and with tags encoded into it to b.
+	AppendName(b []byte, namespace string, name string, tags []stats.Tag) []byte
+
+	// ParseName splits the tags off of a name produced by AppendName.
+	ParseName(s string) (name string, tags []stats.Tag)
+}
+
+var (
+	// NoTags is a tag scheme that discards tags, it produces metrics that
+	// any statsd server understands.
+	NoTags TagScheme = noTags{}
+
+	// GraphiteTags is a tag scheme which encodes tags the same way graphite
+	// does for tagged series, for example "requests;host=a;status=200".
+	GraphiteTags TagScheme = separatorTags{';'}
+
+	// InfluxDBTags is a tag scheme which encodes tags the same way the line
+	// protocol of InfluxDB does, which the statsd input of telegraf
+	// understands, for example "requests,host=a,status=200".
+	InfluxDBTags TagScheme = separatorTags{','}
+)
+
+type noTags struct{}
+
+func (noTags) AppendName(b []byte, namespace string, name string, tags []stats.Tag) []byte {
+	return appendMetricName(b, namespace, name, 0)
+}
+
+func (noTags) ParseName(s string) (string, []stats.Tag) {
+	return s, nil
+}
+
+// separatorTags encodes tags as name=value pairs appended to the metric name,
+// each of them prefixed with sep. Tags with an empty name or value cannot be
+// represented and are omitted.
+type separatorTags struct {
+	sep byte
+}
+
+func (t separatorTags) AppendName(b []byte, namespace string, name string, tags []stats.Tag) []byte {
+	b = appendMetricName(b, namespace, name, t.sep)
+
+	for _, tag := range tags {
+		if len(tag.Name) != 0 && len(tag.Value) != 0 {
+			b = append(b, t.sep)
+			b = appendSanitized(b, tag.Name, t.sep)
+			b = append(b, '=')
+			b = appendSanitized(b, tag.Value, t.sep)
+		}
+	}
+
+	return b
+}
+
+func (t separatorTags) ParseName(s string) (name string, tags []stats.Tag) {
+	name, s = nextToken(s, t.sep)
+
+	if len(s) != 0 {
+		tags = make([]stats.Tag, 0, strings.Count(s, string(t.sep))+1)
+
+		for len(s) != 0 {
+			var tag string
+
+			if tag, s = nextToken(s, t.sep); len(tag) != 0 {
+				k, v := nextToken(tag, '=')
+				tags = append(tags, stats.Tag{k, v})
+			}
+		}
+	}
+
+	return
+}
+
+func appendMetricName(b []byte, namespace string, name string, sep byte) []byte {
+	if len(namespace) != 0 {
+		b = appendSanitized(b, namespace, sep)
+		b = append(b, '.')
+	}
+	return appendSanitized(b, name, sep)
+}
+
+// appendSanitized appends s to b, replacing the characters that have a special
+// meaning in the statsd protocol, or in the tag scheme, with underscores.
+func appendSanitized(b []byte, s string, sep byte) []byte {
+	for i := 0; i != len(s); i++ {
+		switch c := s[i]; c {
+		case ':', '|', '@', '\n', '=', ' ':
+			b = append(b, '_')
+		default:
+			if c == sep {
+				c = '_'
+			}
+			b = append(b, c)
+		}
+	}
+	return b
+}